@@ -19,8 +19,8 @@ import (
 	"strconv"
 	"strings"
 
-	"github.com/deadsy/riscv/csr"
 	"github.com/deadsy/riscv/host"
+	"github.com/deadsy/riscv/machine"
 	"github.com/deadsy/riscv/mem"
 	"github.com/deadsy/riscv/rv"
 	"github.com/deadsy/riscv/util"
@@ -28,7 +28,6 @@ import (
 
 //-----------------------------------------------------------------------------
 
-const heapSize = 1 << 20
 const insLimit = 20000
 
 //-----------------------------------------------------------------------------
@@ -78,7 +77,7 @@ func getTestCases(testPath string) ([]*testCase, error) {
 //-----------------------------------------------------------------------------
 
 // Fixups applies per-test environment tweaks
-func (tc *testCase) Fixups(m *rv.RV) {
+func (tc *testCase) Fixups(m *rv.RV) error {
 	switch tc.testName {
 	case "rv32uc/rvc.elf",
 		"rv32i/I-AUIPC-01.elf",
@@ -86,12 +85,27 @@ func (tc *testCase) Fixups(m *rv.RV) {
 		"rv32ui/fence_i.elf",
 		"rv32ui-p-fence_i",
 		"rv64ui-p-fence_i":
-		m.Mem.SetAttr(".text.init", mem.AttrRWX)
+		return tc.addAttr(m, ".text.init", mem.AttrRWX)
 	case "rv32mi/ma_addr.elf",
 		"rv32mi-p-ma_addr",
 		"rv64mi-p-ma_addr":
-		m.Mem.SetAttr(".data", mem.AttrRWM)
+		return tc.addAttr(m, ".data", mem.AttrRWM)
 	}
+	return nil
+}
+
+// addAttr adds memory attributes to the loaded segment containing an ELF section.
+func (tc *testCase) addAttr(m *rv.RV, section string, attr mem.Attribute) error {
+	f, err := elf.Open(tc.elfFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := f.Section(section)
+	if s == nil {
+		return fmt.Errorf("%s has no %s section", tc.elfFile, section)
+	}
+	return m.Mem.AddAttr(uint(s.Addr), attr)
 }
 
 //-----------------------------------------------------------------------------
@@ -166,61 +180,35 @@ func checkExit(tohost *host.Host, errIn error) error {
 
 func (tc *testCase) Test() error {
 
-	var cpu *rv.RV
-
+	// create the machine
+	xlen := uint(64)
 	if tc.elfClass == elf.ELFCLASS32 {
-		// Setup an RV32 CPU
-		// create the ISA
-		isa := rv.NewISA(csr.IsaExtS | csr.IsaExtU)
-		err := isa.Add(rv.ISArv32gc)
-		if err != nil {
-			return err
-		}
-		// create the cpu
-		csr := csr.NewState(32, isa.GetExtensions())
-		mem := mem.NewMem32(csr, 0)
-		cpu = rv.NewRV32(isa, mem, csr)
-	} else {
-		// Setup an RV64 CPU
-		// create the ISA
-		isa := rv.NewISA(csr.IsaExtS | csr.IsaExtU)
-		err := isa.Add(rv.ISArv64gc)
-		if err != nil {
-			return err
-		}
-		// create the cpu
-		csr := csr.NewState(64, isa.GetExtensions())
-		mem := mem.NewMem64(csr, 0)
-		cpu = rv.NewRV64(isa, mem, csr)
+		xlen = 32
+	}
+	mc, err := machine.NewMachine(machine.Default(xlen))
+	if err != nil {
+		return err
 	}
+	cpu := mc.CPU
 
 	// load the elf file
-	_, err := cpu.Mem.LoadELF(tc.elfFile, tc.elfClass)
+	_, err = cpu.Mem.LoadELF(tc.elfFile, tc.elfClass)
 	if err != nil {
 		return err
 	}
 
-	// add a heap
-	cpu.Mem.Add(mem.NewSection("heap", 0x80000000, heapSize, mem.AttrRW))
-
 	// Callback on the "tohost" write (compliance tests).
 	var tohost *host.Host
-	sym := cpu.Mem.SymbolByName("tohost")
-	if sym != nil {
-		tohost = host.NewHost(cpu.Mem, sym.Addr)
-		if sym.Size == 8 {
-			// trap on a write to the most significant word
-			fn := func(bp *mem.BreakPoint) bool { return tohost.To64(bp) }
-			cpu.Mem.AddBreakPoint(sym.Name, sym.Addr+4, mem.AttrW, fn)
-		} else {
-			// 32-bit variable
-			fn := func(bp *mem.BreakPoint) bool { return tohost.To32(bp) }
-			cpu.Mem.AddBreakPoint(sym.Name, sym.Addr, mem.AttrW, fn)
-		}
+	cfg := host.Config{}
+	if cfg.Symbols(cpu.Mem) {
+		tohost = host.NewHost(cpu.Mem, cfg)
 	}
 
 	// apply per test fixups
-	tc.Fixups(cpu)
+	err = tc.Fixups(cpu)
+	if err != nil {
+		return err
+	}
 
 	// run the emulation
 	cpu.Reset()
@@ -0,0 +1,142 @@
+//-----------------------------------------------------------------------------
+/*
+
+Compliance Test Runner Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/deadsy/riscv/machine"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+const (
+	textBase   = 0x80000000
+	tohostBase = 0x80001000
+	dataBase   = 0x80002000
+)
+
+// assemble returns the machine code for a program at textBase.
+func assemble(t *testing.T, prog []string) []byte {
+	mc, err := machine.NewMachine(machine.Default(64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc.Mem.Insert(mem.NewSection("text", textBase, 0x100, mem.AttrRWX))
+	adr := uint(textBase)
+	for _, s := range prog {
+		n, err := mc.CPU.Assemble(adr, s)
+		if err != nil {
+			t.Fatalf("\"%s\" %s", s, err)
+		}
+		adr += n
+	}
+	var buf bytes.Buffer
+	for a := uint(textBase); a < adr; a += 4 {
+		x, _ := mc.Mem.Rd32Phys(a)
+		binary.Write(&buf, binary.LittleEndian, x)
+	}
+	return buf.Bytes()
+}
+
+// writeELF writes a riscv-tests style ELF file. The .text.init, .tohost
+// and .data sections are merged in a single RWX segment.
+func writeELF(t *testing.T, fname string, code []byte) {
+	const phOfs, segOfs, symOfs, strOfs, shstrOfs, shOfs = 64, 0x1000, 0x3100, 0x3200, 0x3300, 0x3400
+	const segSize = dataBase + 0x10 - textBase
+	shstr := "\x00.text.init\x00.tohost\x00.data\x00.symtab\x00.strtab\x00.shstrtab\x00"
+	name := func(s string) uint32 { return uint32(strings.Index(shstr, "\x00"+s+"\x00") + 1) }
+	var buf bytes.Buffer
+	wr := func(ofs int, v interface{}) {
+		for buf.Len() < ofs {
+			buf.WriteByte(0)
+		}
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	hdr := elf.Header64{
+		Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_RISCV), Version: 1, Entry: textBase,
+		Phoff: phOfs, Shoff: shOfs, Ehsize: 64, Phentsize: 56, Phnum: 1, Shentsize: 64, Shnum: 7, Shstrndx: 6,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS], hdr.Ident[elf.EI_DATA], hdr.Ident[elf.EI_VERSION] = byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), 1
+	wr(0, hdr)
+	wr(phOfs, elf.Prog64{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_W | elf.PF_X), Off: segOfs, Vaddr: textBase, Filesz: segSize, Memsz: segSize})
+	wr(segOfs, code)
+	wr(segOfs+dataBase-textBase, uint64(0x0123456789abcdef))
+	wr(segOfs+segSize, []byte{})
+	wr(symOfs, []elf.Sym64{{}, {Name: 1, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_OBJECT), Shndx: 2, Value: tohostBase, Size: 8}})
+	wr(strOfs, []byte("\x00tohost\x00"))
+	wr(shstrOfs, []byte(shstr))
+	wr(shOfs, []elf.Section64{
+		{},
+		{Name: name(".text.init"), Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR), Addr: textBase, Off: segOfs, Size: uint64(len(code))},
+		{Name: name(".tohost"), Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_WRITE), Addr: tohostBase, Off: segOfs + tohostBase - textBase, Size: 0x10},
+		{Name: name(".data"), Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_WRITE), Addr: dataBase, Off: segOfs + dataBase - textBase, Size: 0x10},
+		{Name: name(".symtab"), Type: uint32(elf.SHT_SYMTAB), Off: symOfs, Size: 48, Link: 5, Info: 1, Entsize: 24},
+		{Name: name(".strtab"), Type: uint32(elf.SHT_STRTAB), Off: strOfs, Size: 8},
+		{Name: name(".shstrtab"), Type: uint32(elf.SHT_STRTAB), Off: shstrOfs, Size: uint64(len(shstr))},
+	})
+	err := ioutil.WriteFile(fname, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pass writes 1 to tohost (the test has passed).
+// s0 is the text base address.
+var pass = []string{
+	"lui t3,0x1",
+	"add t3,t3,s0",
+	"addi t4,zero,1",
+	"sd t4,0(t3)",
+}
+
+func Test_Fixups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compliance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		prog []string
+		ok   bool
+	}{
+		// misaligned data access
+		{"rv64mi-p-ma_addr", []string{"auipc s0,0", "lui t0,0x2", "add t0,t0,s0", "ld t1,1(t0)"}, true},
+		{"rv64ui-p-add", []string{"auipc s0,0", "lui t0,0x2", "add t0,t0,s0", "ld t1,1(t0)"}, false},
+		// self modifying code: replace the zero (illegal) instruction with a nop
+		{"rv64ui-p-fence_i", []string{"auipc s0,0", "addi t1,zero,0x13", "sw t1,16(s0)", "fence.i"}, true},
+	}
+	for _, v := range tests {
+		code := assemble(t, append(v.prog, pass...))
+		if strings.Contains(v.name, "fence_i") {
+			// the zero word at offset 16 is overwritten with a nop
+			code = append(code[:16], append(make([]byte, 4), code[16:]...)...)
+		}
+		fname := filepath.Join(dir, v.name)
+		writeELF(t, fname, code)
+		tc := &testCase{testName: v.name, elfFile: fname, elfClass: elf.ELFCLASS64}
+		err := tc.Test()
+		if (err == nil) != v.ok {
+			t.Errorf("%s: %v", v.name, err)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,270 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V RV32/RV64 ELF Disassembler
+
+Disassembles the executable sections of an ELF file in an objdump-like
+layout, without needing the GNU toolchain.
+
+*/
+//-----------------------------------------------------------------------------
+
+package main
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/rv"
+	"github.com/deadsy/riscv/util"
+)
+
+//-----------------------------------------------------------------------------
+
+// disApp is state associated with the disassembler application.
+type disApp struct {
+	isa *rv.ISA
+	mem *mem.Memory
+}
+
+// newDis returns a disassembler for the ELF class.
+func newDis(class elf.Class) (*disApp, error) {
+	var module []rv.ISAModule
+	var xlen uint
+	switch class {
+	case elf.ELFCLASS32:
+		module = rv.ISArv32gc
+		xlen = 32
+	case elf.ELFCLASS64:
+		module = rv.ISArv64gc
+		xlen = 64
+	default:
+		return nil, fmt.Errorf("ELF class %d is not supported", class)
+	}
+	isa := rv.NewISA(0)
+	err := isa.Add(module)
+	if err != nil {
+		return nil, err
+	}
+	csr := csr.NewState(xlen, isa.GetExtensions())
+	var m *mem.Memory
+	if xlen == 32 {
+		m = mem.NewMem32(csr, 0)
+	} else {
+		m = mem.NewMem64(csr, 0)
+	}
+	return &disApp{
+		isa: isa,
+		mem: m,
+	}, nil
+}
+
+//-----------------------------------------------------------------------------
+
+// insJSON is the JSON output for an instruction.
+type insJSON struct {
+	Address  string `json:"address"`
+	Section  string `json:"section"`
+	Symbol   string `json:"symbol,omitempty"`
+	Bytes    string `json:"bytes"`
+	Mnemonic string `json:"mnemonic"`
+	Operands string `json:"operands,omitempty"`
+	Target   string `json:"target,omitempty"`
+}
+
+// splitAssembly splits the assembly into mnemonic and operands.
+func splitAssembly(s string) (string, string) {
+	x := strings.SplitN(s, " ", 2)
+	if len(x) == 1 {
+		return x[0], ""
+	}
+	return x[0], x[1]
+}
+
+// insBytes returns the instruction code string.
+func insBytes(da *rv.Disassembly) string {
+	if da.Length == 2 {
+		return fmt.Sprintf("%04x", da.Ins&0xffff)
+	}
+	return fmt.Sprintf("%08x", da.Ins)
+}
+
+// text returns the objdump-like disassembly of a memory range.
+func (u *disApp) text(adr, end uint) string {
+	s := []string{}
+	// starting within a symbol
+	if u.mem.SymbolByAddress(adr) == nil {
+		if x := u.mem.SymbolOffset(adr); x != "" {
+			s = append(s, fmt.Sprintf("%s <%s>:", u.mem.AddrStr(adr), x))
+		}
+	}
+	for adr < end {
+		da := u.isa.Disassemble(u.mem, adr)
+		if da.Symbol != "" {
+			s = append(s, "", fmt.Sprintf("%s <%s>:", u.mem.AddrStr(adr), da.Symbol))
+		}
+		mn, ops := splitAssembly(da.Assembly)
+		line := fmt.Sprintf("%8x:\t%-8s\t%-8s%s", adr, insBytes(da), mn, ops)
+		if da.Target != "" {
+			line += " " + da.Target
+		}
+		s = append(s, strings.TrimRight(line, " "))
+		adr += da.Length
+	}
+	return strings.Join(s, "\n")
+}
+
+// json returns the JSON disassembly of a memory range.
+func (u *disApp) json(adr, end uint) []insJSON {
+	x := []insJSON{}
+	for adr < end {
+		da := u.isa.Disassemble(u.mem, adr)
+		mn, ops := splitAssembly(da.Assembly)
+		x = append(x, insJSON{
+			Address:  fmt.Sprintf("%x", adr),
+			Section:  u.mem.GetSectionName(adr),
+			Symbol:   da.Symbol,
+			Bytes:    insBytes(da),
+			Mnemonic: mn,
+			Operands: ops,
+			Target:   strings.Trim(da.Target, "<>"),
+		})
+		adr += da.Length
+	}
+	return x
+}
+
+//-----------------------------------------------------------------------------
+
+// addrRange is an address range to disassemble.
+type addrRange struct {
+	name       string // section/symbol name
+	start, end uint   // [start, end)
+}
+
+// hexArg converts a hex string argument to a value.
+func hexArg(s string) (uint, error) {
+	x, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad address \"%s\"", s)
+	}
+	return uint(x), nil
+}
+
+// ranges returns the address ranges to disassemble.
+func (u *disApp) ranges(fname, fn, start, end string) ([]addrRange, error) {
+	if fn != "" {
+		sym := u.mem.SymbolByName(fn)
+		if sym == nil {
+			return nil, fmt.Errorf("function \"%s\" not found", fn)
+		}
+		if sym.Size == 0 {
+			return nil, fmt.Errorf("function \"%s\" has no size", fn)
+		}
+		return []addrRange{{fn, sym.Addr, sym.Addr + sym.Size}}, nil
+	}
+	if start != "" || end != "" {
+		if start == "" || end == "" {
+			return nil, errors.New("need both -start and -end addresses")
+		}
+		s, err := hexArg(start)
+		if err != nil {
+			return nil, err
+		}
+		e, err := hexArg(end)
+		if err != nil {
+			return nil, err
+		}
+		if e <= s {
+			return nil, errors.New("end address must be greater than the start address")
+		}
+		return []addrRange{{u.mem.GetSectionName(s), s, e}}, nil
+	}
+	// all executable sections (the memory is loaded by segments)
+	f, err := elf.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	x := []addrRange{}
+	for _, s := range f.Sections {
+		if s.Flags&elf.SHF_EXECINSTR != 0 && s.Size != 0 {
+			x = append(x, addrRange{s.Name, uint(s.Addr), uint(s.Addr + s.Size)})
+		}
+	}
+	return x, nil
+}
+
+//-----------------------------------------------------------------------------
+
+func main() {
+	// command line flags
+	fname := flag.String("f", "", "file to disassemble (ELF)")
+	fn := flag.String("func", "", "disassemble a single function")
+	start := flag.String("start", "", "start address (hex)")
+	end := flag.String("end", "", "end address (hex, exclusive)")
+	jsonOut := flag.Bool("json", false, "JSON output")
+	flag.Parse()
+
+	if *fname == "" {
+		fmt.Fprintf(os.Stderr, "need a file to disassemble (-f)\n")
+		os.Exit(1)
+	}
+
+	elfClass, err := util.GetELFClass(*fname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	// create the application
+	app, err := newDis(elfClass)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	// load the file
+	_, err = app.mem.LoadELF(*fname, elfClass)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	ranges, err := app.ranges(*fname, *fn, *start, *end)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	if *jsonOut {
+		x := []insJSON{}
+		for _, r := range ranges {
+			x = append(x, app.json(r.start, r.end)...)
+		}
+		buf, err := json.MarshalIndent(x, "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s\n", buf)
+		os.Exit(0)
+	}
+
+	fmt.Printf("%s:     file format elf%d-littleriscv\n", *fname, map[elf.Class]int{elf.ELFCLASS32: 32, elf.ELFCLASS64: 64}[elfClass])
+	for _, r := range ranges {
+		fmt.Printf("\nDisassembly of section %s:\n", r.name)
+		fmt.Printf("%s\n", app.text(r.start, r.end))
+	}
+	os.Exit(0)
+}
+
+//-----------------------------------------------------------------------------
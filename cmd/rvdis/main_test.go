@@ -0,0 +1,130 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Disassembler Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package main
+
+import (
+	"debug/elf"
+	"strings"
+	"testing"
+
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+// newTestDis returns a disassembler with a test program at 0x1000.
+func newTestDis(t *testing.T) *disApp {
+	u, err := newDis(elf.ELFCLASS64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.mem.Add(mem.NewSection(".text", 0x1000, 0x100, mem.AttrRX))
+	prog := []struct {
+		adr uint
+		s   string
+	}{
+		{0x1000, "addi a0,a1,-1"},
+		{0x1004, "jal ra,1010"},
+		{0x1008, "c.ret"},
+		{0x1010, "c.addi a0,a0,1"},
+		{0x1012, "c.ret"},
+	}
+	for _, v := range prog {
+		code, err := u.isa.Assemble(u.mem, 64, v.adr, v.s)
+		if err != nil {
+			t.Fatalf("\"%s\" %s", v.s, err)
+		}
+		buf := []byte{byte(code[0]), byte(code[0] >> 8)}
+		if v.s[:2] != "c." {
+			buf = append(buf, byte(code[0]>>16), byte(code[0]>>24))
+		}
+		u.mem.Patch(v.adr, buf)
+	}
+	u.mem.AddSymbol("main", 0x1000, 0xa)
+	u.mem.AddSymbol("f", 0x1010, 4)
+	return u
+}
+
+func Test_Text(t *testing.T) {
+	u := newTestDis(t)
+	expect := strings.Join([]string{
+		"",
+		"0000000000001000 <main>:",
+		"    1000:\tfff58513\taddi    a0,a1,-1",
+		"    1004:\t00c000ef\tjal     ra,1010 <f>",
+		"    1008:\t8082    \tret",
+		"    100a:\t0000    \tillegal",
+		"    100c:\t0000    \tillegal",
+		"    100e:\t0000    \tillegal",
+		"",
+		"0000000000001010 <f>:",
+		"    1010:\t0505    \taddi    a0,a0,1",
+		"    1012:\t8082    \tret",
+	}, "\n")
+	if s := u.text(0x1000, 0x1014); s != expect {
+		t.Errorf("got\n%s\nexpected\n%s", s, expect)
+	}
+	// starting within a symbol
+	expect = strings.Join([]string{
+		"0000000000001004 <main+0x4>:",
+		"    1004:\t00c000ef\tjal     ra,1010 <f>",
+	}, "\n")
+	if s := u.text(0x1004, 0x1008); s != expect {
+		t.Errorf("got\n%s\nexpected\n%s", s, expect)
+	}
+}
+
+func Test_JSON(t *testing.T) {
+	u := newTestDis(t)
+	x := u.json(0x1004, 0x100a)
+	if len(x) != 2 {
+		t.Fatalf("%d instructions, expected 2", len(x))
+	}
+	expect := insJSON{Address: "1004", Section: ".text", Bytes: "00c000ef", Mnemonic: "jal", Operands: "ra,1010", Target: "f"}
+	if x[0] != expect {
+		t.Errorf("got %+v, expected %+v", x[0], expect)
+	}
+	if x[1].Mnemonic != "ret" || x[1].Bytes != "8082" || x[1].Operands != "" {
+		t.Errorf("bad c.ret %+v", x[1])
+	}
+}
+
+func Test_Ranges(t *testing.T) {
+	u := newTestDis(t)
+	tests := []struct {
+		fn, start, end string
+		r              addrRange
+		err            string
+	}{
+		{"f", "", "", addrRange{"f", 0x1010, 0x1014}, ""},
+		{"", "1000", "0x1008", addrRange{".text", 0x1000, 0x1008}, ""},
+		{"g", "", "", addrRange{}, "function \"g\" not found"},
+		{"", "1000", "", addrRange{}, "need both -start and -end addresses"},
+		{"", "1008", "1000", addrRange{}, "end address must be greater than the start address"},
+		{"", "xyz", "1000", addrRange{}, "bad address \"xyz\""},
+	}
+	for _, v := range tests {
+		x, err := u.ranges("", v.fn, v.start, v.end)
+		if v.err != "" {
+			if err == nil || err.Error() != v.err {
+				t.Errorf("%s %s %s: error %v, expected \"%s\"", v.fn, v.start, v.end, err, v.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s %s: %s", v.fn, v.start, v.end, err)
+			continue
+		}
+		if len(x) != 1 || x[0] != v.r {
+			t.Errorf("%s %s %s: ranges %v, expected %v", v.fn, v.start, v.end, x, v.r)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
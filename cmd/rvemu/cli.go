@@ -10,6 +10,7 @@ package main
 
 import (
 	"fmt"
+	"strings"
 
 	cli "github.com/deadsy/go-cli"
 	"github.com/deadsy/riscv/csr"
@@ -183,8 +184,7 @@ var helpGo = []cli.Help{
 }
 
 func goLoop(c *cli.CLI) bool {
-	m := c.User.(*emuApp).cpu
-	err := m.Run()
+	err := c.User.(*emuApp).run()
 	if err != nil {
 		c.User.Put(fmt.Sprintf("%s\r\n", err))
 		return true
@@ -207,9 +207,10 @@ var cmdGo = cli.Leaf{
 }
 
 func traceLoop(c *cli.CLI) bool {
-	m := c.User.(*emuApp).cpu
+	u := c.User.(*emuApp)
+	m := u.cpu
 	s := m.Disassemble(uint(m.PC))
-	err := m.Run()
+	err := u.run()
 	c.User.Put(fmt.Sprintf("%s\r\n", s))
 	if err != nil {
 		c.User.Put(fmt.Sprintf("%s\r\n", err))
@@ -243,7 +244,7 @@ var cmdStep = cli.Leaf{
 		}
 		m.PC = uint64(adr)
 		s := m.Disassemble(adr)
-		err = m.Run()
+		err = c.User.(*emuApp).run()
 		c.User.Put(fmt.Sprintf("%s\n", s))
 		if err != nil {
 			c.User.Put(fmt.Sprintf("%s\n", err))
@@ -252,27 +253,130 @@ var cmdStep = cli.Leaf{
 }
 
 //-----------------------------------------------------------------------------
+// reverse execution
+
+var helpReverseStep = []cli.Help{
+	{"[n]", "number of instructions (decimal) - default is 1"},
+}
+
+var cmdReverseStep = cli.Leaf{
+	Descr: "step the emulation backwards",
+	F: func(c *cli.CLI, args []string) {
+		err := cli.CheckArgc(args, []int{0, 1})
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		n := 1
+		if len(args) == 1 {
+			n, err = cli.IntArg(args[0], [2]int{1, 1 << 30}, 10)
+			if err != nil {
+				c.User.Put(fmt.Sprintf("%s\n", err))
+				return
+			}
+		}
+		m := c.User.(*emuApp).cpu
+		for i := 0; i < n; i++ {
+			err = m.ReverseStep()
+			if err != nil {
+				c.User.Put(fmt.Sprintf("%s\n", err))
+				break
+			}
+		}
+		c.User.Put(fmt.Sprintf("%s\n", m.Disassemble(uint(m.PC))))
+	},
+}
+
+var cmdReverseContinue = cli.Leaf{
+	Descr: "run the emulation backwards to the previous break/watch point",
+	F: func(c *cli.CLI, args []string) {
+		m := c.User.(*emuApp).cpu
+		n, err := m.ReverseContinue()
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+		}
+		c.User.Put(fmt.Sprintf("%d instructions back\n", n))
+		c.User.Put(fmt.Sprintf("%s\n", m.Disassemble(uint(m.PC))))
+	},
+}
+
+var cmdReverse = cli.Leaf{
+	Descr: "display the reverse execution status",
+	F: func(c *cli.CLI, args []string) {
+		m := c.User.(*emuApp).cpu
+		c.User.Put(fmt.Sprintf("%s\n", m.ReverseStatus()))
+	},
+}
+
+//-----------------------------------------------------------------------------
+
+// symArg replaces a leading symbol name argument with its (hex) address.
+// It returns the size of the symbol (or 0).
+func symArg(m *mem.Memory, args []string) ([]string, uint) {
+	if len(args) == 0 {
+		return args, 0
+	}
+	sym := m.SymbolByName(args[0])
+	if sym == nil {
+		return args, 0
+	}
+	x := append([]string{fmt.Sprintf("%x", sym.Addr)}, args[1:]...)
+	return x, sym.Size
+}
 
 var helpDisassemble = []cli.Help{
-	{"[adr] [len]", "address (hex) - default is current pc"},
-	{"", "length (hex) - default is 0x10"},
+	{"[adr|symbol] [len]", "address (hex) or symbol name - default is current pc"},
+	{"", "length (hex) - default is the symbol size or 0x80"},
 }
 
 var cmdDisassemble = cli.Leaf{
 	Descr: "disassemble memory",
 	F: func(c *cli.CLI, args []string) {
 		m := c.User.(*emuApp).cpu
+		args, symSize := symArg(m.Mem, args)
 		adr, size, err := util.MemArg(uint(m.PC), maxAdr, args)
 		if err != nil {
 			c.User.Put(fmt.Sprintf("%s\n", err))
 			return
 		}
-		n := int(size)
+		if len(args) == 1 && symSize != 0 {
+			size = symSize
+		}
+		c.User.Put(fmt.Sprintf("%s\n", m.DisassembleRange(adr, size)))
+	},
+}
+
+//-----------------------------------------------------------------------------
+
+var helpAssemble = []cli.Help{
+	{"<adr|symbol> <instruction>", "address (hex) or symbol name"},
+	{"", "instruction in disassembler syntax (use c.* for compressed)"},
+}
+
+var cmdAssemble = cli.Leaf{
+	Descr: "assemble an instruction and write it to memory",
+	F: func(c *cli.CLI, args []string) {
+		if len(args) < 2 {
+			c.User.Put("need an address and an instruction\n")
+			return
+		}
+		m := c.User.(*emuApp).cpu
+		x, _ := symArg(m.Mem, args[:1])
+		adr, err := util.AddrArg(0, maxAdr, x)
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		n, err := m.Assemble(adr, strings.Join(args[1:], " "))
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
 		for n > 0 {
 			da := m.Disassemble(adr)
 			c.User.Put(fmt.Sprintf("%s\n", da))
 			adr += da.Length
-			n -= int(da.Length)
+			n -= da.Length
 		}
 	},
 }
@@ -298,15 +402,93 @@ var cmdIntRegisters = cli.Leaf{
 //-----------------------------------------------------------------------------
 
 var cmdReset = cli.Leaf{
-	Descr: "reset the cpu",
+	Descr: "reset the cpu and devices",
 	F: func(c *cli.CLI, args []string) {
 		m := c.User.(*emuApp).cpu
+		m.Mem.ResetDevices()
 		m.Reset()
 	},
 }
 
 //-----------------------------------------------------------------------------
 
+var helpCheckpoint = []cli.Help{
+	{"<file>", "checkpoint file name"},
+	{"", "save writes a checkpoint, restore reads it (see load for ELF files)"},
+}
+
+var cmdSave = cli.Leaf{
+	Descr: "save a machine checkpoint",
+	F: func(c *cli.CLI, args []string) {
+		err := cli.CheckArgc(args, []int{1})
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		err = c.User.(*emuApp).saveCheckpoint(args[0])
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+		}
+	},
+}
+
+var cmdRestore = cli.Leaf{
+	Descr: "restore a machine checkpoint",
+	F: func(c *cli.CLI, args []string) {
+		err := cli.CheckArgc(args, []int{1})
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		err = c.User.(*emuApp).restoreCheckpoint(args[0])
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+		}
+	},
+}
+
+//-----------------------------------------------------------------------------
+
+var helpLoad = []cli.Help{
+	{"<file> [bias]", "load an additional ELF image (as per -image)"},
+	{"", "bias is the load bias (hex) of a position independent executable"},
+	{"", "no arguments lists the loaded images"},
+}
+
+var cmdLoad = cli.Leaf{
+	Descr: "load an ELF image",
+	F: func(c *cli.CLI, args []string) {
+		err := cli.CheckArgc(args, []int{0, 1, 2})
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		u := c.User.(*emuApp)
+		if len(args) == 0 {
+			images := u.mem.Images()
+			if len(images) == 0 {
+				c.User.Put("no images\n")
+			}
+			for _, img := range images {
+				c.User.Put(fmt.Sprintf("%s\n", img))
+			}
+			return
+		}
+		bias := ""
+		if len(args) == 2 {
+			bias = args[1]
+		}
+		status, err := u.addImage(args[0], bias)
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		c.User.Put(fmt.Sprintf("%s\n", status))
+	},
+}
+
+//-----------------------------------------------------------------------------
+
 var cmdSymbol = cli.Leaf{
 	Descr: "display the symbol table",
 	F: func(c *cli.CLI, args []string) {
@@ -335,6 +517,42 @@ var cmdMap = cli.Leaf{
 	},
 }
 
+var cmdFDT = cli.Leaf{
+	Descr: "display the generated device tree",
+	F: func(c *cli.CLI, args []string) {
+		t := c.User.(*emuApp).fdt
+		if t == nil {
+			c.User.Put("no device tree (use -fdt)\n")
+			return
+		}
+		c.User.Put(t.DTS())
+	},
+}
+
+var helpFramebuffer = []cli.Help{
+	{"<file>", "PNG file name"},
+}
+
+var cmdFramebuffer = cli.Leaf{
+	Descr: "write the framebuffer to a PNG file",
+	F: func(c *cli.CLI, args []string) {
+		err := cli.CheckArgc(args, []int{1})
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		fb := c.User.(*emuApp).machine.Framebuffer
+		if fb == nil {
+			c.User.Put("no framebuffer (use -fb)\n")
+			return
+		}
+		err = fb.SavePNG(args[0])
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+		}
+	},
+}
+
 //-----------------------------------------------------------------------------
 // memory monitors
 
@@ -435,6 +653,60 @@ var cmdHost = cli.Leaf{
 
 //-----------------------------------------------------------------------------
 
+var helpCache = []cli.Help{
+	{"[reset]", "display (or reset) the cache statistics"},
+}
+
+var cmdCache = cli.Leaf{
+	Descr: "display cache statistics",
+	F: func(c *cli.CLI, args []string) {
+		err := cli.CheckArgc(args, []int{0, 1})
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		m := c.User.(*emuApp).mem
+		if len(args) == 1 {
+			if args[0] != "reset" {
+				c.User.Put(fmt.Sprintf("unknown argument \"%s\"\n", args[0]))
+				return
+			}
+			m.CacheReset()
+			return
+		}
+		c.User.Put(fmt.Sprintf("%s\n", m.CacheReport()))
+	},
+}
+
+//-----------------------------------------------------------------------------
+
+var helpPredict = []cli.Help{
+	{"[reset]", "display (or reset) the branch prediction statistics"},
+}
+
+var cmdPredict = cli.Leaf{
+	Descr: "display branch prediction statistics",
+	F: func(c *cli.CLI, args []string) {
+		err := cli.CheckArgc(args, []int{0, 1})
+		if err != nil {
+			c.User.Put(fmt.Sprintf("%s\n", err))
+			return
+		}
+		cpu := c.User.(*emuApp).cpu
+		if len(args) == 1 {
+			if args[0] != "reset" {
+				c.User.Put(fmt.Sprintf("unknown argument \"%s\"\n", args[0]))
+				return
+			}
+			cpu.PredictReset()
+			return
+		}
+		c.User.Put(fmt.Sprintf("%s\n", cpu.PredictReport()))
+	},
+}
+
+//-----------------------------------------------------------------------------
+
 var cmdErrors = cli.Leaf{
 	Descr: "display emulation errors",
 	F: func(c *cli.CLI, args []string) {
@@ -447,21 +719,32 @@ var cmdErrors = cli.Leaf{
 
 // root menu
 var menuRoot = cli.Menu{
+	{"asm", cmdAssemble, helpAssemble},
+	{"cache", cmdCache, helpCache},
 	{"csr", cmdCSR},
 	{"da", cmdDisassemble, helpDisassemble},
 	{"errors", cmdErrors},
 	{"exit", cmdExit},
+	{"fb", cmdFramebuffer, helpFramebuffer},
+	{"fdt", cmdFDT},
 	{"go", cmdGo, helpGo},
 	{"help", cmdHelp},
 	{"history", cmdHistory, cli.HistoryHelp},
 	{"host", cmdHost},
+	{"load", cmdLoad, helpLoad},
 	{"map", cmdMap},
 	{"mm", memBreakPointMenu, "memory monitor functions"},
 	{"pm", memDisplayPm, "physical memory menu"},
+	{"predict", cmdPredict, helpPredict},
 	{"pt", cmdPageTable, helpPageTable},
 	{"rf", cmdFloatRegisters},
 	{"ri", cmdIntRegisters},
+	{"rstep", cmdReverseStep, helpReverseStep},
+	{"rcont", cmdReverseContinue},
 	{"reset", cmdReset},
+	{"restore", cmdRestore, helpCheckpoint},
+	{"reverse", cmdReverse},
+	{"save", cmdSave, helpCheckpoint},
 	{"step", cmdStep, helpGo},
 	{"sym", cmdSymbol},
 	{"trace", cmdTrace, helpGo},
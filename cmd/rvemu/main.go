@@ -12,20 +12,40 @@ import (
 	"debug/elf"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	cli "github.com/deadsy/go-cli"
-	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/cosim"
+	"github.com/deadsy/riscv/dap"
+	"github.com/deadsy/riscv/ecall"
+	"github.com/deadsy/riscv/fdt"
+	"github.com/deadsy/riscv/gdb"
 	"github.com/deadsy/riscv/host"
+	"github.com/deadsy/riscv/machine"
 	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/replay"
 	"github.com/deadsy/riscv/rv"
+	"github.com/deadsy/riscv/sbi"
+	"github.com/deadsy/riscv/semihost"
 	"github.com/deadsy/riscv/util"
 )
 
 //-----------------------------------------------------------------------------
 
 const historyPath = ".rvemu_history"
-const heapSize = 1 << 20
+
+// dtbBase is the load address of the device tree blob (-sbi, -fdt).
+const dtbBase = 0x87e00000
+
+// initrdBase is the load address of the initial ramdisk (-initrd).
+const initrdBase = 0x84000000
 
 //-----------------------------------------------------------------------------
 
@@ -33,47 +53,566 @@ const heapSize = 1 << 20
 type emuApp struct {
 	mem      *mem.Memory
 	cpu      *rv.RV
+	machine  *machine.Machine
 	elfClass elf.Class
 	host     *host.Host
+	semihost *semihost.Semihost
+	user     bool      // Linux user mode emulation
+	fdt      *fdt.Tree // generated device tree
+	commit   *rv.CommitLog
+	inputs   *replay.Log // record/replay of nondeterministic inputs
+	epoch    time.Time   // start time for the real time counter
 	prompt   string
+	status   int // exit status of the last emulation exit
 }
 
-// newEmu32 returns a 32-bit emulator.
-func newEmu32() (*emuApp, error) {
-	// 32-bit ISA
-	isa := rv.NewISA(csr.IsaExtS | csr.IsaExtU)
-	err := isa.Add(rv.ISArv32gc)
+// newEmu returns an emulator for a machine configuration.
+func newEmu(cfg *machine.Config) (*emuApp, error) {
+	mc, err := machine.NewMachine(cfg)
 	if err != nil {
 		return nil, err
 	}
-	// 32-bit CSR and memory
-	csr := csr.NewState(32, isa.GetExtensions())
-	m := mem.NewMem32(csr, 0)
 	return &emuApp{
-		mem:      m,
-		cpu:      rv.NewRV32(isa, m, csr),
-		elfClass: elf.ELFCLASS32,
-		prompt:   "rv32> ",
+		mem:      mc.Mem,
+		cpu:      mc.CPU,
+		machine:  mc,
+		elfClass: mc.Class,
+		prompt:   fmt.Sprintf("rv%d> ", cfg.Xlen),
 	}, nil
 }
 
-// newEmu64 returns a 64-bit emulator.
-func newEmu64() (*emuApp, error) {
-	// 64-bit ISA
-	isa := rv.NewISA(csr.IsaExtS | csr.IsaExtU)
-	err := isa.Add(rv.ISArv64gc)
+//-----------------------------------------------------------------------------
+
+// newCaches creates the cache models from the command line configuration strings.
+func (u *emuApp) newCaches(iArg, dArg, l2Arg string) error {
+	var l2, icache, dcache *mem.Cache
+	if l2Arg != "" {
+		cfg, err := mem.CacheArg("l2", l2Arg)
+		if err != nil {
+			return err
+		}
+		l2, err = mem.NewCache(cfg, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if iArg != "" {
+		cfg, err := mem.CacheArg("icache", iArg)
+		if err != nil {
+			return err
+		}
+		icache, err = mem.NewCache(cfg, l2)
+		if err != nil {
+			return err
+		}
+	}
+	if dArg != "" {
+		cfg, err := mem.CacheArg("dcache", dArg)
+		if err != nil {
+			return err
+		}
+		dcache, err = mem.NewCache(cfg, l2)
+		if err != nil {
+			return err
+		}
+	}
+	u.mem.SetCache(icache, dcache)
+	return nil
+}
+
+// newPredictor creates the branch predictor model from the command line configuration string.
+func (u *emuApp) newPredictor(arg string) error {
+	if arg == "" {
+		return nil
+	}
+	cfg, err := rv.PredictArg(arg)
+	if err != nil {
+		return err
+	}
+	u.cpu.SetPredictor(rv.NewPredictor(cfg))
+	return nil
+}
+
+// newReverse creates the reverse execution recorder from the command line configuration string.
+func (u *emuApp) newReverse(arg string) error {
+	if arg == "" {
+		return nil
+	}
+	cfg, err := rv.ReverseArg(arg)
+	if err != nil {
+		return err
+	}
+	return u.cpu.SetReverse(rv.NewReverse(cfg))
+}
+
+// framebufferDevice returns the framebuffer device for the command line configuration string (WxH[,format]).
+func framebufferDevice(arg string) (machine.Device, error) {
+	d := machine.Device{Type: "framebuffer"}
+	x := strings.Split(arg, ",")
+	_, err := fmt.Sscanf(x[0], "%dx%d", &d.Width, &d.Height)
+	if err != nil {
+		return d, fmt.Errorf("framebuffer size \"%s\" is not valid (E.g. 640x480)", x[0])
+	}
+	if len(x) > 1 {
+		d.Format = x[1]
+	}
+	return d, nil
+}
+
+// dumpFrames writes the framebuffer to numbered PNG files every n instructions.
+// The configuration string is "n[,prefix]". Frames are written when the devices
+// are polled, so the instruction count for a frame is rounded up to the poll interval.
+func (u *emuApp) dumpFrames(arg string) error {
+	if arg == "" {
+		return nil
+	}
+	fb := u.machine.Framebuffer
+	if fb == nil {
+		return fmt.Errorf("there is no framebuffer (use -fb)")
+	}
+	x := strings.Split(arg, ",")
+	n, err := strconv.ParseUint(x[0], 0, 64)
+	if err != nil || n == 0 {
+		return fmt.Errorf("frame interval \"%s\" is not valid", x[0])
+	}
+	prefix := "frame"
+	if len(x) > 1 {
+		prefix = x[1]
+	}
+	next, frame := n, 0
+	u.cpu.AddPoller(func() {
+		_, instret := u.cpu.CSR.Counters()
+		if next == 0 || instret < next {
+			return
+		}
+		next = (instret/n + 1) * n
+		err := fb.SavePNG(fmt.Sprintf("%s%04d.png", prefix, frame))
+		if err != nil {
+			// stop dumping frames
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			next = 0
+		}
+		frame++
+	})
+	return nil
+}
+
+// wallClock returns the real time counter.
+func (u *emuApp) wallClock() uint64 {
+	timebase := u.machine.Config.Counters.Timebase
+	return uint64(time.Since(u.epoch) / (time.Second / time.Duration(timebase)))
+}
+
+// newInputs sets up the recording (or replay) of nondeterministic inputs.
+func (u *emuApp) newInputs(record, replayFile string) error {
+	u.epoch = time.Now()
+	count := func() uint64 {
+		_, n := u.cpu.CSR.Counters()
+		return n
+	}
+	if record != "" && replayFile != "" {
+		return fmt.Errorf("-record and -replay can't be used together")
+	}
+	if record != "" {
+		f, err := os.Create(record)
+		if err != nil {
+			return err
+		}
+		u.inputs, err = replay.NewRecorder(f, count)
+		if err != nil {
+			return err
+		}
+	}
+	if replayFile != "" {
+		f, err := os.Open(replayFile)
+		if err != nil {
+			return err
+		}
+		u.inputs, err = replay.NewReplayer(f, count)
+		if err != nil {
+			return err
+		}
+	}
+	if u.inputs == nil {
+		u.cpu.CSR.SetTime(u.wallClock)
+	} else {
+		u.cpu.CSR.SetTime(func() uint64 { return u.inputs.Uint64("time", u.wallClock) })
+	}
+	return nil
+}
+
+// run runs a single instruction. A replay divergence stops the emulation.
+func (u *emuApp) run() error {
+	err := u.cpu.Run()
+	if err == nil && u.inputs != nil {
+		err = u.inputs.Err()
+	}
+	if e, ok := err.(*rv.Error); ok && e.Type == rv.ErrExit {
+		u.status = e.ExitStatus()
+	}
+	return err
+}
+
+// flushLogs writes any buffered commit log and input log output.
+func (u *emuApp) flushLogs() {
+	if u.commit != nil {
+		err := u.commit.Flush()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "commit log: %s\n", err)
+		}
+	}
+	if u.inputs != nil {
+		err := u.inputs.Flush()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "input log: %s\n", err)
+		}
+	}
+}
+
+// runBatch runs the emulation without the cli and returns the exit code.
+func (u *emuApp) runBatch() int {
+	var err error
+	for err == nil {
+		err = u.run()
+	}
+	e, exit := err.(*rv.Error)
+	exit = exit && e.Type == rv.ErrExit
+	if !(u.user && exit) {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+	}
+	u.flushLogs()
+	if u.inputs != nil {
+		if u.inputs.Err() != nil {
+			return 1
+		}
+		if u.inputs.Pending() {
+			fmt.Fprintf(os.Stderr, "replay: the input log was not fully replayed\n")
+		}
+	}
+	if u.host != nil {
+		fmt.Fprintf(os.Stderr, "tohost %s\n", u.host)
+		if status, ok := u.host.Exited(); ok && status != 0 {
+			return status
+		}
+		if !u.host.Passed() {
+			return 1
+		}
+	}
+	if exit {
+		return e.ExitStatus()
+	}
+	return 0
+}
+
+// runUser runs a static Linux executable in user mode and returns the exit code.
+// The environment is explicit, the host environment is not passed to the program.
+func (u *emuApp) runUser(fname, root string, args, env []string) int {
+	sc := ecall.NewSyscall(ecall.Config{
+		Root:    root,
+		Env:     env,
+		Console: u.machine.Console,
+		Inputs:  u.inputs,
+	})
+	_, err := sc.Load(u.cpu, fname)
+	if err == nil {
+		err = sc.Start(u.cpu, args)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	u.cpu.SetEcall(sc)
+	u.user = true
+	return u.runBatch()
+}
+
+// newFDT generates a device tree for the machine and puts it in memory.
+func (u *emuApp) newFDT(bootargs, initrdFile string) error {
+	cfg := &fdt.Config{Bootargs: bootargs}
+	if initrdFile != "" {
+		buf, err := ioutil.ReadFile(initrdFile)
+		if err != nil {
+			return err
+		}
+		u.mem.Add(mem.NewSection("initrd", initrdBase, uint(len(buf)), mem.AttrRW))
+		err = u.mem.Patch(initrdBase, buf)
+		if err != nil {
+			return err
+		}
+		cfg.InitrdStart = initrdBase
+		cfg.InitrdEnd = initrdBase + uint64(len(buf))
+	}
+	t, err := u.machine.PlaceFDT(cfg)
+	if err != nil {
+		return err
+	}
+	u.fdt = t
+	return nil
+}
+
+// bootSBI starts the kernel in supervisor mode with the built-in SBI firmware.
+func (u *emuApp) bootSBI(dtbFile string) error {
+	var dtb uint64
+	if dtbFile != "" {
+		buf, err := ioutil.ReadFile(dtbFile)
+		if err != nil {
+			return err
+		}
+		u.mem.Add(mem.NewSection("dtb", dtbBase, uint(len(buf)), mem.AttrR))
+		err = u.mem.Patch(dtbBase, buf)
+		if err != nil {
+			return err
+		}
+		dtb = dtbBase
+	} else if u.fdt != nil {
+		dtb = uint64(u.machine.FDTBase())
+	}
+	u.cpu.SetSBI(sbi.NewSBI(sbi.Config{Console: u.machine.Console, Inputs: u.inputs}))
+	// a reset (E.g. a reboot from the kernel) boots the kernel again
+	entry := u.cpu.PC
+	boot := func() { sbi.Boot(u.cpu, entry, dtb) }
+	boot()
+	u.cpu.OnReset(boot)
+	return nil
+}
+
+// runCosim runs a co-simulation against a reference trace and returns the exit code.
+func (u *emuApp) runCosim(fname string, history int) int {
+	f, err := os.Open(fname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	defer f.Close()
+	c := cosim.NewCosim(u.cpu, cosim.NewReader(f), cosim.Config{History: history})
+	err = c.Run()
+	u.flushLogs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%d instructions match the reference\n", c.N)
+	return 0
+}
+
+// saveCheckpoint writes a checkpoint of the machine state to a file.
+func (u *emuApp) saveCheckpoint(fname string) error {
+	ck, err := u.cpu.Checkpoint()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	err = ck.Write(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readCheckpoint reads a checkpoint file.
+func readCheckpoint(fname string) (*rv.Checkpoint, error) {
+	f, err := os.Open(fname)
 	if err != nil {
 		return nil, err
 	}
-	// 64-bit CSR and memory
-	csr := csr.NewState(64, isa.GetExtensions())
-	m := mem.NewMem64(csr, 0)
-	return &emuApp{
-		mem:      m,
-		cpu:      rv.NewRV64(isa, m, csr),
-		elfClass: elf.ELFCLASS64,
-		prompt:   "rv64> ",
-	}, nil
+	defer f.Close()
+	return rv.ReadCheckpoint(f)
+}
+
+// restoreCheckpoint restores the machine state from a checkpoint file.
+func (u *emuApp) restoreCheckpoint(fname string) error {
+	ck, err := readCheckpoint(fname)
+	if err != nil {
+		return err
+	}
+	return u.cpu.Restore(ck)
+}
+
+// runGdb runs a gdb server session and returns the exit code.
+func (u *emuApp) runGdb(addr string) int {
+	l, err := gdb.Listen(addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	defer l.Close()
+	fmt.Fprintf(os.Stderr, "gdb server listening on %s\n", l.Addr())
+	err = gdb.NewServer(u.cpu).Serve(l)
+	u.flushLogs()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// classXlen returns the XLEN for an ELF class.
+func classXlen(class elf.Class) (uint, error) {
+	switch class {
+	case elf.ELFCLASS32:
+		return 32, nil
+	case elf.ELFCLASS64:
+		return 64, nil
+	}
+	return 0, fmt.Errorf("ELF class %d is not supported", class)
+}
+
+// machineConfig returns the machine configuration from a file (or the default).
+func machineConfig(fname string, xlen uint) (*machine.Config, error) {
+	if fname == "" {
+		return machine.Default(xlen), nil
+	}
+	cfg, err := machine.Load(fname)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Xlen != xlen {
+		return nil, fmt.Errorf("%s is a %d-bit machine, the program is %d-bit", fname, cfg.Xlen, xlen)
+	}
+	return cfg, nil
+}
+
+// imageClass returns the ELF class for a file. The class of an ELF file
+// is read from the file, other formats need the XLEN.
+func imageClass(fname string, format mem.ImageFormat, xlen uint) (elf.Class, error) {
+	if format == mem.FormatELF {
+		class, err := util.GetELFClass(fname)
+		if err == nil && xlen != 0 {
+			if x, _ := classXlen(class); x != xlen {
+				err = fmt.Errorf("%s is not a %d-bit ELF file", fname, xlen)
+			}
+		}
+		return class, err
+	}
+	switch xlen {
+	case 32:
+		return elf.ELFCLASS32, nil
+	case 64:
+		return elf.ELFCLASS64, nil
+	case 0:
+		return elf.ELFCLASSNONE, fmt.Errorf("%s is a %s file, use -xlen 32|64", fname, format)
+	}
+	return elf.ELFCLASSNONE, fmt.Errorf("-xlen %d is not supported (32 or 64)", xlen)
+}
+
+// loadImage loads a program file to memory.
+func (u *emuApp) loadImage(fname string, format mem.ImageFormat, base, bias string) (string, error) {
+	switch format {
+	case mem.FormatBinary:
+		adr, err := u.mem.AddrArg(base)
+		if err != nil {
+			return "", fmt.Errorf("-base %s: %s", base, err)
+		}
+		return u.mem.LoadBinary(fname, adr)
+	case mem.FormatHex:
+		return u.mem.LoadHex(fname)
+	case mem.FormatSRec:
+		return u.mem.LoadSRec(fname)
+	}
+	adr, err := u.mem.AddrArg(bias)
+	if err != nil {
+		return "", fmt.Errorf("-bias %s: %s", bias, err)
+	}
+	_, status, err := u.mem.LoadImage(fname, mem.ELFConfig{Class: u.elfClass, Bias: adr})
+	return status, err
+}
+
+// addImage loads an additional ELF image to memory (the entry point is unchanged).
+func (u *emuApp) addImage(fname, bias string) (string, error) {
+	var adr uint
+	if bias != "" {
+		var err error
+		adr, err = u.mem.AddrArg(bias)
+		if err != nil {
+			return "", fmt.Errorf("bias %s: %s", bias, err)
+		}
+	}
+	_, status, err := u.mem.LoadImage(fname, mem.ELFConfig{Class: u.elfClass, Bias: adr, NoEntry: true})
+	return status, err
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, " ")
+}
+
+// Set adds a flag value.
+func (s *stringList) Set(val string) error {
+	*s = append(*s, val)
+	return nil
+}
+
+// elfLauncher returns a function that returns a reset cpu with an ELF file loaded.
+// The machine is configured from a file (or is the default machine).
+func elfLauncher(machineFile string) dap.LaunchFunc {
+	return func(fname string) (*rv.RV, error) {
+		return launchELF(machineFile, fname)
+	}
+}
+
+// launchELF returns a reset cpu with an ELF file loaded.
+func launchELF(machineFile, fname string) (*rv.RV, error) {
+	elfClass, err := util.GetELFClass(fname)
+	if err != nil {
+		return nil, err
+	}
+	xlen, err := classXlen(elfClass)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := machineConfig(machineFile, xlen)
+	if err != nil {
+		return nil, err
+	}
+	app, err := newEmu(cfg)
+	if err != nil {
+		return nil, err
+	}
+	status, err := app.mem.LoadELF(fname, app.elfClass)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "%s\n", status)
+	app.cpu.Reset()
+	return app.cpu, nil
+}
+
+// runDap runs a debug adapter session and returns the exit code.
+// The ELF file (if it loads) is the attach target.
+func runDap(addr, machineFile, fname string) int {
+	attach, err := launchELF(machineFile, fname)
+	if err != nil {
+		// attach requests will fail, launch requests load their own program
+		fmt.Fprintf(os.Stderr, "attach: %s\n", err)
+	}
+	s := dap.NewServer(attach, elfLauncher(machineFile))
+	if addr == "stdio" {
+		err = s.Session(struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout})
+	} else {
+		var l net.Listener
+		l, err = gdb.Listen(addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			return 1
+		}
+		defer l.Close()
+		fmt.Fprintf(os.Stderr, "debug adapter listening on %s\n", l.Addr())
+		err = s.Serve(l)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return 1
+	}
+	return 0
 }
 
 //-----------------------------------------------------------------------------
@@ -87,55 +626,304 @@ func (u *emuApp) Put(s string) {
 
 func main() {
 	// command line flags
-	fname := flag.String("f", "out.bin", "file to load (ELF)")
+	fname := flag.String("f", "out.bin", "file to load (ELF, raw binary, Intel HEX or S-record)")
+	format := flag.String("format", "", "file format (elf, bin, hex or srec, default by file extension)")
+	xlenArg := flag.Uint("xlen", 0, "XLEN (32 or 64) for a file format without an ELF class")
+	baseArg := flag.String("base", "80000000", "load address (hex) for a raw binary file")
+	biasArg := flag.String("bias", "0", "load bias (hex) for a position independent ELF executable")
+	var images stringList
+	flag.Var(&images, "image", "load an additional ELF image (file[,bias], may be repeated)")
+	symFile := flag.String("sym", "", "load the symbols from a file (ELF or nm output)")
+	icache := flag.String("icache", "", "instruction cache (size/ways/line[/lru|random|fifo][/wb|wt][/penalty])")
+	dcache := flag.String("dcache", "", "data cache (size/ways/line[/lru|random|fifo][/wb|wt][/penalty])")
+	l2 := flag.String("l2", "", "level 2 cache (size/ways/line[/lru|random|fifo][/wb|wt][/penalty])")
+	predict := flag.String("predict", "", "branch predictor (btfn|bimodal|gshare[,bits=n][,hist=n][,ras=n][,penalty=n])")
+	commit := flag.String("commit", "", "commit log file (spike --log-commits format)")
+	batch := flag.Bool("batch", false, "run without the cli until the emulation stops")
+	ref := flag.String("cosim", "", "co-simulate against a reference trace (spike commit log or JSON lines)")
+	history := flag.Int("history", 10, "co-simulation: matching instructions to report on divergence")
+	reverse := flag.String("reverse", "", "record for reverse execution (budget MiB[,interval=n])")
+	record := flag.String("record", "", "record nondeterministic inputs to a file")
+	replayFile := flag.String("replay", "", "replay nondeterministic inputs from a file")
+	gdbAddr := flag.String("gdb", "", "run a gdb server (port, host:port or unix socket path)")
+	dapAddr := flag.String("dap", "", "run a debug adapter protocol server (stdio, port, host:port or unix socket path)")
+	semihostRoot := flag.String("semihost", "", "enable semihosting with a sandbox root directory for files")
+	sbiBoot := flag.Bool("sbi", false, "use the built-in SBI firmware and start the kernel in supervisor mode")
+	dtbFile := flag.String("dtb", "", "device tree blob passed to the kernel (with -sbi)")
+	fdtGen := flag.Bool("fdt", false, "add the standard devices and generate a device tree (default with -sbi and no -dtb)")
+	bootargs := flag.String("bootargs", "", "kernel command line for the generated device tree")
+	initrd := flag.String("initrd", "", "initial ramdisk for the generated device tree")
+	user := flag.Bool("user", false, "run a static Linux executable in user mode (rvemu -user prog args...)")
+	var env stringList
+	flag.Var(&env, "env", "environment variable for a user mode program (name=value, may be repeated)")
+	root := flag.String("root", ".", "sandbox root directory for user mode and HTIF file access")
+	disk := flag.String("disk", "", "virtio block device disk image (file[,ro|,cow])")
+	hvc := flag.Bool("hvc", false, "add a virtio console device")
+	rng := flag.String("rng", "", "add a virtio entropy device (host or a random seed)")
+	fbArg := flag.String("fb", "", "add a simple framebuffer (WxH[,format])")
+	fbDump := flag.String("fbdump", "", "write the framebuffer to PNG files every n instructions (n[,prefix])")
+	machineFile := flag.String("machine", "", "machine configuration file (JSON)")
+	checkpoint := flag.String("checkpoint", "", "start from a checkpoint file (instead of loading an ELF file)")
 	flag.Parse()
 
-	elfClass, err := util.GetELFClass(*fname)
+	if *dapAddr != "" {
+		os.Exit(runDap(*dapAddr, *machineFile, *fname))
+	}
+
+	if *user {
+		if flag.NArg() == 0 {
+			fmt.Fprintf(os.Stderr, "-user needs a program to run\n")
+			os.Exit(1)
+		}
+		*fname = flag.Arg(0)
+	}
+
+	imageFormat, err := mem.ImageFormatArg(*format, *fname)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if *user && imageFormat != mem.FormatELF {
+		fmt.Fprintf(os.Stderr, "-user needs an ELF file\n")
+		os.Exit(1)
+	}
+
+	var ck *rv.Checkpoint
+	var elfClass elf.Class
+	if *checkpoint != "" {
+		ck, err = readCheckpoint(*checkpoint)
+		if err == nil {
+			elfClass = elf.ELFCLASS32
+			if ck.Xlen == 64 {
+				elfClass = elf.ELFCLASS64
+			}
+		}
+	} else {
+		elfClass, err = imageClass(*fname, imageFormat, *xlenArg)
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
 
+	// machine configuration
+	xlen, err := classXlen(elfClass)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	cfg, err := machineConfig(*machineFile, xlen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if *user && *machineFile == "" {
+		// user mode sets up its own memory
+		cfg.Memory = nil
+	}
+	genFDT := *fdtGen || cfg.FDT != nil || (*sbiBoot && *dtbFile == "")
+	if (genFDT || *disk != "" || *hvc || *rng != "" || *fbArg != "") && len(cfg.Devices) == 0 {
+		cfg.Devices = machine.DefaultDevices()
+	}
+	if *disk != "" {
+		x := strings.Split(*disk, ",")
+		d := machine.Device{Type: "virtio-blk", File: x[0]}
+		if len(x) > 1 {
+			d.Mode = x[1]
+		}
+		cfg.Devices = append(cfg.Devices, d)
+	}
+	if *hvc {
+		cfg.Devices = append(cfg.Devices, machine.Device{Type: "virtio-console"})
+	}
+	if *rng != "" {
+		d := machine.Device{Type: "virtio-rng"}
+		if *rng != "host" {
+			d.Seed, err = strconv.ParseInt(*rng, 0, 64)
+			if err != nil || d.Seed == 0 {
+				fmt.Fprintf(os.Stderr, "-rng must be \"host\" or a non-zero seed\n")
+				os.Exit(1)
+			}
+		}
+		cfg.Devices = append(cfg.Devices, d)
+	}
+	if *fbArg != "" {
+		d, err := framebufferDevice(*fbArg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		cfg.Devices = append(cfg.Devices, d)
+	}
+
 	// create the application
-	var app *emuApp
-	switch elfClass {
-	case elf.ELFCLASS32:
-		app, err = newEmu32()
-	case elf.ELFCLASS64:
-		app, err = newEmu64()
-	default:
-		fmt.Fprintf(os.Stderr, "ELF class %d is not supported\n", elfClass)
+	app, err := newEmu(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	if ck != nil {
+		// restore the checkpoint
+		err = app.cpu.Restore(ck)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "restored %s (pc %x)\n", *checkpoint, app.cpu.PC)
+	} else if !*user {
+		// load the file
+		status, err := app.loadImage(*fname, imageFormat, *baseArg, *biasArg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", status)
+		for _, arg := range images {
+			x := strings.SplitN(arg, ",", 2)
+			bias := ""
+			if len(x) == 2 {
+				bias = x[1]
+			}
+			status, err := app.addImage(x[0], bias)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s\n", err)
+				os.Exit(1)
+			}
+			fmt.Fprintf(os.Stderr, "%s\n", status)
+		}
+	}
+	if *symFile != "" {
+		status, err := app.mem.LoadSymbols(*symFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "%s\n", status)
+	}
+
+	// add the cache models
+	err = app.newCaches(*icache, *dcache, *l2)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
+
+	// add the branch predictor model
+	err = app.newPredictor(*predict)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
 
-	// load the file
-	status, err := app.mem.LoadELF(*fname, app.elfClass)
+	// record/replay the nondeterministic inputs
+	if *reverse != "" && (*record != "" || *replayFile != "") {
+		fmt.Fprintf(os.Stderr, "-reverse can't be used with -record or -replay\n")
+		os.Exit(1)
+	}
+	err = app.newInputs(*record, *replayFile)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
-	fmt.Fprintf(os.Stderr, "%s\n", status)
 
-	// add a heap
-	app.mem.Add(mem.NewSection("heap", 0x80000000, heapSize, mem.AttrRW))
+	// semihosting
+	if *semihostRoot != "" {
+		cfg := semihost.Config{
+			Root:    *semihostRoot,
+			Cmdline: strings.Join(append([]string{*fname}, flag.Args()...), " "),
+			Console: app.machine.Console,
+			Inputs:  app.inputs,
+		}
+		if heap := app.machine.Heap(); heap != nil {
+			cfg.HeapBase = uint(heap.Base)
+			cfg.HeapLimit = uint(heap.Base + heap.Size)
+		}
+		app.semihost = semihost.NewSemihost(cfg)
+		app.cpu.SetSemihost(app.semihost)
+	}
+
+	// memory mapped devices and the device tree
+	err = app.machine.AddDevices(app.inputs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	err = app.dumpFrames(*fbDump)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if genFDT {
+		if ck != nil {
+			fmt.Fprintf(os.Stderr, "a device tree can't be generated for a checkpoint\n")
+			os.Exit(1)
+		}
+		err = app.newFDT(*bootargs, *initrd)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// HTIF via the "tohost" and "fromhost" symbols (compliance tests and the proxy kernel)
+	// argv[0] is the program name, not the host path.
+	htif := host.Config{
+		Console: app.machine.Console,
+		Root:    *root,
+		Args:    append([]string{filepath.Base(*fname)}, flag.Args()...),
+		Inputs:  app.inputs,
+	}
+	if htif.Symbols(app.mem) {
+		app.host = host.NewHost(app.mem, htif)
+		app.cpu.AddPoller(app.host.Poll)
+	}
+
+	// add the reverse execution recorder (after the devices and host call handlers)
+	err = app.newReverse(*reverse)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
 
-	// Callback on the "tohost" write (compliance tests).
-	sym := app.mem.SymbolByName("tohost")
-	if sym != nil {
-		app.host = host.NewHost(app.mem, sym.Addr)
-		if sym.Size == 8 {
-			// trap on a write to the most significant word
-			fn := func(bp *mem.BreakPoint) bool { return app.host.To64(bp) }
-			app.mem.AddBreakPoint(sym.Name, sym.Addr+4, mem.AttrW, fn)
-		} else {
-			// 32-bit variable
-			fn := func(bp *mem.BreakPoint) bool { return app.host.To32(bp) }
-			app.mem.AddBreakPoint(sym.Name, sym.Addr, mem.AttrW, fn)
+	// add the commit log
+	if *commit != "" {
+		f, err := os.Create(*commit)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
 		}
+		app.commit = rv.NewCommitLog(f, 0)
+		app.cpu.SetCommitLog(app.commit)
+	}
+
+	// reset the cpu (a checkpoint has its own cpu state)
+	if ck == nil {
+		app.cpu.Reset()
+	}
+
+	if *sbiBoot {
+		err = app.bootSBI(*dtbFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *user {
+		os.Exit(app.runUser(*fname, *root, flag.Args(), env))
+	}
+
+	if *batch {
+		os.Exit(app.runBatch())
+	}
+
+	if *ref != "" {
+		os.Exit(app.runCosim(*ref, *history))
+	}
+
+	if *gdbAddr != "" {
+		os.Exit(app.runGdb(*gdbAddr))
 	}
 
 	// create the cli
@@ -144,9 +932,6 @@ func main() {
 	c.SetRoot(menuRoot)
 	c.SetPrompt(app.prompt)
 
-	// reset the cpu
-	app.cpu.Reset()
-
 	// run the cli
 	for c.Running() {
 		c.Run()
@@ -154,7 +939,8 @@ func main() {
 
 	// exit
 	c.HistorySave(historyPath)
-	os.Exit(0)
+	app.flushLogs()
+	os.Exit(app.status)
 }
 
 //-----------------------------------------------------------------------------
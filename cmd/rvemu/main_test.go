@@ -0,0 +1,68 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Emulator Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/deadsy/riscv/machine"
+	"github.com/deadsy/riscv/machine/machinetest"
+)
+
+//-----------------------------------------------------------------------------
+
+// newTestEmu returns an emulator with a looping test program and a reverse execution recorder.
+func newTestEmu(t *testing.T, devices []machine.Device) *emuApp {
+	cfg := machine.Default(64)
+	cfg.Memory = append(cfg.Memory, machine.Region{Name: "text", Base: 0x1000, Size: 0x1000, Attr: "rx"})
+	cfg.Devices = devices
+	app, err := newEmu(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the recorder is added before the devices
+	err = app.newReverse("16,interval=4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.machine.AddDevices(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machinetest.Assemble(t, app.cpu, 0x1000, "addi a0,a0,1", "jal zero,1000")
+	app.cpu.Reset()
+	app.cpu.PC = 0x1000
+	return app
+}
+
+func Test_ReverseDevices(t *testing.T) {
+	test := []struct {
+		devices []machine.Device
+		status  string
+	}{
+		{nil, ", 5 checkpoints,"},
+		{machine.DefaultDevices(), ", 0 checkpoints,"},
+	}
+	for _, v := range test {
+		app := newTestEmu(t, v.devices)
+		for i := 0; i < 20; i++ {
+			err := app.run()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		status := app.cpu.ReverseStatus()
+		if !strings.Contains(status, v.status) {
+			t.Errorf("%d devices: status \"%s\", expected \"%s\"", len(v.devices), status, v.status)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,61 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Random Instruction Stream Self-Test
+
+Generates random instruction streams and runs them on the emulator.
+Any failure can be reproduced with the reported seed.
+
+*/
+//-----------------------------------------------------------------------------
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+func main() {
+	// command line flags
+	seed := flag.Int64("seed", 0, "random seed (0 = time based)")
+	n := flag.Int("n", 10000, "instructions per stream")
+	runs := flag.Int("runs", 1, "number of streams (seed, seed+1, ...)")
+	xlen := flag.Int("xlen", 64, "register length (32 or 64)")
+	flag.Parse()
+
+	var module []rv.ISAModule
+	switch *xlen {
+	case 32:
+		module = rv.ISArv32gc
+	case 64:
+		module = rv.ISArv64gc
+	default:
+		fmt.Fprintf(os.Stderr, "xlen %d is not supported\n", *xlen)
+		os.Exit(1)
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	fmt.Printf("rv%d seed %d, %d runs\n", *xlen, *seed, *runs)
+
+	for i := 0; i < *runs; i++ {
+		s := *seed + int64(i)
+		err := rv.RandomTest(module, uint(*xlen), s, *n)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rv%d seed %d: %s\n", *xlen, s, err)
+			os.Exit(1)
+		}
+		fmt.Printf("rv%d seed %d: %d instructions ok\n", *xlen, s, *n)
+	}
+	os.Exit(0)
+}
+
+//-----------------------------------------------------------------------------
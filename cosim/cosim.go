@@ -0,0 +1,294 @@
+//-----------------------------------------------------------------------------
+/*
+
+Lockstep Co-Simulation
+
+Runs the emulator one instruction at a time and compares each retired
+instruction against a reference execution trace (E.g. from Spike or RTL
+simulation). The simulation stops at the first divergence.
+
+*/
+//-----------------------------------------------------------------------------
+
+package cosim
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// Config is the co-simulation configuration.
+type Config struct {
+	History   int  // number of matching instructions to report on divergence
+	IgnoreCSR bool // don't compare CSR writes
+	IgnoreMem bool // don't compare memory accesses
+}
+
+// maxTraps is the number of traps taken before we expect an instruction to retire.
+const maxTraps = 8
+
+//-----------------------------------------------------------------------------
+
+// Divergence is the first mismatch between the emulator and the reference.
+type Divergence struct {
+	N       uint64   // instruction number
+	Ref     string   // reference record
+	Emu     string   // emulator record
+	Diff    []string // mismatches
+	History []string // last matching instructions
+}
+
+func (d *Divergence) Error() string {
+	s := []string{}
+	s = append(s, fmt.Sprintf("divergence at instruction %d", d.N))
+	for _, x := range d.Diff {
+		s = append(s, fmt.Sprintf("  %s", x))
+	}
+	s = append(s, fmt.Sprintf("ref: %s", d.Ref))
+	s = append(s, fmt.Sprintf("emu: %s", d.Emu))
+	if len(d.History) != 0 {
+		s = append(s, fmt.Sprintf("last %d matching instructions:", len(d.History)))
+		s = append(s, d.History...)
+	}
+	return strings.Join(s, "\n")
+}
+
+//-----------------------------------------------------------------------------
+
+// Cosim is the co-simulation state.
+type Cosim struct {
+	cpu     *rv.RV
+	ref     Reader
+	cfg     Config
+	prev    rv.RetireFunc // retire callback prior to the co-simulation
+	emu     rv.Retire     // emulator record
+	retired bool          // an instruction was retired
+	history []string      // ring buffer of matching instructions
+	N       uint64        // number of matched instructions
+}
+
+// NewCosim returns a co-simulation of the cpu against a reference trace.
+func NewCosim(cpu *rv.RV, ref Reader, cfg Config) *Cosim {
+	c := &Cosim{
+		cpu: cpu,
+		ref: ref,
+		cfg: cfg,
+	}
+	// any existing callback (E.g. a commit log) is called first
+	c.prev = cpu.GetRetire()
+	cpu.SetRetire(rv.RetireFuncs(c.prev, c.retire))
+	return c
+}
+
+// Close detaches the co-simulation from the cpu.
+func (c *Cosim) Close() {
+	c.cpu.SetRetire(c.prev)
+}
+
+// retire copies the emulator record for a retired instruction.
+func (c *Cosim) retire(r *rv.Retire) {
+	c.emu.PC = r.PC
+	c.emu.Ins = r.Ins
+	c.emu.Mode = r.Mode
+	c.emu.X = append(c.emu.X[:0], r.X...)
+	c.emu.F = append(c.emu.F[:0], r.F...)
+	c.emu.CSR = append(c.emu.CSR[:0], r.CSR...)
+	c.emu.Rd = append(c.emu.Rd[:0], r.Rd...)
+	c.emu.Wr = append(c.emu.Wr[:0], r.Wr...)
+	c.emu.Traps = append(c.emu.Traps[:0], r.Traps...)
+	c.retired = true
+}
+
+// addHistory adds a matching instruction to the history.
+func (c *Cosim) addHistory(s string) {
+	if c.cfg.History <= 0 {
+		return
+	}
+	if len(c.history) == c.cfg.History {
+		c.history = c.history[1:]
+	}
+	c.history = append(c.history, s)
+}
+
+//-----------------------------------------------------------------------------
+
+// finalRegs returns the final value written to each register (sorted by register).
+func finalRegs(w []rv.RegWrite) []rv.RegWrite {
+	m := make(map[uint]uint64)
+	for _, v := range w {
+		m[v.Reg] = v.Val
+	}
+	x := make([]rv.RegWrite, 0, len(m))
+	for k, v := range m {
+		x = append(x, rv.RegWrite{Reg: k, Val: v})
+	}
+	sort.Slice(x, func(i, j int) bool { return x[i].Reg < x[j].Reg })
+	return x
+}
+
+// diffRegs compares register writes.
+func diffRegs(kind string, name func(uint) string, ref, emu []rv.RegWrite) []string {
+	d := []string{}
+	r := finalRegs(ref)
+	e := finalRegs(emu)
+	rm := make(map[uint]uint64)
+	for _, v := range r {
+		rm[v.Reg] = v.Val
+	}
+	em := make(map[uint]uint64)
+	for _, v := range e {
+		em[v.Reg] = v.Val
+		x, ok := rm[v.Reg]
+		if !ok {
+			d = append(d, fmt.Sprintf("%s %s: unexpected write 0x%x", kind, name(v.Reg), v.Val))
+		} else if x != v.Val {
+			d = append(d, fmt.Sprintf("%s %s: 0x%x (ref) 0x%x (emu)", kind, name(v.Reg), x, v.Val))
+		}
+	}
+	for _, v := range r {
+		if _, ok := em[v.Reg]; !ok {
+			d = append(d, fmt.Sprintf("%s %s: missing write 0x%x", kind, name(v.Reg), v.Val))
+		}
+	}
+	return d
+}
+
+// diffMem compares memory accesses.
+func diffMem(kind string, ref, emu []rv.MemAccess, isWrite bool) []string {
+	if len(ref) != len(emu) {
+		return []string{fmt.Sprintf("mem %s: %d accesses (ref) %d accesses (emu)", kind, len(ref), len(emu))}
+	}
+	d := []string{}
+	for i := range ref {
+		r := &ref[i]
+		e := &emu[i]
+		if r.Adr != e.Adr {
+			d = append(d, fmt.Sprintf("mem %s: address 0x%x (ref) 0x%x (emu)", kind, r.Adr, e.Adr))
+			continue
+		}
+		if r.Size != 0 && r.Size != e.Size {
+			d = append(d, fmt.Sprintf("mem %s 0x%x: size %d (ref) %d (emu)", kind, r.Adr, r.Size, e.Size))
+			continue
+		}
+		if isWrite && r.Val != e.Val {
+			d = append(d, fmt.Sprintf("mem %s 0x%x: 0x%x (ref) 0x%x (emu)", kind, r.Adr, r.Val, e.Val))
+		}
+	}
+	return d
+}
+
+// diffTraps compares the traps taken before an instruction.
+// The reference trace may not record traps (E.g. a Spike log without -l).
+func diffTraps(ref, emu []rv.Trap) []string {
+	if len(ref) == 0 {
+		return nil
+	}
+	if len(ref) != len(emu) {
+		return []string{fmt.Sprintf("traps: %d (ref) %d (emu)", len(ref), len(emu))}
+	}
+	d := []string{}
+	for i := range ref {
+		r := &ref[i]
+		e := &emu[i]
+		if r.Cause != e.Cause || r.Interrupt != e.Interrupt || r.EPC != e.EPC {
+			d = append(d, fmt.Sprintf("trap: %s epc 0x%x (ref) %s epc 0x%x (emu)", rv.TrapName(r), r.EPC, rv.TrapName(e), e.EPC))
+		}
+	}
+	return d
+}
+
+func xName(reg uint) string { return fmt.Sprintf("x%d", reg) }
+func fName(reg uint) string { return fmt.Sprintf("f%d", reg) }
+
+// compare returns the differences between the reference and emulator records.
+func (c *Cosim) compare(ref, emu *rv.Retire) []string {
+	if d := diffTraps(ref.Traps, emu.Traps); len(d) != 0 {
+		return d
+	}
+	if ref.PC != emu.PC {
+		return []string{fmt.Sprintf("pc: 0x%x (ref) 0x%x (emu)", ref.PC, emu.PC)}
+	}
+	if ref.Ins != emu.Ins {
+		return []string{fmt.Sprintf("ins: 0x%x (ref) 0x%x (emu)", ref.Ins, emu.Ins)}
+	}
+	d := []string{}
+	if ref.Mode != emu.Mode {
+		d = append(d, fmt.Sprintf("mode: %d (ref) %d (emu)", ref.Mode, emu.Mode))
+	}
+	d = append(d, diffRegs("reg", xName, ref.X, emu.X)...)
+	d = append(d, diffRegs("reg", fName, ref.F, emu.F)...)
+	if !c.cfg.IgnoreCSR {
+		d = append(d, diffRegs("csr", csr.Name, ref.CSR, emu.CSR)...)
+	}
+	if !c.cfg.IgnoreMem {
+		d = append(d, diffMem("read", ref.Rd, emu.Rd, false)...)
+		d = append(d, diffMem("write", ref.Wr, emu.Wr, true)...)
+	}
+	return d
+}
+
+//-----------------------------------------------------------------------------
+
+// Step compares the next retired instruction with the reference.
+// It returns io.EOF at the end of the reference trace, a *Divergence on a
+// mismatch, or an emulation error.
+func (c *Cosim) Step() error {
+	ref, err := c.ref.Next()
+	if err != nil {
+		return err
+	}
+	// run until an instruction retires (traps don't retire)
+	c.retired = false
+	for i := 0; !c.retired; i++ {
+		if i == maxTraps {
+			return &Divergence{
+				N:       c.N,
+				Ref:     c.cpu.RetireString(ref),
+				Emu:     fmt.Sprintf("no instruction retired (pc 0x%x)", c.cpu.PC),
+				Diff:    []string{"emulator is trapping"},
+				History: c.history,
+			}
+		}
+		err := c.cpu.Run()
+		if err != nil {
+			return err
+		}
+	}
+	s := c.cpu.RetireString(&c.emu)
+	d := c.compare(ref, &c.emu)
+	if len(d) != 0 {
+		return &Divergence{
+			N:       c.N,
+			Ref:     c.cpu.RetireString(ref),
+			Emu:     s,
+			Diff:    d,
+			History: c.history,
+		}
+	}
+	c.addHistory(s)
+	c.N++
+	return nil
+}
+
+// Run the co-simulation until the end of the reference trace (returns nil)
+// or the first divergence/emulation error.
+func (c *Cosim) Run() error {
+	for {
+		err := c.Step()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,152 @@
+//-----------------------------------------------------------------------------
+/*
+
+Co-Simulation Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package cosim
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/deadsy/riscv/machine"
+	"github.com/deadsy/riscv/machine/machinetest"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// newCPU returns a cpu with a test program loaded at 0x1000.
+func newCPU(t *testing.T) *rv.RV {
+	mc := machinetest.New(t, 64,
+		machine.Region{Name: "text", Base: 0x1000, Size: 0x1000, Attr: "rwx"},
+		machine.Region{Name: "data", Base: 0x400, Size: 0x100, Attr: "rw"},
+	)
+	machinetest.Assemble(t, mc.CPU, 0x1000,
+		"addi a0,zero,5",
+		"sw a0,0x400(zero)",
+		"lw a1,0x400(zero)",
+		"csrw mscratch,a1",
+	)
+	mc.CPU.PC = 0x1000
+	return mc.CPU
+}
+
+const spikeLog = `
+core   0: 0x0000000000001000 (0x00500513) li      a0, 5
+core   0: 3 0x0000000000001000 (0x00500513) x10 0x0000000000000005
+core   0: 3 0x0000000000001004 (0x40a02023) mem 0x0000000000000400 0x00000005
+core   0: 3 0x0000000000001008 (0x40002583) x11 0x0000000000000005 mem 0x0000000000000400
+core   0: 3 0x000000000000100c (0x34059073) c832_mscratch 0x0000000000000005
+`
+
+const jsonLog = `
+{"pc":"0x1000","ins":"0x00500513","x":{"10":"0x5"}}
+{"pc":"0x1004","ins":"0x40a02023","wr":[{"adr":"0x400","size":4,"val":"0x5"}]}
+{"pc":"0x1008","ins":"0x40002583","x":{"11":"0x5"},"rd":[{"adr":"0x400","size":4}]}
+{"pc":"0x100c","ins":"0x34059073","csr":{"mscratch":"0x5"}}
+`
+
+func Test_Cosim(t *testing.T) {
+	for _, log := range []string{spikeLog, jsonLog} {
+		c := NewCosim(newCPU(t), NewReader(strings.NewReader(log)), Config{History: 2})
+		err := c.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.N != 4 {
+			t.Errorf("expected 4 matching instructions, got %d", c.N)
+		}
+	}
+}
+
+func Test_CosimCommitLog(t *testing.T) {
+	cpu := newCPU(t)
+	var buf bytes.Buffer
+	log := rv.NewCommitLog(&buf, 0)
+	cpu.SetCommitLog(log)
+	c := NewCosim(cpu, NewReader(strings.NewReader(spikeLog)), Config{})
+	err := c.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	log.Flush()
+	// the commit log is the reference trace (less the instruction lines)
+	var expect []string
+	for _, l := range strings.Split(strings.TrimSpace(spikeLog), "\n") {
+		if strings.HasPrefix(l, "core   0: 3 ") {
+			expect = append(expect, l)
+		}
+	}
+	if strings.TrimSpace(buf.String()) != strings.Join(expect, "\n") {
+		t.Errorf("commit log mismatch\n%s", buf.String())
+	}
+	if cpu.GetRetire() == nil {
+		t.Errorf("the commit log was detached by the co-simulation")
+	}
+}
+
+func Test_CosimDivergence(t *testing.T) {
+	log := strings.Replace(spikeLog, "x11 0x0000000000000005", "x11 0x0000000000000006", 1)
+	c := NewCosim(newCPU(t), NewReader(strings.NewReader(log)), Config{History: 1})
+	err := c.Run()
+	d, ok := err.(*Divergence)
+	if !ok {
+		t.Fatalf("expected a divergence, got %v", err)
+	}
+	if d.N != 2 || len(d.Diff) != 1 || !strings.HasPrefix(d.Diff[0], "reg x11:") {
+		t.Errorf("unexpected divergence\n%s", d)
+	}
+	if len(d.History) != 1 || !strings.Contains(d.History[0], "0x0000000000001004") {
+		t.Errorf("unexpected history %v", d.History)
+	}
+}
+
+// newTrapCPU returns a cpu with an ecall at 0x1000 and a trap handler at 0x1100.
+func newTrapCPU(t *testing.T) *rv.RV {
+	cpu := newCPU(t)
+	for adr, s := range map[uint]string{0x1000: "ecall", 0x1100: "addi a0,zero,1"} {
+		_, err := cpu.Assemble(adr, s)
+		if err != nil {
+			t.Fatalf("\"%s\" %s", s, err)
+		}
+	}
+	cpu.CSR.DebugWr(0x305, 0x1100) // mtvec
+	return cpu
+}
+
+const spikeTrapLog = `
+core   0: exception trap_machine_ecall, epc 0x0000000000001000
+core   0: 3 0x0000000000001100 (0x00100513) x10 0x0000000000000001
+`
+
+const jsonTrapLog = `
+{"pc":"0x1100","ins":"0x00100513","x":{"10":"0x1"},"traps":[{"cause":11,"epc":"0x1000"}]}
+`
+
+func Test_CosimTrap(t *testing.T) {
+	for _, log := range []string{spikeTrapLog, jsonTrapLog} {
+		c := NewCosim(newTrapCPU(t), NewReader(strings.NewReader(log)), Config{})
+		err := c.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.N != 1 {
+			t.Errorf("expected 1 matching instruction, got %d", c.N)
+		}
+	}
+	log := strings.Replace(spikeTrapLog, "trap_machine_ecall", "trap_illegal_instruction", 1)
+	c := NewCosim(newTrapCPU(t), NewReader(strings.NewReader(log)), Config{})
+	err := c.Run()
+	d, ok := err.(*Divergence)
+	if !ok || len(d.Diff) != 1 || !strings.HasPrefix(d.Diff[0], "trap:") {
+		t.Errorf("expected a trap divergence, got %v", err)
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,417 @@
+//-----------------------------------------------------------------------------
+/*
+
+Reference Trace Readers
+
+Reads retired instruction records from a reference execution trace.
+Two formats are supported:
+
+1) Spike commit logs (spike --log-commits)
+
+core   0: 3 0x0000000080000000 (0x00000297) x5  0x0000000080000000
+
+Exception lines (spike -l) are the traps taken before the next commit record.
+
+core   0: exception trap_illegal_instruction, epc 0x0000000080000004
+core   0:           tval 0x0000000000000000
+
+Other lines (E.g. disassembly) are ignored.
+
+2) JSON lines, one object per retired instruction
+
+{"pc":"0x80000000","ins":"0x00000297","mode":3,"x":{"5":"0x80000000"}}
+
+pc, ins: hex strings (required)
+mode: privilege mode (optional, default 3)
+x, f, csr: register number (or CSR name) to hex value string (optional)
+rd: memory reads, [{"adr":"0x..","size":n}] (optional)
+wr: memory writes, [{"adr":"0x..","size":n,"val":"0x.."}] (optional)
+traps: traps taken before the instruction,
+[{"cause":n,"interrupt":false,"epc":"0x..","tval":"0x.."}] (optional)
+
+*/
+//-----------------------------------------------------------------------------
+
+package cosim
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// Reader reads reference retire records.
+// Next returns io.EOF at the end of the trace.
+type Reader interface {
+	Next() (*rv.Retire, error)
+}
+
+// lineReader reads a trace line by line.
+type lineReader struct {
+	scan  *bufio.Scanner
+	line  int                                      // line number
+	parse func(s string) (*rv.Retire, bool, error) // parse a line (false: skip it)
+}
+
+func (lr *lineReader) Next() (*rv.Retire, error) {
+	for lr.scan.Scan() {
+		lr.line++
+		s := strings.TrimSpace(lr.scan.Text())
+		if s == "" {
+			continue
+		}
+		r, ok, err := lr.parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lr.line, err)
+		}
+		if ok {
+			return r, nil
+		}
+	}
+	err := lr.scan.Err()
+	if err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// NewReader returns a reference trace reader.
+// The format (Spike or JSON lines) is detected from the first character.
+func NewReader(r io.Reader) Reader {
+	br := bufio.NewReader(r)
+	parse := (&spikeParser{}).parse
+	for {
+		c, _, err := br.ReadRune()
+		if err != nil {
+			break
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+		if c == '{' {
+			parse = parseJSON
+		}
+		br.UnreadRune()
+		break
+	}
+	scan := bufio.NewScanner(br)
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	return &lineReader{
+		scan:  scan,
+		parse: parse,
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// hexArg converts a hex string to a value.
+func hexArg(s string) (uint64, error) {
+	x, err := strconv.ParseUint(strings.TrimPrefix(s, "0x"), 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad hex value \"%s\"", s)
+	}
+	return x, nil
+}
+
+// regArg converts a "<prefix><n>" register string to a register number.
+func regArg(s string, prefix byte) (uint, bool) {
+	if len(s) < 2 || s[0] != prefix {
+		return 0, false
+	}
+	x, err := strconv.ParseUint(s[1:], 10, 8)
+	if err != nil || x >= 32 {
+		return 0, false
+	}
+	return uint(x), true
+}
+
+// csrArg converts a "c<n>_<name>" CSR string to a register number.
+func csrArg(s string) (uint, bool) {
+	if len(s) < 2 || s[0] != 'c' {
+		return 0, false
+	}
+	i := strings.IndexByte(s, '_')
+	if i < 0 {
+		return 0, false
+	}
+	x, err := strconv.ParseUint(s[1:i], 10, 12)
+	if err != nil {
+		return 0, false
+	}
+	return uint(x), true
+}
+
+// spikeParser parses Spike commit log lines.
+type spikeParser struct {
+	traps []rv.Trap // traps before the next commit record
+}
+
+// spikeTrap returns the trap for a Spike trap name.
+func spikeTrap(name string) (rv.Trap, bool) {
+	var t rv.Trap
+	if strings.HasPrefix(name, "interrupt #") {
+		x, err := strconv.ParseUint(strings.TrimPrefix(name, "interrupt #"), 10, 8)
+		t.Cause = uint(x)
+		t.Interrupt = true
+		return t, err == nil
+	}
+	for i := uint(0); i < 32; i++ {
+		t.Cause = i
+		if rv.TrapName(&t) == name {
+			return t, true
+		}
+	}
+	return t, false
+}
+
+// trap parses an exception line.
+func (p *spikeParser) trap(f []string) error {
+	// core   0:           tval 0x0000000000000000
+	if len(f) == 4 && f[2] == "tval" {
+		if len(p.traps) == 0 {
+			return nil
+		}
+		val, err := hexArg(f[3])
+		if err != nil {
+			return err
+		}
+		p.traps[len(p.traps)-1].Tval = val
+		return nil
+	}
+	// core   0: exception trap_illegal_instruction, epc 0x0000000080000004
+	if len(f) < 6 || f[2] != "exception" || f[len(f)-2] != "epc" {
+		return nil
+	}
+	name := strings.TrimSuffix(strings.Join(f[3:len(f)-2], " "), ",")
+	t, ok := spikeTrap(name)
+	if !ok {
+		return fmt.Errorf("unknown trap \"%s\"", name)
+	}
+	epc, err := hexArg(f[len(f)-1])
+	if err != nil {
+		return err
+	}
+	t.EPC = epc
+	p.traps = append(p.traps, t)
+	return nil
+}
+
+// parse parses a Spike commit log line.
+func (p *spikeParser) parse(s string) (*rv.Retire, bool, error) {
+	f := strings.Fields(s)
+	if len(f) < 4 || f[0] != "core" || !strings.HasSuffix(f[1], ":") {
+		return nil, false, nil
+	}
+	// core   0: 3 0x0000000080000000 (0x00000297) ...
+	mode, err := strconv.ParseUint(f[2], 10, 2)
+	if err != nil || len(f) < 5 {
+		// disassembly or exception line
+		return nil, false, p.trap(f)
+	}
+	r := &rv.Retire{Mode: csr.Mode(mode), Traps: p.traps}
+	p.traps = nil
+	pc, err := hexArg(f[3])
+	if err != nil {
+		return nil, false, err
+	}
+	r.PC = pc
+	if !strings.HasPrefix(f[4], "(") || !strings.HasSuffix(f[4], ")") {
+		return nil, false, fmt.Errorf("bad instruction \"%s\"", f[4])
+	}
+	ins, err := hexArg(strings.Trim(f[4], "()"))
+	if err != nil {
+		return nil, false, err
+	}
+	r.Ins = uint(ins)
+	// side effects
+	for i := 5; i < len(f); i++ {
+		tok := f[i]
+		if i+1 >= len(f) {
+			return nil, false, fmt.Errorf("missing value for \"%s\"", tok)
+		}
+		val, err := hexArg(f[i+1])
+		if err != nil {
+			return nil, false, err
+		}
+		i++
+		if tok == "mem" {
+			// a memory write has a data value after the address
+			if i+1 < len(f) && strings.HasPrefix(f[i+1], "0x") {
+				data, err := hexArg(f[i+1])
+				if err != nil {
+					return nil, false, err
+				}
+				size := uint(len(f[i+1])-2) / 2
+				r.Wr = append(r.Wr, rv.MemAccess{Adr: uint(val), Size: size, Val: data})
+				i++
+			} else {
+				r.Rd = append(r.Rd, rv.MemAccess{Adr: uint(val)})
+			}
+			continue
+		}
+		if reg, ok := regArg(tok, 'x'); ok {
+			r.X = append(r.X, rv.RegWrite{Reg: reg, Val: val})
+			continue
+		}
+		if reg, ok := regArg(tok, 'f'); ok {
+			r.F = append(r.F, rv.RegWrite{Reg: reg, Val: val})
+			continue
+		}
+		if reg, ok := csrArg(tok); ok {
+			r.CSR = append(r.CSR, rv.RegWrite{Reg: reg, Val: val})
+			continue
+		}
+		return nil, false, fmt.Errorf("unknown field \"%s\"", tok)
+	}
+	return r, true, nil
+}
+
+//-----------------------------------------------------------------------------
+
+// jsonMem is a JSON memory access.
+type jsonMem struct {
+	Adr  string `json:"adr"`
+	Size uint   `json:"size"`
+	Val  string `json:"val"`
+}
+
+// jsonTrap is a JSON trap.
+type jsonTrap struct {
+	Cause     uint   `json:"cause"`
+	Interrupt bool   `json:"interrupt"`
+	EPC       string `json:"epc"`
+	Tval      string `json:"tval"`
+}
+
+// jsonRetire is a JSON retire record.
+type jsonRetire struct {
+	PC    string            `json:"pc"`
+	Ins   string            `json:"ins"`
+	Mode  *uint             `json:"mode"`
+	X     map[string]string `json:"x"`
+	F     map[string]string `json:"f"`
+	CSR   map[string]string `json:"csr"`
+	Rd    []jsonMem         `json:"rd"`
+	Wr    []jsonMem         `json:"wr"`
+	Traps []jsonTrap        `json:"traps"`
+}
+
+// jsonRegs converts a JSON register map to register writes.
+func jsonRegs(x map[string]string, isCSR bool) ([]rv.RegWrite, error) {
+	w := []rv.RegWrite{}
+	for k, v := range x {
+		reg, err := strconv.ParseUint(k, 10, 12)
+		if err != nil {
+			if !isCSR {
+				return nil, fmt.Errorf("bad register \"%s\"", k)
+			}
+			n, err := csr.Number(k)
+			if err != nil {
+				return nil, err
+			}
+			reg = uint64(n)
+		}
+		if !isCSR && reg >= 32 {
+			return nil, fmt.Errorf("bad register \"%s\"", k)
+		}
+		val, err := hexArg(v)
+		if err != nil {
+			return nil, err
+		}
+		w = append(w, rv.RegWrite{Reg: uint(reg), Val: val})
+	}
+	sort.Slice(w, func(i, j int) bool { return w[i].Reg < w[j].Reg })
+	return w, nil
+}
+
+// jsonMems converts JSON memory accesses.
+func jsonMems(x []jsonMem, isWrite bool) ([]rv.MemAccess, error) {
+	a := []rv.MemAccess{}
+	for _, v := range x {
+		adr, err := hexArg(v.Adr)
+		if err != nil {
+			return nil, err
+		}
+		ma := rv.MemAccess{Adr: uint(adr), Size: v.Size}
+		if isWrite {
+			ma.Val, err = hexArg(v.Val)
+			if err != nil {
+				return nil, err
+			}
+		}
+		a = append(a, ma)
+	}
+	return a, nil
+}
+
+// jsonTraps converts JSON traps.
+func jsonTraps(x []jsonTrap) ([]rv.Trap, error) {
+	t := []rv.Trap{}
+	for _, v := range x {
+		epc, err := hexArg(v.EPC)
+		if err != nil {
+			return nil, err
+		}
+		var tval uint64
+		if v.Tval != "" {
+			tval, err = hexArg(v.Tval)
+			if err != nil {
+				return nil, err
+			}
+		}
+		t = append(t, rv.Trap{Cause: v.Cause, Interrupt: v.Interrupt, EPC: epc, Tval: tval})
+	}
+	return t, nil
+}
+
+// parseJSON parses a JSON lines record.
+func parseJSON(s string) (*rv.Retire, bool, error) {
+	var x jsonRetire
+	err := json.Unmarshal([]byte(s), &x)
+	if err != nil {
+		return nil, false, err
+	}
+	r := &rv.Retire{Mode: csr.ModeM}
+	if x.Mode != nil {
+		r.Mode = csr.Mode(*x.Mode)
+	}
+	r.PC, err = hexArg(x.PC)
+	if err != nil {
+		return nil, false, err
+	}
+	ins, err := hexArg(x.Ins)
+	if err != nil {
+		return nil, false, err
+	}
+	r.Ins = uint(ins)
+	if r.X, err = jsonRegs(x.X, false); err != nil {
+		return nil, false, err
+	}
+	if r.F, err = jsonRegs(x.F, false); err != nil {
+		return nil, false, err
+	}
+	if r.CSR, err = jsonRegs(x.CSR, true); err != nil {
+		return nil, false, err
+	}
+	if r.Rd, err = jsonMems(x.Rd, false); err != nil {
+		return nil, false, err
+	}
+	if r.Wr, err = jsonMems(x.Wr, true); err != nil {
+		return nil, false, err
+	}
+	if r.Traps, err = jsonTraps(x.Traps); err != nil {
+		return nil, false, err
+	}
+	return r, true, nil
+}
+
+//-----------------------------------------------------------------------------
@@ -11,6 +11,7 @@ package csr
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 
 	cli "github.com/deadsy/go-cli"
@@ -90,6 +91,11 @@ func (s *State) setMode(mode Mode) {
 	s.mode = mode
 }
 
+// SetMode sets the current processor mode (E.g. user mode for Linux user emulation).
+func (s *State) SetMode(mode Mode) {
+	s.setMode(mode)
+}
+
 // hasMode returns true if the mode is supported.
 func (s *State) hasMode(mode Mode) bool {
 	switch mode {
@@ -140,12 +146,20 @@ func (s *State) getNextMode(code uint, isInterrupt bool) Mode {
 
 // Register numbers for specific CSRs.
 const (
+	USTATUS = 0x000
 	FFLAGS  = 0x001
 	FRM     = 0x002
 	FCSR    = 0x003
+	UEPC    = 0x041
+	UCAUSE  = 0x042
+	UTVAL   = 0x043
 	SSTATUS = 0x100
 	SEDELEG = 0x102
 	SIDELEG = 0x103
+	SEPC    = 0x141
+	SCAUSE  = 0x142
+	STVAL   = 0x143
+	SATP    = 0x180
 	MSTATUS = 0x300
 	MEDELEG = 0x302
 	MIDELEG = 0x303
@@ -947,12 +961,16 @@ func rdSIDELEG(s *State) uint {
 //-----------------------------------------------------------------------------
 // u/s/m interrupt enable
 
+// sMaskIP is the mask of supervisor/user interrupt enable/pending bits.
+const sMaskIP = (1 << IntSupervisorSoftware) | (1 << IntSupervisorTimer) | (1 << IntSupervisorExternal) |
+	(1 << IntUserSoftware) | (1 << IntUserTimer) | (1 << IntUserExternal)
+
 func rdUIE(s *State) uint {
 	return s.mie // TODO mask
 }
 
 func rdSIE(s *State) uint {
-	return s.mie // TODO mask
+	return s.mie & s.mideleg & sMaskIP
 }
 
 func rdMIE(s *State) uint {
@@ -964,7 +982,8 @@ func wrUIE(s *State, x uint) {
 }
 
 func wrSIE(s *State, x uint) {
-	s.mie = x // TODO mask
+	mask := s.mideleg & sMaskIP
+	s.mie = (s.mie &^ mask) | (x & mask)
 }
 
 func wrMIE(s *State, x uint) {
@@ -979,7 +998,7 @@ func rdUIP(s *State) uint {
 }
 
 func rdSIP(s *State) uint {
-	return s.mip // TODO mask
+	return s.mip & s.mideleg & sMaskIP
 }
 
 func rdMIP(s *State) uint {
@@ -991,7 +1010,9 @@ func wrUIP(s *State, x uint) {
 }
 
 func wrSIP(s *State, x uint) {
-	s.mip = x // TODO mask
+	// only the software interrupt is writeable
+	mask := s.mideleg & (1 << IntSupervisorSoftware)
+	s.mip = (s.mip &^ mask) | (x & mask)
 }
 
 func wrMIP(s *State, x uint) {
@@ -1115,6 +1136,41 @@ func (s *State) IncInstructions() {
 	s.minstret++
 }
 
+//-----------------------------------------------------------------------------
+// time
+
+// SetTime sets the source of the real time counter.
+// The default (nil) is the clock cycle counter.
+func (s *State) SetTime(fn func() uint64) {
+	s.time = fn
+}
+
+// getTime returns the real time counter.
+// A debugger or display read returns the last value without reading the
+// time source (it may be a recorded input).
+func (s *State) getTime() uint64 {
+	if s.time == nil {
+		return s.mcycle
+	}
+	if s.debug {
+		return s.lastTime
+	}
+	s.lastTime = s.time()
+	return s.lastTime
+}
+
+func rdTIME(s *State) uint {
+	t := s.getTime()
+	if s.mxlen == 32 {
+		return uint(uint32(t))
+	}
+	return uint(t)
+}
+
+func rdTIMEH(s *State) uint {
+	return uint(s.getTime() >> 32)
+}
+
 //-----------------------------------------------------------------------------
 
 type wrFunc func(s *State, val uint)
@@ -1143,7 +1199,7 @@ var lookup = map[uint]csrDefn{
 	0x044: {"uip", wrUIP, rdUIP, nil},
 	// User CSRs 0xc00 - 0xc7f (read only)
 	0xc00: {"cycle", nil, rdMCYCLE, nil},
-	0xc01: {"time", nil, nil, nil},
+	0xc01: {"time", nil, rdTIME, nil},
 	0xc02: {"instret", nil, rdMINSTRET, nil},
 	0xc03: {"hpmcounter3", nil, nil, nil},
 	0xc04: {"hpmcounter4", nil, nil, nil},
@@ -1176,7 +1232,7 @@ var lookup = map[uint]csrDefn{
 	0xc1f: {"hpmcounter31", nil, nil, nil},
 	// User CSRs 0xc80 - 0xcbf (read only)
 	0xc80: {"cycleh", nil, rdMCYCLEH, nil},
-	0xc81: {"timeh", nil, nil, nil},
+	0xc81: {"timeh", nil, rdTIMEH, nil},
 	0xc82: {"instreth", nil, rdMINSTRETH, nil},
 	0xc83: {"hpmcounter3h", nil, nil, nil},
 	0xc84: {"hpmcounter4h", nil, nil, nil},
@@ -1219,6 +1275,8 @@ var lookup = map[uint]csrDefn{
 	0x142: {"scause", nil, rdSCAUSE, nil},
 	0x143: {"stval", wrSTVAL, rdSTVAL, nil},
 	0x144: {"sip", wrSIP, rdSIP, nil},
+	0x14d: {"stimecmp", wrSTIMECMP, rdSTIMECMP, nil},
+	0x15d: {"stimecmph", wrSTIMECMPH, rdSTIMECMPH, nil},
 	0x180: {"satp", wrSATP, rdSATP, DisplaySATP},
 	// Machine CSRs 0xf00 - 0xf7f (read only)
 	0xf11: {"mvendorid", nil, rdZero, nil},
@@ -1432,6 +1490,8 @@ type State struct {
 	sedeleg  uint // supervisor exception delegation register
 	sideleg  uint // supervisor interrupt delegation register
 	satp     uint // supervisor address translation and protection
+	stimecmp uint // supervisor timer compare (all ones = not armed)
+	mtimecmp uint // machine timer compare (memory mapped, all ones = not armed)
 	// User CSRs
 	ucause   uint // user cause register
 	uepc     uint // user exception program counter
@@ -1439,6 +1499,10 @@ type State struct {
 	utval    uint // user trap value register
 	utvec    uint // user trap vector base address register
 	fcsr     uint // floating point control and status register
+	// real time counter source (optional)
+	time     func() uint64
+	lastTime uint64 // last value read from the time source
+	debug    bool   // debugger/display read, no input side effects
 }
 
 // NewState returns a CSR state object.
@@ -1452,6 +1516,8 @@ func NewState(xlen, ext uint) *State {
 	}
 	initMISA(s, ext)
 	s.mstatus.init(s.mxlen)
+	s.stimecmp = ^uint(0)
+	s.mtimecmp = ^uint(0)
 	return s
 }
 
@@ -1459,6 +1525,8 @@ func NewState(xlen, ext uint) *State {
 func (s *State) Reset() {
 	s.setMode(ModeM)
 	wrSATP(s, 0)
+	s.stimecmp = ^uint(0)
+	s.mtimecmp = ^uint(0)
 	// etc..
 }
 
@@ -1494,6 +1562,43 @@ func (s *State) Wr(reg uint, val uint64) error {
 	return &Error{reg, ErrTodo}
 }
 
+// debugRd reads a CSR without reading any nondeterministic inputs.
+func (s *State) debugRd(r *csrDefn) uint {
+	s.debug = true
+	x := r.rd(s)
+	s.debug = false
+	return x
+}
+
+// DebugRd reads from a CSR without a privilege check (debugger access).
+func (s *State) DebugRd(reg uint) (uint64, error) {
+	if x, ok := lookup[reg]; ok && x.rd != nil {
+		return uint64(s.debugRd(&x)), nil
+	}
+	return 0, &Error{reg, ErrNoRead}
+}
+
+// DebugWr writes to a CSR without a privilege check (debugger access).
+func (s *State) DebugWr(reg uint, val uint64) error {
+	if x, ok := lookup[reg]; ok && x.wr != nil {
+		x.wr(s, uint(val))
+		return nil
+	}
+	return &Error{reg, ErrNoWrite}
+}
+
+// Readable returns the (sorted) register numbers of the readable CSRs.
+func Readable() []uint {
+	x := []uint{}
+	for reg, v := range lookup {
+		if v.rd != nil {
+			x = append(x, reg)
+		}
+	}
+	sort.Slice(x, func(i, j int) bool { return x[i] < x[j] })
+	return x
+}
+
 //-----------------------------------------------------------------------------
 
 // Name returns the name of a given CSR.
@@ -1504,6 +1609,16 @@ func Name(reg uint) string {
 	return fmt.Sprintf("0x%03x", reg)
 }
 
+// Number returns the register number of a named CSR.
+func Number(name string) (uint, error) {
+	for reg, x := range lookup {
+		if x.name == name {
+			return reg, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown csr \"%s\"", name)
+}
+
 // getMode returns the mode bits from a register address.
 func getMode(reg uint) uint {
 	return (reg >> 8) & 3
@@ -1537,11 +1652,11 @@ func (s *State) regDisplay(reg uint) (*regStrings, error) {
 	accessStr := mode + rw
 	// value string
 	valStr := "0"
-	val := r.rd(s)
+	val := s.debugRd(&r)
 	if val != 0 {
 		rlen := []uint{s.uxlen, s.sxlen, 64, s.mxlen}[getMode(reg)]
 		fmtStr := fmt.Sprintf("%%0%dx", rlen>>2)
-		valStr = fmt.Sprintf(fmtStr, r.rd(s))
+		valStr = fmt.Sprintf(fmtStr, val)
 	}
 	// field string
 	fieldStr := ""
@@ -1557,8 +1672,8 @@ func (s *State) regDisplay(reg uint) (*regStrings, error) {
 	}, nil
 }
 
-// Display displays the CSR state.
-func (s *State) Display() string {
+// DisplayRows returns the CSR display table rows (register, value, field decode).
+func (s *State) DisplayRows() [][]string {
 	x := [][]string{}
 	x = append(x, []string{"mode", fmt.Sprintf("%s", s.GetMode()), ""})
 	// read all registers
@@ -1570,8 +1685,12 @@ func (s *State) Display() string {
 		regStr := fmt.Sprintf("%s %s %s", d.num, d.access, d.name)
 		x = append(x, []string{regStr, d.val, d.field})
 	}
-	// return the table string
-	return cli.TableString(x, []int{0, 0, 0}, 1)
+	return x
+}
+
+// Display displays the CSR state.
+func (s *State) Display() string {
+	return cli.TableString(s.DisplayRows(), []int{0, 0, 0}, 1)
 }
 
 //-----------------------------------------------------------------------------
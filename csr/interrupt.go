@@ -0,0 +1,151 @@
+//-----------------------------------------------------------------------------
+/*
+
+Interrupt Delivery
+
+An interrupt is taken when it is pending (mip) and enabled (mie) and
+the target mode (from the delegation registers) is either higher than
+the current mode, or the same as the current mode with the global
+interrupt enable for that mode set.
+
+The supervisor timer interrupt pending bit (STIP) is driven by comparing
+the real time counter with stimecmp (as per the Sstc extension). The
+machine timer interrupt pending bit (MTIP) is driven by comparing the
+real time counter with the memory mapped mtimecmp of a timer device
+(E.g. a CLINT). The real time counter may be a nondeterministic input,
+so it is only read when a compare value is written, on a WFI and
+periodically.
+
+*/
+//-----------------------------------------------------------------------------
+
+package csr
+
+//-----------------------------------------------------------------------------
+
+// timerPoll is the number of retired instructions between timer checks.
+const timerPoll = 1024
+
+// intPriority is the interrupt priority order (highest first).
+var intPriority = []ICode{
+	IntMachineExternal,
+	IntMachineSoftware,
+	IntMachineTimer,
+	IntSupervisorExternal,
+	IntSupervisorSoftware,
+	IntSupervisorTimer,
+	IntUserExternal,
+	IntUserSoftware,
+	IntUserTimer,
+}
+
+// SetPending sets or clears an interrupt pending bit.
+func (s *State) SetPending(code ICode, pending bool) {
+	if pending {
+		s.mip |= 1 << code
+	} else {
+		s.mip &^= 1 << code
+	}
+}
+
+// Pending returns true if an interrupt is pending.
+func (s *State) Pending(code ICode) bool {
+	return s.mip&(1<<code) != 0
+}
+
+// SetTimer sets the supervisor timer compare value.
+func (s *State) SetTimer(t uint64) {
+	s.stimecmp = uint(t)
+	s.SetPending(IntSupervisorTimer, false)
+	s.UpdateTimer()
+}
+
+// SetMachineTimer sets the machine timer compare value.
+func (s *State) SetMachineTimer(t uint64) {
+	s.mtimecmp = uint(t)
+	s.SetPending(IntMachineTimer, false)
+	s.UpdateTimer()
+}
+
+// MachineTimer returns the machine timer compare value.
+func (s *State) MachineTimer() uint64 {
+	return uint64(s.mtimecmp)
+}
+
+// Time returns the real time counter.
+func (s *State) Time() uint64 {
+	return s.getTime()
+}
+
+// UpdateTimer sets the timer interrupt pending bits from the real time counter.
+// A timer with an all ones compare value is not armed.
+func (s *State) UpdateTimer() {
+	if s.stimecmp == ^uint(0) && s.mtimecmp == ^uint(0) {
+		return
+	}
+	t := s.getTime()
+	if s.stimecmp != ^uint(0) {
+		s.SetPending(IntSupervisorTimer, t >= uint64(s.stimecmp))
+	}
+	if s.mtimecmp != ^uint(0) {
+		s.SetPending(IntMachineTimer, t >= uint64(s.mtimecmp))
+	}
+}
+
+// globalEnable returns true if interrupts are globally enabled for a mode.
+func (s *State) globalEnable(mode Mode) bool {
+	switch mode {
+	case ModeU:
+		return s.mstatusRdUIE() != 0
+	case ModeS:
+		return s.mstatusRdSIE() != 0
+	}
+	return s.mstatusRdMIE() != 0
+}
+
+// Interrupt returns the highest priority interrupt that should be taken.
+func (s *State) Interrupt() (ICode, bool) {
+	if s.minstret%timerPoll == 0 {
+		s.UpdateTimer()
+	}
+	active := s.mip & s.mie
+	if active == 0 {
+		return 0, false
+	}
+	for _, code := range intPriority {
+		if active&(1<<code) == 0 {
+			continue
+		}
+		mode := s.getNextMode(uint(code), true)
+		if mode > s.mode || (mode == s.mode && s.globalEnable(mode)) {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+//-----------------------------------------------------------------------------
+
+func rdSTIMECMP(s *State) uint {
+	if s.sxlen == 32 {
+		return uint(uint32(s.stimecmp))
+	}
+	return s.stimecmp
+}
+
+func wrSTIMECMP(s *State, x uint) {
+	if s.sxlen == 32 {
+		x = (s.stimecmp &^ 0xffffffff) | uint(uint32(x))
+	}
+	s.SetTimer(uint64(x))
+}
+
+func rdSTIMECMPH(s *State) uint {
+	return s.stimecmp >> 32
+}
+
+func wrSTIMECMPH(s *State, x uint) {
+	s.SetTimer(uint64(uint32(x))<<32 | uint64(uint32(s.stimecmp)))
+}
+
+//-----------------------------------------------------------------------------
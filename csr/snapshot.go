@@ -0,0 +1,92 @@
+//-----------------------------------------------------------------------------
+/*
+
+CSR State Snapshots
+
+*/
+//-----------------------------------------------------------------------------
+
+package csr
+
+import "fmt"
+
+//-----------------------------------------------------------------------------
+
+// Snapshot is the serializable state of the CSR sub-system.
+type Snapshot struct {
+	Mode    Mode   // current privilege mode
+	VM      VM     // cached virtual memory mode from SATP
+	Regs    []uint // register values (snapshotRegs order)
+	Cycle   uint64 // machine clock cycles
+	Instret uint64 // number of retired instructions
+}
+
+// snapshotRegs returns the state fields saved in a snapshot.
+// Append new fields to the end of the list.
+func (s *State) snapshotRegs() []*uint {
+	return []*uint{
+		&s.xlen, &s.mxlen, &s.uxlen, &s.sxlen, &s.ialign, &s.ppn,
+		&s.mstatus.val, &s.mstatus.wpriMask, &s.mstatus.uMask, &s.mstatus.sMask,
+		&s.mie, &s.mip,
+		&s.mcause, &s.mepc, &s.mscratch, &s.mtvec, &s.mtval, &s.misa, &s.medeleg, &s.mideleg,
+		&s.scause, &s.sepc, &s.sscratch, &s.stval, &s.stvec, &s.sedeleg, &s.sideleg, &s.satp,
+		&s.ucause, &s.uepc, &s.uscratch, &s.utval, &s.utvec, &s.fcsr,
+		&s.stimecmp, &s.mtimecmp,
+	}
+}
+
+// Snapshot returns a snapshot of the CSR state.
+func (s *State) Snapshot() *Snapshot {
+	x := &Snapshot{
+		Mode:    s.mode,
+		VM:      s.vm,
+		Cycle:   s.mcycle,
+		Instret: s.minstret,
+	}
+	for _, p := range s.snapshotRegs() {
+		x.Regs = append(x.Regs, *p)
+	}
+	return x
+}
+
+// Restore sets the CSR state from a snapshot.
+func (s *State) Restore(x *Snapshot) error {
+	regs := s.snapshotRegs()
+	if len(x.Regs) != len(regs) {
+		return fmt.Errorf("csr snapshot has %d registers, expected %d", len(x.Regs), len(regs))
+	}
+	for i, p := range regs {
+		*p = x.Regs[i]
+	}
+	s.mode = x.Mode
+	s.vm = x.VM
+	s.mcycle = x.Cycle
+	s.minstret = x.Instret
+	return nil
+}
+
+// Changed returns true if the CSR state (ignoring the counters) differs from a snapshot.
+func (s *State) Changed(x *Snapshot) bool {
+	if s.mode != x.Mode || s.vm != x.VM {
+		return true
+	}
+	for i, p := range s.snapshotRegs() {
+		if *p != x.Regs[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// Counters returns the clock cycle and retired instruction counters.
+func (s *State) Counters() (uint64, uint64) {
+	return s.mcycle, s.minstret
+}
+
+// SetCounters sets the clock cycle and retired instruction counters.
+func (s *State) SetCounters(cycle, instret uint64) {
+	s.mcycle = cycle
+	s.minstret = instret
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,727 @@
+//-----------------------------------------------------------------------------
+/*
+
+Debug Adapter Protocol Server
+
+Lets an IDE (E.g. VS Code) launch or attach to the emulator.
+
+launch: load an ELF file ("program") and reset the cpu
+attach: debug the cpu the server was created with
+
+Break points are set by function (a symbol name or an address) or by
+instruction address. There is no source line information, so source
+break points are reported as unverified.
+
+Stepping is by instruction. The register scopes are the integer, float and
+CSR registers.
+
+*/
+//-----------------------------------------------------------------------------
+
+package dap
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// runChunk is the number of instructions run between request checks.
+const runChunk = 1024
+
+// threadID is the id of the (single) hart.
+const threadID = 1
+
+// Variable references for the register scopes.
+const (
+	varInt   = 1
+	varFloat = 2
+	varCSR   = 3
+)
+
+// LaunchFunc returns a cpu with an ELF file loaded.
+type LaunchFunc func(program string) (*rv.RV, error)
+
+//-----------------------------------------------------------------------------
+
+// Server is a debug adapter protocol server.
+type Server struct {
+	cpu         *rv.RV        // the debug target
+	attach      *rv.RV        // attach target (optional)
+	launch      LaunchFunc    // launch function (optional)
+	rd          chan *request // client requests
+	w           io.Writer
+	seq         int           // message sequence number
+	stopOnEntry bool          // stop after the configuration is done
+	fnBp        map[uint]bool // function break points
+	insBp       map[uint]bool // instruction break points
+	running     bool          // the cpu is running
+	resumed     bool          // the cpu has been resumed (step over a break point at the PC)
+	retAdr      uint64        // step out: stop at this return address
+	stepOut     bool          // step out is in progress
+	done        bool          // the session is over
+	err         error         // reader error
+}
+
+// NewServer returns a debug adapter server.
+// attach is the cpu for an attach request, launch creates a cpu for a launch request.
+func NewServer(attach *rv.RV, launch LaunchFunc) *Server {
+	return &Server{
+		attach: attach,
+		launch: launch,
+	}
+}
+
+// Serve accepts a single client connection and runs the debug session.
+func (s *Server) Serve(l net.Listener) error {
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.Session(conn)
+}
+
+// Session runs a debug session on a connection.
+func (s *Server) Session(conn io.ReadWriter) error {
+	s.rd = make(chan *request, 16)
+	s.w = conn
+	s.done = false
+	s.running = false
+	s.err = nil
+	go func() {
+		rd := bufio.NewReader(conn)
+		for {
+			buf, err := readMessage(rd)
+			if err != nil {
+				if err != io.EOF {
+					s.err = err
+				}
+				close(s.rd)
+				return
+			}
+			req := &request{}
+			err = json.Unmarshal(buf, req)
+			if err != nil || req.Type != "request" {
+				continue
+			}
+			s.rd <- req
+		}
+	}()
+	for !s.done {
+		var req *request
+		var ok bool
+		if s.running {
+			select {
+			case req, ok = <-s.rd:
+			default:
+				s.run()
+				continue
+			}
+		} else {
+			req, ok = <-s.rd
+		}
+		if !ok {
+			return s.err
+		}
+		err := s.request(req)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// messages
+
+// respond sends a response to a request.
+func (s *Server) respond(req *request, body interface{}) error {
+	s.seq++
+	return writeMessage(s.w, &response{
+		Seq:        s.seq,
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    true,
+		Command:    req.Command,
+		Body:       body,
+	})
+}
+
+// fail sends an error response to a request.
+func (s *Server) fail(req *request, msg string) error {
+	s.seq++
+	return writeMessage(s.w, &response{
+		Seq:        s.seq,
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    false,
+		Command:    req.Command,
+		Message:    msg,
+	})
+}
+
+// event sends an event.
+func (s *Server) event(name string, body interface{}) error {
+	s.seq++
+	return writeMessage(s.w, &event{
+		Seq:   s.seq,
+		Type:  "event",
+		Event: name,
+		Body:  body,
+	})
+}
+
+// output sends text to the client console.
+func (s *Server) output(text string) error {
+	return s.event("output", &outputBody{Category: "console", Output: text})
+}
+
+// stopped stops the cpu and sends a stopped event.
+func (s *Server) stopped(reason, text string) error {
+	s.running = false
+	s.stepOut = false
+	return s.event("stopped", &stoppedBody{
+		Reason:            reason,
+		Text:              text,
+		ThreadID:          threadID,
+		AllThreadsStopped: true,
+	})
+}
+
+//-----------------------------------------------------------------------------
+// addresses
+
+// adrStr returns the memory reference string for an address.
+func adrStr(adr uint) string {
+	return fmt.Sprintf("0x%x", adr)
+}
+
+// parseAdr parses a memory reference (or number) string.
+func parseAdr(s string) (uint, error) {
+	x, err := strconv.ParseUint(strings.TrimSpace(s), 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad address \"%s\"", s)
+	}
+	return uint(x), nil
+}
+
+//-----------------------------------------------------------------------------
+// break points
+
+// setBreakPoints updates the cpu break points after a change to the function
+// or instruction break point sets.
+func (s *Server) setBreakPoints(fnBp, insBp map[uint]bool) {
+	m := s.cpu.Mem
+	old := map[uint]bool{}
+	for adr := range s.fnBp {
+		old[adr] = true
+	}
+	for adr := range s.insBp {
+		old[adr] = true
+	}
+	s.fnBp = fnBp
+	s.insBp = insBp
+	cur := map[uint]bool{}
+	for adr := range fnBp {
+		cur[adr] = true
+	}
+	for adr := range insBp {
+		cur[adr] = true
+	}
+	for adr := range old {
+		if !cur[adr] {
+			m.RemoveBreakPoint("dap", adr, mem.AttrX)
+		}
+	}
+	for adr := range cur {
+		if !old[adr] {
+			m.AddBreakPoint("dap", adr, mem.AttrX, nil)
+		}
+	}
+}
+
+// functionBreakPoints sets the function break points.
+func (s *Server) functionBreakPoints(args *setFunctionBreakpointsArguments) *breakpointsBody {
+	set := map[uint]bool{}
+	bps := []breakpoint{}
+	for _, x := range args.Breakpoints {
+		adr, err := s.cpu.Mem.SymbolGetAddress(x.Name)
+		if err != nil {
+			// not a symbol, try an address
+			adr, err = parseAdr(x.Name)
+			if err != nil {
+				bps = append(bps, breakpoint{Message: fmt.Sprintf("\"%s\" is not a symbol or an address", x.Name)})
+				continue
+			}
+		}
+		set[adr] = true
+		bps = append(bps, breakpoint{Verified: true, InstructionReference: adrStr(adr)})
+	}
+	s.setBreakPoints(set, s.insBp)
+	return &breakpointsBody{bps}
+}
+
+// instructionBreakPoints sets the instruction break points.
+func (s *Server) instructionBreakPoints(args *setInstructionBreakpointsArguments) *breakpointsBody {
+	set := map[uint]bool{}
+	bps := []breakpoint{}
+	for _, x := range args.Breakpoints {
+		adr, err := parseAdr(x.InstructionReference)
+		if err != nil {
+			bps = append(bps, breakpoint{Message: err.Error()})
+			continue
+		}
+		adr += uint(x.Offset)
+		set[adr] = true
+		bps = append(bps, breakpoint{Verified: true, InstructionReference: adrStr(adr)})
+	}
+	s.setBreakPoints(s.fnBp, set)
+	return &breakpointsBody{bps}
+}
+
+// sourceBreakPoints reports source break points as unverified.
+func (s *Server) sourceBreakPoints(args *setBreakpointsArguments) *breakpointsBody {
+	bps := []breakpoint{}
+	for range args.Breakpoints {
+		bps = append(bps, breakpoint{Message: "no source line information (use a function or instruction break point)"})
+	}
+	return &breakpointsBody{bps}
+}
+
+//-----------------------------------------------------------------------------
+// execution
+
+// step runs a single instruction.
+// A break point at the current PC is stepped over.
+func (s *Server) step() error {
+	m := s.cpu
+	if !m.Mem.BreakPointAt(uint(m.PC), mem.AttrX) {
+		return m.Run()
+	}
+	m.Mem.EnableBreakPoints(false)
+	err := m.Run()
+	m.Mem.EnableBreakPoints(true)
+	return err
+}
+
+// stopReason returns the stopped event reason for an emulation error.
+func stopReason(err error) string {
+	e, ok := err.(*rv.Error)
+	if ok && e.Type == rv.ErrMemory && e.GetMemError().Type&mem.ErrBreak != 0 {
+		if e.GetMemError().Type&(mem.ErrRead|mem.ErrWrite) != 0 {
+			return "data breakpoint"
+		}
+		return "breakpoint"
+	}
+	return "exception"
+}
+
+// stop handles an emulation error.
+func (s *Server) stop(err error) error {
+	reason := stopReason(err)
+	if reason == "exception" {
+		s.output(fmt.Sprintf("%s\n", err))
+	}
+	return s.stopped(reason, err.Error())
+}
+
+// resume starts running the cpu.
+func (s *Server) resume() {
+	s.running = true
+	s.resumed = true
+}
+
+// run runs the cpu for a chunk of instructions.
+func (s *Server) run() error {
+	for i := 0; i < runChunk; i++ {
+		var err error
+		if s.resumed {
+			s.resumed = false
+			err = s.step()
+		} else {
+			err = s.cpu.Run()
+		}
+		if err != nil {
+			return s.stop(err)
+		}
+		if s.stepOut && s.cpu.PC == s.retAdr {
+			return s.stopped("step", "")
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// registers
+
+// intRegs returns the integer register variables.
+func (s *Server) intRegs() []variable {
+	m := s.cpu
+	n := m.Xlen() >> 2
+	v := []variable{}
+	v = append(v, variable{Name: "pc", Value: fmt.Sprintf("0x%0*x", n, m.PC), MemoryReference: adrStr(uint(m.PC))})
+	for i := uint(0); i < 32; i++ {
+		val := m.RdX(i)
+		v = append(v, variable{Name: rv.XName(i), Value: fmt.Sprintf("0x%0*x", n, val), MemoryReference: adrStr(uint(val))})
+	}
+	return v
+}
+
+// floatRegs returns the float register variables.
+func (s *Server) floatRegs() []variable {
+	m := s.cpu
+	v := []variable{}
+	for i := uint(0); i < 32; i++ {
+		val := m.RdF(i)
+		v = append(v, variable{Name: rv.FName(i), Value: fmt.Sprintf("0x%016x (%g)", val, math.Float64frombits(val))})
+	}
+	return v
+}
+
+// csrRegs returns the CSR variables.
+func (s *Server) csrRegs() []variable {
+	v := []variable{}
+	for _, x := range s.cpu.CSR.DisplayRows() {
+		// "300 mrw mstatus" -> "mstatus"
+		f := strings.Fields(x[0])
+		val := x[1]
+		if x[2] != "" {
+			val += " " + x[2]
+		}
+		v = append(v, variable{Name: f[len(f)-1], Value: val})
+	}
+	return v
+}
+
+//-----------------------------------------------------------------------------
+// memory
+
+// disassemble returns count instructions from ofs instructions relative to an address.
+func (s *Server) disassemble(adr uint, ofs, count int) []disassembledInstruction {
+	m := s.cpu
+	// instruction reads must not trigger break points
+	m.Mem.EnableBreakPoints(false)
+	defer m.Mem.EnableBreakPoints(true)
+	if ofs < 0 {
+		// Instructions have variable length, so decode forward from
+		// an earlier address and use the instructions before adr.
+		start := uint(0)
+		if uint(-ofs)*4 < adr {
+			start = adr - uint(-ofs)*4
+		}
+		before := []uint{}
+		for x := start; x < adr; x += m.Disassemble(x).Length {
+			before = append(before, x)
+		}
+		if len(before) > -ofs {
+			before = before[len(before)+ofs:]
+		}
+		if len(before) != 0 {
+			adr = before[0]
+		}
+	} else {
+		for i := 0; i < ofs; i++ {
+			adr += m.Disassemble(adr).Length
+		}
+	}
+	x := []disassembledInstruction{}
+	for i := 0; i < count; i++ {
+		da := m.Disassemble(adr)
+		bytes := fmt.Sprintf("%08x", da.Ins)
+		if da.Length == 2 {
+			bytes = fmt.Sprintf("%04x", da.Ins)
+		}
+		x = append(x, disassembledInstruction{
+			Address:          adrStr(adr),
+			InstructionBytes: bytes,
+			Instruction:      da.Assembly,
+			Symbol:           da.Symbol,
+		})
+		adr += da.Length
+	}
+	return x
+}
+
+// readMemory reads memory (virtual addressing).
+func (s *Server) readMemory(adr uint, n int) *readMemoryBody {
+	buf := []byte{}
+	for i := 0; i < n; i++ {
+		val, err := s.cpu.Mem.DebugRd8(adr+uint(i), true)
+		if err != nil {
+			break
+		}
+		buf = append(buf, val)
+	}
+	return &readMemoryBody{
+		Address:         adrStr(adr),
+		Data:            base64.StdEncoding.EncodeToString(buf),
+		UnreadableBytes: n - len(buf),
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// needTarget are the requests that need a debug target.
+var needTarget = map[string]bool{
+	"configurationDone":         true,
+	"setFunctionBreakpoints":    true,
+	"setInstructionBreakpoints": true,
+	"stackTrace":                true,
+	"scopes":                    true,
+	"variables":                 true,
+	"continue":                  true,
+	"next":                      true,
+	"stepIn":                    true,
+	"stepOut":                   true,
+	"pause":                     true,
+	"disassemble":               true,
+	"readMemory":                true,
+}
+
+// needStopped are the requests that need a stopped cpu.
+var needStopped = map[string]bool{
+	"next":    true,
+	"stepIn":  true,
+	"stepOut": true,
+}
+
+// args decodes the request arguments.
+func (s *Server) args(req *request, args interface{}) error {
+	if len(req.Arguments) == 0 {
+		return nil
+	}
+	return json.Unmarshal(req.Arguments, args)
+}
+
+// start sets the debug target.
+func (s *Server) start(cpu *rv.RV) {
+	s.cpu = cpu
+	s.fnBp = nil
+	s.insBp = nil
+}
+
+// request handles a client request.
+func (s *Server) request(req *request) error {
+	if needTarget[req.Command] && s.cpu == nil {
+		return s.fail(req, "no program (launch or attach first)")
+	}
+	if needStopped[req.Command] && s.running {
+		return s.fail(req, "the cpu is running")
+	}
+
+	switch req.Command {
+
+	case "initialize":
+		return s.respond(req, &capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsFunctionBreakpoints:      true,
+			SupportsInstructionBreakpoints:   true,
+			SupportsDisassembleRequest:       true,
+			SupportsReadMemoryRequest:        true,
+			SupportsSteppingGranularity:      true,
+			SupportsTerminateRequest:         true,
+		})
+
+	case "launch":
+		var args launchArguments
+		err := s.args(req, &args)
+		if err != nil {
+			return s.fail(req, err.Error())
+		}
+		if s.launch == nil {
+			return s.fail(req, "launch is not supported")
+		}
+		cpu, err := s.launch(args.Program)
+		if err != nil {
+			return s.fail(req, err.Error())
+		}
+		s.start(cpu)
+		s.stopOnEntry = args.StopOnEntry
+		err = s.respond(req, nil)
+		if err != nil {
+			return err
+		}
+		return s.event("initialized", nil)
+
+	case "attach":
+		if s.attach == nil {
+			return s.fail(req, "there is no cpu to attach to")
+		}
+		s.start(s.attach)
+		s.stopOnEntry = true
+		err := s.respond(req, nil)
+		if err != nil {
+			return err
+		}
+		return s.event("initialized", nil)
+
+	case "configurationDone":
+		err := s.respond(req, nil)
+		if err != nil {
+			return err
+		}
+		if s.stopOnEntry {
+			return s.stopped("entry", "")
+		}
+		s.resume()
+		return nil
+
+	case "setBreakpoints":
+		var args setBreakpointsArguments
+		err := s.args(req, &args)
+		if err != nil {
+			return s.fail(req, err.Error())
+		}
+		return s.respond(req, s.sourceBreakPoints(&args))
+
+	case "setFunctionBreakpoints":
+		var args setFunctionBreakpointsArguments
+		err := s.args(req, &args)
+		if err != nil {
+			return s.fail(req, err.Error())
+		}
+		return s.respond(req, s.functionBreakPoints(&args))
+
+	case "setInstructionBreakpoints":
+		var args setInstructionBreakpointsArguments
+		err := s.args(req, &args)
+		if err != nil {
+			return s.fail(req, err.Error())
+		}
+		return s.respond(req, s.instructionBreakPoints(&args))
+
+	case "setExceptionBreakpoints":
+		return s.respond(req, &breakpointsBody{[]breakpoint{}})
+
+	case "threads":
+		return s.respond(req, &threadsBody{[]thread{{threadID, "hart0"}}})
+
+	case "stackTrace":
+		pc := uint(s.cpu.PC)
+		name := s.cpu.Mem.SymbolOffset(pc)
+		if name == "" {
+			name = s.cpu.Mem.AddrStr(pc)
+		}
+		frame := stackFrame{
+			ID:                          1,
+			Name:                        name,
+			InstructionPointerReference: adrStr(pc),
+		}
+		return s.respond(req, &stackTraceBody{[]stackFrame{frame}, 1})
+
+	case "scopes":
+		return s.respond(req, &scopesBody{[]scope{
+			{"Integer", varInt, false},
+			{"Float", varFloat, false},
+			{"CSR", varCSR, true},
+		}})
+
+	case "variables":
+		var args variablesArguments
+		err := s.args(req, &args)
+		if err != nil {
+			return s.fail(req, err.Error())
+		}
+		var v []variable
+		switch args.VariablesReference {
+		case varInt:
+			v = s.intRegs()
+		case varFloat:
+			v = s.floatRegs()
+		case varCSR:
+			v = s.csrRegs()
+		default:
+			return s.fail(req, fmt.Sprintf("bad variables reference %d", args.VariablesReference))
+		}
+		return s.respond(req, &variablesBody{v})
+
+	case "continue":
+		s.resume()
+		return s.respond(req, &continueBody{true})
+
+	case "next", "stepIn":
+		err := s.respond(req, nil)
+		if err != nil {
+			return err
+		}
+		err = s.step()
+		if err != nil {
+			return s.stop(err)
+		}
+		return s.stopped("step", "")
+
+	case "stepOut":
+		err := s.respond(req, nil)
+		if err != nil {
+			return err
+		}
+		s.retAdr = s.cpu.RdX(rv.RegRa)
+		s.stepOut = true
+		s.resume()
+		return nil
+
+	case "pause":
+		err := s.respond(req, nil)
+		if err != nil {
+			return err
+		}
+		if !s.running {
+			return nil
+		}
+		return s.stopped("pause", "")
+
+	case "disassemble":
+		var args disassembleArguments
+		err := s.args(req, &args)
+		if err != nil {
+			return s.fail(req, err.Error())
+		}
+		adr, err := parseAdr(args.MemoryReference)
+		if err != nil {
+			return s.fail(req, err.Error())
+		}
+		x := s.disassemble(adr+uint(args.Offset), args.InstructionOffset, args.InstructionCount)
+		return s.respond(req, &disassembleBody{x})
+
+	case "readMemory":
+		var args readMemoryArguments
+		err := s.args(req, &args)
+		if err != nil {
+			return s.fail(req, err.Error())
+		}
+		adr, err := parseAdr(args.MemoryReference)
+		if err != nil {
+			return s.fail(req, err.Error())
+		}
+		return s.respond(req, s.readMemory(adr+uint(args.Offset), args.Count))
+
+	case "terminate":
+		err := s.respond(req, nil)
+		if err != nil {
+			return err
+		}
+		s.running = false
+		return s.event("terminated", nil)
+
+	case "disconnect":
+		s.running = false
+		s.done = true
+		return s.respond(req, nil)
+	}
+
+	return s.fail(req, fmt.Sprintf("\"%s\" is not supported", req.Command))
+}
+
+//-----------------------------------------------------------------------------
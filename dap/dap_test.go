@@ -0,0 +1,198 @@
+//-----------------------------------------------------------------------------
+/*
+
+Debug Adapter Protocol Server Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/deadsy/riscv/machine"
+	"github.com/deadsy/riscv/machine/machinetest"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// newCPU returns a cpu with a test program loaded at 0x1000.
+func newCPU(t *testing.T) *rv.RV {
+	mc := machinetest.New(t, 64,
+		machine.Region{Name: "text", Base: 0x1000, Size: 0x1000, Attr: "rx"},
+		machine.Region{Name: "data", Base: 0x400, Size: 0x100, Attr: "rw"},
+	)
+	mc.Mem.AddSymbol("store", 0x1004, 4)
+	machinetest.Assemble(t, mc.CPU, 0x1000,
+		"addi a0,a0,1",
+		"sw a0,0x400(zero)",
+		"jal zero,1000",
+	)
+	mc.CPU.PC = 0x1000
+	return mc.CPU
+}
+
+// message is a server response or event.
+type message struct {
+	Type    string          `json:"type"`
+	Command string          `json:"command"`
+	Event   string          `json:"event"`
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	Body    json.RawMessage `json:"body"`
+}
+
+// client is a minimal debug adapter client.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	rd   *bufio.Reader
+	seq  int
+}
+
+// read reads the next message.
+func (c *client) read() *message {
+	buf, err := readMessage(c.rd)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	m := &message{}
+	err = json.Unmarshal(buf, m)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// request sends a request and returns the response body.
+func (c *client) request(cmd string, args interface{}) json.RawMessage {
+	c.seq++
+	raw, _ := json.Marshal(args)
+	err := writeMessage(c.conn, &request{Seq: c.seq, Type: "request", Command: cmd, Arguments: raw})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		m := c.read()
+		if m.Type == "response" {
+			if m.Command != cmd || !m.Success {
+				c.t.Fatalf("%s: bad response %+v", cmd, m)
+			}
+			return m.Body
+		}
+	}
+}
+
+// event reads messages until an event.
+func (c *client) event(name string) json.RawMessage {
+	for {
+		m := c.read()
+		if m.Type == "event" && m.Event != "output" {
+			if m.Event != name {
+				c.t.Fatalf("got event \"%s\", expected \"%s\"", m.Event, name)
+			}
+			return m.Body
+		}
+	}
+}
+
+// stopped waits for a stopped event and returns the reason and pc.
+func (c *client) stopped() (string, string) {
+	var x stoppedBody
+	json.Unmarshal(c.event("stopped"), &x)
+	var st stackTraceBody
+	json.Unmarshal(c.request("stackTrace", map[string]int{"threadId": threadID}), &st)
+	return x.Reason, st.StackFrames[0].InstructionPointerReference
+}
+
+func Test_Server(t *testing.T) {
+	cpu := newCPU(t)
+	c0, c1 := net.Pipe()
+	go NewServer(cpu, nil).Session(c1)
+	c := &client{t: t, conn: c0, rd: bufio.NewReader(c0)}
+
+	c.request("initialize", map[string]string{"adapterID": "rvemu"})
+	c.request("attach", nil)
+	c.event("initialized")
+
+	// break points
+	var bps breakpointsBody
+	json.Unmarshal(c.request("setFunctionBreakpoints", map[string]interface{}{
+		"breakpoints": []map[string]string{{"name": "store"}, {"name": "nosuchsymbol"}},
+	}), &bps)
+	if len(bps.Breakpoints) != 2 || !bps.Breakpoints[0].Verified || bps.Breakpoints[1].Verified {
+		t.Errorf("bad function break points %+v", bps)
+	}
+	c.request("configurationDone", nil)
+	if reason, pc := c.stopped(); reason != "entry" || pc != "0x1000" {
+		t.Errorf("got %s at %s, expected entry at 0x1000", reason, pc)
+	}
+
+	// step
+	c.request("stepIn", map[string]int{"threadId": threadID})
+	if reason, pc := c.stopped(); reason != "step" || pc != "0x1004" {
+		t.Errorf("got %s at %s, expected step at 0x1004", reason, pc)
+	}
+
+	// continue (stepping over the break point at the PC)
+	for i := 0; i < 2; i++ {
+		c.request("continue", map[string]int{"threadId": threadID})
+		if reason, pc := c.stopped(); reason != "breakpoint" || pc != "0x1004" {
+			t.Errorf("got %s at %s, expected breakpoint at 0x1004", reason, pc)
+		}
+	}
+
+	// registers
+	var v variablesBody
+	json.Unmarshal(c.request("variables", map[string]int{"variablesReference": varInt}), &v)
+	if v.Variables[11].Name != "a0" || v.Variables[11].Value != "0x0000000000000003" {
+		t.Errorf("bad integer registers %+v", v.Variables[11])
+	}
+	json.Unmarshal(c.request("variables", map[string]int{"variablesReference": varCSR}), &v)
+	if v.Variables[0].Name != "mode" {
+		t.Errorf("bad csr registers %+v", v.Variables[0])
+	}
+
+	// disassembly
+	var da disassembleBody
+	json.Unmarshal(c.request("disassemble", map[string]interface{}{
+		"memoryReference":   "0x1004",
+		"instructionOffset": -1,
+		"instructionCount":  3,
+	}), &da)
+	if len(da.Instructions) != 3 || da.Instructions[0].Address != "0x1000" ||
+		!strings.HasPrefix(da.Instructions[0].Instruction, "addi") || da.Instructions[1].Symbol != "store" {
+		t.Errorf("bad disassembly %+v", da)
+	}
+
+	// memory
+	var rm readMemoryBody
+	json.Unmarshal(c.request("readMemory", map[string]interface{}{"memoryReference": "0x400", "count": 4}), &rm)
+	if rm.Data != "AgAAAA==" {
+		t.Errorf("bad memory read %+v", rm)
+	}
+
+	// remove the break points, step out (to the address in ra) and pause
+	c.request("setFunctionBreakpoints", map[string]interface{}{"breakpoints": []string{}})
+	cpu.WrX(rv.RegRa, 0x1008)
+	c.request("stepOut", map[string]int{"threadId": threadID})
+	if reason, pc := c.stopped(); reason != "step" || pc != "0x1008" {
+		t.Errorf("got %s at %s, expected step at 0x1008", reason, pc)
+	}
+	c.request("continue", map[string]int{"threadId": threadID})
+	c.request("pause", map[string]int{"threadId": threadID})
+	if reason, _ := c.stopped(); reason != "pause" {
+		t.Errorf("got %s, expected pause", reason)
+	}
+
+	c.request("disconnect", nil)
+	c0.Close()
+}
+
+//-----------------------------------------------------------------------------
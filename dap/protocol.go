@@ -0,0 +1,248 @@
+//-----------------------------------------------------------------------------
+/*
+
+Debug Adapter Protocol Messages
+
+Each message is a JSON object preceded by a header:
+
+Content-Length: 119\r\n
+\r\n
+{"seq":1,"type":"request","command":"initialize","arguments":{...}}
+
+See: https://microsoft.github.io/debug-adapter-protocol/specification
+
+*/
+//-----------------------------------------------------------------------------
+
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+
+// request is a client request.
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+// response is a response to a client request.
+type response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+// event is a server event.
+type event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+//-----------------------------------------------------------------------------
+// request arguments
+
+type launchArguments struct {
+	Program     string `json:"program"`
+	StopOnEntry bool   `json:"stopOnEntry"`
+}
+
+type sourceBreakpoint struct {
+	Line int `json:"line"`
+}
+
+type setBreakpointsArguments struct {
+	Breakpoints []sourceBreakpoint `json:"breakpoints"`
+}
+
+type functionBreakpoint struct {
+	Name string `json:"name"`
+}
+
+type setFunctionBreakpointsArguments struct {
+	Breakpoints []functionBreakpoint `json:"breakpoints"`
+}
+
+type instructionBreakpoint struct {
+	InstructionReference string `json:"instructionReference"`
+	Offset               int    `json:"offset"`
+}
+
+type setInstructionBreakpointsArguments struct {
+	Breakpoints []instructionBreakpoint `json:"breakpoints"`
+}
+
+type variablesArguments struct {
+	VariablesReference int `json:"variablesReference"`
+}
+
+type disassembleArguments struct {
+	MemoryReference   string `json:"memoryReference"`
+	Offset            int    `json:"offset"`
+	InstructionOffset int    `json:"instructionOffset"`
+	InstructionCount  int    `json:"instructionCount"`
+}
+
+type readMemoryArguments struct {
+	MemoryReference string `json:"memoryReference"`
+	Offset          int    `json:"offset"`
+	Count           int    `json:"count"`
+}
+
+//-----------------------------------------------------------------------------
+// response/event bodies
+
+type capabilities struct {
+	SupportsConfigurationDoneRequest bool `json:"supportsConfigurationDoneRequest"`
+	SupportsFunctionBreakpoints      bool `json:"supportsFunctionBreakpoints"`
+	SupportsInstructionBreakpoints   bool `json:"supportsInstructionBreakpoints"`
+	SupportsDisassembleRequest       bool `json:"supportsDisassembleRequest"`
+	SupportsReadMemoryRequest        bool `json:"supportsReadMemoryRequest"`
+	SupportsSteppingGranularity      bool `json:"supportsSteppingGranularity"`
+	SupportsTerminateRequest         bool `json:"supportsTerminateRequest"`
+}
+
+type breakpoint struct {
+	Verified             bool   `json:"verified"`
+	Message              string `json:"message,omitempty"`
+	InstructionReference string `json:"instructionReference,omitempty"`
+}
+
+type breakpointsBody struct {
+	Breakpoints []breakpoint `json:"breakpoints"`
+}
+
+type thread struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type threadsBody struct {
+	Threads []thread `json:"threads"`
+}
+
+type stackFrame struct {
+	ID                          int    `json:"id"`
+	Name                        string `json:"name"`
+	Line                        int    `json:"line"`
+	Column                      int    `json:"column"`
+	InstructionPointerReference string `json:"instructionPointerReference"`
+}
+
+type stackTraceBody struct {
+	StackFrames []stackFrame `json:"stackFrames"`
+	TotalFrames int          `json:"totalFrames"`
+}
+
+type scope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type scopesBody struct {
+	Scopes []scope `json:"scopes"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+	MemoryReference    string `json:"memoryReference,omitempty"`
+}
+
+type variablesBody struct {
+	Variables []variable `json:"variables"`
+}
+
+type disassembledInstruction struct {
+	Address          string `json:"address"`
+	InstructionBytes string `json:"instructionBytes,omitempty"`
+	Instruction      string `json:"instruction"`
+	Symbol           string `json:"symbol,omitempty"`
+}
+
+type disassembleBody struct {
+	Instructions []disassembledInstruction `json:"instructions"`
+}
+
+type readMemoryBody struct {
+	Address         string `json:"address"`
+	Data            string `json:"data,omitempty"`
+	UnreadableBytes int    `json:"unreadableBytes,omitempty"`
+}
+
+type continueBody struct {
+	AllThreadsContinued bool `json:"allThreadsContinued"`
+}
+
+type stoppedBody struct {
+	Reason            string `json:"reason"`
+	Description       string `json:"description,omitempty"`
+	Text              string `json:"text,omitempty"`
+	ThreadID          int    `json:"threadId"`
+	AllThreadsStopped bool   `json:"allThreadsStopped"`
+}
+
+type outputBody struct {
+	Category string `json:"category"`
+	Output   string `json:"output"`
+}
+
+//-----------------------------------------------------------------------------
+// message framing
+
+// readMessage reads a message.
+func readMessage(rd *bufio.Reader) ([]byte, error) {
+	n := -1
+	for {
+		s, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		s = strings.TrimSpace(s)
+		if s == "" {
+			break
+		}
+		x := strings.SplitN(s, ":", 2)
+		if len(x) == 2 && strings.TrimSpace(x[0]) == "Content-Length" {
+			n, err = strconv.Atoi(strings.TrimSpace(x[1]))
+			if err != nil {
+				return nil, fmt.Errorf("bad header \"%s\"", s)
+			}
+		}
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("no Content-Length header")
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(rd, buf)
+	return buf, err
+}
+
+// writeMessage writes a message.
+func writeMessage(w io.Writer, msg interface{}) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(buf), buf)
+	return err
+}
+
+//-----------------------------------------------------------------------------
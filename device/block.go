@@ -0,0 +1,255 @@
+//-----------------------------------------------------------------------------
+/*
+
+VirtIO Block Device
+
+A virtio-blk device backed by a host disk image file. The image can be
+read/write, read-only, or copy-on-write (writes go to an in-memory overlay
+and the image file is not changed).
+
+The disk contents are not logged as nondeterministic inputs, so a recorded
+run only replays exactly with an unchanged image (read-only or
+copy-on-write).
+
+*/
+//-----------------------------------------------------------------------------
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+//-----------------------------------------------------------------------------
+
+const (
+	blkDeviceID   = 2
+	blkSectorSize = 512
+	blkFeatRO     = 1 << 5 // VIRTIO_BLK_F_RO
+	blkFeatFlush  = 1 << 9 // VIRTIO_BLK_F_FLUSH
+	blkTypeIn     = 0      // read
+	blkTypeOut    = 1      // write
+	blkTypeFlush  = 4
+	blkTypeGetID  = 8
+	blkStatusOK   = 0
+	blkStatusIO   = 1
+	blkStatusUnsp = 2
+	blkIDLen      = 20
+)
+
+// BlockMode is the write mode of the disk image.
+type BlockMode int
+
+// Block modes
+const (
+	BlockRW  BlockMode = iota // writes go to the image file
+	BlockRO                   // read-only
+	BlockCOW                  // writes go to an in-memory overlay
+)
+
+// BlockConfig is the block device configuration.
+type BlockConfig struct {
+	Image string    // disk image file
+	Mode  BlockMode // write mode
+}
+
+// Block is a virtio block device.
+type Block struct {
+	cfg     BlockConfig
+	f       *os.File
+	sectors uint64            // capacity in sectors
+	overlay map[uint64][]byte // copy-on-write sectors
+}
+
+// NewBlock returns a virtio block device.
+func NewBlock(cfg BlockConfig) (*Block, error) {
+	flag := os.O_RDWR
+	if cfg.Mode != BlockRW {
+		flag = os.O_RDONLY
+	}
+	f, err := os.OpenFile(cfg.Image, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Block{
+		cfg:     cfg,
+		f:       f,
+		sectors: uint64(info.Size()) / blkSectorSize,
+		overlay: map[uint64][]byte{},
+	}, nil
+}
+
+// Close closes the disk image.
+func (d *Block) Close() error {
+	return d.f.Close()
+}
+
+//-----------------------------------------------------------------------------
+
+// DeviceID returns the virtio device id.
+func (d *Block) DeviceID() uint32 {
+	return blkDeviceID
+}
+
+// Features returns the device specific feature bits.
+func (d *Block) Features() uint64 {
+	x := uint64(blkFeatFlush)
+	if d.cfg.Mode == BlockRO {
+		x |= blkFeatRO
+	}
+	return x
+}
+
+// NumQueues returns the number of virtqueues.
+func (d *Block) NumQueues() int {
+	return 1
+}
+
+// ConfigRd reads the device configuration (the capacity).
+func (d *Block) ConfigRd(ofs, size uint) uint64 {
+	if ofs < 8 {
+		return rdReg(d.sectors, ofs, size)
+	}
+	return 0
+}
+
+// ConfigWr writes the device configuration (read only).
+func (d *Block) ConfigWr(ofs, size uint, val uint64) {
+}
+
+// Reset resets the device.
+func (d *Block) Reset() {
+}
+
+// Notify processes the requests on the queue.
+func (d *Block) Notify(v *VirtIO, q int) {
+	for {
+		c, ok := v.Next(q)
+		if !ok {
+			return
+		}
+		n, err := d.request(v, c)
+		if err != nil {
+			v.Fail()
+			return
+		}
+		v.Used(q, c, n)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// request processes a block request and returns the number of bytes written.
+func (d *Block) request(v *VirtIO, c *Chain) (uint32, error) {
+	in, err := v.Read(c)
+	if err != nil {
+		return 0, err
+	}
+	wlen := c.WriteLen()
+	if len(in) < 16 || wlen < 1 {
+		return 0, fmt.Errorf("bad block request")
+	}
+	typ := binary.LittleEndian.Uint32(in[0:])
+	sector := binary.LittleEndian.Uint64(in[8:])
+	data := in[16:]
+
+	var out []byte
+	status := byte(blkStatusOK)
+	switch typ {
+	case blkTypeIn:
+		out, err = d.read(sector, (wlen-1)/blkSectorSize)
+		if err != nil {
+			out = make([]byte, ((wlen-1)/blkSectorSize)*blkSectorSize)
+			status = blkStatusIO
+		}
+	case blkTypeOut:
+		if d.cfg.Mode == BlockRO || d.write(sector, data) != nil {
+			status = blkStatusIO
+		}
+	case blkTypeFlush:
+		if d.cfg.Mode == BlockRW && d.f.Sync() != nil {
+			status = blkStatusIO
+		}
+	case blkTypeGetID:
+		out = make([]byte, blkIDLen)
+		copy(out, "rvemu-blk")
+	default:
+		status = blkStatusUnsp
+	}
+	out = append(out, status)
+	err = v.Write(c, out)
+	if err != nil {
+		return 0, err
+	}
+	return uint32(len(out)), nil
+}
+
+// read reads sectors from the disk.
+func (d *Block) read(sector uint64, n uint32) ([]byte, error) {
+	if sector+uint64(n) > d.sectors {
+		return nil, fmt.Errorf("read beyond the end of the disk")
+	}
+	buf := make([]byte, n*blkSectorSize)
+	_, err := d.f.ReadAt(buf, int64(sector*blkSectorSize))
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < uint64(n); i++ {
+		if x, ok := d.overlay[sector+i]; ok {
+			copy(buf[i*blkSectorSize:], x)
+		}
+	}
+	return buf, nil
+}
+
+// write writes sectors to the disk.
+func (d *Block) write(sector uint64, buf []byte) error {
+	n := uint64(len(buf)) / blkSectorSize
+	if uint64(len(buf))%blkSectorSize != 0 || sector+n > d.sectors {
+		return fmt.Errorf("bad disk write")
+	}
+	if d.cfg.Mode == BlockCOW {
+		for i := uint64(0); i < n; i++ {
+			x := make([]byte, blkSectorSize)
+			copy(x, buf[i*blkSectorSize:])
+			d.overlay[sector+i] = x
+		}
+		return nil
+	}
+	_, err := d.f.WriteAt(buf, int64(sector*blkSectorSize))
+	return err
+}
+
+//-----------------------------------------------------------------------------
+
+// SaveState returns the copy-on-write overlay.
+// The writes to a read/write image can't be undone, so it can't be saved.
+func (d *Block) SaveState() ([]byte, error) {
+	if d.cfg.Mode == BlockRW {
+		return nil, fmt.Errorf("a read/write disk image can't be saved (use copy-on-write)")
+	}
+	return encodeState(d.overlay)
+}
+
+// RestoreState sets the copy-on-write overlay.
+func (d *Block) RestoreState(buf []byte) error {
+	if d.cfg.Mode == BlockRW {
+		return fmt.Errorf("a read/write disk image can't be restored")
+	}
+	overlay := map[uint64][]byte{}
+	err := decodeState(buf, &overlay)
+	if err != nil {
+		return err
+	}
+	d.overlay = overlay
+	return nil
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,89 @@
+//-----------------------------------------------------------------------------
+/*
+
+Core Local Interruptor (CLINT)
+
+The CLINT has the machine software interrupt (msip), timer compare
+(mtimecmp) and real time counter (mtime) registers for hart 0.
+
+*/
+//-----------------------------------------------------------------------------
+
+package device
+
+import (
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/fdt"
+)
+
+//-----------------------------------------------------------------------------
+
+// CLINTSize is the size of the CLINT register space.
+const CLINTSize = 0x10000
+
+// CLINT register offsets
+const (
+	clintMSIP     = 0x0000
+	clintMTIMECMP = 0x4000
+	clintMTIME    = 0xbff8
+)
+
+// CLINT is a core local interruptor.
+type CLINT struct {
+	csr *csr.State
+}
+
+// NewCLINT returns a CLINT driving the interrupts of a hart.
+func NewCLINT(csr *csr.State) *CLINT {
+	return &CLINT{csr: csr}
+}
+
+// Rd reads a CLINT register.
+func (d *CLINT) Rd(ofs, size uint) uint64 {
+	switch {
+	case ofs >= clintMSIP && ofs < clintMSIP+4:
+		if d.csr.Pending(csr.IntMachineSoftware) {
+			return rdReg(1, ofs-clintMSIP, size)
+		}
+	case ofs >= clintMTIMECMP && ofs < clintMTIMECMP+8:
+		return rdReg(d.csr.MachineTimer(), ofs-clintMTIMECMP, size)
+	case ofs >= clintMTIME && ofs < clintMTIME+8:
+		return rdReg(d.csr.Time(), ofs-clintMTIME, size)
+	}
+	return 0
+}
+
+// Wr writes a CLINT register.
+func (d *CLINT) Wr(ofs, size uint, val uint64) {
+	switch {
+	case ofs == clintMSIP:
+		d.csr.SetPending(csr.IntMachineSoftware, val&1 != 0)
+	case ofs >= clintMTIMECMP && ofs < clintMTIMECMP+8:
+		d.csr.SetMachineTimer(wrReg(d.csr.MachineTimer(), ofs-clintMTIMECMP, size, val))
+	}
+	// mtime is read only
+}
+
+// DeviceNode returns the device tree node for the CLINT.
+func (d *CLINT) DeviceNode(t *fdt.Tree, base, size uint64) *fdt.Node {
+	intc := t.Phandle(fdt.LabelCPUIntc)
+	return fdt.NewNodeAt("clint", base).
+		String("compatible", "sifive,clint0", "riscv,clint0").
+		Cells("interrupts-extended", intc, uint32(csr.IntMachineSoftware), intc, uint32(csr.IntMachineTimer)).
+		U64("reg", base, size)
+}
+
+//-----------------------------------------------------------------------------
+
+// SaveState returns the CLINT state (there is none, the timer and
+// interrupt state are in the CSRs).
+func (d *CLINT) SaveState() ([]byte, error) {
+	return nil, nil
+}
+
+// RestoreState sets the CLINT state.
+func (d *CLINT) RestoreState(buf []byte) error {
+	return nil
+}
+
+//-----------------------------------------------------------------------------
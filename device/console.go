@@ -0,0 +1,138 @@
+//-----------------------------------------------------------------------------
+/*
+
+Console Backend
+
+A host terminal backend for the console devices (E.g. the UART and the
+virtio console). Devices sharing the host terminal share a console, so
+they don't compete for the input.
+
+*/
+//-----------------------------------------------------------------------------
+
+package device
+
+import (
+	"io"
+	"os"
+
+	"github.com/deadsy/riscv/replay"
+)
+
+//-----------------------------------------------------------------------------
+
+// Console is a host terminal backend.
+type Console struct {
+	in    io.Reader
+	out   io.Writer
+	input chan byte // console input
+}
+
+// NewConsole returns a console backend (default os.Stdin and os.Stdout).
+func NewConsole(in io.Reader, out io.Writer) *Console {
+	if in == nil {
+		in = os.Stdin
+	}
+	if out == nil {
+		out = os.Stdout
+	}
+	return &Console{in: in, out: out}
+}
+
+// start reads the console in the background so the emulation doesn't block.
+// The input channel is closed at the end of the input.
+func (c *Console) start() {
+	if c.input != nil {
+		return
+	}
+	c.input = make(chan byte, 256)
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			k, err := c.in.Read(buf)
+			if k == 1 {
+				c.input <- buf[0]
+			}
+			if err != nil {
+				close(c.input)
+				return
+			}
+		}
+	}()
+}
+
+// Read returns up to n bytes of the available console input (without blocking).
+func (c *Console) Read(n int) []byte {
+	c.start()
+	buf := []byte{}
+	for len(buf) < n {
+		select {
+		case x, ok := <-c.input:
+			if !ok {
+				return buf
+			}
+			buf = append(buf, x)
+		default:
+			return buf
+		}
+	}
+	return buf
+}
+
+// ReadWait returns up to n bytes of console input. It blocks until there
+// is some input, or the input has ended.
+func (c *Console) ReadWait(n int) []byte {
+	c.start()
+	if n == 0 {
+		return nil
+	}
+	x, ok := <-c.input
+	if !ok {
+		return nil
+	}
+	return append([]byte{x}, c.Read(n-1)...)
+}
+
+// Input returns up to n bytes of console input as a nondeterministic input
+// from a source (the input log is optional).
+func (c *Console) Input(inputs *replay.Log, src string, n int) []byte {
+	fn := func() []byte { return c.Read(n) }
+	if inputs != nil {
+		return inputs.Bytes(src, fn)
+	}
+	return fn()
+}
+
+// Write writes console output.
+func (c *Console) Write(buf []byte) {
+	c.out.Write(buf)
+}
+
+// consoleReader reads the console input as per a blocking read.
+type consoleReader struct {
+	c *Console
+}
+
+func (r consoleReader) Read(buf []byte) (int, error) {
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	x := r.c.ReadWait(len(buf))
+	if len(x) == 0 {
+		return 0, io.EOF
+	}
+	return copy(buf, x), nil
+}
+
+// Reader returns a reader for the console input (E.g. a host file for stdin).
+// A read blocks until there is some input, or the input has ended.
+func (c *Console) Reader() io.Reader {
+	return consoleReader{c}
+}
+
+// Writer returns the console output writer.
+func (c *Console) Writer() io.Writer {
+	return c.out
+}
+
+//-----------------------------------------------------------------------------
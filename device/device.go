@@ -0,0 +1,69 @@
+//-----------------------------------------------------------------------------
+/*
+
+Memory Mapped Devices
+
+Devices for a virt-like machine: a CLINT (timer and software interrupts),
+a PLIC (external interrupts) and an NS16550A UART. Each device implements
+mem.DeviceIO and is added to memory with mem.NewDevice. Each device also
+describes itself for the device tree, and implements mem.DeviceState so
+it can be checkpointed and reverse executed.
+
+*/
+//-----------------------------------------------------------------------------
+
+package device
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+//-----------------------------------------------------------------------------
+
+// Standard device addresses (as per the QEMU virt machine).
+const (
+	CLINTBase = 0x02000000
+	PLICBase  = 0x0c000000
+	UARTBase  = 0x10000000
+	UARTIRQ   = 10
+)
+
+//-----------------------------------------------------------------------------
+
+// rdReg returns the bytes of a register value for a sized access at an offset.
+func rdReg(reg uint64, ofs, size uint) uint64 {
+	x := reg >> (8 * ofs)
+	if size < 8 {
+		x &= (1 << (8 * size)) - 1
+	}
+	return x
+}
+
+// wrReg merges a sized write at an offset into a register value.
+func wrReg(reg uint64, ofs, size uint, val uint64) uint64 {
+	mask := ^uint64(0)
+	if size < 8 {
+		mask = (1 << (8 * size)) - 1
+	}
+	return reg&^(mask<<(8*ofs)) | (val&mask)<<(8*ofs)
+}
+
+//-----------------------------------------------------------------------------
+
+// encodeState returns the encoding of a device state.
+func encodeState(x interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(x)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeState decodes a device state.
+func decodeState(buf []byte, x interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(buf)).Decode(x)
+}
+
+//-----------------------------------------------------------------------------
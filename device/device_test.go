@@ -0,0 +1,594 @@
+//-----------------------------------------------------------------------------
+/*
+
+Device Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package device
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/fdt"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+func Test_CLINT(t *testing.T) {
+	state := csr.NewState(32, csr.IsaExtS|csr.IsaExtU)
+	now := uint64(1000)
+	state.SetTime(func() uint64 { return now })
+	d := NewCLINT(state)
+
+	// software interrupt
+	d.Wr(clintMSIP, 4, 1)
+	if !state.Pending(csr.IntMachineSoftware) || d.Rd(clintMSIP, 4) != 1 {
+		t.Errorf("msip is not set")
+	}
+	d.Wr(clintMSIP, 4, 0)
+	if state.Pending(csr.IntMachineSoftware) {
+		t.Errorf("msip is not clear")
+	}
+
+	// timer (32-bit writes)
+	if d.Rd(clintMTIME, 4) != now || d.Rd(clintMTIME+4, 4) != 0 {
+		t.Errorf("bad mtime")
+	}
+	d.Wr(clintMTIMECMP+4, 4, 0)
+	d.Wr(clintMTIMECMP, 4, 2000)
+	if d.Rd(clintMTIMECMP, 8) != 2000 || state.Pending(csr.IntMachineTimer) {
+		t.Errorf("timer is pending")
+	}
+	now = 2000
+	state.UpdateTimer()
+	if !state.Pending(csr.IntMachineTimer) {
+		t.Errorf("timer is not pending")
+	}
+}
+
+func Test_PLIC(t *testing.T) {
+	state := csr.NewState(64, csr.IsaExtS|csr.IsaExtU)
+	d := NewPLIC(state)
+	irq := d.IRQ(10)
+
+	// supervisor context: priority 1, enabled, threshold 0
+	d.Wr(plicPriority+4*10, 4, 1)
+	d.Wr(plicEnable+plicEnableCtx, 4, 1<<10)
+	irq.Set(true)
+	if !state.Pending(csr.IntSupervisorExternal) || state.Pending(csr.IntMachineExternal) {
+		t.Fatalf("bad external interrupt pending state")
+	}
+	if d.Rd(plicPending, 4) != 1<<10 {
+		t.Errorf("source is not pending")
+	}
+
+	// claim and complete
+	claimReg := uint(plicContext + plicCtxSize + 4)
+	if d.Rd(claimReg, 4) != 10 {
+		t.Fatalf("bad claim")
+	}
+	if state.Pending(csr.IntSupervisorExternal) || d.Rd(claimReg, 4) != 0 {
+		t.Errorf("interrupt is pending after the claim")
+	}
+	d.Wr(claimReg, 4, 10)
+	if !state.Pending(csr.IntSupervisorExternal) {
+		t.Errorf("level interrupt is not pending after the complete")
+	}
+	irq.Set(false)
+	if state.Pending(csr.IntSupervisorExternal) {
+		t.Errorf("interrupt is pending after the level is cleared")
+	}
+
+	// threshold
+	irq.Set(true)
+	d.Wr(plicContext+plicCtxSize, 4, 1)
+	if state.Pending(csr.IntSupervisorExternal) {
+		t.Errorf("interrupt is not masked by the threshold")
+	}
+
+	// a nil irq is not connected
+	var none *IRQ
+	none.Set(true)
+}
+
+func Test_UART(t *testing.T) {
+	state := csr.NewState(64, csr.IsaExtS|csr.IsaExtU)
+	plic := NewPLIC(state)
+	plic.Wr(plicPriority+4*UARTIRQ, 4, 1)
+	plic.Wr(plicEnable+plicEnableCtx, 4, 1<<UARTIRQ)
+	var out bytes.Buffer
+	d := NewUART(UARTConfig{
+		Console: NewConsole(strings.NewReader("ok"), &out),
+		IRQ:     plic.IRQ(UARTIRQ),
+	})
+
+	// transmit
+	for _, c := range []byte("hi") {
+		if d.Rd(uartLSR, 1)&lsrTHRE == 0 {
+			t.Fatalf("transmitter is not empty")
+		}
+		d.Wr(uartRBR, 1, uint64(c))
+	}
+	if out.String() != "hi" {
+		t.Errorf("output is \"%s\"", out.String())
+	}
+
+	// transmit interrupt
+	d.Wr(uartIER, 1, ierTHRE)
+	if !state.Pending(csr.IntSupervisorExternal) || d.Rd(uartIIR, 1) != iirTHRE {
+		t.Errorf("no thre interrupt")
+	}
+	if d.Rd(uartIIR, 1) != iirNone {
+		t.Errorf("thre interrupt is not cleared")
+	}
+
+	// receive interrupt
+	d.Wr(uartIER, 1, ierRDA)
+	in := []byte{}
+	for i := 0; i < 1000 && len(in) < 2; i++ {
+		// wait for the background console reader
+		time.Sleep(time.Millisecond)
+		d.Poll()
+		if d.Rd(uartIIR, 1) == iirRDA {
+			in = append(in, byte(d.Rd(uartRBR, 1)))
+		}
+	}
+	if string(in) != "ok" {
+		t.Errorf("input is \"%s\"", string(in))
+	}
+
+	// divisor latch
+	d.Wr(uartLCR, 1, lcrDLAB)
+	d.Wr(uartRBR, 1, 0x12)
+	d.Wr(uartLCR, 1, 3)
+	if d.dll != 0x12 || out.String() != "hi" {
+		t.Errorf("bad divisor latch")
+	}
+
+	// device tree
+	tree := fdt.NewTree()
+	n := d.DeviceNode(tree, UARTBase, UARTSize)
+	if n.Name != "serial@10000000" || n.Prop("interrupts") == nil {
+		t.Errorf("bad device node")
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// virtio queue layout in guest memory (per queue)
+const (
+	ramBase   = 0x80000000
+	queueBase = ramBase + 0x0000 // queue n at queueBase + n * queueStep
+	queueStep = 0x4000
+	availOfs  = 0x1000
+	usedOfs   = 0x2000
+	reqBase   = ramBase + 0x10000 // request header
+	dataBase  = ramBase + 0x11000 // request data
+	statBase  = ramBase + 0x12000 // request status
+	queueSize = 8
+)
+
+// vioTest drives a virtio device as the driver would.
+type vioTest struct {
+	t     *testing.T
+	m     *mem.Memory
+	state *csr.State
+	v     *VirtIO
+	avail []uint16
+}
+
+func newVirtIOTest(t *testing.T, dev VirtIODevice) *vioTest {
+	state := csr.NewState(64, csr.IsaExtS|csr.IsaExtU)
+	m := mem.NewMem64(state, 0)
+	m.Add(mem.NewSection("ram", ramBase, 0x20000, mem.AttrRW))
+	plic := NewPLIC(state)
+	plic.Wr(plicPriority+4*VirtIOIRQ, 4, 1)
+	plic.Wr(plicEnable+plicEnableCtx, 4, 1<<VirtIOIRQ)
+	v := NewVirtIO(m, dev, plic.IRQ(VirtIOIRQ))
+	x := &vioTest{t: t, m: m, state: state, v: v, avail: make([]uint16, dev.NumQueues())}
+
+	// device initialisation
+	if v.Rd(vioMagic, 4) != vioMagicValue || v.Rd(vioVersion, 4) != 2 || v.Rd(vioDeviceID, 4) != uint64(dev.DeviceID()) {
+		t.Fatalf("bad device identification")
+	}
+	v.Wr(vioStatus, 4, 0)
+	v.Wr(vioStatus, 4, 1|2) // acknowledge, driver
+	v.Wr(vioDevFeatSel, 4, 1)
+	if v.Rd(vioDevFeatures, 4)&1 == 0 {
+		t.Fatalf("no VIRTIO_F_VERSION_1")
+	}
+	v.Wr(vioDrvFeatSel, 4, 1)
+	v.Wr(vioDrvFeatures, 4, 1)
+	v.Wr(vioStatus, 4, 1|2|8) // features ok
+	for q := 0; q < dev.NumQueues(); q++ {
+		base := uint64(queueBase + q*queueStep)
+		v.Wr(vioQueueSel, 4, uint64(q))
+		v.Wr(vioQueueNum, 4, queueSize)
+		v.Wr(vioQueueDescLo, 4, base)
+		v.Wr(vioQueueDriverLo, 4, base+availOfs)
+		v.Wr(vioQueueDeviceLo, 4, base+usedOfs)
+		v.Wr(vioQueueReady, 4, 1)
+	}
+	v.Wr(vioStatus, 4, 1|2|8|4) // driver ok
+	return x
+}
+
+// desc writes a descriptor.
+func (x *vioTest) desc(q int, i uint, addr uint64, n uint32, flags, next uint16) {
+	adr := uint(queueBase+q*queueStep) + 16*i
+	x.m.Wr64Phys(adr, addr)
+	x.m.Wr32Phys(adr+8, n)
+	x.m.Wr16Phys(adr+12, flags)
+	x.m.Wr16Phys(adr+14, next)
+}
+
+// submit makes the chain at descriptor 0 available and notifies the device.
+func (x *vioTest) submit(q int) {
+	avail := uint(queueBase+q*queueStep) + availOfs
+	x.m.Wr16Phys(avail+4+2*uint(x.avail[q]%queueSize), 0)
+	x.avail[q]++
+	x.m.Wr16Phys(avail+2, x.avail[q])
+	x.v.Wr(vioQueueNotify, 4, uint64(q))
+}
+
+// used checks that the submitted chains have been used and returns the
+// length of the last one.
+func (x *vioTest) used(q int) uint32 {
+	used := uint(queueBase+q*queueStep) + usedOfs
+	idx, _ := x.m.Rd16Phys(used + 2)
+	if idx != x.avail[q] {
+		x.t.Fatalf("used index is %d, expected %d", idx, x.avail[q])
+	}
+	if !x.state.Pending(csr.IntSupervisorExternal) || x.v.Rd(vioIntStatus, 4) != vioIntUsed {
+		x.t.Errorf("no used buffer interrupt")
+	}
+	x.v.Wr(vioIntACK, 4, vioIntUsed)
+	if x.state.Pending(csr.IntSupervisorExternal) {
+		x.t.Errorf("interrupt is pending after the ack")
+	}
+	n, _ := x.m.Rd32Phys(used + 4 + 8*uint((idx-1)%queueSize) + 4)
+	return n
+}
+
+// request runs a block request and returns the status.
+func (x *vioTest) request(typ uint32, sector uint64, n uint32) uint8 {
+	x.m.Wr32Phys(reqBase, typ)
+	x.m.Wr64Phys(reqBase+8, sector)
+	dataFlags := uint16(vringDescNext)
+	if typ == blkTypeIn {
+		dataFlags |= vringDescWrite
+	}
+	x.desc(0, 0, reqBase, 16, vringDescNext, 1)
+	x.desc(0, 1, dataBase, n, dataFlags, 2)
+	x.desc(0, 2, statBase, 1, vringDescWrite, 0)
+	x.submit(0)
+	x.used(0)
+	status, _ := x.m.Rd8Phys(statBase)
+	return status
+}
+
+func Test_VirtIOBlock(t *testing.T) {
+	f, err := ioutil.TempFile("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	image := bytes.Repeat([]byte{0xa5}, 4*blkSectorSize)
+	copy(image[blkSectorSize:], "sector 1")
+	f.Write(image)
+	f.Close()
+
+	for _, mode := range []BlockMode{BlockRW, BlockRO, BlockCOW} {
+		blk, err := NewBlock(BlockConfig{Image: f.Name(), Mode: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		x := newVirtIOTest(t, blk)
+		if x.v.Rd(vioConfig, 8) != 4 {
+			t.Errorf("bad capacity")
+		}
+		// read sector 1
+		if x.request(blkTypeIn, 1, blkSectorSize) != blkStatusOK {
+			t.Errorf("read failed")
+		}
+		if b, _ := x.m.Rd64Phys(dataBase); b != 0x3120726f74636573 {
+			t.Errorf("bad sector data %x", b)
+		}
+		// write sector 2
+		x.m.Wr64Phys(dataBase, 0x1122334455667788)
+		status := x.request(blkTypeOut, 2, blkSectorSize)
+		if (mode == BlockRO) != (status == blkStatusIO) {
+			t.Errorf("mode %d: write status %d", mode, status)
+		}
+		x.m.Wr64Phys(dataBase, 0)
+		x.request(blkTypeIn, 2, blkSectorSize)
+		b, _ := x.m.Rd64Phys(dataBase)
+		if (mode == BlockRO) != (b == 0xa5a5a5a5a5a5a5a5) {
+			t.Errorf("mode %d: bad data after write %x", mode, b)
+		}
+		// read beyond the end of the disk
+		if x.request(blkTypeIn, 4, blkSectorSize) != blkStatusIO {
+			t.Errorf("read beyond the end of the disk")
+		}
+		if x.request(0x55, 0, blkSectorSize) != blkStatusUnsp {
+			t.Errorf("unsupported request")
+		}
+		blk.Close()
+
+		// the image file is only written in read/write mode
+		buf, _ := ioutil.ReadFile(f.Name())
+		changed := !bytes.Equal(buf, image)
+		if changed != (mode == BlockRW) {
+			t.Errorf("mode %d: image changed %v", mode, changed)
+		}
+		ioutil.WriteFile(f.Name(), image, 0644)
+	}
+}
+
+func Test_VirtIOBadRequest(t *testing.T) {
+	f, err := ioutil.TempFile("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(make([]byte, blkSectorSize))
+	f.Close()
+
+	tests := []struct {
+		addr uint64
+		n    uint32
+	}{
+		{reqBase, 0xffffffff},     // too big
+		{reqBase, vioRequestMax},  // chain too long
+		{ramBase + 0x1fff0, 0x20}, // beyond the end of memory
+		{0x1000, 16},              // not mapped
+	}
+	for _, v := range tests {
+		blk, err := NewBlock(BlockConfig{Image: f.Name(), Mode: BlockRO})
+		if err != nil {
+			t.Fatal(err)
+		}
+		x := newVirtIOTest(t, blk)
+		x.desc(0, 0, v.addr, v.n, vringDescNext, 1)
+		x.desc(0, 1, statBase, 1, vringDescWrite, 0)
+		x.submit(0)
+		if x.v.Rd(vioStatus, 4)&vioNeedsReset == 0 {
+			t.Errorf("%x (%d bytes): device didn't fail", v.addr, v.n)
+		}
+		blk.Close()
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_VirtIOConsole(t *testing.T) {
+	var out bytes.Buffer
+	d := NewVirtIOConsole(VirtIOConsoleConfig{Console: NewConsole(strings.NewReader("input"), &out)})
+	x := newVirtIOTest(t, d)
+
+	// transmit
+	x.m.Patch(dataBase, []byte("hello"))
+	x.desc(consoleTxQueue, 0, dataBase, 5, 0, 0)
+	x.submit(consoleTxQueue)
+	x.used(consoleTxQueue)
+	if out.String() != "hello" {
+		t.Errorf("output is \"%s\"", out.String())
+	}
+
+	// receive
+	x.desc(consoleRxQueue, 0, statBase, 16, vringDescWrite, 0)
+	x.submit(consoleRxQueue)
+	for i := 0; i < 1000 && !x.state.Pending(csr.IntSupervisorExternal); i++ {
+		// wait for the background console reader
+		time.Sleep(time.Millisecond)
+		x.v.Poll()
+	}
+	n := x.used(consoleRxQueue)
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i], _ = x.m.Rd8Phys(statBase + uint(i))
+	}
+	if !strings.HasPrefix("input", string(buf)) || n == 0 {
+		t.Errorf("input is \"%s\"", string(buf))
+	}
+}
+
+func Test_VirtIORNG(t *testing.T) {
+	random := func(seed int64) []byte {
+		x := newVirtIOTest(t, NewVirtIORNG(VirtIORNGConfig{Seed: seed}))
+		x.desc(0, 0, dataBase, 32, vringDescWrite, 0)
+		x.submit(0)
+		if x.used(0) != 32 {
+			t.Fatalf("bad used length")
+		}
+		buf := make([]byte, 32)
+		for i := range buf {
+			buf[i], _ = x.m.Rd8Phys(dataBase + uint(i))
+		}
+		return buf
+	}
+	a, b, c := random(1), random(1), random(0)
+	if !bytes.Equal(a, b) || bytes.Equal(a, c) {
+		t.Errorf("seeded generator is not deterministic")
+	}
+	if bytes.Equal(c, make([]byte, 32)) {
+		t.Errorf("no random data")
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// saveState returns the device state (or fails the test).
+func saveState(t *testing.T, d mem.DeviceState) []byte {
+	buf, err := d.SaveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
+
+func Test_DeviceState(t *testing.T) {
+	state := csr.NewState(64, csr.IsaExtS|csr.IsaExtU)
+	plic := NewPLIC(state)
+	plic.Wr(plicPriority+4*UARTIRQ, 4, 1)
+	plic.Wr(plicEnable+plicEnableCtx, 4, 1<<UARTIRQ)
+	uart := NewUART(UARTConfig{Console: NewConsole(strings.NewReader(""), ioutil.Discard), IRQ: plic.IRQ(UARTIRQ)})
+
+	// uart and plic
+	uart.Wr(uartSCR, 1, 0x5a)
+	s0, s1 := saveState(t, uart), saveState(t, plic)
+	uart.rx = []byte("abc")
+	uart.Wr(uartIER, 1, ierRDA)
+	uart.Wr(uartSCR, 1, 0)
+	if !state.Pending(csr.IntSupervisorExternal) {
+		t.Fatalf("no uart interrupt")
+	}
+	if uart.RestoreState(s0) != nil || plic.RestoreState(s1) != nil {
+		t.Fatalf("restore failed")
+	}
+	if len(uart.rx) != 0 || uart.ier != 0 || uart.Rd(uartSCR, 1) != 0x5a {
+		t.Errorf("uart state not restored")
+	}
+	if plic.Rd(plicPending, 4) != 0 || state.Pending(csr.IntSupervisorExternal) {
+		t.Errorf("plic state not restored")
+	}
+
+	// seeded random number generator
+	rng := NewVirtIORNG(VirtIORNGConfig{Seed: 1})
+	rng.random(10)
+	s0 = saveState(t, rng)
+	a := rng.random(5000)
+	rng.random(10)
+	if rng.RestoreState(s0) != nil || !bytes.Equal(a, rng.random(5000)) {
+		t.Errorf("rng state not restored")
+	}
+
+	// block device overlay
+	f, err := ioutil.TempFile("", "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Write(make([]byte, 4*blkSectorSize))
+	f.Close()
+	for _, mode := range []BlockMode{BlockRW, BlockCOW} {
+		blk, err := NewBlock(BlockConfig{Image: f.Name(), Mode: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		x := newVirtIOTest(t, blk)
+		s0, err := x.v.SaveState()
+		if mode == BlockRW {
+			if err == nil {
+				t.Errorf("read/write image state saved")
+			}
+			blk.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		x.m.Wr64Phys(dataBase, 0x1122334455667788)
+		x.request(blkTypeOut, 2, blkSectorSize)
+		if x.v.RestoreState(s0) != nil || len(blk.overlay) != 0 || x.v.queue[0].lastAvail != 0 {
+			t.Errorf("block state not restored")
+		}
+		blk.Close()
+	}
+}
+
+func Test_DeviceReset(t *testing.T) {
+	state := csr.NewState(64, csr.IsaExtS|csr.IsaExtU)
+	plic := NewPLIC(state)
+	plic.Wr(plicPriority+4*UARTIRQ, 4, 1)
+	plic.Wr(plicEnable+plicEnableCtx, 4, 1<<UARTIRQ)
+	uart := NewUART(UARTConfig{Console: NewConsole(strings.NewReader(""), ioutil.Discard), IRQ: plic.IRQ(UARTIRQ)})
+	m := mem.NewMem64(state, 0)
+	m.Add(mem.NewDevice("uart", UARTBase, UARTSize, uart))
+	m.Add(mem.NewDevice("plic", PLICBase, PLICSize, plic))
+
+	uart.rx = []byte("abc")
+	uart.Wr(uartIER, 1, ierRDA)
+	uart.Wr(uartSCR, 1, 0x5a)
+	if !state.Pending(csr.IntSupervisorExternal) {
+		t.Fatalf("no uart interrupt")
+	}
+	m.ResetDevices()
+	if len(uart.rx) != 0 || uart.ier != 0 || uart.Rd(uartSCR, 1) != 0 {
+		t.Errorf("uart is not reset")
+	}
+	if plic.Rd(plicEnable+plicEnableCtx, 4) != 0 || plic.Rd(plicPending, 4) != 0 || state.Pending(csr.IntSupervisorExternal) {
+		t.Errorf("plic is not reset")
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_Framebuffer(t *testing.T) {
+	if _, err := NewFramebuffer(FramebufferConfig{Width: 4, Height: 2, Format: "y8"}); err == nil {
+		t.Errorf("bad pixel format accepted")
+	}
+	tests := []struct {
+		format string
+		pixel  uint64
+		c      color.NRGBA
+	}{
+		{"", 0x00ff8001, color.NRGBA{0xff, 0x80, 0x01, 0xff}},
+		{"a8b8g8r8", 0xff0080ff, color.NRGBA{0xff, 0x80, 0x00, 0xff}},
+		{"r5g6b5", 0xf81f, color.NRGBA{0xff, 0x00, 0xff, 0xff}},
+		{"r8g8b8", 0x102030, color.NRGBA{0x10, 0x20, 0x30, 0xff}},
+	}
+	for _, x := range tests {
+		d, err := NewFramebuffer(FramebufferConfig{Width: 4, Height: 2, Format: x.format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bpp := d.format.bytes
+		if d.Size() != 4096 || d.stride != 4*bpp {
+			t.Errorf("%s: bad size %d, stride %d", x.format, d.Size(), d.stride)
+		}
+		// pixel (2, 1)
+		ofs := d.stride + 2*bpp
+		d.Wr(ofs, bpp, x.pixel)
+		if d.Rd(ofs, bpp) != x.pixel {
+			t.Errorf("%s: bad read back", x.format)
+		}
+		var buf bytes.Buffer
+		err = d.WritePNG(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		black := color.NRGBA{0, 0, 0, 0xff}
+		if color.NRGBAModel.Convert(img.At(2, 1)) != x.c || color.NRGBAModel.Convert(img.At(1, 1)) != black {
+			t.Errorf("%s: pixel is %v, expected %v", x.format, img.At(2, 1), x.c)
+		}
+	}
+
+	// device tree
+	d, _ := NewFramebuffer(FramebufferConfig{Width: 640, Height: 480, Format: "R5G6B5"})
+	tree := fdt.NewTree()
+	tree.Root.Add(d.DeviceNode(tree, FramebufferBase, uint64(d.Size())))
+	dts := tree.DTS()
+	for _, s := range []string{"framebuffer@28000000 {", "compatible = \"simple-framebuffer\";", "stride = <0x500>;", "format = \"r5g6b5\";"} {
+		if !strings.Contains(dts, s) {
+			t.Errorf("no %s in\n%s", s, dts)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
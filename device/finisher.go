@@ -0,0 +1,111 @@
+//-----------------------------------------------------------------------------
+/*
+
+SiFive Test Finisher
+
+A write to the finisher register stops the emulation with an exit status,
+or resets the machine. This lets test programs and kernels (via the
+syscon-poweroff and syscon-reboot drivers) end the emulation without
+special symbols such as "tohost".
+
+	0x5555             pass (exit status 0)
+	0x3333 | code<<16  fail (exit status code, or 1 if code is 0)
+	0x7777             reset
+
+*/
+//-----------------------------------------------------------------------------
+
+package device
+
+import "github.com/deadsy/riscv/fdt"
+
+//-----------------------------------------------------------------------------
+
+// Standard finisher address (as per the QEMU virt machine).
+const (
+	FinisherBase = 0x100000
+	FinisherSize = 0x1000
+)
+
+// finisher commands
+const (
+	finisherFail  = 0x3333
+	finisherPass  = 0x5555
+	finisherReset = 0x7777
+)
+
+const labelFinisher = "test"
+
+// FinisherConfig is the test finisher configuration.
+type FinisherConfig struct {
+	Exit  func(status int) // stop the emulation with an exit status
+	Reset func()           // reset the machine
+}
+
+// Finisher is a SiFive test finisher.
+type Finisher struct {
+	cfg FinisherConfig
+}
+
+// NewFinisher returns a SiFive test finisher.
+func NewFinisher(cfg FinisherConfig) *Finisher {
+	return &Finisher{cfg: cfg}
+}
+
+// Rd reads a finisher register.
+func (d *Finisher) Rd(ofs, size uint) uint64 {
+	return 0
+}
+
+// Wr writes a finisher register.
+func (d *Finisher) Wr(ofs, size uint, val uint64) {
+	if ofs != 0 || size < 4 {
+		return
+	}
+	switch uint32(val) & 0xffff {
+	case finisherPass:
+		d.cfg.Exit(0)
+	case finisherFail:
+		status := int(uint32(val) >> 16)
+		if status == 0 {
+			status = 1
+		}
+		d.cfg.Exit(status)
+	case finisherReset:
+		d.cfg.Reset()
+	}
+}
+
+// DeviceNode returns the device tree node for the finisher.
+// The poweroff and reboot nodes let a kernel use the finisher.
+func (d *Finisher) DeviceNode(t *fdt.Tree, base, size uint64) *fdt.Node {
+	test := t.Phandle(labelFinisher)
+	return fdt.NewNodeAt("test", base).
+		String("compatible", "sifive,test1", "sifive,test0", "syscon", "simple-mfd").
+		U64("reg", base, size).
+		Cells("phandle", test).
+		Add(fdt.NewNode("poweroff").
+			String("compatible", "syscon-poweroff").
+			Cells("regmap", test).
+			Cells("offset", 0).
+			Cells("value", finisherPass)).
+		Add(fdt.NewNode("reboot").
+			String("compatible", "syscon-reboot").
+			Cells("regmap", test).
+			Cells("offset", 0).
+			Cells("value", finisherReset))
+}
+
+//-----------------------------------------------------------------------------
+
+// SaveState returns the finisher state (there is none).
+func (d *Finisher) SaveState() ([]byte, error) {
+	return nil, nil
+}
+
+// RestoreState sets the finisher state.
+func (d *Finisher) RestoreState(buf []byte) error {
+	return nil
+}
+
+//-----------------------------------------------------------------------------
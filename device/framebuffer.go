@@ -0,0 +1,206 @@
+//-----------------------------------------------------------------------------
+/*
+
+Simple Framebuffer
+
+A linear framebuffer in memory with a fixed width, height and pixel
+format. The device tree node is a "simple-framebuffer", so the kernel
+(or boot code) can draw to it without a display controller driver.
+The current contents can be written to a PNG file.
+
+See:
+
+linux/Documentation/devicetree/bindings/display/simple-framebuffer.yaml
+
+*/
+//-----------------------------------------------------------------------------
+
+package device
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/deadsy/riscv/fdt"
+)
+
+//-----------------------------------------------------------------------------
+
+// FramebufferBase is the standard framebuffer address.
+const FramebufferBase = 0x28000000
+
+// field is a color channel within a pixel.
+type field struct {
+	shift, bits uint
+}
+
+// pixelFormat is the layout of a little-endian pixel.
+type pixelFormat struct {
+	bytes   uint // bytes per pixel
+	r, g, b field
+}
+
+// pixelFormats are the supported simple-framebuffer pixel formats.
+var pixelFormats = map[string]pixelFormat{
+	"r5g6b5":      {2, field{11, 5}, field{5, 6}, field{0, 5}},
+	"x1r5g5b5":    {2, field{10, 5}, field{5, 5}, field{0, 5}},
+	"a1r5g5b5":    {2, field{10, 5}, field{5, 5}, field{0, 5}},
+	"r8g8b8":      {3, field{16, 8}, field{8, 8}, field{0, 8}},
+	"x8r8g8b8":    {4, field{16, 8}, field{8, 8}, field{0, 8}},
+	"a8r8g8b8":    {4, field{16, 8}, field{8, 8}, field{0, 8}},
+	"x8b8g8r8":    {4, field{0, 8}, field{8, 8}, field{16, 8}},
+	"a8b8g8r8":    {4, field{0, 8}, field{8, 8}, field{16, 8}},
+	"x2r10g10b10": {4, field{20, 10}, field{10, 10}, field{0, 10}},
+	"a2r10g10b10": {4, field{20, 10}, field{10, 10}, field{0, 10}},
+}
+
+// value returns the 8-bit channel value from a pixel.
+func (f field) value(x uint32) uint8 {
+	v := (x >> f.shift) & ((1 << f.bits) - 1)
+	if f.bits >= 8 {
+		return uint8(v >> (f.bits - 8))
+	}
+	// replicate the high bits into the low bits
+	return uint8((v << (8 - f.bits)) | (v >> (2*f.bits - 8)))
+}
+
+// FramebufferConfig is the framebuffer configuration.
+type FramebufferConfig struct {
+	Width  uint   // pixels
+	Height uint   // pixels
+	Format string // pixel format (default a8r8g8b8)
+}
+
+// Framebuffer is a simple framebuffer.
+type Framebuffer struct {
+	cfg    FramebufferConfig
+	format pixelFormat
+	stride uint   // bytes per line
+	buf    []byte // pixel memory
+}
+
+// NewFramebuffer returns a simple framebuffer.
+func NewFramebuffer(cfg FramebufferConfig) (*Framebuffer, error) {
+	if cfg.Format == "" {
+		cfg.Format = "a8r8g8b8"
+	}
+	cfg.Format = strings.ToLower(cfg.Format)
+	format, ok := pixelFormats[cfg.Format]
+	if !ok {
+		return nil, fmt.Errorf("framebuffer pixel format \"%s\" is not supported", cfg.Format)
+	}
+	if cfg.Width == 0 || cfg.Height == 0 {
+		return nil, fmt.Errorf("framebuffer size %dx%d is not valid", cfg.Width, cfg.Height)
+	}
+	d := &Framebuffer{
+		cfg:    cfg,
+		format: format,
+		stride: cfg.Width * format.bytes,
+	}
+	// round up to a page, so the region can be mapped by the guest
+	size := (d.stride*cfg.Height + 4095) &^ 4095
+	d.buf = make([]byte, size)
+	return d, nil
+}
+
+// Size returns the size of the framebuffer memory.
+func (d *Framebuffer) Size() uint {
+	return uint(len(d.buf))
+}
+
+// Rd reads the framebuffer memory.
+func (d *Framebuffer) Rd(ofs, size uint) uint64 {
+	var x uint64
+	for i := size; i > 0; i-- {
+		x = x<<8 | uint64(d.buf[ofs+i-1])
+	}
+	return x
+}
+
+// Wr writes the framebuffer memory.
+func (d *Framebuffer) Wr(ofs, size uint, val uint64) {
+	for i := uint(0); i < size; i++ {
+		d.buf[ofs+i] = uint8(val >> (8 * i))
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// Image returns an image of the current framebuffer contents.
+func (d *Framebuffer) Image() image.Image {
+	w, h := int(d.cfg.Width), int(d.cfg.Height)
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	f := &d.format
+	for y := 0; y < h; y++ {
+		ofs := uint(y) * d.stride
+		for x := 0; x < w; x++ {
+			var p uint32
+			for i := f.bytes; i > 0; i-- {
+				p = p<<8 | uint32(d.buf[ofs+i-1])
+			}
+			ofs += f.bytes
+			img.SetNRGBA(x, y, color.NRGBA{f.r.value(p), f.g.value(p), f.b.value(p), 0xff})
+		}
+	}
+	return img
+}
+
+// WritePNG writes the current framebuffer contents as a PNG image.
+func (d *Framebuffer) WritePNG(w io.Writer) error {
+	return png.Encode(w, d.Image())
+}
+
+// SavePNG writes the current framebuffer contents to a PNG file.
+func (d *Framebuffer) SavePNG(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = d.WritePNG(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+//-----------------------------------------------------------------------------
+
+// DeviceNode returns the device tree node for the framebuffer.
+func (d *Framebuffer) DeviceNode(t *fdt.Tree, base, size uint64) *fdt.Node {
+	return fdt.NewNodeAt("framebuffer", base).
+		String("compatible", "simple-framebuffer").
+		U64("reg", base, size).
+		Cells("width", uint32(d.cfg.Width)).
+		Cells("height", uint32(d.cfg.Height)).
+		Cells("stride", uint32(d.stride)).
+		String("format", d.cfg.Format)
+}
+
+//-----------------------------------------------------------------------------
+
+// Bytes returns the framebuffer memory.
+func (d *Framebuffer) Bytes() []uint8 {
+	return d.buf
+}
+
+// SaveState returns the framebuffer contents.
+func (d *Framebuffer) SaveState() ([]byte, error) {
+	return append([]byte(nil), d.buf...), nil
+}
+
+// RestoreState sets the framebuffer contents.
+func (d *Framebuffer) RestoreState(buf []byte) error {
+	if len(buf) != len(d.buf) {
+		return fmt.Errorf("framebuffer state is %d bytes, expected %d", len(buf), len(d.buf))
+	}
+	copy(d.buf, buf)
+	return nil
+}
+
+//-----------------------------------------------------------------------------
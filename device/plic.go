@@ -0,0 +1,271 @@
+//-----------------------------------------------------------------------------
+/*
+
+Platform Level Interrupt Controller (PLIC)
+
+The PLIC has level triggered interrupt sources with claim/complete and
+two contexts for hart 0: context 0 drives the machine external interrupt
+and context 1 drives the supervisor external interrupt.
+
+See:
+
+https://github.com/riscv/riscv-plic-spec
+
+*/
+//-----------------------------------------------------------------------------
+
+package device
+
+import (
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/fdt"
+)
+
+//-----------------------------------------------------------------------------
+
+// PLICSize is the size of the PLIC register space.
+const PLICSize = 0x4000000
+
+// PLICSources is the number of interrupt sources (source 0 is reserved).
+const PLICSources = 64
+
+// labelPLIC is the device tree label for the PLIC.
+const labelPLIC = "plic"
+
+// PLIC register offsets
+const (
+	plicPriority  = 0x000000
+	plicPending   = 0x001000
+	plicEnable    = 0x002000
+	plicEnableCtx = 0x80
+	plicContext   = 0x200000
+	plicCtxSize   = 0x1000
+)
+
+// plicCtxInt is the interrupt driven by each context.
+var plicCtxInt = []csr.ICode{csr.IntMachineExternal, csr.IntSupervisorExternal}
+
+// PLIC is a platform level interrupt controller.
+type PLIC struct {
+	csr       *csr.State
+	priority  [PLICSources]uint32
+	level     uint64 // source levels
+	pending   uint64 // pending sources
+	claimed   uint64 // claimed (in service) sources
+	enable    [2]uint64
+	threshold [2]uint32
+}
+
+// NewPLIC returns a PLIC driving the external interrupts of a hart.
+func NewPLIC(csr *csr.State) *PLIC {
+	return &PLIC{csr: csr}
+}
+
+//-----------------------------------------------------------------------------
+
+// Reset resets the PLIC registers.
+// Sources that are still asserted are pending.
+func (d *PLIC) Reset() {
+	d.priority = [PLICSources]uint32{}
+	d.pending = d.level
+	d.claimed = 0
+	d.enable = [2]uint64{}
+	d.threshold = [2]uint32{}
+	d.update()
+}
+
+// best returns the highest priority pending and enabled source for a context (or 0).
+func (d *PLIC) best(ctx int) uint {
+	x := d.pending & d.enable[ctx] &^ 1
+	best, prio := uint(0), d.threshold[ctx]
+	for n := uint(1); n < PLICSources; n++ {
+		if x&(1<<n) != 0 && d.priority[n] > prio {
+			best, prio = n, d.priority[n]
+		}
+	}
+	return best
+}
+
+// update sets the external interrupt pending bits.
+func (d *PLIC) update() {
+	for ctx, code := range plicCtxInt {
+		d.csr.SetPending(code, d.best(ctx) != 0)
+	}
+}
+
+// setLevel sets the level of an interrupt source.
+func (d *PLIC) setLevel(n uint, level bool) {
+	if level {
+		d.level |= 1 << n
+		if d.claimed&(1<<n) == 0 {
+			d.pending |= 1 << n
+		}
+	} else {
+		d.level &^= 1 << n
+		d.pending &^= 1 << n
+	}
+	d.update()
+}
+
+// claim claims the best interrupt for a context.
+func (d *PLIC) claim(ctx int) uint {
+	n := d.best(ctx)
+	if n != 0 {
+		d.pending &^= 1 << n
+		d.claimed |= 1 << n
+		d.update()
+	}
+	return n
+}
+
+// complete completes the servicing of an interrupt.
+func (d *PLIC) complete(n uint) {
+	if n == 0 || n >= PLICSources {
+		return
+	}
+	d.claimed &^= 1 << n
+	if d.level&(1<<n) != 0 {
+		d.pending |= 1 << n
+	}
+	d.update()
+}
+
+//-----------------------------------------------------------------------------
+
+// ctxReg returns the context and register offset for a context register.
+func ctxReg(ofs, base, size uint) (int, uint, bool) {
+	if ofs < base {
+		return 0, 0, false
+	}
+	ctx := int((ofs - base) / size)
+	if ctx >= len(plicCtxInt) {
+		return 0, 0, false
+	}
+	return ctx, (ofs - base) % size, true
+}
+
+// Rd reads a PLIC register.
+func (d *PLIC) Rd(ofs, size uint) uint64 {
+	switch {
+	case ofs < plicPriority+4*PLICSources:
+		return rdReg(uint64(d.priority[ofs/4]), ofs%4, size)
+	case ofs >= plicPending && ofs < plicPending+8:
+		return rdReg(d.pending, ofs-plicPending, size)
+	case ofs >= plicEnable && ofs < plicContext:
+		if ctx, r, ok := ctxReg(ofs, plicEnable, plicEnableCtx); ok && r < 8 {
+			return rdReg(d.enable[ctx], r, size)
+		}
+	default:
+		if ctx, r, ok := ctxReg(ofs, plicContext, plicCtxSize); ok {
+			switch r {
+			case 0:
+				return uint64(d.threshold[ctx])
+			case 4:
+				return uint64(d.claim(ctx))
+			}
+		}
+	}
+	return 0
+}
+
+// Wr writes a PLIC register.
+func (d *PLIC) Wr(ofs, size uint, val uint64) {
+	switch {
+	case ofs < plicPriority+4*PLICSources:
+		if ofs >= 4 {
+			d.priority[ofs/4] = uint32(wrReg(uint64(d.priority[ofs/4]), ofs%4, size, val)) & 7
+		}
+	case ofs >= plicEnable && ofs < plicContext:
+		if ctx, r, ok := ctxReg(ofs, plicEnable, plicEnableCtx); ok && r < 8 {
+			d.enable[ctx] = wrReg(d.enable[ctx], r, size, val) &^ 1
+		}
+	default:
+		if ctx, r, ok := ctxReg(ofs, plicContext, plicCtxSize); ok {
+			switch r {
+			case 0:
+				d.threshold[ctx] = uint32(val) & 7
+			case 4:
+				d.complete(uint(val))
+			}
+		}
+	}
+	d.update()
+}
+
+// DeviceNode returns the device tree node for the PLIC.
+func (d *PLIC) DeviceNode(t *fdt.Tree, base, size uint64) *fdt.Node {
+	intc := t.Phandle(fdt.LabelCPUIntc)
+	return fdt.NewNodeAt("interrupt-controller", base).
+		Cells("#address-cells", 0).
+		Cells("#interrupt-cells", 1).
+		Empty("interrupt-controller").
+		String("compatible", "sifive,plic-1.0.0", "riscv,plic0").
+		Cells("interrupts-extended", intc, uint32(csr.IntMachineExternal), intc, uint32(csr.IntSupervisorExternal)).
+		U64("reg", base, size).
+		Cells("riscv,ndev", PLICSources-1).
+		Cells("phandle", t.Phandle(labelPLIC))
+}
+
+//-----------------------------------------------------------------------------
+
+// IRQ is an interrupt line to the PLIC.
+type IRQ struct {
+	plic *PLIC
+	n    uint
+}
+
+// IRQ returns an interrupt line for a source number.
+func (d *PLIC) IRQ(n uint) *IRQ {
+	if n == 0 || n >= PLICSources {
+		panic("bad plic source number")
+	}
+	return &IRQ{d, n}
+}
+
+// Set sets the level of the interrupt line.
+// A nil interrupt line is not connected.
+func (irq *IRQ) Set(level bool) {
+	if irq != nil {
+		irq.plic.setLevel(irq.n, level)
+	}
+}
+
+// describe adds the interrupt properties for a device node.
+func (irq *IRQ) describe(t *fdt.Tree, n *fdt.Node) {
+	if irq != nil {
+		n.Cells("interrupt-parent", t.Phandle(labelPLIC))
+		n.Cells("interrupts", uint32(irq.n))
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// plicState is the saved state of the PLIC.
+type plicState struct {
+	Priority                [PLICSources]uint32
+	Level, Pending, Claimed uint64
+	Enable                  [2]uint64
+	Threshold               [2]uint32
+}
+
+// SaveState returns the PLIC state.
+func (d *PLIC) SaveState() ([]byte, error) {
+	return encodeState(&plicState{d.priority, d.level, d.pending, d.claimed, d.enable, d.threshold})
+}
+
+// RestoreState sets the PLIC state.
+func (d *PLIC) RestoreState(buf []byte) error {
+	var x plicState
+	err := decodeState(buf, &x)
+	if err != nil {
+		return err
+	}
+	d.priority = x.Priority
+	d.level, d.pending, d.claimed = x.Level, x.Pending, x.Claimed
+	d.enable = x.Enable
+	d.threshold = x.Threshold
+	d.update()
+	return nil
+}
+
+//-----------------------------------------------------------------------------
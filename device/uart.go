@@ -0,0 +1,260 @@
+//-----------------------------------------------------------------------------
+/*
+
+NS16550A UART
+
+A UART with the 16550 register set. Transmitted characters are written
+to the console output immediately, so the transmitter is always empty.
+Received characters are moved from the console to the receive buffer
+when the CPU polls the device.
+
+*/
+//-----------------------------------------------------------------------------
+
+package device
+
+import (
+	"github.com/deadsy/riscv/fdt"
+	"github.com/deadsy/riscv/replay"
+)
+
+//-----------------------------------------------------------------------------
+
+// UARTSize is the size of the UART register space.
+const UARTSize = 0x100
+
+// uartClock is the UART input clock frequency (Hz).
+const uartClock = 3686400
+
+// uartFifo is the receive FIFO size.
+const uartFifo = 16
+
+// UART register offsets
+const (
+	uartRBR = 0 // receive buffer (read), transmit holding (write), divisor latch lsb
+	uartIER = 1 // interrupt enable, divisor latch msb
+	uartIIR = 2 // interrupt identification (read), fifo control (write)
+	uartLCR = 3 // line control
+	uartMCR = 4 // modem control
+	uartLSR = 5 // line status
+	uartMSR = 6 // modem status
+	uartSCR = 7 // scratch
+)
+
+// UART register bits
+const (
+	ierRDA   = 1 << 0 // receive data available
+	ierTHRE  = 1 << 1 // transmit holding register empty
+	iirNone  = 0x01   // no interrupt pending
+	iirTHRE  = 0x02   // transmit holding register empty
+	iirRDA   = 0x04   // receive data available
+	iirFifo  = 0xc0   // fifos enabled
+	lcrDLAB  = 1 << 7 // divisor latch access
+	lsrDR    = 1 << 0 // data ready
+	lsrTHRE  = 1 << 5 // transmit holding register empty
+	lsrTEMT  = 1 << 6 // transmitter empty
+	msrDCD   = 1 << 7
+	msrDSR   = 1 << 5
+	msrCTS   = 1 << 4
+	fcrFifo  = 1 << 0 // fifo enable
+	fcrClrRx = 1 << 1 // clear receive fifo
+)
+
+// UARTConfig is the UART configuration.
+type UARTConfig struct {
+	Console *Console    // host terminal (default os.Stdin and os.Stdout)
+	Inputs  *replay.Log // record/replay of nondeterministic inputs (optional)
+	IRQ     *IRQ        // interrupt line (optional)
+}
+
+// UART is a 16550A UART.
+type UART struct {
+	cfg   UARTConfig
+	rx    []byte // receive buffer
+	ier   uint8
+	lcr   uint8
+	mcr   uint8
+	fcr   uint8
+	scr   uint8
+	dll   uint8
+	dlm   uint8
+	thrIP bool // transmit holding register empty interrupt pending
+}
+
+// NewUART returns a 16550A UART.
+func NewUART(cfg UARTConfig) *UART {
+	if cfg.Console == nil {
+		cfg.Console = NewConsole(nil, nil)
+	}
+	return &UART{cfg: cfg}
+}
+
+//-----------------------------------------------------------------------------
+
+// Reset resets the UART registers and empties the receive buffer.
+func (d *UART) Reset() {
+	*d = UART{cfg: d.cfg}
+	d.update()
+}
+
+// read moves the available console input to the receive buffer.
+func (d *UART) read() {
+	d.rx = append(d.rx, d.cfg.Console.Input(d.cfg.Inputs, "uart.rx", uartFifo-len(d.rx))...)
+	d.update()
+}
+
+// Poll checks for console input when receive interrupts are enabled.
+func (d *UART) Poll() {
+	if d.ier&ierRDA != 0 && len(d.rx) == 0 {
+		d.read()
+	}
+}
+
+// iir returns the interrupt identification.
+func (d *UART) iir() uint8 {
+	id := uint8(iirNone)
+	if d.ier&ierRDA != 0 && len(d.rx) != 0 {
+		id = iirRDA
+	} else if d.ier&ierTHRE != 0 && d.thrIP {
+		id = iirTHRE
+	}
+	if d.fcr&fcrFifo != 0 {
+		id |= iirFifo
+	}
+	return id
+}
+
+// update sets the interrupt line.
+func (d *UART) update() {
+	d.cfg.IRQ.Set(d.iir()&iirNone == 0)
+}
+
+//-----------------------------------------------------------------------------
+
+// Rd reads a UART register.
+func (d *UART) Rd(ofs, size uint) uint64 {
+	dlab := d.lcr&lcrDLAB != 0
+	var x uint8
+	switch ofs {
+	case uartRBR:
+		if dlab {
+			x = d.dll
+			break
+		}
+		if len(d.rx) == 0 {
+			d.read()
+		}
+		if len(d.rx) != 0 {
+			x = d.rx[0]
+			d.rx = d.rx[1:]
+			d.update()
+		}
+	case uartIER:
+		if dlab {
+			x = d.dlm
+		} else {
+			x = d.ier
+		}
+	case uartIIR:
+		x = d.iir()
+		if x&0xf == iirTHRE {
+			// reading the iir clears the thre interrupt
+			d.thrIP = false
+			d.update()
+		}
+	case uartLCR:
+		x = d.lcr
+	case uartMCR:
+		x = d.mcr
+	case uartLSR:
+		if len(d.rx) == 0 {
+			d.read()
+		}
+		x = lsrTHRE | lsrTEMT
+		if len(d.rx) != 0 {
+			x |= lsrDR
+		}
+	case uartMSR:
+		x = msrDCD | msrDSR | msrCTS
+	case uartSCR:
+		x = d.scr
+	}
+	return uint64(x)
+}
+
+// Wr writes a UART register.
+func (d *UART) Wr(ofs, size uint, val uint64) {
+	dlab := d.lcr&lcrDLAB != 0
+	x := uint8(val)
+	switch ofs {
+	case uartRBR:
+		if dlab {
+			d.dll = x
+			break
+		}
+		d.cfg.Console.Write([]byte{x})
+		d.thrIP = true
+	case uartIER:
+		if dlab {
+			d.dlm = x
+			break
+		}
+		if x&ierTHRE != 0 && d.ier&ierTHRE == 0 {
+			// the transmitter is empty
+			d.thrIP = true
+		}
+		d.ier = x & 0x0f
+	case uartIIR:
+		d.fcr = x
+		if x&fcrClrRx != 0 {
+			d.rx = nil
+		}
+	case uartLCR:
+		d.lcr = x
+	case uartMCR:
+		d.mcr = x
+	case uartSCR:
+		d.scr = x
+	}
+	d.update()
+}
+
+// DeviceNode returns the device tree node for the UART.
+func (d *UART) DeviceNode(t *fdt.Tree, base, size uint64) *fdt.Node {
+	n := fdt.NewNodeAt("serial", base).
+		String("compatible", "ns16550a").
+		U64("reg", base, size).
+		Cells("clock-frequency", uartClock)
+	d.cfg.IRQ.describe(t, n)
+	return n
+}
+
+//-----------------------------------------------------------------------------
+
+// uartState is the saved state of the UART.
+type uartState struct {
+	Rx                                []byte
+	IER, LCR, MCR, FCR, SCR, DLL, DLM uint8
+	ThrIP                             bool
+}
+
+// SaveState returns the UART state.
+func (d *UART) SaveState() ([]byte, error) {
+	return encodeState(&uartState{d.rx, d.ier, d.lcr, d.mcr, d.fcr, d.scr, d.dll, d.dlm, d.thrIP})
+}
+
+// RestoreState sets the UART state.
+// The interrupt line level is part of the PLIC state.
+func (d *UART) RestoreState(buf []byte) error {
+	var x uartState
+	err := decodeState(buf, &x)
+	if err != nil {
+		return err
+	}
+	d.rx = x.Rx
+	d.ier, d.lcr, d.mcr, d.fcr, d.scr, d.dll, d.dlm = x.IER, x.LCR, x.MCR, x.FCR, x.SCR, x.DLL, x.DLM
+	d.thrIP = x.ThrIP
+	return nil
+}
+
+//-----------------------------------------------------------------------------
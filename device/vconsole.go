@@ -0,0 +1,268 @@
+//-----------------------------------------------------------------------------
+/*
+
+VirtIO Console and Entropy Devices
+
+The virtio console has a single port (no multiport feature) connected to
+a host terminal. It is the hvc0 console of a Linux guest.
+
+The virtio entropy device fills the driver's buffers from a seeded
+deterministic generator, or from the host crypto/rand (logged as a
+nondeterministic input).
+
+*/
+//-----------------------------------------------------------------------------
+
+package device
+
+import (
+	crand "crypto/rand"
+	"math/rand"
+
+	"github.com/deadsy/riscv/replay"
+)
+
+//-----------------------------------------------------------------------------
+
+const (
+	consoleDeviceID = 3
+	consoleRxQueue  = 0 // port 0 receive queue
+	consoleTxQueue  = 1 // port 0 transmit queue
+	consoleRxMax    = 256
+	rngDeviceID     = 4
+	rngMax          = 4096 // maximum bytes per request
+)
+
+// VirtIOConsoleConfig is the virtio console configuration.
+type VirtIOConsoleConfig struct {
+	Console *Console    // host terminal (default os.Stdin and os.Stdout)
+	Inputs  *replay.Log // record/replay of nondeterministic inputs (optional)
+}
+
+// VirtIOConsole is a virtio console device.
+type VirtIOConsole struct {
+	cfg VirtIOConsoleConfig
+	rx  []byte // input waiting for a receive buffer
+}
+
+// NewVirtIOConsole returns a virtio console device.
+func NewVirtIOConsole(cfg VirtIOConsoleConfig) *VirtIOConsole {
+	if cfg.Console == nil {
+		cfg.Console = NewConsole(nil, nil)
+	}
+	return &VirtIOConsole{cfg: cfg}
+}
+
+// DeviceID returns the virtio device id.
+func (d *VirtIOConsole) DeviceID() uint32 {
+	return consoleDeviceID
+}
+
+// Features returns the device specific feature bits.
+func (d *VirtIOConsole) Features() uint64 {
+	return 0
+}
+
+// NumQueues returns the number of virtqueues.
+func (d *VirtIOConsole) NumQueues() int {
+	return 2
+}
+
+// ConfigRd reads the device configuration (no console size or ports).
+func (d *VirtIOConsole) ConfigRd(ofs, size uint) uint64 {
+	return 0
+}
+
+// ConfigWr writes the device configuration.
+func (d *VirtIOConsole) ConfigWr(ofs, size uint, val uint64) {
+}
+
+// Reset resets the device.
+func (d *VirtIOConsole) Reset() {
+	d.rx = nil
+}
+
+// SaveState returns the input waiting for a receive buffer.
+func (d *VirtIOConsole) SaveState() ([]byte, error) {
+	return append([]byte(nil), d.rx...), nil
+}
+
+// RestoreState sets the input waiting for a receive buffer.
+func (d *VirtIOConsole) RestoreState(buf []byte) error {
+	d.rx = append([]byte(nil), buf...)
+	return nil
+}
+
+// Notify processes the transmit queue, or delivers input to new receive buffers.
+func (d *VirtIOConsole) Notify(v *VirtIO, q int) {
+	if q == consoleRxQueue {
+		d.deliver(v)
+		return
+	}
+	for {
+		c, ok := v.Next(q)
+		if !ok {
+			return
+		}
+		buf, err := v.Read(c)
+		if err != nil {
+			v.Fail()
+			return
+		}
+		d.cfg.Console.Write(buf)
+		v.Used(q, c, 0)
+	}
+}
+
+// Poll checks for console input when there is a receive buffer.
+func (d *VirtIOConsole) Poll(v *VirtIO) {
+	if len(d.rx) == 0 && v.Available(consoleRxQueue) {
+		d.rx = d.cfg.Console.Input(d.cfg.Inputs, "virtio-console.rx", consoleRxMax)
+	}
+	d.deliver(v)
+}
+
+// deliver writes the waiting input to the receive buffers.
+func (d *VirtIOConsole) deliver(v *VirtIO) {
+	for len(d.rx) != 0 {
+		c, ok := v.Next(consoleRxQueue)
+		if !ok {
+			return
+		}
+		n := c.WriteLen()
+		if n > uint32(len(d.rx)) {
+			n = uint32(len(d.rx))
+		}
+		err := v.Write(c, d.rx[:n])
+		if err != nil {
+			v.Fail()
+			return
+		}
+		d.rx = d.rx[n:]
+		v.Used(consoleRxQueue, c, n)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// VirtIORNGConfig is the virtio entropy device configuration.
+type VirtIORNGConfig struct {
+	Seed   int64       // seed for a deterministic generator (0 = host crypto/rand)
+	Inputs *replay.Log // record/replay of nondeterministic inputs (optional)
+}
+
+// VirtIORNG is a virtio entropy device.
+type VirtIORNG struct {
+	cfg   VirtIORNGConfig
+	rand  *rand.Rand // deterministic generator (nil for crypto/rand)
+	drawn uint64     // bytes drawn from the deterministic generator
+}
+
+// NewVirtIORNG returns a virtio entropy device.
+func NewVirtIORNG(cfg VirtIORNGConfig) *VirtIORNG {
+	d := &VirtIORNG{cfg: cfg}
+	if cfg.Seed != 0 {
+		d.rand = rand.New(rand.NewSource(cfg.Seed))
+	}
+	return d
+}
+
+// DeviceID returns the virtio device id.
+func (d *VirtIORNG) DeviceID() uint32 {
+	return rngDeviceID
+}
+
+// Features returns the device specific feature bits.
+func (d *VirtIORNG) Features() uint64 {
+	return 0
+}
+
+// NumQueues returns the number of virtqueues.
+func (d *VirtIORNG) NumQueues() int {
+	return 1
+}
+
+// ConfigRd reads the device configuration (there is none).
+func (d *VirtIORNG) ConfigRd(ofs, size uint) uint64 {
+	return 0
+}
+
+// ConfigWr writes the device configuration.
+func (d *VirtIORNG) ConfigWr(ofs, size uint, val uint64) {
+}
+
+// Reset resets the device.
+func (d *VirtIORNG) Reset() {
+}
+
+// SaveState returns the number of bytes drawn from the deterministic generator.
+func (d *VirtIORNG) SaveState() ([]byte, error) {
+	return encodeState(d.drawn)
+}
+
+// RestoreState sets the deterministic generator to the saved position.
+// The generator state can't be saved, so it is re-seeded and advanced.
+func (d *VirtIORNG) RestoreState(buf []byte) error {
+	var drawn uint64
+	err := decodeState(buf, &drawn)
+	if err != nil {
+		return err
+	}
+	if d.rand == nil {
+		return nil
+	}
+	if drawn < d.drawn {
+		d.rand.Seed(d.cfg.Seed)
+		d.drawn = 0
+	}
+	skip := make([]byte, rngMax)
+	for d.drawn < drawn {
+		n := drawn - d.drawn
+		if n > rngMax {
+			n = rngMax
+		}
+		d.rand.Read(skip[:n])
+		d.drawn += n
+	}
+	return nil
+}
+
+// random returns n random bytes.
+func (d *VirtIORNG) random(n uint32) []byte {
+	buf := make([]byte, n)
+	if d.rand != nil {
+		d.rand.Read(buf)
+		d.drawn += uint64(n)
+		return buf
+	}
+	fn := func() []byte {
+		crand.Read(buf)
+		return buf
+	}
+	if d.cfg.Inputs != nil {
+		return d.cfg.Inputs.Bytes("virtio-rng", fn)
+	}
+	return fn()
+}
+
+// Notify fills the request buffers with random bytes.
+func (d *VirtIORNG) Notify(v *VirtIO, q int) {
+	for {
+		c, ok := v.Next(q)
+		if !ok {
+			return
+		}
+		n := c.WriteLen()
+		if n > rngMax {
+			n = rngMax
+		}
+		err := v.Write(c, d.random(n))
+		if err != nil {
+			v.Fail()
+			return
+		}
+		v.Used(q, c, n)
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,604 @@
+//-----------------------------------------------------------------------------
+/*
+
+VirtIO MMIO Transport
+
+A virtio device (E.g. a block device) is connected to the guest through a
+virtio-mmio (version 2) register region. The driver shares split
+virtqueues with the device in guest memory, and the device reads and
+writes the queues and buffers with physical memory accesses (DMA).
+
+See:
+
+https://docs.oasis-open.org/virtio/virtio/v1.1/virtio-v1.1.html
+
+*/
+//-----------------------------------------------------------------------------
+
+package device
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/deadsy/riscv/fdt"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+// VirtIO device addresses (as per the QEMU virt machine).
+const (
+	VirtIOBase   = 0x10001000 // base address of the first device
+	VirtIOStride = 0x1000     // address stride between devices
+	VirtIOIRQ    = 1          // irq of the first device
+	VirtIOSize   = 0x1000     // size of the register space
+)
+
+// virtio-mmio register offsets
+const (
+	vioMagic         = 0x000
+	vioVersion       = 0x004
+	vioDeviceID      = 0x008
+	vioVendorID      = 0x00c
+	vioDevFeatures   = 0x010
+	vioDevFeatSel    = 0x014
+	vioDrvFeatures   = 0x020
+	vioDrvFeatSel    = 0x024
+	vioQueueSel      = 0x030
+	vioQueueNumMax   = 0x034
+	vioQueueNum      = 0x038
+	vioQueueReady    = 0x044
+	vioQueueNotify   = 0x050
+	vioIntStatus     = 0x060
+	vioIntACK        = 0x064
+	vioStatus        = 0x070
+	vioQueueDescLo   = 0x080
+	vioQueueDescHi   = 0x084
+	vioQueueDriverLo = 0x090
+	vioQueueDriverHi = 0x094
+	vioQueueDeviceLo = 0x0a0
+	vioQueueDeviceHi = 0x0a4
+	vioConfigGen     = 0x0fc
+	vioConfig        = 0x100
+)
+
+const (
+	vioMagicValue     = 0x74726976 // "virt"
+	vioVendor         = 0x6d657672 // "rvem"
+	vioQueueMax       = 256        // maximum queue size
+	vioRequestMax     = 4 << 20    // maximum bytes in a descriptor chain
+	vioFeatureVersion = 1 << 32    // VIRTIO_F_VERSION_1
+	vioStatusFailed   = 0x80
+	vioNeedsReset     = 0x40
+	vioIntUsed        = 1 << 0 // used buffer notification
+	vioIntConfig      = 1 << 1 // configuration change notification
+	vringDescNext     = 1      // descriptor continues via the next field
+	vringDescWrite    = 2      // descriptor is device writable
+)
+
+//-----------------------------------------------------------------------------
+
+// VirtIOPoller is implemented by virtio devices with (nondeterministic)
+// input, they are polled periodically as the CPU runs.
+type VirtIOPoller interface {
+	Poll(v *VirtIO)
+}
+
+// VirtIODevice is a virtio device behind the virtio-mmio transport.
+// It should also implement mem.DeviceState to be saved with the transport.
+type VirtIODevice interface {
+	DeviceID() uint32                    // virtio device id
+	Features() uint64                    // device specific feature bits
+	NumQueues() int                      // number of virtqueues
+	ConfigRd(ofs, size uint) uint64      // read the device configuration
+	ConfigWr(ofs, size uint, val uint64) // write the device configuration
+	Notify(v *VirtIO, q int)             // the driver has made buffers available
+	Reset()                              // the driver has reset the device
+}
+
+// virtqueue is a split virtqueue.
+type virtqueue struct {
+	num       uint32 // queue size
+	ready     bool
+	desc      uint64 // descriptor table address
+	driver    uint64 // available ring address
+	device    uint64 // used ring address
+	lastAvail uint16 // next available ring entry to process
+}
+
+// VirtIO is a virtio-mmio transport.
+type VirtIO struct {
+	mem      *mem.Memory
+	dev      VirtIODevice
+	irq      *IRQ
+	queue    []virtqueue
+	queueSel uint32
+	devSel   uint32 // device features select
+	drvSel   uint32 // driver features select
+	driver   uint64 // driver features
+	status   uint32
+	intr     uint32 // interrupt status
+}
+
+// NewVirtIO returns a virtio-mmio transport for a device.
+// Memory is the guest physical memory for DMA.
+func NewVirtIO(m *mem.Memory, dev VirtIODevice, irq *IRQ) *VirtIO {
+	return &VirtIO{
+		mem:   m,
+		dev:   dev,
+		irq:   irq,
+		queue: make([]virtqueue, dev.NumQueues()),
+	}
+}
+
+// reset resets the transport and the device.
+func (v *VirtIO) reset() {
+	for i := range v.queue {
+		v.queue[i] = virtqueue{}
+	}
+	v.queueSel = 0
+	v.devSel = 0
+	v.drvSel = 0
+	v.driver = 0
+	v.status = 0
+	v.intr = 0
+	v.irq.Set(false)
+	v.dev.Reset()
+}
+
+// Reset resets the transport and the device.
+func (v *VirtIO) Reset() {
+	v.reset()
+}
+
+// Poll polls the device for input.
+func (v *VirtIO) Poll() {
+	if p, ok := v.dev.(VirtIOPoller); ok {
+		p.Poll(v)
+	}
+}
+
+// features returns the offered feature bits.
+func (v *VirtIO) features() uint64 {
+	return v.dev.Features() | vioFeatureVersion
+}
+
+// sel returns the selected queue (or nil).
+func (v *VirtIO) sel() *virtqueue {
+	if int(v.queueSel) < len(v.queue) {
+		return &v.queue[v.queueSel]
+	}
+	return nil
+}
+
+// Interrupt raises an interrupt (E.g. a configuration change).
+func (v *VirtIO) Interrupt(bits uint32) {
+	v.intr |= bits
+	v.irq.Set(v.intr != 0)
+}
+
+// Fail sets the needs reset status after a device error (E.g. a bad request).
+func (v *VirtIO) Fail() {
+	v.status |= vioNeedsReset
+	v.Interrupt(vioIntConfig)
+}
+
+//-----------------------------------------------------------------------------
+
+// Rd reads a virtio-mmio register.
+func (v *VirtIO) Rd(ofs, size uint) uint64 {
+	if ofs >= vioConfig {
+		return v.dev.ConfigRd(ofs-vioConfig, size)
+	}
+	q := v.sel()
+	var x uint32
+	switch ofs {
+	case vioMagic:
+		x = vioMagicValue
+	case vioVersion:
+		x = 2
+	case vioDeviceID:
+		x = v.dev.DeviceID()
+	case vioVendorID:
+		x = vioVendor
+	case vioDevFeatures:
+		if v.devSel < 2 {
+			x = uint32(v.features() >> (32 * v.devSel))
+		}
+	case vioQueueNumMax:
+		if q != nil {
+			x = vioQueueMax
+		}
+	case vioQueueReady:
+		if q != nil && q.ready {
+			x = 1
+		}
+	case vioIntStatus:
+		x = v.intr
+	case vioStatus:
+		x = v.status
+	case vioConfigGen:
+		x = 0
+	}
+	return uint64(x)
+}
+
+// Wr writes a virtio-mmio register.
+func (v *VirtIO) Wr(ofs, size uint, val uint64) {
+	if ofs >= vioConfig {
+		v.dev.ConfigWr(ofs-vioConfig, size, val)
+		return
+	}
+	x := uint32(val)
+	q := v.sel()
+	switch ofs {
+	case vioDevFeatSel:
+		v.devSel = x
+	case vioDrvFeatures:
+		if v.drvSel < 2 {
+			shift := 32 * v.drvSel
+			v.driver = v.driver&^(0xffffffff<<shift) | uint64(x)<<shift
+		}
+	case vioDrvFeatSel:
+		v.drvSel = x
+	case vioQueueSel:
+		v.queueSel = x
+	case vioQueueNotify:
+		if int(x) < len(v.queue) && v.queue[x].ready {
+			v.dev.Notify(v, int(x))
+		}
+	case vioIntACK:
+		v.intr &^= x
+		v.irq.Set(v.intr != 0)
+	case vioStatus:
+		if x == 0 {
+			v.reset()
+		} else {
+			v.status = x
+		}
+	}
+	if q == nil {
+		return
+	}
+	switch ofs {
+	case vioQueueNum:
+		if x != 0 && x <= vioQueueMax && x&(x-1) == 0 {
+			q.num = x
+		}
+	case vioQueueReady:
+		q.ready = x&1 != 0
+	case vioQueueDescLo:
+		q.desc = q.desc&^0xffffffff | uint64(x)
+	case vioQueueDescHi:
+		q.desc = q.desc&0xffffffff | uint64(x)<<32
+	case vioQueueDriverLo:
+		q.driver = q.driver&^0xffffffff | uint64(x)
+	case vioQueueDriverHi:
+		q.driver = q.driver&0xffffffff | uint64(x)<<32
+	case vioQueueDeviceLo:
+		q.device = q.device&^0xffffffff | uint64(x)
+	case vioQueueDeviceHi:
+		q.device = q.device&0xffffffff | uint64(x)<<32
+	}
+}
+
+// DeviceNode returns the device tree node for the virtio-mmio transport.
+func (v *VirtIO) DeviceNode(t *fdt.Tree, base, size uint64) *fdt.Node {
+	n := fdt.NewNodeAt("virtio_mmio", base).
+		String("compatible", "virtio,mmio").
+		U64("reg", base, size)
+	v.irq.describe(t, n)
+	return n
+}
+
+//-----------------------------------------------------------------------------
+// DMA
+
+// dmaCheck checks a guest physical memory buffer before it is accessed.
+// The length is guest controlled, so it is bounded before we allocate for it.
+func (v *VirtIO) dmaCheck(pa uint64, n uint32) error {
+	if n > vioRequestMax {
+		return fmt.Errorf("dma length %d is too big", n)
+	}
+	if n != 0 && !v.mem.Mapped(uint(pa), uint(n)) {
+		return fmt.Errorf("dma buffer %x (%d bytes) is not mapped", pa, n)
+	}
+	return nil
+}
+
+// dmaRd reads a buffer from guest physical memory.
+func (v *VirtIO) dmaRd(pa uint64, n uint32) ([]byte, error) {
+	err := v.dmaCheck(pa, n)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	for i := uint32(0); i < n; {
+		adr := uint(pa) + uint(i)
+		if adr&7 == 0 && n-i >= 8 {
+			x, err := v.mem.Rd64Phys(adr)
+			if err != nil {
+				return nil, err
+			}
+			binary.LittleEndian.PutUint64(buf[i:], x)
+			i += 8
+			continue
+		}
+		x, err := v.mem.Rd8Phys(adr)
+		if err != nil {
+			return nil, err
+		}
+		buf[i] = x
+		i++
+	}
+	return buf, nil
+}
+
+// dmaWr writes a buffer to guest physical memory.
+func (v *VirtIO) dmaWr(pa uint64, buf []byte) error {
+	n := uint32(len(buf))
+	for i := uint32(0); i < n; {
+		adr := uint(pa) + uint(i)
+		if adr&7 == 0 && n-i >= 8 {
+			err := v.mem.Wr64Phys(adr, binary.LittleEndian.Uint64(buf[i:]))
+			if err != nil {
+				return err
+			}
+			i += 8
+			continue
+		}
+		err := v.mem.Wr8Phys(adr, buf[i])
+		if err != nil {
+			return err
+		}
+		i++
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// Virtqueues
+
+// vdesc is a virtqueue descriptor.
+type vdesc struct {
+	addr  uint64
+	len   uint32
+	write bool // device writable
+}
+
+// Chain is a descriptor chain taken from a virtqueue.
+type Chain struct {
+	head uint16
+	desc []vdesc
+}
+
+// ReadLen returns the length of the device readable buffers.
+func (c *Chain) ReadLen() uint32 {
+	var n uint32
+	for _, d := range c.desc {
+		if !d.write {
+			n += d.len
+		}
+	}
+	return n
+}
+
+// WriteLen returns the length of the device writable buffers.
+func (c *Chain) WriteLen() uint32 {
+	var n uint32
+	for _, d := range c.desc {
+		if d.write {
+			n += d.len
+		}
+	}
+	return n
+}
+
+// Available returns true if a descriptor chain is available on a queue.
+func (v *VirtIO) Available(qn int) bool {
+	q := &v.queue[qn]
+	if !q.ready || q.num == 0 || v.status&vioNeedsReset != 0 {
+		return false
+	}
+	idx, err := v.mem.Rd16Phys(uint(q.driver + 2))
+	return err == nil && idx != q.lastAvail
+}
+
+// Next takes the next available descriptor chain from a queue.
+func (v *VirtIO) Next(qn int) (*Chain, bool) {
+	q := &v.queue[qn]
+	if !q.ready || q.num == 0 || v.status&vioNeedsReset != 0 {
+		return nil, false
+	}
+	idx, err := v.mem.Rd16Phys(uint(q.driver + 2))
+	if err != nil {
+		v.Fail()
+		return nil, false
+	}
+	if idx == q.lastAvail {
+		return nil, false
+	}
+	head, err := v.mem.Rd16Phys(uint(q.driver + 4 + 2*uint64(uint32(q.lastAvail)%q.num)))
+	if err != nil {
+		v.Fail()
+		return nil, false
+	}
+	q.lastAvail++
+	c, err := v.chain(q, head)
+	if err != nil {
+		v.Fail()
+		return nil, false
+	}
+	return c, true
+}
+
+// chain reads a descriptor chain.
+func (v *VirtIO) chain(q *virtqueue, head uint16) (*Chain, error) {
+	c := &Chain{head: head}
+	i := uint32(head)
+	var total uint64
+	for n := uint32(0); ; n++ {
+		if i >= q.num || n >= q.num {
+			return nil, fmt.Errorf("bad descriptor chain")
+		}
+		buf, err := v.dmaRd(q.desc+16*uint64(i), 16)
+		if err != nil {
+			return nil, err
+		}
+		d := vdesc{
+			addr:  binary.LittleEndian.Uint64(buf[0:]),
+			len:   binary.LittleEndian.Uint32(buf[8:]),
+			write: buf[12]&vringDescWrite != 0,
+		}
+		total += uint64(d.len)
+		if total > vioRequestMax {
+			return nil, fmt.Errorf("descriptor chain is too long")
+		}
+		err = v.dmaCheck(d.addr, d.len)
+		if err != nil {
+			return nil, err
+		}
+		c.desc = append(c.desc, d)
+		if buf[12]&vringDescNext == 0 {
+			break
+		}
+		i = uint32(binary.LittleEndian.Uint16(buf[14:]))
+	}
+	return c, nil
+}
+
+// Read returns the contents of the device readable buffers of a chain.
+func (v *VirtIO) Read(c *Chain) ([]byte, error) {
+	buf := []byte{}
+	for _, d := range c.desc {
+		if d.write {
+			continue
+		}
+		x, err := v.dmaRd(d.addr, d.len)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, x...)
+	}
+	return buf, nil
+}
+
+// Write writes to the device writable buffers of a chain.
+func (v *VirtIO) Write(c *Chain, buf []byte) error {
+	for _, d := range c.desc {
+		if len(buf) == 0 {
+			break
+		}
+		if !d.write {
+			continue
+		}
+		n := d.len
+		if uint32(len(buf)) < n {
+			n = uint32(len(buf))
+		}
+		err := v.dmaWr(d.addr, buf[:n])
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	if len(buf) != 0 {
+		return fmt.Errorf("descriptor chain is too short")
+	}
+	return nil
+}
+
+// Used returns a descriptor chain to the driver with the number of bytes
+// written to it, and notifies the driver.
+func (v *VirtIO) Used(qn int, c *Chain, n uint32) {
+	q := &v.queue[qn]
+	idx, err := v.mem.Rd16Phys(uint(q.device + 2))
+	if err != nil {
+		v.Fail()
+		return
+	}
+	elem := q.device + 4 + 8*uint64(uint32(idx)%q.num)
+	if v.mem.Wr32Phys(uint(elem), uint32(c.head)) != nil ||
+		v.mem.Wr32Phys(uint(elem+4), n) != nil ||
+		v.mem.Wr16Phys(uint(q.device+2), idx+1) != nil {
+		v.Fail()
+		return
+	}
+	v.Interrupt(vioIntUsed)
+}
+
+//-----------------------------------------------------------------------------
+
+// virtqueueState is the saved state of a virtqueue.
+type virtqueueState struct {
+	Num                  uint32
+	Ready                bool
+	Desc, Driver, Device uint64
+	LastAvail            uint16
+}
+
+// virtioState is the saved state of a virtio-mmio transport and its device.
+type virtioState struct {
+	Queue            []virtqueueState
+	QueueSel, DevSel uint32
+	DrvSel           uint32
+	Driver           uint64
+	Status, Intr     uint32
+	Dev              []byte
+}
+
+// SaveState returns the transport and device state.
+func (v *VirtIO) SaveState() ([]byte, error) {
+	ds, ok := v.dev.(mem.DeviceState)
+	if !ok {
+		return nil, fmt.Errorf("virtio device %d state can't be saved", v.dev.DeviceID())
+	}
+	dev, err := ds.SaveState()
+	if err != nil {
+		return nil, err
+	}
+	x := &virtioState{
+		QueueSel: v.queueSel,
+		DevSel:   v.devSel,
+		DrvSel:   v.drvSel,
+		Driver:   v.driver,
+		Status:   v.status,
+		Intr:     v.intr,
+		Dev:      dev,
+	}
+	for _, q := range v.queue {
+		x.Queue = append(x.Queue, virtqueueState{q.num, q.ready, q.desc, q.driver, q.device, q.lastAvail})
+	}
+	return encodeState(x)
+}
+
+// RestoreState sets the transport and device state.
+// The interrupt line level is part of the PLIC state.
+func (v *VirtIO) RestoreState(buf []byte) error {
+	ds, ok := v.dev.(mem.DeviceState)
+	if !ok {
+		return fmt.Errorf("virtio device %d state can't be restored", v.dev.DeviceID())
+	}
+	var x virtioState
+	err := decodeState(buf, &x)
+	if err != nil {
+		return err
+	}
+	if len(x.Queue) != len(v.queue) {
+		return fmt.Errorf("virtio state has %d queues, expected %d", len(x.Queue), len(v.queue))
+	}
+	err = ds.RestoreState(x.Dev)
+	if err != nil {
+		return err
+	}
+	for i, q := range x.Queue {
+		v.queue[i] = virtqueue{q.Num, q.Ready, q.Desc, q.Driver, q.Device, q.LastAvail}
+	}
+	v.queueSel, v.devSel, v.drvSel = x.QueueSel, x.DevSel, x.DrvSel
+	v.driver = x.Driver
+	v.status, v.intr = x.Status, x.Intr
+	return nil
+}
+
+//-----------------------------------------------------------------------------
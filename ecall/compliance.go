@@ -30,8 +30,7 @@ func NewCompliance() *Compliance {
 
 // Call is an ecall.
 func (c *Compliance) Call(m *rv.RV) error {
-	//return m.Exit(m.X[rv.RegGp])
-	return nil
+	return m.Exit(int(m.RdX(rv.RegGp)))
 }
 
 //-----------------------------------------------------------------------------
@@ -0,0 +1,253 @@
+//-----------------------------------------------------------------------------
+/*
+
+Linux User Mode Program Loading
+
+A statically linked Linux executable is loaded into memory and started
+in user mode with an initial stack of argc, argv, envp and the auxiliary
+vector, as set up by the kernel's execve().
+
+See:
+
+linux/fs/binfmt_elf.c
+linux/include/uapi/linux/auxvec.h
+
+*/
+//-----------------------------------------------------------------------------
+
+package ecall
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// auxiliary vector types
+const (
+	atNull   = 0
+	atPhdr   = 3
+	atPhent  = 4
+	atPhnum  = 5
+	atPagesz = 6
+	atBase   = 7
+	atFlags  = 8
+	atEntry  = 9
+	atUID    = 11
+	atEUID   = 12
+	atGID    = 13
+	atEGID   = 14
+	atHwcap  = 16
+	atClktck = 17
+	atSecure = 23
+	atRandom = 25
+	atExecfn = 31
+)
+
+const (
+	stackSize = 8 << 20  // user stack size
+	brkSize   = 64 << 20 // maximum heap size
+)
+
+// image is a loaded program image.
+type image struct {
+	name  string
+	entry uint
+	phdr  uint // address of the program headers
+	phent uint // program header entry size
+	phnum uint // number of program headers
+	end   uint // end of the loaded segments
+}
+
+//-----------------------------------------------------------------------------
+
+// Load loads a static Linux executable into memory.
+func (sc *Syscall) Load(m *rv.RV, filename string) (string, error) {
+	class := elf.ELFCLASS64
+	if m.Xlen() == 32 {
+		class = elf.ELFCLASS32
+	}
+	status, err := m.Mem.LoadELF(filename, class)
+	if err != nil {
+		return "", err
+	}
+	f, err := elf.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+
+	// program header location from the raw ELF header
+	hdrSize := 64
+	if class == elf.ELFCLASS32 {
+		hdrSize = 52
+	}
+	if len(buf) < hdrSize {
+		return "", fmt.Errorf("%s has a short ELF header", filename)
+	}
+	var phoff uint64
+	img := &image{name: filename, entry: uint(f.Entry)}
+	if class == elf.ELFCLASS32 {
+		phoff = uint64(binary.LittleEndian.Uint32(buf[0x1c:]))
+		img.phent = uint(binary.LittleEndian.Uint16(buf[0x2a:]))
+		img.phnum = uint(binary.LittleEndian.Uint16(buf[0x2c:]))
+	} else {
+		phoff = binary.LittleEndian.Uint64(buf[0x20:])
+		img.phent = uint(binary.LittleEndian.Uint16(buf[0x36:]))
+		img.phnum = uint(binary.LittleEndian.Uint16(buf[0x38:]))
+	}
+
+	for _, p := range f.Progs {
+		switch p.Type {
+		case elf.PT_PHDR:
+			img.phdr = uint(p.Vaddr)
+		case elf.PT_LOAD:
+			if p.Off == 0 && img.phdr == 0 {
+				img.phdr = uint(p.Vaddr + phoff)
+			}
+			if end := uint(p.Vaddr + p.Memsz); end > img.end {
+				img.end = end
+			}
+		}
+	}
+	if img.end == 0 {
+		return "", fmt.Errorf("%s has no loadable segments", filename)
+	}
+
+	// make sure the program headers are in memory (AT_PHDR)
+	size := img.phent * img.phnum
+	if phoff > uint64(len(buf)) || uint64(size) > uint64(len(buf))-phoff {
+		return "", fmt.Errorf("%s program headers are outside the file", filename)
+	}
+	if img.phdr == 0 || m.Mem.GetSectionName(img.phdr) == m.Mem.GetSectionName(0) {
+		img.phdr = (img.end + pageSize - 1) &^ (pageSize - 1)
+		img.end = img.phdr + size
+		m.Mem.Add(mem.NewSection("phdr", img.phdr, size, mem.AttrR))
+		err := m.Mem.Patch(img.phdr, buf[phoff:phoff+uint64(size)])
+		if err != nil {
+			return "", err
+		}
+	}
+
+	sc.img = img
+	return status, nil
+}
+
+//-----------------------------------------------------------------------------
+
+// stack builds the initial process stack.
+type stack struct {
+	m   *rv.RV
+	sp  uint
+	err error
+}
+
+func (s *stack) push(buf []byte) uint {
+	s.sp -= uint(len(buf))
+	if !guest(s.m).WrBuf(uint64(s.sp), buf) && s.err == nil {
+		s.err = fmt.Errorf("stack overflow at %x", s.sp)
+	}
+	return s.sp
+}
+
+func (s *stack) pushString(str string) uint {
+	return s.push(append([]byte(str), 0))
+}
+
+//-----------------------------------------------------------------------------
+
+// Start sets up the initial stack, heap and registers for a loaded
+// program and puts the cpu in user mode at the program entry point.
+func (sc *Syscall) Start(m *rv.RV, args []string) error {
+	img := sc.img
+	if img == nil {
+		return fmt.Errorf("no program has been loaded")
+	}
+
+	// heap
+	sc.brkMin = (img.end + pageSize - 1) &^ (pageSize - 1)
+	sc.brk = sc.brkMin
+	sc.brkMax = sc.brkMin + brkSize
+	m.Mem.Add(mem.NewSection("brk", sc.brkMin, brkSize, mem.AttrRW))
+
+	// stack
+	top := uint(0x3ffffff000)
+	if m.Xlen() == 32 {
+		top = 0x80000000
+	}
+	m.Mem.Add(mem.NewSection("stack", top-stackSize, stackSize, mem.AttrRW))
+	sc.mmapTop = top - stackSize - pageSize
+
+	// strings and random bytes
+	s := &stack{m: m, sp: top}
+	execfn := s.pushString(img.name)
+	argv := []uint{}
+	for _, a := range args {
+		argv = append(argv, s.pushString(a))
+	}
+	envp := []uint{}
+	for _, e := range sc.cfg.Env {
+		envp = append(envp, s.pushString(e))
+	}
+	random := s.push(sc.random(16))
+
+	// auxiliary vector
+	hwcap, _ := m.CSR.DebugRd(0x301) // misa
+	auxv := [][2]uint{
+		{atPhdr, img.phdr},
+		{atPhent, img.phent},
+		{atPhnum, img.phnum},
+		{atPagesz, pageSize},
+		{atBase, 0},
+		{atFlags, 0},
+		{atEntry, img.entry},
+		{atUID, 0},
+		{atEUID, 0},
+		{atGID, 0},
+		{atEGID, 0},
+		{atHwcap, uint(hwcap) & 0x3ffffff},
+		{atClktck, 100},
+		{atSecure, 0},
+		{atRandom, random},
+		{atExecfn, execfn},
+		{atNull, 0},
+	}
+
+	// argc, argv, envp and auxv
+	size := int(m.Xlen() >> 3)
+	buf := le(nil, uint64(len(argv)), size)
+	for _, a := range argv {
+		buf = le(buf, uint64(a), size)
+	}
+	buf = le(buf, 0, size)
+	for _, e := range envp {
+		buf = le(buf, uint64(e), size)
+	}
+	buf = le(buf, 0, size)
+	for _, a := range auxv {
+		buf = le(le(buf, uint64(a[0]), size), uint64(a[1]), size)
+	}
+	s.sp = (s.sp - uint(len(buf))) &^ 15
+	guest(m).WrBuf(uint64(s.sp), buf)
+	if s.err != nil {
+		return s.err
+	}
+
+	m.WrX(rv.RegSp, uint64(s.sp))
+	m.PC = uint64(img.entry)
+	m.CSR.SetMode(csr.ModeU)
+	return nil
+}
+
+//-----------------------------------------------------------------------------
@@ -11,33 +11,821 @@ glibc/sysdeps/unix/sysv/linux/riscv/sysdep.h
 glibc passes the syscall number in a7.
 Syscall arguments are passed in a0..a6.
 The syscall return value is passed in a0.
+A failed syscall returns -errno.
+
+File operations are confined to a sandbox root directory. Absolute and
+relative paths are relative to the root directory and can't escape it
+(see hostcall).
+
+Nondeterministic inputs (file/console reads, clocks and random numbers)
+go through the record/replay log (if there is one).
 
 */
 //-----------------------------------------------------------------------------
 
 package ecall
 
-import "github.com/deadsy/riscv/rv"
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/deadsy/riscv/device"
+	"github.com/deadsy/riscv/hostcall"
+	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/replay"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// Linux errno values.
+const (
+	ePERM   = 1
+	eNOENT  = 2
+	eIO     = 5
+	eBADF   = 9
+	eNOMEM  = 12
+	eACCES  = 13
+	eFAULT  = 14
+	eEXIST  = 17
+	eNOTDIR = 20
+	eISDIR  = 21
+	eINVAL  = 22
+	eNOTTY  = 25
+	eSPIPE  = 29
+	eNOSYS  = 38
+)
+
+// Linux open flags.
+const (
+	oWRONLY = 01
+	oRDWR   = 02
+	oCREAT  = 0100
+	oEXCL   = 0200
+	oTRUNC  = 01000
+	oAPPEND = 02000
+)
+
+// Linux mmap flags.
+const (
+	mapFixed     = 0x10
+	mapAnonymous = 0x20
+)
+
+// Linux file types (st_mode).
+const (
+	sIFCHR = 0020000
+	sIFDIR = 0040000
+	sIFREG = 0100000
+)
+
+const pageSize = 4096
+
+// iovMax is the maximum number of iovec entries (IOV_MAX).
+const iovMax = 1024
+
+// mmapMax is the maximum size of a mapping.
+const mmapMax = 256 << 20
+
+//-----------------------------------------------------------------------------
+
+// Config is the Linux user emulation configuration.
+type Config struct {
+	Root    string          // sandbox root directory for files ("" = no file access)
+	Env     []string        // environment variables (name=value)
+	Console *device.Console // console (default os.Stdin and os.Stdout)
+	Stderr  io.Writer       // console error output (default os.Stderr)
+	Inputs  *replay.Log     // record/replay of nondeterministic inputs (optional)
+}
+
+// fdesc is an open file descriptor.
+type fdesc struct {
+	f  *os.File  // host file (nil for the console)
+	rd io.Reader // console input
+	wr io.Writer // console output
+}
+
+// Syscall is a syscall ecall object.
+type Syscall struct {
+	cfg     Config
+	fd      map[int]*fdesc // open file descriptors
+	brkMin  uint           // initial program break
+	brk     uint           // current program break
+	brkMax  uint           // maximum program break
+	mmapTop uint           // anonymous mappings are allocated below this address
+	start   time.Time      // start time for the monotonic clock
+	img     *image         // loaded program image
+	warned  map[uint]bool  // unimplemented syscalls that have been reported
+}
+
+// NewSyscall returns a syscall ecall object.
+func NewSyscall(cfg Config) *Syscall {
+	if cfg.Console == nil {
+		cfg.Console = device.NewConsole(nil, nil)
+	}
+	if cfg.Stderr == nil {
+		cfg.Stderr = os.Stderr
+	}
+	return &Syscall{
+		cfg: cfg,
+		fd: map[int]*fdesc{
+			0: {rd: cfg.Console.Reader()},
+			1: {wr: cfg.Console.Writer()},
+			2: {wr: cfg.Stderr},
+		},
+		start:  time.Now(),
+		warned: map[uint]bool{},
+	}
+}
+
+//-----------------------------------------------------------------------------
+// helpers
+
+// arg returns the n-th syscall argument.
+func arg(m *rv.RV, n uint) uint64 {
+	return m.RdX(rv.RegA0 + n)
+}
+
+// sarg returns the n-th syscall argument as a signed integer.
+func sarg(m *rv.RV, n uint) int64 {
+	x := arg(m, n)
+	if m.Xlen() == 32 {
+		return int64(int32(x))
+	}
+	return int64(x)
+}
+
+// errno returns the -errno syscall return value for a host error.
+func errno(err error) int64 {
+	return -int64(hostcall.Errno(err))
+}
+
+// guest returns the target memory access for a syscall.
+func guest(m *rv.RV) *hostcall.Memory {
+	return hostcall.NewMemory(m.Mem, true)
+}
+
+// le appends a little endian value to a buffer.
+func le(buf []byte, val uint64, size int) []byte {
+	for i := 0; i < size; i++ {
+		buf = append(buf, byte(val>>(8*uint(i))))
+	}
+	return buf
+}
+
+// path returns the host path for a file name in the sandbox.
+func (sc *Syscall) path(name string) (string, int64) {
+	path, err := hostcall.Path(sc.cfg.Root, name)
+	if err != nil {
+		return "", errno(err)
+	}
+	return path, 0
+}
+
+// getFd returns the file for a file descriptor.
+func (sc *Syscall) getFd(m *rv.RV, n uint) (*fdesc, int64) {
+	x, ok := sc.fd[int(sarg(m, n))]
+	if !ok {
+		return nil, -eBADF
+	}
+	return x, 0
+}
+
+// newFd returns a file descriptor for an open file.
+func (sc *Syscall) newFd(x *fdesc) int64 {
+	n := 0
+	for {
+		if _, ok := sc.fd[n]; !ok {
+			sc.fd[n] = x
+			return int64(n)
+		}
+		n++
+	}
+}
+
+// input returns the data and return code of a host file operation
+// (a nondeterministic input).
+func (sc *Syscall) input(src string, fn func() ([]byte, int64)) ([]byte, int64) {
+	return hostcall.Input(sc.cfg.Inputs, src, fn)
+}
+
+// read reads from a file.
+func (sc *Syscall) read(x *fdesc, n uint64) ([]byte, int64) {
+	return sc.input("syscall.read", func() ([]byte, int64) {
+		buf := make([]byte, n)
+		var k int
+		var err error
+		if x.f != nil {
+			k, err = x.f.Read(buf)
+		} else if x.rd != nil {
+			k, err = x.rd.Read(buf)
+		} else {
+			return nil, -eBADF
+		}
+		if err != nil && err != io.EOF {
+			return nil, errno(err)
+		}
+		return buf[:k], 0
+	})
+}
+
+// write writes to a file.
+func (sc *Syscall) write(x *fdesc, buf []byte) int64 {
+	var n int
+	var err error
+	if x.f != nil {
+		n, err = x.f.Write(buf)
+	} else if x.wr != nil {
+		n, err = x.wr.Write(buf)
+	} else {
+		return -eBADF
+	}
+	if err != nil && n == 0 {
+		return errno(err)
+	}
+	return int64(n)
+}
+
+// iovec returns the (address, length) pairs of an iovec array.
+// The total length is limited to hostcall.MaxIO (a short read or write).
+func iovec(m *rv.RV, adr, n uint64) ([][2]uint64, int64) {
+	if n > iovMax {
+		return nil, -eINVAL
+	}
+	size := uint64(m.Xlen() >> 3)
+	iov := [][2]uint64{}
+	total := uint64(0)
+	for i := uint64(0); i < n; i++ {
+		base, ok0 := guest(m).RdWord(adr+2*i*size, int(size))
+		l, ok1 := guest(m).RdWord(adr+(2*i+1)*size, int(size))
+		if !ok0 || !ok1 {
+			return nil, -eFAULT
+		}
+		if l > hostcall.MaxIO-total {
+			l = hostcall.MaxIO - total
+		}
+		total += l
+		iov = append(iov, [2]uint64{base, l})
+	}
+	return iov, 0
+}
+
+// clock returns a nondeterministic clock value (nanoseconds).
+func (sc *Syscall) clock(src string, fn func() uint64) uint64 {
+	return hostcall.Clock(sc.cfg.Inputs, src, fn)
+}
+
+// random returns nondeterministic random bytes.
+func (sc *Syscall) random(n int) []byte {
+	fn := func() []byte {
+		buf := make([]byte, n)
+		rand.Read(buf)
+		return buf
+	}
+	if sc.cfg.Inputs != nil {
+		return sc.cfg.Inputs.Bytes("syscall.random", fn)
+	}
+	return fn()
+}
+
+// clockNanos returns the time (nanoseconds) for a clock id.
+func (sc *Syscall) clockNanos(id uint64) uint64 {
+	if id == 0 {
+		// CLOCK_REALTIME
+		return sc.clock("syscall.realtime", func() uint64 { return uint64(time.Now().UnixNano()) })
+	}
+	// monotonic, process and thread clocks
+	return sc.clock("syscall.monotonic", func() uint64 { return uint64(time.Since(sc.start)) })
+}
+
+//-----------------------------------------------------------------------------
+// file status
+
+// stat is the host independent file status.
+type stat struct {
+	mode  uint32
+	size  int64
+	mtime time.Time
+}
+
+// fileStat returns the file status for a file.
+func fileStat(x *fdesc) (*stat, int64) {
+	if x.f == nil {
+		return &stat{mode: sIFCHR | 0620}, 0
+	}
+	fi, err := x.f.Stat()
+	if err != nil {
+		return nil, errno(err)
+	}
+	return newStat(fi), 0
+}
+
+// bytes returns the file status as a replay log record.
+func (st *stat) bytes() []byte {
+	return le(le(le(nil, uint64(st.mode), 4), uint64(st.size), 8), uint64(st.mtime.UnixNano()), 8)
+}
+
+// statInput returns the file status from a host stat function (a nondeterministic input).
+func (sc *Syscall) statInput(fn func() (*stat, int64)) (*stat, int64) {
+	buf, rc := sc.input("syscall.stat", func() ([]byte, int64) {
+		st, rc := fn()
+		if st == nil {
+			return nil, rc
+		}
+		return st.bytes(), 0
+	})
+	if rc != 0 {
+		return nil, rc
+	}
+	if len(buf) != 20 {
+		return nil, -eIO
+	}
+	return &stat{
+		mode:  binary.LittleEndian.Uint32(buf[0:]),
+		size:  int64(binary.LittleEndian.Uint64(buf[4:])),
+		mtime: time.Unix(0, int64(binary.LittleEndian.Uint64(buf[12:]))),
+	}, 0
+}
+
+// newStat returns the file status for host file information.
+func newStat(fi os.FileInfo) *stat {
+	mode := uint32(fi.Mode().Perm())
+	if fi.IsDir() {
+		mode |= sIFDIR
+	} else {
+		mode |= sIFREG
+	}
+	return &stat{mode: mode, size: fi.Size(), mtime: fi.ModTime()}
+}
+
+// wrStat writes a struct stat (asm-generic layout).
+func wrStat(m *rv.RV, adr uint64, st *stat) int64 {
+	t := uint64(st.mtime.Unix())
+	ns := uint64(st.mtime.Nanosecond())
+	buf := []byte{}
+	buf = le(buf, 0, 8)                         // st_dev
+	buf = le(buf, 0, 8)                         // st_ino
+	buf = le(buf, uint64(st.mode), 4)           // st_mode
+	buf = le(buf, 1, 4)                         // st_nlink
+	buf = le(buf, 0, 4)                         // st_uid
+	buf = le(buf, 0, 4)                         // st_gid
+	buf = le(buf, 0, 8)                         // st_rdev
+	buf = le(buf, 0, 8)                         // __pad1
+	buf = le(buf, uint64(st.size), 8)           // st_size
+	buf = le(buf, pageSize, 4)                  // st_blksize
+	buf = le(buf, 0, 4)                         // __pad2
+	buf = le(buf, uint64((st.size+511)/512), 8) // st_blocks
+	buf = le(le(buf, t, 8), ns, 8)              // st_atime
+	buf = le(le(buf, t, 8), ns, 8)              // st_mtime
+	buf = le(le(buf, t, 8), ns, 8)              // st_ctime
+	buf = le(buf, 0, 8)                         // __unused
+	if !guest(m).WrBuf(adr, buf) {
+		return -eFAULT
+	}
+	return 0
+}
+
+// wrStatx writes a struct statx.
+func wrStatx(m *rv.RV, adr uint64, st *stat) int64 {
+	t := uint64(st.mtime.Unix())
+	ns := uint64(st.mtime.Nanosecond())
+	buf := []byte{}
+	buf = le(buf, 0x7ff, 4)                     // stx_mask (STATX_BASIC_STATS)
+	buf = le(buf, pageSize, 4)                  // stx_blksize
+	buf = le(buf, 0, 8)                         // stx_attributes
+	buf = le(buf, 1, 4)                         // stx_nlink
+	buf = le(buf, 0, 4)                         // stx_uid
+	buf = le(buf, 0, 4)                         // stx_gid
+	buf = le(buf, uint64(st.mode), 2)           // stx_mode
+	buf = le(buf, 0, 2)                         // __spare0
+	buf = le(buf, 0, 8)                         // stx_ino
+	buf = le(buf, uint64(st.size), 8)           // stx_size
+	buf = le(buf, uint64((st.size+511)/512), 8) // stx_blocks
+	buf = le(buf, 0, 8)                         // stx_attributes_mask
+	for i := 0; i < 4; i++ {
+		// stx_atime, stx_btime, stx_ctime, stx_mtime
+		buf = le(le(le(buf, t, 8), ns, 4), 0, 4)
+	}
+	for len(buf) < 256 {
+		buf = append(buf, 0)
+	}
+	if !guest(m).WrBuf(adr, buf) {
+		return -eFAULT
+	}
+	return 0
+}
 
 //-----------------------------------------------------------------------------
 // system calls
 
-func sc_close(m *rv.RV) error {
-	return nil
+func (sc *Syscall) scOpenat(m *rv.RV) (int64, error) {
+	name, ok := guest(m).RdString(arg(m, 1))
+	if !ok {
+		return -eFAULT, nil
+	}
+	path, rc := sc.path(name)
+	if rc != 0 {
+		return rc, nil
+	}
+	flags := arg(m, 2)
+	oflags := os.O_RDONLY
+	switch flags & 3 {
+	case oWRONLY:
+		oflags = os.O_WRONLY
+	case oRDWR:
+		oflags = os.O_RDWR
+	}
+	if flags&oCREAT != 0 {
+		oflags |= os.O_CREATE
+	}
+	if flags&oEXCL != 0 {
+		oflags |= os.O_EXCL
+	}
+	if flags&oTRUNC != 0 {
+		oflags |= os.O_TRUNC
+	}
+	if flags&oAPPEND != 0 {
+		oflags |= os.O_APPEND
+	}
+	var f *os.File
+	_, rc = sc.input("syscall.openat", func() ([]byte, int64) {
+		var err error
+		f, err = os.OpenFile(path, oflags, os.FileMode(arg(m, 3)&0777))
+		if err != nil {
+			return nil, errno(err)
+		}
+		return nil, 0
+	})
+	if rc != 0 {
+		return rc, nil
+	}
+	if f == nil {
+		// replayed open, the file reads are replayed and writes are discarded
+		return sc.newFd(&fdesc{wr: ioutil.Discard}), nil
+	}
+	return sc.newFd(&fdesc{f: f}), nil
 }
 
-func sc_fstat(m *rv.RV) error {
-	return nil
+func (sc *Syscall) scClose(m *rv.RV) (int64, error) {
+	x, rc := sc.getFd(m, 0)
+	if x == nil {
+		return rc, nil
+	}
+	delete(sc.fd, int(sarg(m, 0)))
+	if x.f != nil {
+		err := x.f.Close()
+		if err != nil {
+			return errno(err), nil
+		}
+	}
+	return 0, nil
 }
 
-func sc_exit(m *rv.RV) error {
-	//return m.Exit(0)
-	return nil
+func (sc *Syscall) scLseek(m *rv.RV) (int64, error) {
+	x, rc := sc.getFd(m, 0)
+	if x == nil {
+		return rc, nil
+	}
+	seek := func(ofs int64, whence int) int64 {
+		_, pos := sc.input("syscall.lseek", func() ([]byte, int64) {
+			if x.f == nil {
+				return nil, -eSPIPE
+			}
+			pos, err := x.f.Seek(ofs, whence)
+			if err != nil {
+				return nil, errno(err)
+			}
+			return nil, pos
+		})
+		return pos
+	}
+	if m.Xlen() == 32 {
+		// llseek(fd, offset_hi, offset_lo, *result, whence)
+		pos := seek(int64(arg(m, 1)<<32|arg(m, 2)), int(arg(m, 4)))
+		if pos < 0 {
+			return pos, nil
+		}
+		if !guest(m).WrBuf(arg(m, 3), le(nil, uint64(pos), 8)) {
+			return -eFAULT, nil
+		}
+		return 0, nil
+	}
+	return seek(sarg(m, 1), int(arg(m, 2))), nil
+}
+
+func (sc *Syscall) scRead(m *rv.RV) (int64, error) {
+	x, rc := sc.getFd(m, 0)
+	if x == nil {
+		return rc, nil
+	}
+	n := hostcall.Clamp(arg(m, 2))
+	if !guest(m).Check(arg(m, 1), n, mem.AttrW) {
+		return -eFAULT, nil
+	}
+	buf, rc := sc.read(x, n)
+	if rc != 0 {
+		return rc, nil
+	}
+	if !guest(m).WrBuf(arg(m, 1), buf) {
+		return -eFAULT, nil
+	}
+	return int64(len(buf)), nil
+}
+
+func (sc *Syscall) scWrite(m *rv.RV) (int64, error) {
+	x, rc := sc.getFd(m, 0)
+	if x == nil {
+		return rc, nil
+	}
+	buf, ok := guest(m).RdBuf(arg(m, 1), hostcall.Clamp(arg(m, 2)))
+	if !ok {
+		return -eFAULT, nil
+	}
+	return sc.write(x, buf), nil
+}
+
+func (sc *Syscall) scReadv(m *rv.RV) (int64, error) {
+	x, rc := sc.getFd(m, 0)
+	if x == nil {
+		return rc, nil
+	}
+	iov, rc := iovec(m, arg(m, 1), arg(m, 2))
+	if rc != 0 {
+		return rc, nil
+	}
+	n := uint64(0)
+	for _, v := range iov {
+		if !guest(m).Check(v[0], v[1], mem.AttrW) {
+			return -eFAULT, nil
+		}
+		n += v[1]
+	}
+	buf, rc := sc.read(x, n)
+	if rc != 0 {
+		return rc, nil
+	}
+	// scatter the data
+	k := int64(len(buf))
+	for _, v := range iov {
+		if len(buf) == 0 {
+			break
+		}
+		l := v[1]
+		if l > uint64(len(buf)) {
+			l = uint64(len(buf))
+		}
+		if !guest(m).WrBuf(v[0], buf[:l]) {
+			return -eFAULT, nil
+		}
+		buf = buf[l:]
+	}
+	return k, nil
+}
+
+func (sc *Syscall) scWritev(m *rv.RV) (int64, error) {
+	x, rc := sc.getFd(m, 0)
+	if x == nil {
+		return rc, nil
+	}
+	iov, rc := iovec(m, arg(m, 1), arg(m, 2))
+	if rc != 0 {
+		return rc, nil
+	}
+	// gather the data
+	buf := []byte{}
+	for _, v := range iov {
+		b, ok := guest(m).RdBuf(v[0], v[1])
+		if !ok {
+			return -eFAULT, nil
+		}
+		buf = append(buf, b...)
+	}
+	return sc.write(x, buf), nil
+}
+
+func (sc *Syscall) scFstat(m *rv.RV) (int64, error) {
+	x, rc := sc.getFd(m, 0)
+	if x == nil {
+		return rc, nil
+	}
+	st, rc := sc.statInput(func() (*stat, int64) { return fileStat(x) })
+	if st == nil {
+		return rc, nil
+	}
+	return wrStat(m, arg(m, 1), st), nil
+}
+
+// statAt returns the file status for a (dirfd, path) pair.
+// An empty path (AT_EMPTY_PATH) is the status of the file descriptor.
+func (sc *Syscall) statAt(m *rv.RV) (*stat, int64) {
+	name, ok := guest(m).RdString(arg(m, 1))
+	if !ok {
+		return nil, -eFAULT
+	}
+	if name == "" {
+		x, rc := sc.getFd(m, 0)
+		if x == nil {
+			return nil, rc
+		}
+		return sc.statInput(func() (*stat, int64) { return fileStat(x) })
+	}
+	path, rc := sc.path(name)
+	if rc != 0 {
+		return nil, rc
+	}
+	return sc.statInput(func() (*stat, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, errno(err)
+		}
+		return newStat(fi), 0
+	})
+}
+
+func (sc *Syscall) scNewfstatat(m *rv.RV) (int64, error) {
+	st, rc := sc.statAt(m)
+	if st == nil {
+		return rc, nil
+	}
+	return wrStat(m, arg(m, 2), st), nil
+}
+
+func (sc *Syscall) scStatx(m *rv.RV) (int64, error) {
+	st, rc := sc.statAt(m)
+	if st == nil {
+		return rc, nil
+	}
+	return wrStatx(m, arg(m, 4), st), nil
+}
+
+func (sc *Syscall) scIoctl(m *rv.RV) (int64, error) {
+	x, rc := sc.getFd(m, 0)
+	if x == nil {
+		return rc, nil
+	}
+	return -eNOTTY, nil
+}
+
+func (sc *Syscall) scExit(m *rv.RV) (int64, error) {
+	return 0, m.Exit(int(sarg(m, 0)))
+}
+
+func (sc *Syscall) scSetTidAddress(m *rv.RV) (int64, error) {
+	return 1, nil
+}
+
+func (sc *Syscall) scClockGettime(m *rv.RV) (int64, error) {
+	ns := sc.clockNanos(arg(m, 0))
+	buf := le(le(nil, ns/1e9, 8), ns%1e9, 8)
+	if !guest(m).WrBuf(arg(m, 1), buf) {
+		return -eFAULT, nil
+	}
+	return 0, nil
+}
+
+func (sc *Syscall) scGettimeofday(m *rv.RV) (int64, error) {
+	if arg(m, 0) == 0 {
+		return 0, nil
+	}
+	ns := sc.clockNanos(0)
+	buf := le(le(nil, ns/1e9, 8), (ns%1e9)/1e3, 8)
+	if !guest(m).WrBuf(arg(m, 0), buf) {
+		return -eFAULT, nil
+	}
+	return 0, nil
+}
+
+func (sc *Syscall) scUname(m *rv.RV) (int64, error) {
+	field := func(s string) []byte {
+		buf := make([]byte, 65)
+		copy(buf, s)
+		return buf
+	}
+	buf := []byte{}
+	buf = append(buf, field("Linux")...)
+	buf = append(buf, field("rvemu")...)
+	buf = append(buf, field("6.1.0")...)
+	buf = append(buf, field("#1")...)
+	buf = append(buf, field(fmt.Sprintf("riscv%d", m.Xlen()))...)
+	buf = append(buf, field("")...)
+	if !guest(m).WrBuf(arg(m, 0), buf) {
+		return -eFAULT, nil
+	}
+	return 0, nil
+}
+
+func (sc *Syscall) scZero(m *rv.RV) (int64, error) {
+	return 0, nil
+}
+
+func (sc *Syscall) scGetpid(m *rv.RV) (int64, error) {
+	return 1, nil
+}
+
+func (sc *Syscall) scBrk(m *rv.RV) (int64, error) {
+	adr := uint(arg(m, 0))
+	if adr >= sc.brkMin && adr <= sc.brkMax {
+		if adr < sc.brk {
+			// zero the released memory
+			for a := adr; a < sc.brk; a++ {
+				m.Mem.Wr8(a, 0)
+			}
+		}
+		sc.brk = adr
+	}
+	return int64(sc.brk), nil
+}
+
+func (sc *Syscall) scMmap(m *rv.RV) (int64, error) {
+	adr := uint(arg(m, 0))
+	size := (uint(arg(m, 1)) + pageSize - 1) &^ (pageSize - 1)
+	prot := arg(m, 2)
+	flags := arg(m, 3)
+	if size == 0 {
+		return -eINVAL, nil
+	}
+	if size > mmapMax {
+		return -eNOMEM, nil
+	}
+	if flags&mapFixed == 0 || adr == 0 {
+		if sc.mmapTop < size || sc.mmapTop-size < sc.brkMax {
+			return -eNOMEM, nil
+		}
+		sc.mmapTop -= size
+		adr = sc.mmapTop
+	} else if m.Mem.GetSectionName(adr) != m.Mem.GetSectionName(0) {
+		// fixed mappings over existing memory are not supported
+		return -eINVAL, nil
+	}
+	s := mem.NewSection("mmap", adr, size, mem.AttrRW)
+	if flags&mapAnonymous == 0 {
+		// file mapping (private copy)
+		x, rc := sc.getFd(m, 4)
+		if x == nil {
+			return rc, nil
+		}
+		buf, rc := sc.input("syscall.mmap", func() ([]byte, int64) {
+			if x.f == nil {
+				return nil, -eACCES
+			}
+			buf := make([]byte, size)
+			n, err := x.f.ReadAt(buf, int64(arg(m, 5)))
+			if err != nil && err != io.EOF {
+				return nil, errno(err)
+			}
+			return buf[:n], 0
+		})
+		if rc != 0 {
+			return rc, nil
+		}
+		for i := range buf {
+			s.Wr8(adr+uint(i), buf[i])
+		}
+	}
+	attr := mem.Attribute(0)
+	if prot&1 != 0 {
+		attr |= mem.AttrR
+	}
+	if prot&2 != 0 {
+		attr |= mem.AttrW
+	}
+	if prot&4 != 0 {
+		attr |= mem.AttrX
+	}
+	s.SetAttr(attr)
+	m.Mem.Add(s)
+	return int64(adr), nil
+}
+
+func (sc *Syscall) scMunmap(m *rv.RV) (int64, error) {
+	// Only whole mappings are removed. A partial unmap is ignored.
+	adr := uint(arg(m, 0))
+	if m.Mem.GetSectionName(adr) == "mmap" {
+		m.Mem.Remove(adr)
+	}
+	return 0, nil
+}
+
+func (sc *Syscall) scGetrandom(m *rv.RV) (int64, error) {
+	n := hostcall.Clamp(arg(m, 1))
+	if !guest(m).Check(arg(m, 0), n, mem.AttrW) {
+		return -eFAULT, nil
+	}
+	buf := sc.random(int(n))
+	if !guest(m).WrBuf(arg(m, 0), buf) {
+		return -eFAULT, nil
+	}
+	return int64(len(buf)), nil
 }
 
 //-----------------------------------------------------------------------------
 
-type scFunc func(m *rv.RV) error
+type scFunc func(sc *Syscall, m *rv.RV) (int64, error)
 
 type scEntry struct {
 	name string
@@ -45,9 +833,38 @@ type scEntry struct {
 }
 
 var scTable = map[uint]scEntry{
-	57: {"close", sc_close},
-	80: {"fstat", sc_fstat},
-	93: {"exit", sc_exit},
+	29:  {"ioctl", (*Syscall).scIoctl},
+	56:  {"openat", (*Syscall).scOpenat},
+	57:  {"close", (*Syscall).scClose},
+	62:  {"lseek", (*Syscall).scLseek},
+	63:  {"read", (*Syscall).scRead},
+	64:  {"write", (*Syscall).scWrite},
+	65:  {"readv", (*Syscall).scReadv},
+	66:  {"writev", (*Syscall).scWritev},
+	79:  {"newfstatat", (*Syscall).scNewfstatat},
+	80:  {"fstat", (*Syscall).scFstat},
+	93:  {"exit", (*Syscall).scExit},
+	94:  {"exit_group", (*Syscall).scExit},
+	96:  {"set_tid_address", (*Syscall).scSetTidAddress},
+	99:  {"set_robust_list", (*Syscall).scZero},
+	113: {"clock_gettime", (*Syscall).scClockGettime},
+	134: {"rt_sigaction", (*Syscall).scZero},
+	135: {"rt_sigprocmask", (*Syscall).scZero},
+	160: {"uname", (*Syscall).scUname},
+	169: {"gettimeofday", (*Syscall).scGettimeofday},
+	172: {"getpid", (*Syscall).scGetpid},
+	174: {"getuid", (*Syscall).scZero},
+	175: {"geteuid", (*Syscall).scZero},
+	176: {"getgid", (*Syscall).scZero},
+	177: {"getegid", (*Syscall).scZero},
+	178: {"gettid", (*Syscall).scGetpid},
+	214: {"brk", (*Syscall).scBrk},
+	215: {"munmap", (*Syscall).scMunmap},
+	222: {"mmap", (*Syscall).scMmap},
+	226: {"mprotect", (*Syscall).scZero},
+	278: {"getrandom", (*Syscall).scGetrandom},
+	291: {"statx", (*Syscall).scStatx},
+	403: {"clock_gettime64", (*Syscall).scClockGettime},
 }
 
 func scLookup(n uint) *scEntry {
@@ -59,22 +876,24 @@ func scLookup(n uint) *scEntry {
 
 //-----------------------------------------------------------------------------
 
-// Syscall is a syscall ecall object.
-type Syscall struct {
-}
-
-// NewSyscall returns a syscall ecall object.
-func NewSyscall() *Syscall {
-	return &Syscall{}
-}
-
 // Call is an ecall handler.
 func (sc *Syscall) Call(m *rv.RV) error {
-	n := uint(m.X[rv.RegA7])
+	n := uint(m.RdX(rv.RegA7))
 	e := scLookup(n)
-	if e != nil {
-		return e.sc(m)
+	if e == nil {
+		if !sc.warned[n] {
+			fmt.Fprintf(sc.cfg.Stderr, "syscall %d is not implemented\n", n)
+			sc.warned[n] = true
+		}
+		rc := int64(-eNOSYS)
+		m.WrX(rv.RegA0, uint64(rc))
+		return nil
+	}
+	rc, err := e.sc(sc, m)
+	if err != nil {
+		return err
 	}
+	m.WrX(rv.RegA0, uint64(rc))
 	return nil
 }
 
@@ -0,0 +1,284 @@
+//-----------------------------------------------------------------------------
+/*
+
+Linux System Call Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package ecall
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/device"
+	"github.com/deadsy/riscv/machine"
+	"github.com/deadsy/riscv/machine/machinetest"
+	"github.com/deadsy/riscv/replay"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+const (
+	textBase = 0x10000
+	dataBase = 0x11000
+)
+
+// newCPU returns a cpu with a nop and an ecall at textBase.
+func newCPU(t *testing.T, xlen uint) *rv.RV {
+	mc := machinetest.New(t, xlen,
+		machine.Region{Name: "text", Base: textBase, Size: 0x1000, Attr: "rx"},
+		machine.Region{Name: "data", Base: dataBase, Size: 0x1000, Attr: "rw"},
+	)
+	machinetest.Assemble(t, mc.CPU, textBase, "addi zero,zero,0", "ecall")
+	return mc.CPU
+}
+
+// linux runs system calls.
+type linux struct {
+	t   *testing.T
+	cpu *rv.RV
+}
+
+// call runs a system call and returns a0.
+func (x *linux) call(n uint64, args ...uint64) (int64, error) {
+	m := x.cpu
+	m.PC = textBase
+	m.CSR.SetMode(csr.ModeU)
+	m.WrX(rv.RegA7, n)
+	for i, v := range args {
+		m.WrX(rv.RegA0+uint(i), v)
+	}
+	for i := 0; i < 2; i++ {
+		err := m.Run()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if m.PC != textBase+8 {
+		x.t.Fatalf("pc is %x, expected %x", m.PC, textBase+8)
+	}
+	return sarg(m, 0), nil
+}
+
+// must runs a system call that should succeed.
+func (x *linux) must(n uint64, args ...uint64) int64 {
+	rc, err := x.call(n, args...)
+	if err != nil {
+		x.t.Fatal(err)
+	}
+	return rc
+}
+
+// str writes a string to data memory and returns the address.
+func (x *linux) str(adr uint64, s string) uint64 {
+	guest(x.cpu).WrBuf(adr, append([]byte(s), 0))
+	return adr
+}
+
+//-----------------------------------------------------------------------------
+
+func testSyscall(t *testing.T, xlen uint) {
+	root, err := ioutil.TempDir("", "syscall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var out bytes.Buffer
+	cpu := newCPU(t, xlen)
+	sc := NewSyscall(Config{
+		Root:    root,
+		Env:     []string{"HOME=/"},
+		Console: device.NewConsole(&bytes.Buffer{}, &out),
+		Stderr:  &out,
+	})
+	cpu.SetEcall(sc)
+	x := &linux{t, cpu}
+
+	// start the program
+	sc.img = &image{name: "/prog", entry: textBase, phdr: textBase, phent: 56, end: dataBase + 0x1000}
+	err = sc.Start(cpu, []string{"prog", "arg1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp := cpu.RdX(rv.RegSp)
+	if argc, _ := guest(cpu).RdWord(sp, int(xlen>>3)); argc != 2 || sp&15 != 0 {
+		t.Errorf("bad initial stack (sp %x, argc %d)", sp, argc)
+	}
+	argv1, _ := guest(cpu).RdWord(sp+2*uint64(xlen>>3), int(xlen>>3))
+	if s, _ := guest(cpu).RdString(argv1); s != "arg1" {
+		t.Errorf("argv[1] is \"%s\"", s)
+	}
+
+	// write/writev
+	if x.must(64, 1, x.str(dataBase, "hello "), 6) != 6 {
+		t.Errorf("bad write count")
+	}
+	size := uint64(xlen >> 3)
+	iov := uint64(dataBase + 0x100)
+	v := le(nil, x.str(dataBase, "wor"), int(size))
+	v = le(v, 3, int(size))
+	v = le(v, x.str(dataBase+8, "ld"), int(size))
+	v = le(v, 2, int(size))
+	guest(cpu).WrBuf(iov, v)
+	if x.must(66, 1, iov, 2) != 5 {
+		t.Errorf("bad writev count")
+	}
+	if out.String() != "hello world" {
+		t.Errorf("console output is \"%s\"", out.String())
+	}
+
+	// files (escaping the root directory is not possible)
+	atFdcwd := uint64(0xffffff9c)
+	if xlen == 64 {
+		atFdcwd = 0xffffffffffffff9c
+	}
+	fd := x.must(56, atFdcwd, x.str(dataBase, "../test.txt"), oWRONLY|oCREAT|oTRUNC, 0644)
+	if fd != 3 {
+		t.Fatalf("openat returned %d", fd)
+	}
+	x.must(64, uint64(fd), x.str(dataBase, "0123456789"), 10)
+	x.must(57, uint64(fd))
+	buf, err := ioutil.ReadFile(filepath.Join(root, "test.txt"))
+	if err != nil || string(buf) != "0123456789" {
+		t.Errorf("bad file contents \"%s\" %v", buf, err)
+	}
+	fd = x.must(56, atFdcwd, x.str(dataBase, "/test.txt"), 0, 0)
+	x.must(80, uint64(fd), dataBase+0x200)
+	if n, _ := cpu.Mem.Rd64(dataBase + 0x230); n != 10 {
+		t.Errorf("bad fstat size %d", n)
+	}
+	if x.must(63, uint64(fd), dataBase, 4) != 4 {
+		t.Errorf("bad read count")
+	}
+	if s, _ := guest(cpu).RdBuf(dataBase, 4); string(s) != "0123" {
+		t.Errorf("bad read data \"%s\"", s)
+	}
+	// bad guest lengths
+	huge := ^uint64(0) >> (64 - xlen)
+	end := uint64(dataBase + 0x1000 + brkSize - 0x100) // near the end of memory
+	if x.must(63, uint64(fd), end, huge) != -eFAULT {
+		t.Errorf("read with a bad length")
+	}
+	if x.must(64, 1, end, huge) != -eFAULT {
+		t.Errorf("write with a bad length")
+	}
+	if x.must(66, 1, iov, 2000) != -eINVAL {
+		t.Errorf("writev with a bad count")
+	}
+	if x.must(278, end, huge, 0) != -eFAULT {
+		t.Errorf("getrandom with a bad length")
+	}
+	if x.must(222, 0, huge&^(pageSize-1), 3, mapAnonymous|2, ^uint64(0), 0) != -eNOMEM {
+		t.Errorf("mmap with a bad length")
+	}
+	if x.must(56, atFdcwd, x.str(dataBase, "nofile"), 0, 0) != -eNOENT {
+		t.Errorf("opened a missing file")
+	}
+	if x.must(57, 99) != -eBADF {
+		t.Errorf("closed a bad file descriptor")
+	}
+
+	// brk
+	brk := uint64(x.must(214, 0))
+	if brk != dataBase+0x1000 {
+		t.Errorf("bad initial brk %x", brk)
+	}
+	if uint64(x.must(214, brk+0x2000)) != brk+0x2000 {
+		t.Errorf("brk was not set")
+	}
+	if cpu.Mem.Wr32(uint(brk+0x1000), 1) != nil {
+		t.Errorf("can't write to the heap")
+	}
+
+	// mmap/munmap
+	adr := uint64(x.must(222, 0, 0x3000, 3, mapAnonymous|2, ^uint64(0), 0))
+	if adr&(pageSize-1) != 0 || cpu.Mem.Wr32(uint(adr+0x2ffc), 1) != nil {
+		t.Errorf("bad mmap %x", adr)
+	}
+	x.must(215, adr, 0x3000)
+	if cpu.Mem.Wr32(uint(adr), 1) == nil {
+		t.Errorf("munmap did not remove the mapping")
+	}
+
+	// unimplemented
+	if x.must(1000) != -eNOSYS {
+		t.Errorf("unimplemented syscall did not return ENOSYS")
+	}
+
+	// exit
+	_, err = x.call(94, 7)
+	e, ok := err.(*rv.Error)
+	if !ok || e.Type != rv.ErrExit || e.ExitStatus() != 7 {
+		t.Errorf("bad exit %v", err)
+	}
+}
+
+func Test_SyscallReplay(t *testing.T) {
+	root, err := ioutil.TempDir("", "syscall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "test.txt"), []byte("hello"), 0644)
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+
+	// run the file syscalls, recording or replaying the inputs
+	run := func(log *replay.Log) []int64 {
+		cpu := newCPU(t, 64)
+		cpu.SetEcall(NewSyscall(Config{Root: root, Inputs: log}))
+		x := &linux{t, cpu}
+		atFdcwd := uint64(0xffffffffffffff9c)
+		fd := x.must(56, atFdcwd, x.str(dataBase, "test.txt"), 0, 0)
+		dir := x.must(56, atFdcwd, x.str(dataBase, "dir"), 0, 0)
+		return []int64{
+			fd,
+			x.must(80, uint64(fd), dataBase+0x200),
+			x.must(63, uint64(fd), dataBase, 16),
+			x.must(62, uint64(fd), 1, 0),
+			x.must(63, uint64(dir), dataBase, 16),
+			x.must(56, atFdcwd, x.str(dataBase, "nofile"), 0, 0),
+		}
+	}
+	count := func() uint64 { return 0 }
+
+	var buf bytes.Buffer
+	rec, _ := replay.NewRecorder(&buf, count)
+	x := run(rec)
+	rec.Flush()
+	if x[2] != 5 || x[4] != -eISDIR || x[5] != -eNOENT {
+		t.Fatalf("bad syscall results %v", x)
+	}
+
+	// the replayed results don't depend on the host files
+	os.RemoveAll(filepath.Join(root, "dir"))
+	os.Remove(filepath.Join(root, "test.txt"))
+	rep, _ := replay.NewReplayer(&buf, count)
+	y := run(rep)
+	for i := range x {
+		if x[i] != y[i] {
+			t.Errorf("replayed results %v, expected %v", y, x)
+			break
+		}
+	}
+	if rep.Err() != nil || rep.Pending() {
+		t.Errorf("bad replay %v", rep.Err())
+	}
+}
+
+func Test_Syscall32(t *testing.T) {
+	testSyscall(t, 32)
+}
+
+func Test_Syscall64(t *testing.T) {
+	testSyscall(t, 64)
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,200 @@
+//-----------------------------------------------------------------------------
+/*
+
+Device Tree Generation
+
+Build a device tree describing the emulated machine: the hart (with an
+ISA string from the CPU extensions), the memory sections and the memory
+mapped devices.
+
+*/
+//-----------------------------------------------------------------------------
+
+package fdt
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// LabelCPUIntc is the label of the hart local interrupt controller.
+const LabelCPUIntc = "cpu0-intc"
+
+// Describer is implemented by devices that appear in the device tree.
+type Describer interface {
+	// DeviceNode returns the device tree node for the device at an address.
+	DeviceNode(t *Tree, base, size uint64) *Node
+}
+
+// Config is the device tree configuration.
+type Config struct {
+	Model       string // machine model (default "rvemu")
+	Timebase    uint64 // real time counter frequency (Hz)
+	Bootargs    string // kernel command line
+	InitrdStart uint64 // initial ramdisk start address (optional)
+	InitrdEnd   uint64 // initial ramdisk end address
+}
+
+//-----------------------------------------------------------------------------
+
+// isaOrder is the canonical order of the single letter ISA extensions.
+const isaOrder = "IEMAFDQCBPVH"
+
+// isaString returns the riscv,isa string for the CPU.
+func isaString(m *rv.RV) string {
+	ext := m.ISA().GetExtensions()
+	s := fmt.Sprintf("rv%d", m.Xlen())
+	for _, c := range isaOrder {
+		if ext&(1<<uint(c-'A')) != 0 {
+			s += strings.ToLower(string(c))
+		}
+	}
+	return s + "_zicsr_zifencei"
+}
+
+// mmuType returns the mmu-type string for the CPU (or "" for no mmu).
+func mmuType(m *rv.RV) string {
+	if m.ISA().GetExtensions()&csr.IsaExtS == 0 {
+		return ""
+	}
+	if m.Xlen() == 32 {
+		return "riscv,sv32"
+	}
+	return "riscv,sv48"
+}
+
+// cpus returns the cpus node.
+func cpus(t *Tree, m *rv.RV, cfg *Config) *Node {
+	intc := NewNode("interrupt-controller").
+		Cells("#interrupt-cells", 1).
+		Empty("interrupt-controller").
+		String("compatible", "riscv,cpu-intc").
+		Cells("phandle", t.Phandle(LabelCPUIntc))
+	cpu := NewNodeAt("cpu", 0).
+		String("device_type", "cpu").
+		Cells("reg", 0).
+		String("status", "okay").
+		String("compatible", "riscv").
+		String("riscv,isa", isaString(m))
+	if s := mmuType(m); s != "" {
+		cpu.String("mmu-type", s)
+	}
+	cpu.Add(intc)
+	return NewNode("cpus").
+		Cells("#address-cells", 1).
+		Cells("#size-cells", 0).
+		Cells("timebase-frequency", uint32(cfg.Timebase)).
+		Add(cpu)
+}
+
+// memory returns the memory nodes (one per contiguous range of memory sections).
+// Overlapping sections (E.g. program sections loaded over RAM) are merged.
+func memory(m *mem.Memory) []*Node {
+	type span struct{ start, end uint }
+	x := []span{}
+	for _, s := range m.Sections() {
+		if n := len(x); n > 0 && s.Start() <= x[n-1].end+1 {
+			if s.End() > x[n-1].end {
+				x[n-1].end = s.End()
+			}
+			continue
+		}
+		x = append(x, span{s.Start(), s.End()})
+	}
+	nodes := []*Node{}
+	for _, s := range x {
+		n := NewNodeAt("memory", uint64(s.start)).
+			String("device_type", "memory").
+			U64("reg", uint64(s.start), uint64(s.end-s.start+1))
+		nodes = append(nodes, n)
+	}
+	return nodes
+}
+
+// Build returns a device tree for the emulated machine.
+func Build(m *rv.RV, cfg *Config) *Tree {
+	t := NewTree()
+	model := cfg.Model
+	if model == "" {
+		model = "rvemu"
+	}
+	t.Root.Cells("#address-cells", 2).
+		Cells("#size-cells", 2).
+		String("compatible", "deadsy,"+model).
+		String("model", model)
+
+	chosen := NewNode("chosen")
+	t.Root.Add(chosen)
+	t.Root.Add(cpus(t, m, cfg))
+	for _, n := range memory(m.Mem) {
+		t.Root.Add(n)
+	}
+
+	// devices
+	soc := NewNode("soc").
+		Cells("#address-cells", 2).
+		Cells("#size-cells", 2).
+		String("compatible", "simple-bus").
+		Empty("ranges")
+	for _, d := range m.Mem.Devices() {
+		x, ok := d.IO().(Describer)
+		if !ok {
+			continue
+		}
+		info := d.Info()
+		soc.Add(x.DeviceNode(t, uint64(info.Start()), uint64(info.End()-info.Start()+1)))
+	}
+	t.Root.Add(soc)
+
+	// chosen
+	if cfg.Bootargs != "" {
+		chosen.String("bootargs", cfg.Bootargs)
+	}
+	for _, n := range soc.Children {
+		if strings.HasPrefix(n.Name, "serial@") {
+			chosen.String("stdout-path", "/soc/"+n.Name)
+			break
+		}
+	}
+	if cfg.InitrdEnd > cfg.InitrdStart {
+		chosen.U64("linux,initrd-start", cfg.InitrdStart)
+		chosen.U64("linux,initrd-end", cfg.InitrdEnd)
+	}
+	return t
+}
+
+//-----------------------------------------------------------------------------
+
+// placeSlack allows for a change of the blob size when it is rebuilt
+// with its own memory section (E.g. an extra memory node).
+const placeSlack = 256
+
+// Place builds the device tree and puts the blob in memory at an address.
+// A memory section is added for the blob if the address is not in memory
+// (E.g. RAM). The address is passed to the boot code in a1.
+func Place(m *rv.RV, cfg *Config, addr uint) (*Tree, error) {
+	n := len(Build(m, cfg).Blob()) + placeSlack
+	size := uint((n + 0xfff) &^ 0xfff)
+	if !m.Mem.Mapped(addr, size) {
+		m.Mem.Add(mem.NewSection("fdt", addr, size, mem.AttrR))
+	}
+	t := Build(m, cfg)
+	buf := t.Blob()
+	if uint(len(buf)) > size {
+		return nil, fmt.Errorf("device tree blob (%d bytes) is larger than its section", len(buf))
+	}
+	err := m.Mem.Patch(addr, buf)
+	if err != nil {
+		return nil, err
+	}
+	m.SetDTB(uint64(addr))
+	return t, nil
+}
+
+//-----------------------------------------------------------------------------
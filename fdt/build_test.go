@@ -0,0 +1,53 @@
+//-----------------------------------------------------------------------------
+/*
+
+Device Tree Build Testing
+
+The machine package imports fdt, so these are external tests.
+
+*/
+//-----------------------------------------------------------------------------
+
+package fdt_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/deadsy/riscv/fdt"
+	"github.com/deadsy/riscv/machine/machinetest"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+func Test_Build(t *testing.T) {
+	cpu := machinetest.NewDevices(t, 64).CPU
+	tree, err := fdt.Place(cpu, &fdt.Config{Timebase: 10000000, Bootargs: "console=ttyS0"}, 0x87e00000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cpu.RdX(rv.RegA1) != 0x87e00000 {
+		t.Errorf("dtb address is not in a1")
+	}
+	dts := tree.DTS()
+	for _, s := range []string{
+		"riscv,isa = \"rv64imafdc_zicsr_zifencei\";",
+		"mmu-type = \"riscv,sv48\";",
+		"memory@80000000 {",
+		"reg = <0x0 0x80000000 0x0 0x100000>;",
+		"memory@87e00000 {",
+		"serial@10000000 {",
+		"stdout-path = \"/soc/serial@10000000\";",
+		"bootargs = \"console=ttyS0\";",
+	} {
+		if !strings.Contains(dts, s) {
+			t.Errorf("no %s in\n%s", s, dts)
+		}
+	}
+	if tree.Find("/cpus/cpu@0/interrupt-controller").Prop("phandle") == nil {
+		t.Errorf("no cpu interrupt controller phandle")
+	}
+}
+
+//-----------------------------------------------------------------------------
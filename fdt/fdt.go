@@ -0,0 +1,324 @@
+//-----------------------------------------------------------------------------
+/*
+
+Flattened Device Tree
+
+A device tree is built as a tree of nodes with properties and is then
+written as a flattened device tree blob (DTB) or as device tree source
+(DTS) text.
+
+See:
+
+https://github.com/devicetree-org/devicetree-specification
+
+*/
+//-----------------------------------------------------------------------------
+
+package fdt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+
+// FDT structure block tokens
+const (
+	tokenBeginNode = 1
+	tokenEndNode   = 2
+	tokenProp      = 3
+	tokenEnd       = 9
+)
+
+const (
+	fdtMagic      = 0xd00dfeed
+	fdtVersion    = 17
+	fdtLastCompat = 16
+	headerSize    = 40
+)
+
+//-----------------------------------------------------------------------------
+
+// propKind is the type of a property value (for DTS output).
+type propKind int
+
+const (
+	kindEmpty   propKind = iota // no value
+	kindStrings                 // list of strings
+	kindCells                   // list of 32-bit cells
+	kindBytes                   // byte string
+)
+
+// Prop is a device tree property.
+type Prop struct {
+	Name  string
+	Value []byte
+	kind  propKind
+}
+
+// Node is a device tree node.
+type Node struct {
+	Name     string
+	Props    []*Prop
+	Children []*Node
+}
+
+// NewNode returns a device tree node.
+func NewNode(name string) *Node {
+	return &Node{Name: name}
+}
+
+// NewNodeAt returns a device tree node with a unit address (E.g. serial@10000000).
+func NewNodeAt(name string, addr uint64) *Node {
+	return NewNode(fmt.Sprintf("%s@%x", name, addr))
+}
+
+// Add adds a child node.
+func (n *Node) Add(c *Node) *Node {
+	n.Children = append(n.Children, c)
+	return n
+}
+
+// Child returns the named child node (or nil).
+func (n *Node) Child(name string) *Node {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Prop returns the named property (or nil).
+func (n *Node) Prop(name string) *Prop {
+	for _, p := range n.Props {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func (n *Node) setProp(name string, kind propKind, val []byte) *Node {
+	if p := n.Prop(name); p != nil {
+		p.Value = val
+		p.kind = kind
+		return n
+	}
+	n.Props = append(n.Props, &Prop{name, val, kind})
+	return n
+}
+
+// Empty sets an empty (boolean) property.
+func (n *Node) Empty(name string) *Node {
+	return n.setProp(name, kindEmpty, nil)
+}
+
+// String sets a string (or string list) property.
+func (n *Node) String(name string, s ...string) *Node {
+	buf := []byte{}
+	for _, x := range s {
+		buf = append(append(buf, x...), 0)
+	}
+	return n.setProp(name, kindStrings, buf)
+}
+
+// Cells sets a 32-bit cell list property.
+func (n *Node) Cells(name string, cells ...uint32) *Node {
+	buf := make([]byte, 4*len(cells))
+	for i, x := range cells {
+		binary.BigEndian.PutUint32(buf[4*i:], x)
+	}
+	return n.setProp(name, kindCells, buf)
+}
+
+// U64 sets a property of 64-bit values (each as two cells).
+func (n *Node) U64(name string, vals ...uint64) *Node {
+	cells := []uint32{}
+	for _, x := range vals {
+		cells = append(cells, uint32(x>>32), uint32(x))
+	}
+	return n.Cells(name, cells...)
+}
+
+// Bytes sets a byte string property.
+func (n *Node) Bytes(name string, buf []byte) *Node {
+	return n.setProp(name, kindBytes, buf)
+}
+
+//-----------------------------------------------------------------------------
+
+// Tree is a device tree.
+type Tree struct {
+	Root    *Node
+	phandle map[string]uint32 // phandles by label
+}
+
+// NewTree returns an empty device tree.
+func NewTree() *Tree {
+	return &Tree{
+		Root:    NewNode(""),
+		phandle: map[string]uint32{},
+	}
+}
+
+// Phandle returns the phandle for a node label.
+// A phandle is allocated on first use (by either the node or a reference).
+func (t *Tree) Phandle(label string) uint32 {
+	if p, ok := t.phandle[label]; ok {
+		return p
+	}
+	p := uint32(len(t.phandle) + 1)
+	t.phandle[label] = p
+	return p
+}
+
+// Find returns the node for a path (E.g. "/cpus/cpu@0"), or nil.
+func (t *Tree) Find(path string) *Node {
+	n := t.Root
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		n = n.Child(name)
+		if n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+//-----------------------------------------------------------------------------
+
+// blob is the state for writing a flattened device tree.
+type blob struct {
+	dt      []byte         // structure block
+	str     []byte         // strings block
+	strOffs map[string]int // string offsets
+}
+
+func (b *blob) u32(x uint32) {
+	b.dt = append(b.dt, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b.dt[len(b.dt)-4:], x)
+}
+
+func (b *blob) pad() {
+	for len(b.dt)&3 != 0 {
+		b.dt = append(b.dt, 0)
+	}
+}
+
+func (b *blob) strOffset(s string) uint32 {
+	if ofs, ok := b.strOffs[s]; ok {
+		return uint32(ofs)
+	}
+	ofs := len(b.str)
+	b.str = append(append(b.str, s...), 0)
+	b.strOffs[s] = ofs
+	return uint32(ofs)
+}
+
+func (b *blob) node(n *Node) {
+	b.u32(tokenBeginNode)
+	b.dt = append(append(b.dt, n.Name...), 0)
+	b.pad()
+	for _, p := range n.Props {
+		b.u32(tokenProp)
+		b.u32(uint32(len(p.Value)))
+		b.u32(b.strOffset(p.Name))
+		b.dt = append(b.dt, p.Value...)
+		b.pad()
+	}
+	for _, c := range n.Children {
+		b.node(c)
+	}
+	b.u32(tokenEndNode)
+}
+
+// Blob returns the flattened device tree blob.
+func (t *Tree) Blob() []byte {
+	b := &blob{strOffs: map[string]int{}}
+	b.node(t.Root)
+	b.u32(tokenEnd)
+	// header, empty memory reservation map, structure block, strings block
+	rsvOffset := headerSize
+	dtOffset := rsvOffset + 16
+	strOffset := dtOffset + len(b.dt)
+	size := strOffset + len(b.str)
+	hdr := []uint32{
+		fdtMagic,
+		uint32(size),
+		uint32(dtOffset),
+		uint32(strOffset),
+		uint32(rsvOffset),
+		fdtVersion,
+		fdtLastCompat,
+		0, // boot cpu
+		uint32(len(b.str)),
+		uint32(len(b.dt)),
+	}
+	buf := make([]byte, dtOffset)
+	for i, x := range hdr {
+		binary.BigEndian.PutUint32(buf[4*i:], x)
+	}
+	buf = append(buf, b.dt...)
+	return append(buf, b.str...)
+}
+
+//-----------------------------------------------------------------------------
+
+// dtsValue returns the DTS text for a property value.
+func (p *Prop) dtsValue() string {
+	switch p.kind {
+	case kindStrings:
+		s := strings.Split(strings.TrimSuffix(string(p.Value), "\x00"), "\x00")
+		for i := range s {
+			s[i] = fmt.Sprintf("%q", s[i])
+		}
+		return strings.Join(s, ", ")
+	case kindCells:
+		s := []string{}
+		for i := 0; i+4 <= len(p.Value); i += 4 {
+			s = append(s, fmt.Sprintf("0x%x", binary.BigEndian.Uint32(p.Value[i:])))
+		}
+		return "<" + strings.Join(s, " ") + ">"
+	}
+	s := []string{}
+	for _, x := range p.Value {
+		s = append(s, fmt.Sprintf("%02x", x))
+	}
+	return "[" + strings.Join(s, " ") + "]"
+}
+
+func (n *Node) dts(s *strings.Builder, indent int) {
+	tab := strings.Repeat("\t", indent)
+	name := n.Name
+	if name == "" {
+		name = "/"
+	}
+	fmt.Fprintf(s, "%s%s {\n", tab, name)
+	for _, p := range n.Props {
+		if p.kind == kindEmpty {
+			fmt.Fprintf(s, "%s\t%s;\n", tab, p.Name)
+		} else {
+			fmt.Fprintf(s, "%s\t%s = %s;\n", tab, p.Name, p.dtsValue())
+		}
+	}
+	for _, c := range n.Children {
+		s.WriteString("\n")
+		c.dts(s, indent+1)
+	}
+	fmt.Fprintf(s, "%s};\n", tab)
+}
+
+// DTS returns the device tree source text.
+func (t *Tree) DTS() string {
+	s := &strings.Builder{}
+	s.WriteString("/dts-v1/;\n\n")
+	t.Root.dts(s, 0)
+	return s.String()
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,42 @@
+//-----------------------------------------------------------------------------
+/*
+
+Device Tree Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package fdt
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+//-----------------------------------------------------------------------------
+
+func Test_Blob(t *testing.T) {
+	tree := NewTree()
+	tree.Root.Cells("#address-cells", 2).Add(NewNode("chosen").String("bootargs", "console=ttyS0"))
+	buf := tree.Blob()
+	hdr := func(i int) uint32 { return binary.BigEndian.Uint32(buf[4*i:]) }
+	if hdr(0) != fdtMagic || int(hdr(1)) != len(buf) || hdr(5) != fdtVersion {
+		t.Fatalf("bad header")
+	}
+	// the structure block starts with the root node
+	dt := buf[hdr(2):]
+	if binary.BigEndian.Uint32(dt) != tokenBeginNode {
+		t.Errorf("bad structure block")
+	}
+	// the strings block has the property names
+	str := string(buf[hdr(3) : hdr(3)+hdr(8)])
+	if str != "#address-cells\x00bootargs\x00" {
+		t.Errorf("bad strings block %q", str)
+	}
+	// the structure block ends with the end token
+	if binary.BigEndian.Uint32(dt[hdr(9)-4:]) != tokenEnd {
+		t.Errorf("no end token")
+	}
+}
+
+//-----------------------------------------------------------------------------
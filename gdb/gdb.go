@@ -0,0 +1,689 @@
+//-----------------------------------------------------------------------------
+/*
+
+GDB Remote Serial Protocol Server
+
+Lets gdb (E.g. riscv64-unknown-elf-gdb) debug the emulated cpu.
+
+(gdb) target remote localhost:1234
+
+Supported: register read/write (g/G/p/P), memory read/write (m/M/X),
+software/hardware break points (Z0/Z1), watch points (Z2/Z3/Z4),
+single step, continue and ctrl-c interrupt.
+
+Monitor commands:
+
+(gdb) monitor phys on|off   physical (or virtual) memory addressing
+
+See: https://sourceware.org/gdb/onlinedocs/gdb/Remote-Protocol.html
+
+*/
+//-----------------------------------------------------------------------------
+
+package gdb
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// Signal numbers for stop replies.
+const (
+	sigINT  = 2
+	sigILL  = 4
+	sigTRAP = 5
+	sigSEGV = 11
+)
+
+// interrupt is the out of band ctrl-c character.
+const interrupt = 0x03
+
+// runChunk is the number of instructions run between interrupt checks.
+const runChunk = 1024
+
+// packetSize is the maximum packet size.
+const packetSize = 0x4000
+
+//-----------------------------------------------------------------------------
+
+// Listen returns a listener for the address.
+// "unix:path" or a path containing "/" is a Unix socket.
+// A port number on its own listens on localhost.
+func Listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return net.Listen("unix", strings.TrimPrefix(addr, "unix:"))
+	}
+	if strings.Contains(addr, "/") {
+		return net.Listen("unix", addr)
+	}
+	if _, err := strconv.ParseUint(addr, 10, 16); err == nil {
+		addr = "localhost:" + addr
+	}
+	return net.Listen("tcp", addr)
+}
+
+//-----------------------------------------------------------------------------
+
+// Server is a gdb remote serial protocol server.
+type Server struct {
+	cpu   *rv.RV
+	phys  bool      // physical memory addressing
+	rd    chan byte // bytes read from the connection
+	w     *bufio.Writer
+	noAck bool // no acknowledgement mode
+	done  bool // the session is over
+}
+
+// NewServer returns a gdb server for the cpu.
+func NewServer(cpu *rv.RV) *Server {
+	return &Server{
+		cpu: cpu,
+	}
+}
+
+// Serve accepts a single gdb connection and runs the debug session.
+func (s *Server) Serve(l net.Listener) error {
+	conn, err := l.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.Session(conn)
+}
+
+// Session runs a debug session on a connection.
+func (s *Server) Session(conn io.ReadWriter) error {
+	s.rd = make(chan byte, packetSize)
+	s.w = bufio.NewWriter(conn)
+	s.noAck = false
+	s.done = false
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			for _, c := range buf[:n] {
+				s.rd <- c
+			}
+			if err != nil {
+				close(s.rd)
+				return
+			}
+		}
+	}()
+	for !s.done {
+		pkt, err := s.getPacket()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if pkt == nil {
+			continue
+		}
+		reply, ok := s.command(string(pkt))
+		if ok {
+			err = s.putPacket(reply)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// packets
+
+// getByte reads a byte from the connection.
+func (s *Server) getByte() (byte, error) {
+	c, ok := <-s.rd
+	if !ok {
+		return 0, io.EOF
+	}
+	return c, nil
+}
+
+// getPacket reads a packet. A nil packet is a ctrl-c while the cpu is stopped.
+func (s *Server) getPacket() ([]byte, error) {
+	for {
+		// wait for the start of packet
+		c, err := s.getByte()
+		if err != nil {
+			return nil, err
+		}
+		if c == interrupt {
+			return nil, nil
+		}
+		if c != '$' {
+			// acks, etc.
+			continue
+		}
+		// read the packet data
+		pkt := []byte{}
+		var sum byte
+		for {
+			c, err = s.getByte()
+			if err != nil {
+				return nil, err
+			}
+			if c == '#' {
+				break
+			}
+			sum += c
+			if c == '}' {
+				// escaped character
+				c, err = s.getByte()
+				if err != nil {
+					return nil, err
+				}
+				sum += c
+				c ^= 0x20
+			}
+			pkt = append(pkt, c)
+		}
+		// checksum
+		cs := make([]byte, 2)
+		for i := range cs {
+			cs[i], err = s.getByte()
+			if err != nil {
+				return nil, err
+			}
+		}
+		x, err := strconv.ParseUint(string(cs), 16, 8)
+		if !s.noAck {
+			if err != nil || byte(x) != sum {
+				s.w.WriteByte('-')
+				s.w.Flush()
+				continue
+			}
+			s.w.WriteByte('+')
+		}
+		return pkt, nil
+	}
+}
+
+// putPacket writes a packet.
+func (s *Server) putPacket(data string) error {
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		sum += data[i]
+	}
+	fmt.Fprintf(s.w, "$%s#%02x", data, sum)
+	return s.w.Flush()
+}
+
+// output sends text to the gdb console.
+func (s *Server) output(text string) error {
+	return s.putPacket("O" + hex.EncodeToString([]byte(text)))
+}
+
+//-----------------------------------------------------------------------------
+// registers
+
+// leHex returns the little endian hex string for a value.
+func leHex(val uint64, size uint) string {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = byte(val >> (8 * uint(i)))
+	}
+	return hex.EncodeToString(buf)
+}
+
+// leValue returns the value of a little endian hex string.
+func leValue(s string) (uint64, error) {
+	buf, err := hex.DecodeString(s)
+	if err != nil || len(buf) > 8 {
+		return 0, fmt.Errorf("bad value")
+	}
+	var val uint64
+	for i, b := range buf {
+		val |= uint64(b) << (8 * uint(i))
+	}
+	return val, nil
+}
+
+// rdReg reads a register.
+func (s *Server) rdReg(reg uint) (uint64, error) {
+	m := s.cpu
+	switch {
+	case reg < regPC:
+		return m.RdX(reg), nil
+	case reg == regPC:
+		return m.PC, nil
+	case reg < regCSR0:
+		return m.RdF(reg - regF0), nil
+	case reg < regPriv:
+		return m.CSR.DebugRd(reg - regCSR0)
+	case reg == regPriv:
+		return uint64(m.CSR.GetMode()), nil
+	}
+	return 0, fmt.Errorf("bad register %d", reg)
+}
+
+// wrReg writes a register.
+func (s *Server) wrReg(reg uint, val uint64) error {
+	m := s.cpu
+	switch {
+	case reg < regPC:
+		m.WrX(reg, val)
+		return nil
+	case reg == regPC:
+		m.PC = val
+		return nil
+	case reg < regCSR0:
+		m.WrF(reg-regF0, val)
+		return nil
+	case reg < regPriv:
+		return m.CSR.DebugWr(reg-regCSR0, val)
+	}
+	return fmt.Errorf("register %d is read only", reg)
+}
+
+// rdRegs returns the hex string for the 'g' packet (x0..x31, pc).
+func (s *Server) rdRegs() string {
+	xlen := s.cpu.Xlen()
+	x := []string{}
+	for reg := uint(0); reg <= regPC; reg++ {
+		val, _ := s.rdReg(reg)
+		x = append(x, leHex(val, regSize(reg, xlen)))
+	}
+	return strings.Join(x, "")
+}
+
+// wrRegs writes the registers from a 'G' packet.
+func (s *Server) wrRegs(data string) error {
+	xlen := s.cpu.Xlen()
+	for reg := uint(0); reg <= regPC && len(data) != 0; reg++ {
+		n := 2 * int(regSize(reg, xlen))
+		if len(data) < n {
+			return fmt.Errorf("short register data")
+		}
+		val, err := leValue(data[:n])
+		if err != nil {
+			return err
+		}
+		err = s.wrReg(reg, val)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// memory
+
+// adrLen parses an "addr,length" string.
+func adrLen(arg string) (uint, uint, error) {
+	x := strings.Split(arg, ",")
+	if len(x) != 2 {
+		return 0, 0, fmt.Errorf("bad address/length")
+	}
+	adr, err := strconv.ParseUint(x[0], 16, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err := strconv.ParseUint(x[1], 16, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint(adr), uint(n), nil
+}
+
+// rdMem reads memory.
+func (s *Server) rdMem(adr, n uint) (string, error) {
+	if n > packetSize/2 {
+		n = packetSize / 2
+	}
+	buf := make([]byte, 0, n)
+	for i := uint(0); i < n; i++ {
+		val, err := s.cpu.Mem.DebugRd8(adr+i, !s.phys)
+		if err != nil {
+			if i == 0 {
+				return "", err
+			}
+			break
+		}
+		buf = append(buf, val)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// wrMem writes memory.
+func (s *Server) wrMem(adr uint, buf []byte) error {
+	for i, val := range buf {
+		err := s.cpu.Mem.DebugWr8(adr+uint(i), val, !s.phys)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// break points
+
+// bpAccess returns the break point access for a Z/z packet type.
+func bpAccess(t string) (mem.Attribute, bool) {
+	switch t {
+	case "0", "1":
+		return mem.AttrX, true
+	case "2":
+		return mem.AttrW, true
+	case "3":
+		return mem.AttrR, true
+	case "4":
+		return mem.AttrR | mem.AttrW, true
+	}
+	return 0, false
+}
+
+// breakPoint adds or removes a break point.
+func (s *Server) breakPoint(arg string, add bool) (string, bool) {
+	x := strings.Split(arg, ",")
+	if len(x) < 3 {
+		return "E01", true
+	}
+	access, ok := bpAccess(x[0])
+	if !ok {
+		// not supported
+		return "", true
+	}
+	adr, err := strconv.ParseUint(x[1], 16, 64)
+	if err != nil {
+		return "E01", true
+	}
+	n, err := strconv.ParseUint(x[2], 16, 64)
+	if err != nil {
+		return "E01", true
+	}
+	if access == mem.AttrX {
+		// the kind is the instruction length, the break is on the first byte
+		n = 1
+	}
+	name := bpName(x[0])
+	if add {
+		s.cpu.Mem.AddWatchPoint(name, uint(adr), uint(n), access, nil)
+	} else {
+		s.cpu.Mem.RemoveBreakPoint(name, uint(adr), access)
+	}
+	return "OK", true
+}
+
+// bpName returns the break point name for a Z/z packet type.
+func bpName(t string) string {
+	return fmt.Sprintf("gdb%s", t)
+}
+
+//-----------------------------------------------------------------------------
+// execution
+
+// stopReply returns the stop reply for an emulation error.
+func (s *Server) stopReply(err error) string {
+	if err == nil {
+		return fmt.Sprintf("S%02x", sigTRAP)
+	}
+	e, ok := err.(*rv.Error)
+	if !ok {
+		s.output(fmt.Sprintf("%s\n", err))
+		return fmt.Sprintf("S%02x", sigTRAP)
+	}
+	switch e.Type {
+	case rv.ErrMemory:
+		me := e.GetMemError()
+		if me.Type&mem.ErrBreak != 0 {
+			switch {
+			case me.Name == bpName("1"):
+				return fmt.Sprintf("T%02xhwbreak:;", sigTRAP)
+			case me.Name == bpName("4"):
+				return fmt.Sprintf("T%02xawatch:%x;", sigTRAP, me.Addr)
+			case me.Type&mem.ErrWrite != 0:
+				return fmt.Sprintf("T%02xwatch:%x;", sigTRAP, me.Addr)
+			case me.Type&mem.ErrRead != 0:
+				return fmt.Sprintf("T%02xrwatch:%x;", sigTRAP, me.Addr)
+			}
+			return fmt.Sprintf("T%02xswbreak:;", sigTRAP)
+		}
+		s.output(fmt.Sprintf("%s\n", err))
+		return fmt.Sprintf("S%02x", sigSEGV)
+	case rv.ErrIllegal, rv.ErrTodo:
+		s.output(fmt.Sprintf("%s\n", err))
+		return fmt.Sprintf("S%02x", sigILL)
+	}
+	s.output(fmt.Sprintf("%s\n", err))
+	return fmt.Sprintf("S%02x", sigTRAP)
+}
+
+// step runs a single instruction.
+func (s *Server) step() string {
+	return s.stopReply(s.cpu.Run())
+}
+
+// cont runs the cpu until a break point, an emulation error or a ctrl-c.
+func (s *Server) cont() string {
+	for {
+		for i := 0; i < runChunk; i++ {
+			err := s.cpu.Run()
+			if err != nil {
+				return s.stopReply(err)
+			}
+		}
+		// check for a ctrl-c
+		select {
+		case c, ok := <-s.rd:
+			if !ok {
+				s.done = true
+				return ""
+			}
+			if c == interrupt {
+				return fmt.Sprintf("S%02x", sigINT)
+			}
+		default:
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+// queries
+
+// monitor runs a monitor command.
+func (s *Server) monitor(cmd string) string {
+	x := strings.Fields(cmd)
+	if len(x) == 2 && x[0] == "phys" {
+		switch x[1] {
+		case "on":
+			s.phys = true
+			return "physical memory addressing\n"
+		case "off":
+			s.phys = false
+			return "virtual memory addressing\n"
+		}
+	}
+	return "monitor commands:\n  phys on|off - physical (or virtual) memory addressing\n"
+}
+
+// xfer handles a qXfer:features:read:target.xml:offset,length query.
+func (s *Server) xfer(arg string) string {
+	const prefix = "features:read:target.xml:"
+	if !strings.HasPrefix(arg, prefix) {
+		return ""
+	}
+	ofs, n, err := adrLen(strings.TrimPrefix(arg, prefix))
+	if err != nil {
+		return "E01"
+	}
+	xml := targetXML(s.cpu.Xlen())
+	if ofs >= uint(len(xml)) {
+		return "l"
+	}
+	xml = xml[ofs:]
+	if uint(len(xml)) > n {
+		return "m" + xml[:n]
+	}
+	return "l" + xml
+}
+
+// query handles the q packets.
+func (s *Server) query(pkt string) string {
+	switch {
+	case strings.HasPrefix(pkt, "qSupported"):
+		return fmt.Sprintf("PacketSize=%x;qXfer:features:read+;swbreak+;hwbreak+;QStartNoAckMode+", packetSize)
+	case strings.HasPrefix(pkt, "qXfer:"):
+		return s.xfer(strings.TrimPrefix(pkt, "qXfer:"))
+	case pkt == "qC":
+		return "QC1"
+	case pkt == "qfThreadInfo":
+		return "m1"
+	case pkt == "qsThreadInfo":
+		return "l"
+	case strings.HasPrefix(pkt, "qAttached"):
+		return "1"
+	case strings.HasPrefix(pkt, "qRcmd,"):
+		cmd, err := hex.DecodeString(strings.TrimPrefix(pkt, "qRcmd,"))
+		if err != nil {
+			return "E01"
+		}
+		return hex.EncodeToString([]byte(s.monitor(string(cmd))))
+	}
+	return ""
+}
+
+//-----------------------------------------------------------------------------
+
+// command handles a packet and returns the reply (false: no reply).
+func (s *Server) command(pkt string) (string, bool) {
+	if len(pkt) == 0 {
+		return "", true
+	}
+	arg := pkt[1:]
+	switch pkt[0] {
+	case '?':
+		return fmt.Sprintf("S%02x", sigTRAP), true
+	case 'g':
+		return s.rdRegs(), true
+	case 'G':
+		if s.wrRegs(arg) != nil {
+			return "E01", true
+		}
+		return "OK", true
+	case 'p':
+		reg, err := strconv.ParseUint(arg, 16, 16)
+		if err != nil {
+			return "E01", true
+		}
+		val, err := s.rdReg(uint(reg))
+		if err != nil {
+			return "E01", true
+		}
+		return leHex(val, regSize(uint(reg), s.cpu.Xlen())), true
+	case 'P':
+		x := strings.Split(arg, "=")
+		if len(x) != 2 {
+			return "E01", true
+		}
+		reg, err := strconv.ParseUint(x[0], 16, 16)
+		if err != nil {
+			return "E01", true
+		}
+		val, err := leValue(x[1])
+		if err != nil || s.wrReg(uint(reg), val) != nil {
+			return "E01", true
+		}
+		return "OK", true
+	case 'm':
+		adr, n, err := adrLen(arg)
+		if err != nil {
+			return "E01", true
+		}
+		x, err := s.rdMem(adr, n)
+		if err != nil {
+			return "E14", true
+		}
+		return x, true
+	case 'M':
+		x := strings.Split(arg, ":")
+		if len(x) != 2 {
+			return "E01", true
+		}
+		adr, _, err := adrLen(x[0])
+		if err != nil {
+			return "E01", true
+		}
+		buf, err := hex.DecodeString(x[1])
+		if err != nil {
+			return "E01", true
+		}
+		if s.wrMem(adr, buf) != nil {
+			return "E14", true
+		}
+		return "OK", true
+	case 'X':
+		i := strings.IndexByte(arg, ':')
+		if i < 0 {
+			return "E01", true
+		}
+		adr, _, err := adrLen(arg[:i])
+		if err != nil {
+			return "E01", true
+		}
+		if s.wrMem(adr, []byte(arg[i+1:])) != nil {
+			return "E14", true
+		}
+		return "OK", true
+	case 'Z':
+		return s.breakPoint(arg, true)
+	case 'z':
+		return s.breakPoint(arg, false)
+	case 's', 'c':
+		if arg != "" {
+			adr, err := strconv.ParseUint(arg, 16, 64)
+			if err != nil {
+				return "E01", true
+			}
+			s.cpu.PC = adr
+		}
+		if pkt[0] == 's' {
+			return s.step(), true
+		}
+		reply := s.cont()
+		return reply, !s.done
+	case 'H', 'T':
+		return "OK", true
+	case 'D':
+		s.done = true
+		return "OK", true
+	case 'k':
+		s.done = true
+		return "", false
+	case 'q':
+		return s.query(pkt), true
+	case 'Q':
+		if pkt == "QStartNoAckMode" {
+			// the ack for this packet has been sent
+			s.noAck = true
+			return "OK", true
+		}
+		return "", true
+	case 'v':
+		if strings.HasPrefix(pkt, "vKill") {
+			s.done = true
+			return "OK", true
+		}
+		return "", true
+	}
+	return "", true
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,133 @@
+//-----------------------------------------------------------------------------
+/*
+
+GDB Server Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package gdb
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/deadsy/riscv/machine"
+	"github.com/deadsy/riscv/machine/machinetest"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// newCPU returns a cpu with a test program loaded at 0x1000.
+func newCPU(t *testing.T) *rv.RV {
+	mc := machinetest.New(t, 64,
+		machine.Region{Name: "text", Base: 0x1000, Size: 0x1000, Attr: "rx"},
+		machine.Region{Name: "data", Base: 0x400, Size: 0x100, Attr: "rw"},
+	)
+	machinetest.Assemble(t, mc.CPU, 0x1000,
+		"addi a0,a0,1",
+		"sw a0,0x400(zero)",
+		"jal zero,1000",
+	)
+	mc.CPU.PC = 0x1000
+	return mc.CPU
+}
+
+// client is a minimal gdb client.
+type client struct {
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// cmd sends a packet and returns the reply packet (skipping console output).
+func (c *client) cmd(t *testing.T, pkt string) string {
+	var sum byte
+	for i := 0; i < len(pkt); i++ {
+		sum += pkt[i]
+	}
+	fmt.Fprintf(c.conn, "$%s#%02x", pkt, sum)
+	for {
+		s, err := c.rd.ReadString('#')
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.rd.Discard(2)
+		s = strings.TrimSuffix(s[strings.IndexByte(s, '$')+1:], "#")
+		if !strings.HasPrefix(s, "O") || s == "OK" {
+			return s
+		}
+	}
+}
+
+func Test_Server(t *testing.T) {
+	cpu := newCPU(t)
+	c0, c1 := net.Pipe()
+	go NewServer(cpu).Session(c1)
+	c := &client{c0, bufio.NewReader(c0)}
+
+	tests := []struct {
+		pkt, reply string
+	}{
+		{"?", "S05"},
+		{"p20", "0010000000000000"},
+		{"P0a=0500000000000000", "OK"},
+		{"p0a", "0500000000000000"},
+		{"s", "S05"},
+		{"p0a", "0600000000000000"},
+		{"Z2,400,4", "OK"},
+		{"c", "T05watch:400;"},
+		{"m400,4", "06000000"},
+		{"p20", "0810000000000000"},
+		{"z2,400,4", "OK"},
+		{"Z0,1004,4", "OK"},
+		{"c", "T05swbreak:;"},
+		{"p20", "0410000000000000"},
+		{"p0a", "0700000000000000"},
+		{"z0,1004,4", "OK"},
+		{"Z4,402,2", "OK"},
+		{"c", "T05awatch:400;"},
+		{"z4,402,2", "OK"},
+		{"Z0,1000,4", "OK"},
+		{"Z1,1000,4", "OK"},
+		{"z0,1000,4", "OK"},
+		{"c", "T05hwbreak:;"},
+		{"z1,1000,4", "OK"},
+		{"M400,2:3412", "OK"},
+		{"m400,4", "34120000"},
+		{fmt.Sprintf("P%x=efbeadde00000000", regCSR0+0x340), "OK"},
+		{fmt.Sprintf("p%x", regCSR0+0x340), "efbeadde00000000"},
+		{fmt.Sprintf("p%x", regPriv), "0300000000000000"},
+		{"qXfer:features:read:target.xml:0,10", "m<?xml version=\"1"},
+		{"D", "OK"},
+	}
+	for _, x := range tests {
+		reply := c.cmd(t, x.pkt)
+		if reply != x.reply {
+			t.Errorf("%s: got \"%s\", expected \"%s\"", x.pkt, reply, x.reply)
+		}
+	}
+	c0.Close()
+}
+
+func Test_Interrupt(t *testing.T) {
+	cpu := newCPU(t)
+	c0, c1 := net.Pipe()
+	go NewServer(cpu).Session(c1)
+	c := &client{c0, bufio.NewReader(c0)}
+	fmt.Fprintf(c.conn, "$c#63")
+	c.conn.Write([]byte{interrupt})
+	s, err := c.rd.ReadString('#')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(s, "$S02#") {
+		t.Errorf("got \"%s\", expected a SIGINT stop", s)
+	}
+	c0.Close()
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,102 @@
+//-----------------------------------------------------------------------------
+/*
+
+GDB Target Description
+
+Register numbering follows the gdb RISC-V target:
+
+0..31      x0..x31
+32         pc
+33..64     f0..f31
+65..4160   CSRs (65 + CSR number)
+4161       priv (virtual privilege mode register)
+
+*/
+//-----------------------------------------------------------------------------
+
+package gdb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// Register numbers.
+const (
+	regPC   = 32
+	regF0   = 33
+	regCSR0 = 65
+	regPriv = regCSR0 + 4096
+)
+
+// fpuCSR are the CSRs described in the fpu feature.
+var fpuCSR = map[uint]bool{
+	0x001: true, // fflags
+	0x002: true, // frm
+	0x003: true, // fcsr
+}
+
+// regSize returns the size (in bytes) of a register.
+func regSize(reg, xlen uint) uint {
+	if reg >= regF0 && reg < regCSR0 {
+		return 8
+	}
+	if reg >= regCSR0 && reg < regPriv && fpuCSR[reg-regCSR0] {
+		return 4
+	}
+	return xlen >> 3
+}
+
+// targetXML returns the target description for the cpu.
+func targetXML(xlen uint) string {
+	s := []string{}
+	s = append(s, `<?xml version="1.0"?>`)
+	s = append(s, `<!DOCTYPE target SYSTEM "gdb-target.dtd">`)
+	s = append(s, `<target version="1.0">`)
+	s = append(s, fmt.Sprintf(`<architecture>riscv:rv%d</architecture>`, xlen))
+	// integer registers
+	s = append(s, `<feature name="org.gnu.gdb.riscv.cpu">`)
+	for i := uint(0); i < 32; i++ {
+		t := "int"
+		switch i {
+		case rv.RegRa:
+			t = "code_ptr"
+		case rv.RegSp, rv.RegGp, rv.RegTp:
+			t = "data_ptr"
+		}
+		s = append(s, fmt.Sprintf(`<reg name="%s" bitsize="%d" type="%s" regnum="%d"/>`, rv.XName(i), xlen, t, i))
+	}
+	s = append(s, fmt.Sprintf(`<reg name="pc" bitsize="%d" type="code_ptr" regnum="%d"/>`, xlen, regPC))
+	s = append(s, `</feature>`)
+	// float registers
+	s = append(s, `<feature name="org.gnu.gdb.riscv.fpu">`)
+	for i := uint(0); i < 32; i++ {
+		s = append(s, fmt.Sprintf(`<reg name="%s" bitsize="64" type="ieee_double" regnum="%d"/>`, rv.FName(i), regF0+i))
+	}
+	for _, reg := range []uint{1, 2, 3} {
+		s = append(s, fmt.Sprintf(`<reg name="%s" bitsize="32" type="int" regnum="%d"/>`, csr.Name(reg), regCSR0+reg))
+	}
+	s = append(s, `</feature>`)
+	// control and status registers
+	s = append(s, `<feature name="org.gnu.gdb.riscv.csr">`)
+	for _, reg := range csr.Readable() {
+		if fpuCSR[reg] {
+			continue
+		}
+		s = append(s, fmt.Sprintf(`<reg name="%s" bitsize="%d" type="int" regnum="%d"/>`, csr.Name(reg), xlen, regCSR0+reg))
+	}
+	s = append(s, `</feature>`)
+	// privilege mode
+	s = append(s, `<feature name="org.gnu.gdb.riscv.virtual">`)
+	s = append(s, fmt.Sprintf(`<reg name="priv" bitsize="%d" type="int" regnum="%d"/>`, xlen, regPriv))
+	s = append(s, `</feature>`)
+	s = append(s, `</target>`)
+	return strings.Join(s, "\n")
+}
+
+//-----------------------------------------------------------------------------
@@ -1,11 +1,24 @@
 //-----------------------------------------------------------------------------
 /*
 
-to/from host functions
+Host Target Interface (HTIF)
 
-Compliance testing communicates with the "host" via reads/writes to memory
-locations with symbols "tohost" and "fromhost". This code intercepts this
-acess via the breakpoint mechanism and records interesting state.
+Test programs and the proxy kernel (riscv-pk) communicate with the "host"
+via the memory locations with symbols "tohost" and "fromhost". Writes to
+"tohost" are intercepted with the breakpoint mechanism.
+
+A 64-bit "tohost" value is a command:
+
+	device<<56 | command<<48 | payload
+
+	device 0, command 0: payload&1 = 1 is an exit with status payload>>1
+	device 0, command 0: payload&1 = 0 is a proxied syscall (see syscall.go)
+	device 1, command 0: console read (getchar)
+	device 1, command 1: console write (putchar)
+
+The host consumes a command by clearing "tohost". Responses are written
+to "fromhost" when it is clear (the target clears it once it has read
+the response), so they are queued until then.
 
 */
 //-----------------------------------------------------------------------------
@@ -14,37 +27,99 @@ package host
 
 import (
 	"fmt"
-	"strings"
+	"io"
+	"os"
 
+	"github.com/deadsy/riscv/device"
 	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/replay"
 )
 
 //-----------------------------------------------------------------------------
 
-// Host stores the state of writes to the "tohost" location.
+// HTIF devices and commands
+const (
+	devSyscall   = 0
+	devConsole   = 1
+	cmdSyscall   = 0
+	cmdGetchar   = 0
+	cmdPutchar   = 1
+	payloadMask  = (1 << 48) - 1
+	consoleValid = 0x100 // a console read response has a character
+)
+
+// Config is the HTIF configuration.
+type Config struct {
+	Tohost   uint            // address of "tohost"
+	Size     uint            // size of "tohost" and "fromhost" (4 or 8)
+	Fromhost uint            // address of "fromhost" (0 = no responses)
+	Console  *device.Console // host terminal (default os.Stdin and os.Stdout)
+	Stderr   io.Writer       // error output for the proxied syscalls (default os.Stderr)
+	Root     string          // sandbox root directory for proxied file access ("" = no file access)
+	Args     []string        // program arguments for the proxy kernel (getmainvars)
+	Inputs   *replay.Log     // record/replay of nondeterministic inputs (optional)
+}
+
+// Symbols sets the "tohost" and "fromhost" addresses from the symbols of
+// a loaded program. It returns false if there is no "tohost" symbol.
+func (cfg *Config) Symbols(m *mem.Memory) bool {
+	sym := m.SymbolByName("tohost")
+	if sym == nil {
+		return false
+	}
+	cfg.Tohost = sym.Addr
+	cfg.Size = sym.Size
+	if sym := m.SymbolByName("fromhost"); sym != nil {
+		cfg.Fromhost = sym.Addr
+	}
+	return true
+}
+
+// Host is the host side of the HTIF.
 type Host struct {
-	mem    *mem.Memory // memory sub-system
-	addr   uint        // base address of "tohost" symbol
-	status uint
-	text   []rune // characters written "tohost"
+	cfg      Config
+	mem      *mem.Memory   // memory sub-system
+	status   uint64        // exit payload
+	exited   bool          // the target has exited
+	reads    int           // pending console reads
+	response []uint64      // queued "fromhost" responses
+	fd       map[int]*file // open files for proxied syscalls
 }
 
-// NewHost returns a Host empty structure.
-func NewHost(mem *mem.Memory, addr uint) *Host {
-	return &Host{
-		mem:  mem,
-		addr: addr,
-		text: make([]rune, 0, 128),
+// NewHost returns the host side of the HTIF, and adds the breakpoints for
+// the "tohost" writes.
+func NewHost(m *mem.Memory, cfg Config) *Host {
+	if cfg.Console == nil {
+		cfg.Console = device.NewConsole(nil, nil)
+	}
+	if cfg.Stderr == nil {
+		cfg.Stderr = os.Stderr
 	}
+	h := &Host{
+		cfg: cfg,
+		mem: m,
+		fd: map[int]*file{
+			0: {console: true},
+			1: {console: true},
+			2: {wr: cfg.Stderr},
+		},
+	}
+	fn := func(bp *mem.BreakPoint) bool { return h.To32(bp) }
+	if cfg.Size == 8 {
+		// trap on a 64-bit write, or a write to the most significant word
+		fn = func(bp *mem.BreakPoint) bool { return h.To64(bp) }
+		m.AddBreakPoint("tohost", cfg.Tohost+4, mem.AttrW, fn)
+	}
+	m.AddBreakPoint("tohost", cfg.Tohost, mem.AttrW, fn)
+	return h
 }
 
 func (h *Host) String() string {
-	s := []string{}
-	s = append(s, fmt.Sprintf("(%d)", h.status))
-	if h.text != nil {
-		s = append(s, strings.TrimSpace(string(h.text)))
+	s := fmt.Sprintf("(%d)", h.status)
+	if len(h.response) != 0 || h.reads != 0 {
+		s += fmt.Sprintf(" %d queued responses, %d pending reads", len(h.response), h.reads)
 	}
-	return strings.Join(s, " ")
+	return s
 }
 
 // Passed returns if the compliance test has passed.
@@ -52,38 +127,111 @@ func (h *Host) Passed() bool {
 	return h.status == 1
 }
 
+// Exited returns the exit status if the target has exited.
+func (h *Host) Exited() (int, bool) {
+	return int(h.status >> 1), h.exited
+}
+
 //-----------------------------------------------------------------------------
 
-// The risc-v compliance tests use this as the upper word in "tohost" when
-// they want to send a character to the host.
-const charMagic = 0x01010000
+// rd reads a tohost/fromhost location.
+func (h *Host) rd(adr uint) uint64 {
+	if h.cfg.Size == 8 {
+		val, _ := h.mem.Rd64Phys(adr)
+		return val
+	}
+	val, _ := h.mem.Rd32Phys(adr)
+	return uint64(val)
+}
+
+// wr writes a tohost/fromhost location.
+func (h *Host) wr(adr uint, val uint64) {
+	if h.cfg.Size == 8 {
+		h.mem.Wr64Phys(adr, val)
+	} else {
+		h.mem.Wr32Phys(adr, uint32(val))
+	}
+}
 
 // To64 intercepts writes to a 64-bit tohost memory location.
 func (h *Host) To64(bp *mem.BreakPoint) bool {
-	// get the tohost value
-	val, _ := h.mem.Rd64Phys(h.addr)
-	// Is this a character write?
-	if (val >> 32) == charMagic {
-		h.text = append(h.text, rune(val&0xff))
-		// signal write consumption to the risc-v test.
-		h.mem.Wr64Phys(h.addr, 0)
-		// no break
+	if bp.Addr == h.cfg.Tohost && bp.Size != 8 {
+		// wait for the most significant word
 		return false
 	}
-	h.status = uint(val)
-	// break
-	return true
+	val := h.rd(h.cfg.Tohost)
+	if val == 0 {
+		return false
+	}
+	h.wr(h.cfg.Tohost, 0)
+	return h.command(val)
 }
 
-//-----------------------------------------------------------------------------
-
 // To32 intercepts writes to a 32-bit tohost memory location.
 func (h *Host) To32(bp *mem.BreakPoint) bool {
-	// get the tohost value
-	val, _ := h.mem.Rd32Phys(h.addr)
-	h.status = uint(val)
-	// break
-	return true
+	val := h.rd(h.cfg.Tohost)
+	if val == 0 {
+		return false
+	}
+	h.wr(h.cfg.Tohost, 0)
+	return h.command(val)
+}
+
+// command runs a tohost command and returns true if the emulation should stop.
+func (h *Host) command(val uint64) bool {
+	dev := val >> 56
+	cmd := (val >> 48) & 0xff
+	payload := val & payloadMask
+	switch {
+	case dev == devSyscall && cmd == cmdSyscall:
+		if payload&1 != 0 {
+			h.status = payload
+			h.exited = true
+			return true
+		}
+		if h.syscall(payload) {
+			return true
+		}
+		h.respond(val&^payloadMask | 1)
+	case dev == devConsole && cmd == cmdGetchar:
+		h.reads++
+	case dev == devConsole && cmd == cmdPutchar:
+		h.cfg.Console.Write([]byte{byte(payload)})
+	}
+	h.Poll()
+	return false
+}
+
+//-----------------------------------------------------------------------------
+
+// respond queues a response.
+func (h *Host) respond(val uint64) {
+	if h.cfg.Fromhost != 0 {
+		h.response = append(h.response, val)
+	}
+}
+
+// Poll reads the console for pending reads and writes the next queued
+// response to "fromhost" (if the target has consumed the last one).
+func (h *Host) Poll() {
+	if h.cfg.Fromhost == 0 {
+		return
+	}
+	if h.reads != 0 {
+		buf := h.cfg.Console.Input(h.cfg.Inputs, "htif.getchar", 1)
+		if len(buf) != 0 {
+			h.reads--
+			h.respond(devConsole<<56 | cmdGetchar<<48 | consoleValid | uint64(buf[0]))
+		}
+	}
+	if len(h.response) == 0 {
+		return
+	}
+	if h.rd(h.cfg.Fromhost) != 0 {
+		return
+	}
+	h.wr(h.cfg.Fromhost, h.response[0])
+	h.response = h.response[1:]
 }
 
 //-----------------------------------------------------------------------------
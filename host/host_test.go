@@ -0,0 +1,240 @@
+//-----------------------------------------------------------------------------
+/*
+
+HTIF Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package host
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/device"
+	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/replay"
+)
+
+//-----------------------------------------------------------------------------
+
+const (
+	tohost   = 0x1000
+	fromhost = 0x1040
+	magic    = 0x1100 // syscall buffer
+	dataBase = 0x1200
+)
+
+// target acts as the target side of the HTIF.
+type target struct {
+	t *testing.T
+	m *mem.Memory
+	h *Host
+}
+
+// syscall runs a proxied syscall and returns the result.
+func (x *target) syscall(n uint64, args ...uint64) int64 {
+	x.m.Wr64(magic, n)
+	for i := 0; i < magicWords-1; i++ {
+		var a uint64
+		if i < len(args) {
+			a = args[i]
+		}
+		x.m.Wr64(magic+8*uint(i+1), a)
+	}
+	x.m.Wr64(tohost, magic)
+	if x.m.GetBreak() != nil {
+		x.t.Fatalf("syscall %d stopped the emulation", n)
+	}
+	if fh, _ := x.m.Rd64(fromhost); fh != 1 {
+		x.t.Fatalf("syscall %d: fromhost is %x", n, fh)
+	}
+	x.m.Wr64(fromhost, 0)
+	rc, _ := x.m.Rd64(magic)
+	return int64(rc)
+}
+
+// wrString writes a string to memory and returns the address and length (with the nul).
+func (x *target) wrString(adr uint, s string) (uint64, uint64) {
+	x.m.Patch(adr, append([]byte(s), 0))
+	return uint64(adr), uint64(len(s) + 1)
+}
+
+func Test_HTIF(t *testing.T) {
+	root, err := ioutil.TempDir("", "htif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "data.txt"), []byte("hello world"), 0644)
+
+	var out bytes.Buffer
+	state := csr.NewState(64, 0)
+	m := mem.NewMem64(state, 0)
+	m.Add(mem.NewSection("ram", 0x1000, 0x1000, mem.AttrRW))
+	h := NewHost(m, Config{
+		Tohost:   tohost,
+		Size:     8,
+		Fromhost: fromhost,
+		Console:  device.NewConsole(strings.NewReader("k"), &out),
+		Root:     root,
+		Args:     []string{"pk", "prog", "arg"},
+	})
+	x := &target{t, m, h}
+
+	// console output (64-bit and split 32-bit writes)
+	m.Wr64(tohost, devConsole<<56|cmdPutchar<<48|'h')
+	m.Wr32(tohost, 'i')
+	if out.String() != "h" {
+		t.Errorf("the low word of a split write was taken as a command")
+	}
+	m.Wr32(tohost+4, devConsole<<24|cmdPutchar<<16)
+	if out.String() != "hi" {
+		t.Errorf("console output is \"%s\"", out.String())
+	}
+	if val, _ := m.Rd64(tohost); val != 0 {
+		t.Errorf("tohost was not consumed")
+	}
+
+	// proxied syscalls
+	buf, n := x.wrString(dataBase, "!\n")
+	if x.syscall(64, 1, buf, n-1) != 2 || out.String() != "hi!\n" {
+		t.Errorf("bad write, console output is \"%s\"", out.String())
+	}
+	if x.syscall(2011, dataBase, 0x100) != 0 {
+		t.Fatalf("getmainvars failed")
+	}
+	argc, _ := m.Rd64(dataBase)
+	argv2, _ := m.Rd64(dataBase + 24)
+	arg, _ := m.Rd8(uint(argv2))
+	if argc != 3 || arg != 'a' {
+		t.Errorf("bad getmainvars argc %d", argc)
+	}
+	name, n := x.wrString(dataBase, "/../data.txt")
+	fd := x.syscall(56, ^uint64(99), name, n, 0, 0)
+	if fd != 3 {
+		t.Fatalf("openat returned %d", fd)
+	}
+	if x.syscall(67, uint64(fd), dataBase, 5, 6) != 5 {
+		t.Errorf("bad pread")
+	}
+	if s, _ := m.Rd8(dataBase + 4); s != 'd' {
+		t.Errorf("bad pread data")
+	}
+	if x.syscall(80, uint64(fd), dataBase) != 0 {
+		t.Errorf("bad fstat")
+	}
+	if size, _ := m.Rd64(dataBase + 48); size != 11 {
+		t.Errorf("fstat size is %d", size)
+	}
+	if x.syscall(57, uint64(fd)) != 0 || x.syscall(57, uint64(fd)) != -eBADF {
+		t.Errorf("bad close")
+	}
+	name, n = x.wrString(dataBase, "missing")
+	if x.syscall(48, ^uint64(99), name, n, 0) != -eNOENT {
+		t.Errorf("bad faccessat")
+	}
+	if x.syscall(63, 0, 0x1ff0, ^uint64(0)) != -eFAULT {
+		t.Errorf("read with a bad length")
+	}
+	if x.syscall(0x1234) != -eNOSYS {
+		t.Errorf("unknown syscall")
+	}
+
+	// console input
+	m.Wr64(tohost, devConsole<<56|cmdGetchar<<48)
+	for i := 0; i < 1000; i++ {
+		if fh, _ := m.Rd64(fromhost); fh != 0 {
+			break
+		}
+		// wait for the background console reader
+		time.Sleep(time.Millisecond)
+		h.Poll()
+	}
+	if fh, _ := m.Rd64(fromhost); fh != devConsole<<56|consoleValid|'k' {
+		t.Errorf("getchar response is %x", fh)
+	}
+
+	// exit
+	m.Wr64(tohost, 3<<1|1)
+	if m.GetBreak() == nil {
+		t.Errorf("no break on exit")
+	}
+	if status, ok := h.Exited(); !ok || status != 3 || h.Passed() {
+		t.Errorf("bad exit status %d", status)
+	}
+}
+
+// getchar polls for a console character and returns the poll count.
+func getchar(t *testing.T, m *mem.Memory, h *Host, n *uint64, wait bool) int {
+	m.Wr64(tohost, devConsole<<56|cmdGetchar<<48)
+	for i := 0; i < 1000; i++ {
+		*n++
+		h.Poll()
+		if fh, _ := m.Rd64(fromhost); fh != 0 {
+			if fh != devConsole<<56|consoleValid|'k' {
+				t.Errorf("getchar response is %x", fh)
+			}
+			return i
+		}
+		if wait {
+			// wait for the background console reader
+			time.Sleep(time.Millisecond)
+		}
+	}
+	t.Fatalf("no getchar response")
+	return 0
+}
+
+// The idle polls for a console character are not logged, the character
+// is replayed at the same poll (instruction count) it was recorded.
+func Test_HTIFReplay(t *testing.T) {
+	var n uint64
+	count := func() uint64 { return n }
+	var log bytes.Buffer
+	rec, err := replay.NewRecorder(&log, count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newHost := func(r *replay.Log, in string) (*mem.Memory, *Host) {
+		m := mem.NewMem64(csr.NewState(64, 0), 0)
+		m.Add(mem.NewSection("ram", 0x1000, 0x1000, mem.AttrRW))
+		h := NewHost(m, Config{
+			Tohost:   tohost,
+			Size:     8,
+			Fromhost: fromhost,
+			Console:  device.NewConsole(strings.NewReader(in), ioutil.Discard),
+			Inputs:   r,
+		})
+		return m, h
+	}
+
+	m, h := newHost(rec, "k")
+	i := getchar(t, m, h, &n, true)
+	rec.Flush()
+	if rec.N != 1 {
+		t.Errorf("%d inputs were logged, expected 1", rec.N)
+	}
+
+	n = 0
+	rep, err := replay.NewReplayer(strings.NewReader(log.String()), count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, h = newHost(rep, "")
+	if j := getchar(t, m, h, &n, false); j != i {
+		t.Errorf("replayed at poll %d, recorded at poll %d", j, i)
+	}
+	if rep.Err() != nil || rep.Pending() {
+		t.Errorf("bad replay %v", rep.Err())
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,522 @@
+//-----------------------------------------------------------------------------
+/*
+
+HTIF Frontend Syscall Proxy
+
+The proxy kernel (riscv-pk) passes file and console system calls to the
+host. The target writes the syscall number and arguments to a buffer of
+eight 64-bit words (the "magic memory") and writes its address to
+"tohost". The host runs the syscall, writes the return value to the
+first word of the buffer and responds on "fromhost".
+
+The argument conventions are those of the riscv-fesvr frontend (E.g.
+path names are passed with their length). A failed syscall returns
+-errno. File operations are confined to a sandbox root directory (see
+hostcall).
+
+See:
+
+riscv-isa-sim/fesvr/syscall.cc
+riscv-pk/pk/frontend.c
+
+*/
+//-----------------------------------------------------------------------------
+
+package host
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/deadsy/riscv/hostcall"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+// Linux errno values.
+const (
+	eNOENT = 2
+	eIO    = 5
+	eBADF  = 9
+	eNOMEM = 12
+	eACCES = 13
+	eFAULT = 14
+	eEXIST = 17
+	eSPIPE = 29
+	eNOSYS = 38
+)
+
+// Linux open flags.
+const (
+	oWRONLY = 01
+	oRDWR   = 02
+	oCREAT  = 0100
+	oEXCL   = 0200
+	oTRUNC  = 01000
+	oAPPEND = 02000
+)
+
+// Linux file types (st_mode).
+const (
+	sIFCHR = 0020000
+	sIFDIR = 0040000
+	sIFREG = 0100000
+)
+
+// magicWords is the number of 64-bit words in the syscall buffer.
+const magicWords = 8
+
+// sysExit is the exit syscall number.
+const sysExit = 93
+
+// file is an open file for the proxied syscalls.
+type file struct {
+	f       *os.File  // host file
+	console bool      // console input and output
+	wr      io.Writer // error output
+}
+
+//-----------------------------------------------------------------------------
+// helpers
+
+// errno returns the -errno value for a host error.
+func errno(err error) int64 {
+	return -int64(hostcall.Errno(err))
+}
+
+// rdBuf reads a buffer from physical memory.
+func (h *Host) rdBuf(adr, n uint64) ([]byte, bool) {
+	return hostcall.NewMemory(h.mem, false).RdBuf(adr, n)
+}
+
+// wrBuf writes a buffer to physical memory.
+func (h *Host) wrBuf(adr uint64, buf []byte) bool {
+	return hostcall.NewMemory(h.mem, false).WrBuf(adr, buf)
+}
+
+// path returns the host path for a (name address, length) pair in the sandbox.
+func (h *Host) path(adr, n uint64) (string, int64) {
+	buf, ok := h.rdBuf(adr, n)
+	if !ok {
+		return "", -eFAULT
+	}
+	name := strings.SplitN(string(buf), "\x00", 2)[0]
+	path, err := hostcall.Path(h.cfg.Root, name)
+	if err != nil {
+		return "", errno(err)
+	}
+	return path, 0
+}
+
+// getFd returns the open file for a file descriptor.
+func (h *Host) getFd(fd uint64) (*file, int64) {
+	x, ok := h.fd[int(int32(fd))]
+	if !ok {
+		return nil, -eBADF
+	}
+	return x, 0
+}
+
+// newFd returns a file descriptor for an open file.
+func (h *Host) newFd(x *file) int64 {
+	n := 0
+	for {
+		if _, ok := h.fd[n]; !ok {
+			h.fd[n] = x
+			return int64(n)
+		}
+		n++
+	}
+}
+
+// input returns the data and return code of a host file operation
+// (a nondeterministic input).
+func (h *Host) input(src string, fn func() ([]byte, int64)) ([]byte, int64) {
+	return hostcall.Input(h.cfg.Inputs, src, fn)
+}
+
+// read reads from a file at an offset (< 0 for the current offset).
+func (h *Host) read(x *file, n uint64, ofs int64) ([]byte, int64) {
+	return h.input("htif.read", func() ([]byte, int64) {
+		if x.console {
+			// wait for console input, as per a blocking read
+			return h.cfg.Console.ReadWait(int(n)), 0
+		}
+		if x.f == nil {
+			return nil, -eBADF
+		}
+		buf := make([]byte, n)
+		var k int
+		var err error
+		if ofs < 0 {
+			k, err = x.f.Read(buf)
+		} else {
+			k, err = x.f.ReadAt(buf, ofs)
+		}
+		if err != nil && err != io.EOF {
+			return nil, errno(err)
+		}
+		return buf[:k], 0
+	})
+}
+
+// write writes to a file at an offset (< 0 for the current offset).
+func (h *Host) write(x *file, buf []byte, ofs int64) int64 {
+	var n int
+	var err error
+	switch {
+	case x.console:
+		h.cfg.Console.Write(buf)
+		n = len(buf)
+	case x.wr != nil:
+		n, err = x.wr.Write(buf)
+	case x.f == nil:
+		return -eBADF
+	case ofs < 0:
+		n, err = x.f.Write(buf)
+	default:
+		n, err = x.f.WriteAt(buf, ofs)
+	}
+	if err != nil && n == 0 {
+		return errno(err)
+	}
+	return int64(n)
+}
+
+// statBuf returns a struct stat (the frontend layout).
+func statBuf(fi os.FileInfo) []byte {
+	mode := uint32(sIFCHR | 0620)
+	var size int64
+	var t, ns uint64
+	if fi != nil {
+		mode = uint32(fi.Mode().Perm())
+		if fi.IsDir() {
+			mode |= sIFDIR
+		} else {
+			mode |= sIFREG
+		}
+		size = fi.Size()
+		t = uint64(fi.ModTime().Unix())
+		ns = uint64(fi.ModTime().Nanosecond())
+	}
+	buf := make([]byte, 128)
+	binary.LittleEndian.PutUint32(buf[16:], mode)                   // st_mode
+	binary.LittleEndian.PutUint32(buf[20:], 1)                      // st_nlink
+	binary.LittleEndian.PutUint64(buf[48:], uint64(size))           // st_size
+	binary.LittleEndian.PutUint32(buf[56:], 4096)                   // st_blksize
+	binary.LittleEndian.PutUint64(buf[64:], uint64((size+511)/512)) // st_blocks
+	for i := 0; i < 3; i++ {
+		// st_atime, st_mtime, st_ctime
+		binary.LittleEndian.PutUint64(buf[72+16*i:], t)
+		binary.LittleEndian.PutUint64(buf[80+16*i:], ns)
+	}
+	return buf
+}
+
+// wrStat writes the struct stat from a host stat function (a nondeterministic input).
+func (h *Host) wrStat(adr uint64, fn func() ([]byte, int64)) int64 {
+	buf, rc := h.input("htif.stat", fn)
+	if rc != 0 {
+		return rc
+	}
+	if !h.wrBuf(adr, buf) {
+		return -eFAULT
+	}
+	return 0
+}
+
+//-----------------------------------------------------------------------------
+// system calls
+
+func (h *Host) scGetcwd(a []uint64) int64 {
+	// the working directory is the sandbox root
+	if a[1] < 2 {
+		return -eNOMEM
+	}
+	if !h.wrBuf(a[0], []byte("/\x00")) {
+		return -eFAULT
+	}
+	return 0
+}
+
+func (h *Host) scMkdirat(a []uint64) int64 {
+	path, rc := h.path(a[1], a[2])
+	if rc != 0 {
+		return rc
+	}
+	err := os.Mkdir(path, os.FileMode(a[3]&0777))
+	if err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+func (h *Host) scUnlinkat(a []uint64) int64 {
+	path, rc := h.path(a[1], a[2])
+	if rc != 0 {
+		return rc
+	}
+	err := os.Remove(path)
+	if err != nil {
+		return errno(err)
+	}
+	return 0
+}
+
+func (h *Host) scFaccessat(a []uint64) int64 {
+	path, rc := h.path(a[1], a[2])
+	if rc != 0 {
+		return rc
+	}
+	_, rc = h.input("htif.faccessat", func() ([]byte, int64) {
+		_, err := os.Stat(path)
+		if err != nil {
+			return nil, errno(err)
+		}
+		return nil, 0
+	})
+	return rc
+}
+
+func (h *Host) scOpenat(a []uint64) int64 {
+	path, rc := h.path(a[1], a[2])
+	if rc != 0 {
+		return rc
+	}
+	flags := a[3]
+	oflags := os.O_RDONLY
+	switch flags & 3 {
+	case oWRONLY:
+		oflags = os.O_WRONLY
+	case oRDWR:
+		oflags = os.O_RDWR
+	}
+	if flags&oCREAT != 0 {
+		oflags |= os.O_CREATE
+	}
+	if flags&oEXCL != 0 {
+		oflags |= os.O_EXCL
+	}
+	if flags&oTRUNC != 0 {
+		oflags |= os.O_TRUNC
+	}
+	if flags&oAPPEND != 0 {
+		oflags |= os.O_APPEND
+	}
+	var f *os.File
+	_, rc = h.input("htif.openat", func() ([]byte, int64) {
+		var err error
+		f, err = os.OpenFile(path, oflags, os.FileMode(a[4]&0777))
+		if err != nil {
+			return nil, errno(err)
+		}
+		return nil, 0
+	})
+	if rc != 0 {
+		return rc
+	}
+	if f == nil {
+		// replayed open, the file reads are replayed and writes are discarded
+		return h.newFd(&file{wr: ioutil.Discard})
+	}
+	return h.newFd(&file{f: f})
+}
+
+func (h *Host) scClose(a []uint64) int64 {
+	x, rc := h.getFd(a[0])
+	if x == nil {
+		return rc
+	}
+	delete(h.fd, int(int32(a[0])))
+	if x.f != nil {
+		err := x.f.Close()
+		if err != nil {
+			return errno(err)
+		}
+	}
+	return 0
+}
+
+func (h *Host) scLseek(a []uint64) int64 {
+	x, rc := h.getFd(a[0])
+	if x == nil {
+		return rc
+	}
+	_, pos := h.input("htif.lseek", func() ([]byte, int64) {
+		if x.f == nil {
+			return nil, -eSPIPE
+		}
+		pos, err := x.f.Seek(int64(a[1]), int(a[2]))
+		if err != nil {
+			return nil, errno(err)
+		}
+		return nil, pos
+	})
+	return pos
+}
+
+func (h *Host) scRead(a []uint64) int64 {
+	return h.pread(a[0], a[1], a[2], -1)
+}
+
+func (h *Host) scPread(a []uint64) int64 {
+	return h.pread(a[0], a[1], a[2], int64(a[3]))
+}
+
+func (h *Host) pread(fd, adr, n uint64, ofs int64) int64 {
+	x, rc := h.getFd(fd)
+	if x == nil {
+		return rc
+	}
+	// a larger read is a short read
+	n = hostcall.Clamp(n)
+	if !hostcall.NewMemory(h.mem, false).Check(adr, n, mem.AttrW) {
+		return -eFAULT
+	}
+	buf, rc := h.read(x, n, ofs)
+	if rc != 0 {
+		return rc
+	}
+	if !h.wrBuf(adr, buf) {
+		return -eFAULT
+	}
+	return int64(len(buf))
+}
+
+func (h *Host) scWrite(a []uint64) int64 {
+	return h.pwrite(a[0], a[1], a[2], -1)
+}
+
+func (h *Host) scPwrite(a []uint64) int64 {
+	return h.pwrite(a[0], a[1], a[2], int64(a[3]))
+}
+
+func (h *Host) pwrite(fd, adr, n uint64, ofs int64) int64 {
+	x, rc := h.getFd(fd)
+	if x == nil {
+		return rc
+	}
+	buf, ok := h.rdBuf(adr, n)
+	if !ok {
+		return -eFAULT
+	}
+	return h.write(x, buf, ofs)
+}
+
+func (h *Host) scFstatat(a []uint64) int64 {
+	path, rc := h.path(a[1], a[2])
+	if rc != 0 {
+		return rc
+	}
+	return h.wrStat(a[3], func() ([]byte, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, errno(err)
+		}
+		return statBuf(fi), 0
+	})
+}
+
+func (h *Host) scFstat(a []uint64) int64 {
+	x, rc := h.getFd(a[0])
+	if x == nil {
+		return rc
+	}
+	return h.wrStat(a[1], func() ([]byte, int64) {
+		if x.f == nil {
+			// console
+			return statBuf(nil), 0
+		}
+		fi, err := x.f.Stat()
+		if err != nil {
+			return nil, errno(err)
+		}
+		return statBuf(fi), 0
+	})
+}
+
+// scGetmainvars writes argc, the argv pointers, a null argv and envp
+// terminator (all 64-bit words) and the argument strings.
+func (h *Host) scGetmainvars(a []uint64) int64 {
+	args := h.cfg.Args
+	words := make([]uint64, len(args)+3)
+	words[0] = uint64(len(args))
+	size := uint64(8 * len(words))
+	for i, s := range args {
+		words[i+1] = a[0] + size
+		size += uint64(len(s) + 1)
+	}
+	if size > a[1] {
+		return -eNOMEM
+	}
+	buf := make([]byte, 8*len(words))
+	for i, x := range words {
+		binary.LittleEndian.PutUint64(buf[8*i:], x)
+	}
+	for _, s := range args {
+		buf = append(append(buf, s...), 0)
+	}
+	if !h.wrBuf(a[0], buf) {
+		return -eFAULT
+	}
+	return 0
+}
+
+//-----------------------------------------------------------------------------
+
+type scEntry struct {
+	name string
+	sc   func(h *Host, a []uint64) int64
+}
+
+var scTable = map[uint64]scEntry{
+	17:   {"getcwd", (*Host).scGetcwd},
+	34:   {"mkdirat", (*Host).scMkdirat},
+	35:   {"unlinkat", (*Host).scUnlinkat},
+	48:   {"faccessat", (*Host).scFaccessat},
+	56:   {"openat", (*Host).scOpenat},
+	57:   {"close", (*Host).scClose},
+	62:   {"lseek", (*Host).scLseek},
+	63:   {"read", (*Host).scRead},
+	64:   {"write", (*Host).scWrite},
+	67:   {"pread", (*Host).scPread},
+	68:   {"pwrite", (*Host).scPwrite},
+	79:   {"fstatat", (*Host).scFstatat},
+	80:   {"fstat", (*Host).scFstat},
+	2011: {"getmainvars", (*Host).scGetmainvars},
+}
+
+// syscall runs a proxied syscall with the buffer at an address.
+// It returns true if the emulation should stop (an exit).
+func (h *Host) syscall(adr uint64) bool {
+	buf, ok := h.rdBuf(adr, 8*magicWords)
+	if !ok {
+		fmt.Fprintf(h.cfg.Stderr, "htif: bad syscall buffer address %x\n", adr)
+		return false
+	}
+	magic := make([]uint64, magicWords)
+	for i := range magic {
+		magic[i] = binary.LittleEndian.Uint64(buf[8*i:])
+	}
+	n, args := magic[0], magic[1:]
+	if n == sysExit {
+		h.status = args[0]<<1 | 1
+		h.exited = true
+		return true
+	}
+	rc := int64(-eNOSYS)
+	if e, ok := scTable[n]; ok {
+		rc = e.sc(h, args)
+	} else {
+		fmt.Fprintf(h.cfg.Stderr, "htif: syscall %d is not implemented\n", n)
+	}
+	h.mem.Wr64Phys(uint(adr), uint64(rc))
+	return false
+}
+
+//-----------------------------------------------------------------------------
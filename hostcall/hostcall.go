@@ -0,0 +1,228 @@
+//-----------------------------------------------------------------------------
+/*
+
+Host Call Helpers
+
+Helpers shared by the target to host call handlers: the Linux system
+calls (ecall), semihosting and the HTIF syscall proxy (host).
+
+File operations are confined to a sandbox root directory. A file name is
+relative to the root directory and can't escape it, either with ".." or
+with a symbolic link that resolves to a path outside the root directory.
+
+Target buffers are accessed with the target memory permissions, but
+without break point, cache or trace side effects. A buffer is at most
+MaxIO bytes, so a bad length from the target can't exhaust host memory.
+A larger read or write is a short read or write.
+
+Nondeterministic inputs (E.g. file reads and clocks) go through the
+record/replay log (if there is one).
+
+*/
+//-----------------------------------------------------------------------------
+
+package hostcall
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/replay"
+)
+
+//-----------------------------------------------------------------------------
+
+// MaxIO is the maximum size of a target buffer (bytes).
+const MaxIO = 1 << 20
+
+// Clamp limits a read or write length to MaxIO.
+func Clamp(n uint64) uint64 {
+	if n > MaxIO {
+		return MaxIO
+	}
+	return n
+}
+
+//-----------------------------------------------------------------------------
+// sandbox
+
+// within returns true if a path is the root directory or within it.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Path returns the host path for a file name in the sandbox root directory
+// ("" = no file access). The symbolic links of the existing part of the
+// path are resolved, and they must resolve within the root directory.
+func Path(root, name string) (string, error) {
+	if root == "" {
+		return "", syscall.EACCES
+	}
+	root, err := filepath.Abs(root)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return "", err
+	}
+	// the cleaned absolute name can't escape the root directory
+	path := filepath.Join(root, filepath.Clean("/"+name))
+	// resolve the longest existing prefix, the rest doesn't exist yet
+	dir, rest := path, ""
+	for {
+		x, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			path = filepath.Join(x, rest)
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if fi, err := os.Lstat(dir); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			// a dangling link would be followed by a create
+			return "", syscall.EACCES
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = filepath.Dir(dir)
+	}
+	if !within(root, path) {
+		return "", syscall.EACCES
+	}
+	return path, nil
+}
+
+// Errno returns the errno value for a host error.
+func Errno(err error) int {
+	var e syscall.Errno
+	if errors.As(err, &e) {
+		return int(e)
+	}
+	if os.IsNotExist(err) {
+		return int(syscall.ENOENT)
+	}
+	if os.IsExist(err) {
+		return int(syscall.EEXIST)
+	}
+	if os.IsPermission(err) {
+		return int(syscall.EACCES)
+	}
+	return int(syscall.EIO)
+}
+
+//-----------------------------------------------------------------------------
+// nondeterministic inputs
+
+// Input returns the data and return code of a host operation
+// (a nondeterministic input). The input log is optional.
+func Input(inputs *replay.Log, src string, fn func() ([]byte, int64)) ([]byte, int64) {
+	if inputs != nil {
+		return inputs.Read(src, fn)
+	}
+	return fn()
+}
+
+// Clock returns a nondeterministic clock value. The input log is optional.
+func Clock(inputs *replay.Log, src string, fn func() uint64) uint64 {
+	if inputs != nil {
+		return inputs.Uint64(src, fn)
+	}
+	return fn()
+}
+
+//-----------------------------------------------------------------------------
+// target memory
+
+// Memory accesses the target memory for a host call.
+type Memory struct {
+	mem *mem.Memory
+	vm  bool // virtual addresses
+}
+
+// NewMemory returns the target memory access for a host call.
+// Addresses are virtual (vm) or physical.
+func NewMemory(m *mem.Memory, vm bool) *Memory {
+	return &Memory{mem: m, vm: vm}
+}
+
+// Check returns true if a buffer (of at most MaxIO bytes) can be accessed.
+func (m *Memory) Check(adr, n uint64, attr mem.Attribute) bool {
+	return n <= MaxIO && m.mem.HostCheck(uint(adr), uint(n), attr, m.vm) == nil
+}
+
+// RdBuf reads a buffer (of at most MaxIO bytes).
+func (m *Memory) RdBuf(adr, n uint64) ([]byte, bool) {
+	if !m.Check(adr, n, mem.AttrR) {
+		return nil, false
+	}
+	buf := make([]byte, n)
+	for i := range buf {
+		x, err := m.mem.HostRd8(uint(adr)+uint(i), m.vm)
+		if err != nil {
+			return nil, false
+		}
+		buf[i] = x
+	}
+	return buf, true
+}
+
+// RdString reads a nul terminated string (of at most MaxIO bytes).
+func (m *Memory) RdString(adr uint64) (string, bool) {
+	buf := []byte{}
+	for len(buf) < MaxIO {
+		x, err := m.mem.HostRd8(uint(adr), m.vm)
+		if err != nil {
+			return "", false
+		}
+		if x == 0 {
+			return string(buf), true
+		}
+		buf = append(buf, x)
+		adr++
+	}
+	return "", false
+}
+
+// WrBuf writes a buffer.
+func (m *Memory) WrBuf(adr uint64, buf []byte) bool {
+	if !m.Check(adr, uint64(len(buf)), mem.AttrW) {
+		return false
+	}
+	for i, x := range buf {
+		if m.mem.HostWr8(uint(adr)+uint(i), x, m.vm) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// RdWord reads a little endian word of size bytes.
+func (m *Memory) RdWord(adr uint64, size int) (uint64, bool) {
+	buf, ok := m.RdBuf(adr, uint64(size))
+	if !ok {
+		return 0, false
+	}
+	var x uint64
+	for i := size - 1; i >= 0; i-- {
+		x = x<<8 | uint64(buf[i])
+	}
+	return x, true
+}
+
+// WrWord writes a little endian word of size bytes.
+func (m *Memory) WrWord(adr, val uint64, size int) bool {
+	buf := make([]byte, size)
+	for i := range buf {
+		buf[i] = byte(val >> (8 * uint(i)))
+	}
+	return m.WrBuf(adr, buf)
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,120 @@
+//-----------------------------------------------------------------------------
+/*
+
+Host Call Helper Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package hostcall
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+func Test_Path(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+	root := filepath.Join(dir, "root")
+	os.Mkdir(root, 0755)
+	os.Mkdir(filepath.Join(root, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(dir, "secret"), filepath.Join(root, "out"))
+	os.Symlink(dir, filepath.Join(root, "outdir"))
+	os.Symlink("sub", filepath.Join(root, "in"))
+	os.Symlink(filepath.Join(dir, "nofile"), filepath.Join(root, "dangling"))
+
+	test := []struct {
+		name string
+		path string // "" = access denied
+	}{
+		{"file", filepath.Join(root, "file")},
+		{"/sub/file", filepath.Join(root, "sub/file")},
+		{"../secret", filepath.Join(root, "secret")},
+		{"sub/../../secret", filepath.Join(root, "secret")},
+		{"in/file", filepath.Join(root, "sub/file")},
+		{"out", ""},
+		{"outdir/secret", ""},
+		{"outdir/nofile", ""},
+		{"dangling", ""},
+		{"/", root},
+	}
+	for _, v := range test {
+		path, err := Path(root, v.name)
+		if v.path == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", v.name, path)
+			}
+			continue
+		}
+		if err != nil || path != v.path {
+			t.Errorf("%s: got %s %v, expected %s", v.name, path, err, v.path)
+		}
+	}
+	if _, err := Path("", "file"); err == nil {
+		t.Errorf("no root directory: expected an error")
+	}
+}
+
+func Test_Memory(t *testing.T) {
+	state := csr.NewState(64, 0)
+	m := mem.NewMem64(state, 0)
+	m.Add(mem.NewSection("ram", 0x1000, 0x2000, mem.AttrRW))
+	m.Add(mem.NewSection("rom", 0x4000, 0x1000, mem.AttrR))
+	m.AddBreakPoint("watch", 0x1000, mem.AttrW, nil)
+	x := NewMemory(m, true)
+
+	if !x.WrBuf(0x1000, []byte("hello\x00")) {
+		t.Fatalf("write failed")
+	}
+	if s, ok := x.RdString(0x1000); !ok || s != "hello" {
+		t.Errorf("read \"%s\" %v", s, ok)
+	}
+	if m.GetBreak() != nil {
+		t.Errorf("host access hit a break point")
+	}
+	if !x.WrWord(0x1ff8, 0x1122334455667788, 8) {
+		t.Errorf("word write failed")
+	}
+	if v, ok := x.RdWord(0x1ff8, 8); !ok || v != 0x1122334455667788 {
+		t.Errorf("read %x", v)
+	}
+	// spans two pages
+	if _, ok := x.RdBuf(0x1800, 0x1000); !ok {
+		t.Errorf("read across a page failed")
+	}
+
+	// bad buffers
+	if _, ok := x.RdBuf(0x2800, 0x1000); ok {
+		t.Errorf("read beyond the end of memory")
+	}
+	if _, ok := x.RdBuf(0x1000, ^uint64(0)); ok {
+		t.Errorf("read with a bad length")
+	}
+	if x.WrBuf(0x4000, []byte{1}) {
+		t.Errorf("write to read only memory")
+	}
+	if x.WrBuf(0x2ffe, []byte{1, 2, 3}) {
+		t.Errorf("write beyond the end of memory")
+	}
+	if v, _ := x.RdWord(0x2ffe, 2); v != 0 {
+		t.Errorf("partial write")
+	}
+	if Clamp(^uint64(0)) != MaxIO || Clamp(10) != 10 {
+		t.Errorf("bad clamp")
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,235 @@
+//-----------------------------------------------------------------------------
+/*
+
+Machine Configuration
+
+A machine is described by a JSON file:
+
+	{
+		"name": "board",
+		"xlen": 64,
+		"isa": ["i", "m", "a", "f", "d", "c"],
+		"modes": ["m", "s", "u"],
+		"memory": [
+			{"name": "rom", "base": "0x1000", "size": "64k", "attr": "rx", "file": "boot.bin"},
+			{"name": "ram", "base": "0x80000000", "size": "128m", "attr": "rwx"}
+		],
+		"reset": "0x1000",
+		"devices": [
+			{"type": "clint", "base": "0x2000000"},
+			{"type": "plic", "base": "0xc000000"},
+			{"type": "uart", "base": "0x10000000", "irq": 10},
+			{"type": "finisher", "base": "0x100000"},
+			{"type": "virtio-blk", "file": "rootfs.img", "mode": "cow"},
+			{"type": "virtio-rng", "seed": 1},
+			{"type": "framebuffer", "width": 640, "height": 480, "format": "r5g6b5"}
+		],
+		"counters": {"timebase": 10000000, "cpi": 2},
+		"fdt": {"base": "0x87e00000", "bootargs": "console=ttyS0"}
+	}
+
+Addresses and sizes are numbers or strings (E.g. "0x80000000", "64k", "128m").
+
+*/
+//-----------------------------------------------------------------------------
+
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+
+// Uint is an address or size value.
+// In JSON it is a number or a string with an optional k/m/g suffix.
+type Uint uint64
+
+// UnmarshalJSON decodes a JSON number or string.
+func (x *Uint) UnmarshalJSON(buf []byte) error {
+	var s string
+	if json.Unmarshal(buf, &s) != nil {
+		s = string(buf)
+	}
+	k := uint64(1)
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch {
+	case strings.HasSuffix(s, "k"):
+		k = 1 << 10
+	case strings.HasSuffix(s, "m"):
+		k = 1 << 20
+	case strings.HasSuffix(s, "g"):
+		k = 1 << 30
+	}
+	if k != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return fmt.Errorf("bad value %s", string(buf))
+	}
+	*x = Uint(n * k)
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+// Region is a memory region.
+type Region struct {
+	Name string `json:"name"`
+	Base Uint   `json:"base"`
+	Size Uint   `json:"size"` // default: the size of the backing file
+	Attr string `json:"attr"` // r/w/x/m (default "rw")
+	File string `json:"file"` // initial contents, relative to the config file (optional)
+}
+
+// Device is a memory mapped device.
+type Device struct {
+	Type   string `json:"type"`   // clint, plic, uart, finisher, virtio-blk, virtio-console, virtio-rng or framebuffer
+	Base   *Uint  `json:"base"`   // default: the standard device address
+	IRQ    uint   `json:"irq"`    // plic interrupt source (default: the standard irq)
+	File   string `json:"file"`   // disk image, relative to the config file (virtio-blk)
+	Mode   string `json:"mode"`   // disk image mode: rw, ro or cow (default rw)
+	Seed   int64  `json:"seed"`   // random seed, 0 for host entropy (virtio-rng)
+	Width  uint   `json:"width"`  // pixels (framebuffer)
+	Height uint   `json:"height"` // pixels (framebuffer)
+	Format string `json:"format"` // pixel format (framebuffer, default a8r8g8b8)
+}
+
+// Counters is the counter configuration.
+type Counters struct {
+	Timebase uint64 `json:"timebase"` // real time counter frequency (Hz)
+	CPI      uint   `json:"cpi"`      // clock cycles per instruction
+}
+
+// FDT is the generated device tree configuration.
+type FDT struct {
+	Base     Uint   `json:"base"`     // address of the device tree blob
+	Bootargs string `json:"bootargs"` // kernel command line
+}
+
+// Config is a machine configuration.
+type Config struct {
+	Name     string   `json:"name"`
+	Xlen     uint     `json:"xlen"`     // 32 or 64
+	ISA      []string `json:"isa"`      // single letter ISA extensions (default "g", "c")
+	Modes    []string `json:"modes"`    // privilege modes (default "m", "s", "u")
+	Memory   []Region `json:"memory"`   // memory regions
+	Reset    Uint     `json:"reset"`    // reset vector (default: the program entry point)
+	Devices  []Device `json:"devices"`  // memory mapped devices
+	Counters Counters `json:"counters"` // counter configuration
+	FDT      *FDT     `json:"fdt"`      // generated device tree (optional)
+}
+
+//-----------------------------------------------------------------------------
+
+// Default configuration values.
+const (
+	DefaultTimebase = 10000000
+	DefaultCPI      = 2
+	DefaultFDTBase  = 0x87e00000
+	heapBase        = 0x80000000
+	heapSize        = 1 << 20
+)
+
+// Default returns the default machine configuration for an XLEN.
+// The machine has a 1 MiB heap at 0x80000000 and no devices. The heap is
+// executable, so program images can be loaded to it.
+func Default(xlen uint) *Config {
+	return &Config{
+		Name:  fmt.Sprintf("rv%d", xlen),
+		Xlen:  xlen,
+		ISA:   []string{"g", "c"},
+		Modes: []string{"m", "s", "u"},
+		Memory: []Region{
+			{Name: "heap", Base: heapBase, Size: heapSize, Attr: "rwx"},
+		},
+		Counters: Counters{DefaultTimebase, DefaultCPI},
+	}
+}
+
+// DefaultDevices returns the standard CLINT, PLIC, UART and test finisher devices.
+func DefaultDevices() []Device {
+	return []Device{
+		{Type: "clint"},
+		{Type: "plic"},
+		{Type: "uart"},
+		{Type: "finisher"},
+	}
+}
+
+// Load reads a machine configuration file.
+func Load(filename string) (*Config, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	err = json.Unmarshal(buf, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	err = cfg.check()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	// backing files are relative to the configuration file
+	path := func(name string) string {
+		if name == "" || filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(filepath.Dir(filename), name)
+	}
+	for i := range cfg.Memory {
+		cfg.Memory[i].File = path(cfg.Memory[i].File)
+	}
+	for i := range cfg.Devices {
+		cfg.Devices[i].File = path(cfg.Devices[i].File)
+	}
+	return cfg, nil
+}
+
+// check checks the configuration and sets the default values.
+func (cfg *Config) check() error {
+	if cfg.Xlen != 32 && cfg.Xlen != 64 {
+		return fmt.Errorf("xlen must be 32 or 64")
+	}
+	if cfg.Name == "" {
+		cfg.Name = fmt.Sprintf("rv%d", cfg.Xlen)
+	}
+	if len(cfg.ISA) == 0 {
+		cfg.ISA = []string{"g", "c"}
+	}
+	if len(cfg.Modes) == 0 {
+		cfg.Modes = []string{"m", "s", "u"}
+	}
+	if cfg.Counters.Timebase == 0 {
+		cfg.Counters.Timebase = DefaultTimebase
+	}
+	if cfg.Counters.CPI == 0 {
+		cfg.Counters.CPI = DefaultCPI
+	}
+	for i := range cfg.Memory {
+		r := &cfg.Memory[i]
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("mem%d", i)
+		}
+		if r.Size == 0 && r.File == "" {
+			return fmt.Errorf("memory region \"%s\" has no size", r.Name)
+		}
+		if r.Attr == "" {
+			r.Attr = "rw"
+		}
+	}
+	if cfg.FDT != nil && cfg.FDT.Base == 0 {
+		cfg.FDT.Base = DefaultFDTBase
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
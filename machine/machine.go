@@ -0,0 +1,358 @@
+//-----------------------------------------------------------------------------
+/*
+
+Machine Builder
+
+Build a CPU, memory and devices from a machine configuration.
+
+*/
+//-----------------------------------------------------------------------------
+
+package machine
+
+import (
+	"debug/elf"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/device"
+	"github.com/deadsy/riscv/fdt"
+	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/replay"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// Machine is an emulated machine.
+type Machine struct {
+	Config      *Config
+	CPU         *rv.RV
+	Mem         *mem.Memory
+	Class       elf.Class // ELF class for the XLEN
+	UART        *device.UART
+	PLIC        *device.PLIC
+	Framebuffer *device.Framebuffer // display (or nil)
+	Console     *device.Console     // host terminal shared by the console devices
+	regions     []*mem.RegionInfo   // configured memory regions and devices
+}
+
+// modeBits returns the misa bits for the privilege modes.
+func modeBits(modes []string) (uint, error) {
+	var ext uint
+	m := false
+	for _, s := range modes {
+		switch strings.ToLower(s) {
+		case "m":
+			m = true
+		case "s":
+			ext |= csr.IsaExtS
+		case "u":
+			ext |= csr.IsaExtU
+		default:
+			return 0, fmt.Errorf("privilege mode \"%s\" is not supported", s)
+		}
+	}
+	if !m {
+		return 0, fmt.Errorf("machine mode is required")
+	}
+	if ext&csr.IsaExtS != 0 && ext&csr.IsaExtU == 0 {
+		return 0, fmt.Errorf("supervisor mode requires user mode")
+	}
+	return ext, nil
+}
+
+// NewMachine builds the CPU and memory for a machine configuration.
+// The memory regions are added before any program is loaded, so loaded
+// program sections take precedence.
+func NewMachine(cfg *Config) (*Machine, error) {
+	err := cfg.check()
+	if err != nil {
+		return nil, err
+	}
+
+	// ISA
+	modes, err := modeBits(cfg.Modes)
+	if err != nil {
+		return nil, err
+	}
+	module, err := rv.ISAModules(cfg.Xlen, cfg.ISA)
+	if err != nil {
+		return nil, err
+	}
+	isa := rv.NewISA(modes)
+	err = isa.Add(module)
+	if err != nil {
+		return nil, err
+	}
+
+	// CSR, memory and cpu
+	state := csr.NewState(cfg.Xlen, isa.GetExtensions())
+	mc := &Machine{Config: cfg, Console: device.NewConsole(nil, nil)}
+	if cfg.Xlen == 32 {
+		mc.Mem = mem.NewMem32(state, 0)
+		mc.CPU = rv.NewRV32(isa, mc.Mem, state)
+		mc.Class = elf.ELFCLASS32
+	} else {
+		mc.Mem = mem.NewMem64(state, 0)
+		mc.CPU = rv.NewRV64(isa, mc.Mem, state)
+		mc.Class = elf.ELFCLASS64
+	}
+	mc.CPU.SetCPI(cfg.Counters.CPI)
+	mc.CPU.SetResetVector(uint64(cfg.Reset))
+
+	// memory regions
+	for i := range cfg.Memory {
+		err := mc.addRegion(&cfg.Memory[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mc.CPU.Reset()
+	return mc, nil
+}
+
+// addRegion adds a memory region.
+// A region without a size is sized by its backing file.
+func (mc *Machine) addRegion(r *Region) error {
+	attr, err := mem.AttrArg(r.Attr)
+	if err != nil {
+		return fmt.Errorf("memory region \"%s\": %s", r.Name, err)
+	}
+	var buf []byte
+	if r.File != "" {
+		buf, err = ioutil.ReadFile(r.File)
+		if err != nil {
+			return err
+		}
+	}
+	size := uint(r.Size)
+	if size == 0 {
+		size = uint(len(buf))
+	}
+	if uint(len(buf)) > size {
+		return fmt.Errorf("memory region \"%s\": %s is larger than the region", r.Name, r.File)
+	}
+	r.Size = Uint(size)
+	err = mc.add(mem.NewSection(r.Name, uint(r.Base), size, attr))
+	if err != nil {
+		return err
+	}
+	return mc.Mem.Patch(uint(r.Base), buf)
+}
+
+// add adds a memory region or device that doesn't overlap the others.
+func (mc *Machine) add(r mem.Region) error {
+	ri := r.Info()
+	for _, x := range mc.regions {
+		if ri.Start() <= x.End() && x.Start() <= ri.End() {
+			return fmt.Errorf("%s %s overlaps %s %s", ri.Name(), rangeStr(ri), x.Name(), rangeStr(x))
+		}
+	}
+	mc.regions = append(mc.regions, ri)
+	mc.Mem.Add(r)
+	return nil
+}
+
+// rangeStr returns the address range of a region.
+func rangeStr(ri *mem.RegionInfo) string {
+	return fmt.Sprintf("[%#x, %#x]", ri.Start(), ri.End())
+}
+
+// Heap returns the memory region used as the program heap.
+// This is the first writable memory region (nil if there is none).
+func (mc *Machine) Heap() *Region {
+	for i := range mc.Config.Memory {
+		r := &mc.Config.Memory[i]
+		attr, err := mem.AttrArg(r.Attr)
+		if err == nil && attr&mem.AttrW != 0 {
+			return r
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+// AddDevices adds the memory mapped devices.
+// The device inputs are recorded/replayed with the input log (optional).
+func (mc *Machine) AddDevices(inputs *replay.Log) error {
+	cpu := mc.CPU
+	// the plic is created first, so other devices can use its interrupts
+	for _, d := range mc.Config.Devices {
+		if strings.ToLower(d.Type) == "plic" {
+			if mc.PLIC != nil {
+				return fmt.Errorf("only one plic is supported")
+			}
+			mc.PLIC = device.NewPLIC(cpu.CSR)
+			err := mc.addDevice("plic", d.Base, device.PLICBase, device.PLICSize, mc.PLIC)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	nvirtio := uint(0)
+	for _, d := range mc.Config.Devices {
+		switch strings.ToLower(d.Type) {
+		case "plic":
+			// done
+		case "clint":
+			err := mc.addDevice("clint", d.Base, device.CLINTBase, device.CLINTSize, device.NewCLINT(cpu.CSR))
+			if err != nil {
+				return err
+			}
+		case "uart":
+			if mc.UART != nil {
+				return fmt.Errorf("only one uart is supported")
+			}
+			if d.IRQ == 0 {
+				d.IRQ = device.UARTIRQ
+			}
+			irq, err := mc.irq(d.IRQ)
+			if err != nil {
+				return err
+			}
+			mc.UART = device.NewUART(device.UARTConfig{Console: mc.Console, Inputs: inputs, IRQ: irq})
+			err = mc.addDevice("uart", d.Base, device.UARTBase, device.UARTSize, mc.UART)
+			if err != nil {
+				return err
+			}
+			cpu.AddPoller(mc.UART.Poll)
+		case "virtio-blk":
+			mode, err := blockMode(d.Mode)
+			if err != nil {
+				return err
+			}
+			blk, err := device.NewBlock(device.BlockConfig{Image: d.File, Mode: mode})
+			if err != nil {
+				return err
+			}
+			err = mc.addVirtIO(&d, &nvirtio, blk)
+			if err != nil {
+				return err
+			}
+		case "virtio-console":
+			vc := device.NewVirtIOConsole(device.VirtIOConsoleConfig{Console: mc.Console, Inputs: inputs})
+			err := mc.addVirtIO(&d, &nvirtio, vc)
+			if err != nil {
+				return err
+			}
+		case "virtio-rng":
+			rng := device.NewVirtIORNG(device.VirtIORNGConfig{Seed: d.Seed, Inputs: inputs})
+			err := mc.addVirtIO(&d, &nvirtio, rng)
+			if err != nil {
+				return err
+			}
+		case "finisher":
+			f := device.NewFinisher(device.FinisherConfig{
+				Exit:  func(status int) { cpu.Halt(cpu.Exit(status)) },
+				Reset: cpu.Reboot,
+			})
+			err := mc.addDevice("finisher", d.Base, device.FinisherBase, device.FinisherSize, f)
+			if err != nil {
+				return err
+			}
+		case "framebuffer":
+			if mc.Framebuffer != nil {
+				return fmt.Errorf("only one framebuffer is supported")
+			}
+			fb, err := device.NewFramebuffer(device.FramebufferConfig{Width: d.Width, Height: d.Height, Format: d.Format})
+			if err != nil {
+				return err
+			}
+			mc.Framebuffer = fb
+			err = mc.addDevice("framebuffer", d.Base, device.FramebufferBase, fb.Size(), fb)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("device type \"%s\" is not supported", d.Type)
+		}
+	}
+	return nil
+}
+
+// addVirtIO adds a virtio-mmio device. The n-th virtio device defaults to
+// the n-th standard virtio address and irq.
+func (mc *Machine) addVirtIO(d *Device, n *uint, dev device.VirtIODevice) error {
+	base := device.VirtIOBase + *n*device.VirtIOStride
+	if d.Base != nil {
+		base = uint(*d.Base)
+	}
+	if d.IRQ == 0 {
+		d.IRQ = device.VirtIOIRQ + *n
+	}
+	irq, err := mc.irq(d.IRQ)
+	if err != nil {
+		return err
+	}
+	v := device.NewVirtIO(mc.Mem, dev, irq)
+	err = mc.add(mem.NewDevice(fmt.Sprintf("virtio%d", *n), base, device.VirtIOSize, v))
+	if err != nil {
+		return err
+	}
+	mc.CPU.AddPoller(v.Poll)
+	*n++
+	return nil
+}
+
+// irq returns a plic interrupt line (or nil if there is no plic).
+func (mc *Machine) irq(n uint) (*device.IRQ, error) {
+	if mc.PLIC == nil {
+		return nil, nil
+	}
+	if n >= device.PLICSources {
+		return nil, fmt.Errorf("irq %d is not a valid plic source", n)
+	}
+	return mc.PLIC.IRQ(n), nil
+}
+
+// blockMode returns the block device mode for a mode string.
+func blockMode(s string) (device.BlockMode, error) {
+	switch strings.ToLower(s) {
+	case "", "rw":
+		return device.BlockRW, nil
+	case "ro":
+		return device.BlockRO, nil
+	case "cow":
+		return device.BlockCOW, nil
+	}
+	return 0, fmt.Errorf("disk image mode \"%s\" is not valid (rw, ro or cow)", s)
+}
+
+// addDevice adds a memory mapped device at its configured (or standard) address.
+func (mc *Machine) addDevice(name string, base *Uint, std, size uint, io mem.DeviceIO) error {
+	adr := std
+	if base != nil {
+		adr = uint(*base)
+	}
+	return mc.add(mem.NewDevice(name, adr, size, io))
+}
+
+//-----------------------------------------------------------------------------
+
+// FDTBase returns the address of the generated device tree blob.
+func (mc *Machine) FDTBase() uint {
+	if mc.Config.FDT != nil {
+		return uint(mc.Config.FDT.Base)
+	}
+	return DefaultFDTBase
+}
+
+// PlaceFDT generates the device tree for the machine and puts it in memory.
+// It should be called once the program has been loaded.
+func (mc *Machine) PlaceFDT(cfg *fdt.Config) (*fdt.Tree, error) {
+	if mc.Config.FDT != nil && cfg.Bootargs == "" {
+		cfg.Bootargs = mc.Config.FDT.Bootargs
+	}
+	if cfg.Model == "" {
+		cfg.Model = mc.Config.Name
+	}
+	cfg.Timebase = mc.Config.Counters.Timebase
+	return fdt.Place(mc.CPU, cfg, mc.FDTBase())
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,249 @@
+//-----------------------------------------------------------------------------
+/*
+
+Machine Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package machine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/device"
+	"github.com/deadsy/riscv/fdt"
+	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+const textBase = 0x1000
+
+const testConfig = `{
+	"name": "board",
+	"xlen": 32,
+	"isa": ["i", "m", "c"],
+	"modes": ["m", "u"],
+	"memory": [
+		{"name": "rom", "base": "0x1000", "attr": "rx", "file": "rom.bin"},
+		{"name": "ram", "base": "0x80000000", "size": "64k"}
+	],
+	"reset": "0x1000",
+	"devices": [
+		{"type": "clint"},
+		{"type": "plic", "base": 201326592},
+		{"type": "uart", "base": "0x10000000", "irq": 3},
+		{"type": "virtio-rng", "seed": 1},
+		{"type": "virtio-console"}
+	],
+	"counters": {"cpi": 1}
+}`
+
+func Test_Machine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "machine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "board.json")
+	ioutil.WriteFile(fname, []byte(testConfig), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "rom.bin"), []byte{0x13, 0, 0, 0, 0x13, 0, 0, 0}, 0644) // nop, nop
+
+	cfg, err := Load(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc, err := NewMachine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mc.AddDevices(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := mc.CPU
+
+	// isa and privilege modes
+	ext := cpu.ISA().GetExtensions()
+	if ext != csr.IsaExtI|csr.IsaExtM|csr.IsaExtC|csr.IsaExtU || cpu.Xlen() != 32 {
+		t.Errorf("bad isa %x", ext)
+	}
+
+	// memory regions and devices
+	if mc.Mem.GetSectionName(0x1004) != "rom" || mc.Mem.GetSectionName(0x8000fffc) != "ram" {
+		t.Errorf("bad memory regions")
+	}
+	names := []string{}
+	for _, d := range mc.Mem.Devices() {
+		names = append(names, d.Info().Name())
+	}
+	if strings.Join(names, ",") != "clint,plic,uart,virtio0,virtio1" {
+		t.Errorf("bad devices %v", names)
+	}
+
+	// run from the reset vector
+	if cpu.PC != 0x1000 {
+		t.Fatalf("pc is %x", cpu.PC)
+	}
+	err = cpu.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cycles, _ := cpu.CSR.Counters()
+	if cpu.PC != 0x1004 || cycles != 1 {
+		t.Errorf("pc %x, cycles %d", cpu.PC, cycles)
+	}
+
+	// device tree
+	tree, err := mc.PlaceFDT(&fdt.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dts := tree.DTS()
+	for _, s := range []string{"riscv,isa = \"rv32imc_zicsr_zifencei\";", "interrupts = <0x3>;", "model = \"board\";", "virtio_mmio@10002000"} {
+		if !strings.Contains(dts, s) {
+			t.Errorf("no %s in\n%s", s, dts)
+		}
+	}
+	if strings.Contains(dts, "mmu-type") {
+		t.Errorf("mmu-type without supervisor mode")
+	}
+}
+
+func Test_Default(t *testing.T) {
+	presets := map[uint][]rv.ISAModule{32: rv.ISArv32gc, 64: rv.ISArv64gc}
+	for xlen, preset := range presets {
+		mc, err := NewMachine(Default(xlen))
+		if err != nil {
+			t.Fatal(err)
+		}
+		isa := rv.NewISA(csr.IsaExtS | csr.IsaExtU)
+		isa.Add(preset)
+		if mc.CPU.ISA().GetExtensions() != isa.GetExtensions() {
+			t.Errorf("rv%d: bad isa", xlen)
+		}
+		// loaded program sections take precedence over the heap
+		mc.Mem.Insert(mem.NewSection("text", heapBase, 0x100, mem.AttrRX))
+		if mc.Mem.GetSectionName(heapBase) != "text" || mc.Mem.GetSectionName(heapBase+0x100) != "heap" {
+			t.Errorf("rv%d: bad memory precedence", xlen)
+		}
+	}
+	if _, err := NewMachine(&Config{Xlen: 64, ISA: []string{"i", "q"}}); err == nil {
+		t.Errorf("unsupported extension accepted")
+	}
+}
+
+func Test_Overlap(t *testing.T) {
+	base := func(x Uint) *Uint { return &x }
+	tests := []struct {
+		memory  []Region
+		devices []Device
+		ok      bool
+	}{
+		{[]Region{{Base: 0x1000, Size: 0x1000}, {Base: 0x1800, Size: 0x1000}}, nil, false},
+		{[]Region{{Base: 0x1000, Size: 0x1000}, {Base: 0x2000, Size: 0x1000}}, nil, true},
+		{[]Region{{Base: 0x2000000, Size: 0x1000}}, []Device{{Type: "clint"}}, false},
+		{nil, []Device{{Type: "clint"}, {Type: "finisher", Base: base(0x2000000)}}, false},
+		{nil, []Device{{Type: "virtio-rng"}, {Type: "virtio-rng", Base: base(device.VirtIOBase)}}, false},
+		// an explicit base of 0 is not the standard address
+		{[]Region{{Base: 0x1000, Size: 0x1000}}, []Device{{Type: "finisher", Base: base(0)}}, true},
+	}
+	for i, v := range tests {
+		mc, err := NewMachine(&Config{Xlen: 64, Memory: v.memory, Devices: v.devices})
+		if err == nil {
+			err = mc.AddDevices(nil)
+		}
+		if (err == nil) != v.ok {
+			t.Errorf("test %d: error %v", i, err)
+		}
+		if err == nil && len(v.devices) != 0 && v.devices[0].Base != nil && mc.Mem.Devices()[0].Info().Start() != 0 {
+			t.Errorf("test %d: device is not at address 0", i)
+		}
+	}
+
+	// the heap is the first writable region
+	cfg := Default(32)
+	cfg.Memory = append([]Region{{Name: "rom", Base: 0x1000, Size: 0x1000, Attr: "rx"}}, cfg.Memory...)
+	mc, err := NewMachine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if heap := mc.Heap(); heap == nil || heap.Base != heapBase || heap.Size != heapSize {
+		t.Errorf("bad heap %v", heap)
+	}
+}
+
+func Test_Finisher(t *testing.T) {
+	cfg := Default(64)
+	cfg.Devices = DefaultDevices()
+	mc, err := NewMachine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mc.AddDevices(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := mc.CPU
+	mc.Mem.Insert(mem.NewSection("text", textBase, 0x100, mem.AttrRX))
+	cpu.SetResetVector(textBase)
+
+	// run a program that writes to the finisher, return the pc and error
+	run := func(cmd uint32) (uint64, error) {
+		prog := []string{
+			"lui t0,0x100",
+			fmt.Sprintf("lui t1,0x%x", cmd>>12),
+			fmt.Sprintf("addi t1,t1,%d", int32(cmd<<20)>>20),
+			"sw t1,0(t0)",
+			"addi zero,zero,0",
+		}
+		adr := uint(textBase)
+		for _, s := range prog {
+			n, err := cpu.Assemble(adr, s)
+			if err != nil {
+				t.Fatalf("\"%s\" %s", s, err)
+			}
+			adr += n
+		}
+		cpu.Reset()
+		for i := 0; i < 4; i++ {
+			err := cpu.Run()
+			if err != nil {
+				return cpu.PC, err
+			}
+		}
+		return cpu.PC, nil
+	}
+
+	tests := []struct {
+		cmd    uint32
+		status int
+	}{
+		{0x5555, 0},
+		{0x3333, 1},
+		{0x7f3333, 0x7f},
+	}
+	for _, x := range tests {
+		pc, err := run(x.cmd)
+		e, ok := err.(*rv.Error)
+		if !ok || e.Type != rv.ErrExit || e.ExitStatus() != x.status || pc != textBase+16 {
+			t.Errorf("%x: bad exit %v", x.cmd, err)
+		}
+	}
+
+	// reset
+	pc, err := run(0x7777)
+	if err != nil || pc != textBase {
+		t.Errorf("no reset (pc %x, %v)", pc, err)
+	}
+}
+
+//-----------------------------------------------------------------------------
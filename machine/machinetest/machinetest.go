@@ -0,0 +1,66 @@
+//-----------------------------------------------------------------------------
+/*
+
+Machine Test Helpers
+
+Build a machine from the default configuration for the tests of packages
+that run programs on a cpu (E.g. cosim, gdb, sbi). Each test adds its own
+memory regions and assembles its own test program.
+
+*/
+//-----------------------------------------------------------------------------
+
+package machinetest
+
+import (
+	"testing"
+
+	"github.com/deadsy/riscv/machine"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// build returns a machine for a configuration with extra memory regions.
+func build(t testing.TB, cfg *machine.Config, regions []machine.Region) *machine.Machine {
+	t.Helper()
+	cfg.Memory = append(cfg.Memory, regions...)
+	mc, err := machine.NewMachine(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mc.AddDevices(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mc
+}
+
+// New returns a default machine (without devices) with extra memory regions.
+func New(t testing.TB, xlen uint, regions ...machine.Region) *machine.Machine {
+	t.Helper()
+	return build(t, machine.Default(xlen), regions)
+}
+
+// NewDevices returns a default machine with the default devices and extra memory regions.
+func NewDevices(t testing.TB, xlen uint, regions ...machine.Region) *machine.Machine {
+	t.Helper()
+	cfg := machine.Default(xlen)
+	cfg.Devices = machine.DefaultDevices()
+	return build(t, cfg, regions)
+}
+
+// Assemble assembles a program at an address and returns the end address.
+func Assemble(t testing.TB, cpu *rv.RV, adr uint, prog ...string) uint {
+	t.Helper()
+	for _, s := range prog {
+		n, err := cpu.Assemble(adr, s)
+		if err != nil {
+			t.Fatalf("\"%s\" %s", s, err)
+		}
+		adr += n
+	}
+	return adr
+}
+
+//-----------------------------------------------------------------------------
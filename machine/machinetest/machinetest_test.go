@@ -0,0 +1,37 @@
+//-----------------------------------------------------------------------------
+/*
+
+Machine Test Helper Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package machinetest
+
+import (
+	"testing"
+
+	"github.com/deadsy/riscv/machine"
+)
+
+//-----------------------------------------------------------------------------
+
+func Test_New(t *testing.T) {
+	mc := New(t, 32, machine.Region{Name: "text", Base: 0x1000, Size: 0x1000, Attr: "rx"})
+	if mc.CPU.Xlen() != 32 || mc.UART != nil {
+		t.Errorf("bad default machine")
+	}
+	end := Assemble(t, mc.CPU, 0x1000, "addi a0,zero,1", "c.addi a0,a0,1", "ecall")
+	if end != 0x100a {
+		t.Errorf("program ends at %x, expected 100a", end)
+	}
+	if mc.Mem.GetSectionName(0x1000) != "text" || mc.Mem.GetSectionName(0x80000000) != "heap" {
+		t.Errorf("bad memory regions")
+	}
+	mc = NewDevices(t, 64)
+	if mc.UART == nil || mc.PLIC == nil {
+		t.Errorf("no default devices")
+	}
+}
+
+//-----------------------------------------------------------------------------
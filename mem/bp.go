@@ -5,6 +5,10 @@ Memory Break Points
 
 Perform a debug action when specific memory addresses have RWX access.
 
+A break point is identified by its address, access and name (the owner),
+so different users (E.g. gdb, the HTIF) can have break points at the same
+address. A break point covers one or more bytes (E.g. a watch point).
+
 */
 //-----------------------------------------------------------------------------
 
@@ -39,6 +43,8 @@ type BreakPoint struct {
 	Name   string    // breakpoint name
 	Addr   uint      // address for trigger
 	Access Attribute // access for trigger
+	Len    uint      // number of bytes covered
+	Size   uint      // size of the triggering access
 	alen   uint      // address bit length
 	state  bpState   // breakpoint state
 	cond   bpFunc    // condition function
@@ -47,16 +53,59 @@ type BreakPoint struct {
 func (mon *BreakPoint) String() string {
 	s := []string{}
 	s = append(s, addrStr(mon.Addr, mon.alen))
+	if mon.Len > 1 {
+		s = append(s, fmt.Sprintf("len %d", mon.Len))
+	}
 	s = append(s, mon.Access.String())
 	s = append(s, mon.state.String())
+	s = append(s, mon.Name)
 	return strings.Join(s, " ")
 }
 
+// bpKey identifies a break point.
+type bpKey struct {
+	addr   uint
+	access Attribute
+	name   string
+}
+
+func (mon *BreakPoint) key() bpKey {
+	return bpKey{mon.Addr, mon.Access, mon.Name}
+}
+
+// bpIndex rebuilds the break point index (break points by byte address).
+func (m *Memory) bpIndex() {
+	m.bpAddr = make(map[uint][]*BreakPoint)
+	for _, bp := range m.bp {
+		for i := uint(0); i < bp.Len; i++ {
+			m.bpAddr[bp.Addr+i] = append(m.bpAddr[bp.Addr+i], bp)
+		}
+	}
+}
+
 //-----------------------------------------------------------------------------
 
 func (m *Memory) monitor(addr, size uint, access Attribute) {
-	bp, ok := m.bp[addr]
-	if !ok {
+	if len(m.bpAddr) == 0 {
+		return
+	}
+	for i := uint(0); i < size; i++ {
+		for _, bp := range m.bpAddr[addr+i] {
+			if i == 0 || addr+i == bp.Addr {
+				// once per access
+				m.trigger(bp, addr, size, access)
+			}
+		}
+	}
+}
+
+// trigger handles an access to a break point.
+func (m *Memory) trigger(bp *BreakPoint, addr, size uint, access Attribute) {
+	if m.bpOff {
+		// note data accesses that would trigger
+		if access&bp.Access&(AttrR|AttrW) != 0 && bp.state != sOff {
+			m.bpHit = true
+		}
 		return
 	}
 	if access&bp.Access == 0 || bp.state == sOff {
@@ -65,10 +114,14 @@ func (m *Memory) monitor(addr, size uint, access Attribute) {
 	}
 	if bp.state == sSkip {
 		// trigger on the next access
+		if m.bpUndo != nil {
+			m.bpUndo(bp)
+		}
 		bp.state = sOn
 		return
 	}
 	// triggered...
+	bp.Size = size
 	brk := true
 	if bp.cond != nil {
 		brk = bp.cond(bp)
@@ -83,15 +136,50 @@ func (m *Memory) monitor(addr, size uint, access Attribute) {
 
 // AddBreakPoint adds a break point.
 func (m *Memory) AddBreakPoint(name string, addr uint, attr Attribute, cond bpFunc) {
+	m.AddWatchPoint(name, addr, 1, attr, cond)
+}
+
+// AddWatchPoint adds a break point covering n bytes.
+// It replaces a break point with the same name, address and access.
+func (m *Memory) AddWatchPoint(name string, addr, n uint, attr Attribute, cond bpFunc) {
+	if n == 0 {
+		n = 1
+	}
 	bp := &BreakPoint{
 		Name:   name,
 		Addr:   addr,
 		Access: attr,
+		Len:    n,
 		alen:   m.alen,
 		state:  sOn,
 		cond:   cond,
 	}
-	m.bp[addr] = bp
+	m.bp[bp.key()] = bp
+	m.bpIndex()
+}
+
+// RemoveBreakPoint removes the break point with a name, address and access.
+func (m *Memory) RemoveBreakPoint(name string, addr uint, attr Attribute) {
+	delete(m.bp, bpKey{addr, attr, name})
+	m.bpIndex()
+}
+
+// SkipBreakPoint skips the next trigger of the break point with a name, address and access.
+func (m *Memory) SkipBreakPoint(name string, addr uint, attr Attribute) error {
+	bp, ok := m.bp[bpKey{addr, attr, name}]
+	if !ok {
+		return fmt.Errorf("break point \"%s\" not found", name)
+	}
+	bp.state = sSkip
+	return nil
+}
+
+// BreakPointUndoFunc is called with a break point before its skip state is cleared.
+type BreakPointUndoFunc func(bp *BreakPoint)
+
+// SetBreakPointUndo sets the break point skip undo logger (nil to remove).
+func (m *Memory) SetBreakPointUndo(fn BreakPointUndoFunc) {
+	m.bpUndo = fn
 }
 
 // AddBreakPointByName adds a break point by symbol name.
@@ -104,6 +192,30 @@ func (m *Memory) AddBreakPointByName(name string, attr Attribute, cond bpFunc) e
 	return nil
 }
 
+// BreakPointAt returns true if there is an enabled break point for the address and access.
+func (m *Memory) BreakPointAt(addr uint, access Attribute) bool {
+	for _, bp := range m.bpAddr[addr] {
+		if bp.state != sOff && access&bp.Access != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// EnableBreakPoints enables (or disables) all break points.
+func (m *Memory) EnableBreakPoints(on bool) {
+	m.bpOff = !on
+	m.bpHit = false
+}
+
+// WatchHit returns (and resets) a flag indicating that a data access matched
+// a break point while the break points were disabled.
+func (m *Memory) WatchHit() bool {
+	hit := m.bpHit
+	m.bpHit = false
+	return hit
+}
+
 //-----------------------------------------------------------------------------
 
 // GetBreak returned (and resets) any pending breakpoint.
@@ -120,7 +232,18 @@ type bpByAddr []*BreakPoint
 
 func (a bpByAddr) Len() int           { return len(a) }
 func (a bpByAddr) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
-func (a bpByAddr) Less(i, j int) bool { return a[i].Addr < a[j].Addr }
+func (a bpByAddr) Less(i, j int) bool { return bpLess(a[i], a[j]) }
+
+// bpLess orders break points by address, access and name.
+func bpLess(a, b *BreakPoint) bool {
+	if a.Addr != b.Addr {
+		return a.Addr < b.Addr
+	}
+	if a.Access != b.Access {
+		return a.Access < b.Access
+	}
+	return a.Name < b.Name
+}
 
 // DisplayBreakPoints displays a string for the memory break points.
 func (m *Memory) DisplayBreakPoints() string {
@@ -0,0 +1,464 @@
+//-----------------------------------------------------------------------------
+/*
+
+Cache Simulation
+
+A set associative cache model that sits on the instruction fetch and data
+paths of the memory sub-system. It doesn't hold any data, it just tracks
+tags so we can count hits and misses for a given cache geometry. Misses can
+optionally be charged to the mcycle counter.
+
+*/
+//-----------------------------------------------------------------------------
+
+package mem
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	cli "github.com/deadsy/go-cli"
+)
+
+//-----------------------------------------------------------------------------
+
+// Policy is a cache line replacement policy.
+type Policy uint
+
+// Replacement policies.
+const (
+	PolicyLRU    Policy = iota // least recently used
+	PolicyRandom               // random
+	PolicyFIFO                 // first in, first out
+)
+
+func (p Policy) String() string {
+	return [3]string{"lru", "random", "fifo"}[p]
+}
+
+// CacheConfig is the configuration for a cache.
+type CacheConfig struct {
+	Name      string // cache name
+	Size      uint   // total size in bytes
+	Ways      uint   // associativity
+	LineSize  uint   // line size in bytes
+	Policy    Policy // replacement policy
+	WriteBack bool   // write-back (true) or write-through (false)
+	Penalty   uint   // miss penalty charged to mcycle (0 = none)
+}
+
+func (cfg *CacheConfig) String() string {
+	wb := "wt"
+	if cfg.WriteBack {
+		wb = "wb"
+	}
+	return fmt.Sprintf("%d bytes, %d-way, %d byte lines, %s, %s, penalty %d", cfg.Size, cfg.Ways, cfg.LineSize, cfg.Policy, wb, cfg.Penalty)
+}
+
+// isPow2 returns true if x is a non-zero power of 2.
+func isPow2(x uint) bool {
+	return x != 0 && x&(x-1) == 0
+}
+
+// sizeArg converts a size string (with optional k/m suffix) to a value.
+func sizeArg(s string) (uint, error) {
+	k := uint(1)
+	s = strings.ToLower(s)
+	if strings.HasSuffix(s, "k") {
+		k = 1 << 10
+		s = strings.TrimSuffix(s, "k")
+	} else if strings.HasSuffix(s, "m") {
+		k = 1 << 20
+		s = strings.TrimSuffix(s, "m")
+	}
+	x, err := strconv.ParseUint(s, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad size \"%s\"", s)
+	}
+	return uint(x) * k, nil
+}
+
+// CacheArg converts a "size/ways/line[/policy][/wb|wt][/penalty]" string
+// (eg: "16k/4/32/lru/wb/10") to a cache configuration.
+func CacheArg(name, arg string) (*CacheConfig, error) {
+	x := strings.Split(arg, "/")
+	if len(x) < 3 {
+		return nil, errors.New("cache config is size/ways/line[/policy][/wb|wt][/penalty]")
+	}
+	cfg := &CacheConfig{
+		Name:      name,
+		Policy:    PolicyLRU,
+		WriteBack: true,
+	}
+	var err error
+	cfg.Size, err = sizeArg(x[0])
+	if err != nil {
+		return nil, err
+	}
+	cfg.Ways, err = sizeArg(x[1])
+	if err != nil {
+		return nil, err
+	}
+	cfg.LineSize, err = sizeArg(x[2])
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range x[3:] {
+		switch strings.ToLower(s) {
+		case "lru":
+			cfg.Policy = PolicyLRU
+		case "random":
+			cfg.Policy = PolicyRandom
+		case "fifo":
+			cfg.Policy = PolicyFIFO
+		case "wb":
+			cfg.WriteBack = true
+		case "wt":
+			cfg.WriteBack = false
+		default:
+			n, err := strconv.ParseUint(s, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("cache option \"%s\" is not valid", s)
+			}
+			cfg.Penalty = uint(n)
+		}
+	}
+	return cfg, nil
+}
+
+//-----------------------------------------------------------------------------
+
+// cacheLine is the state of a single cache line.
+type cacheLine struct {
+	tag   uint   // line address tag
+	valid bool   // line is valid
+	dirty bool   // line has been written (write-back only)
+	used  uint64 // time of last use (lru)
+	fill  uint64 // time of line fill (fifo)
+}
+
+// cacheStats are the access statistics for a region and symbol.
+type cacheStats struct {
+	hits, misses uint64
+}
+
+// cacheKey is the region and symbol of an address.
+// The statistics are kept by key, so they are bounded by the number of symbols.
+type cacheKey struct {
+	region, symbol string
+}
+
+// Cache is a set associative cache model.
+type Cache struct {
+	cfg        CacheConfig
+	sets       [][]cacheLine
+	lineShift  uint
+	setMask    uint
+	next       *Cache                   // next level cache (nil for memory)
+	rnd        *rand.Rand               // random replacement
+	time       uint64                   // access time for lru/fifo
+	hits       uint64                   // total hits
+	misses     uint64                   // total misses
+	writebacks uint64                   // dirty line evictions
+	locate     func(adr uint) cacheKey  // statistics key for an address (nil = no statistics)
+	stats      map[cacheKey]*cacheStats // statistics by region and symbol
+}
+
+// NewCache returns a cache model for the configuration.
+// Misses are passed to the next level cache (which may be nil).
+func NewCache(cfg *CacheConfig, next *Cache) (*Cache, error) {
+	if !isPow2(cfg.LineSize) {
+		return nil, fmt.Errorf("%s: line size must be a power of 2", cfg.Name)
+	}
+	if cfg.Ways == 0 || cfg.Size%(cfg.Ways*cfg.LineSize) != 0 {
+		return nil, fmt.Errorf("%s: size must be a multiple of ways * line size", cfg.Name)
+	}
+	nsets := cfg.Size / (cfg.Ways * cfg.LineSize)
+	if !isPow2(nsets) {
+		return nil, fmt.Errorf("%s: number of sets must be a power of 2", cfg.Name)
+	}
+	c := &Cache{
+		cfg:     *cfg,
+		sets:    make([][]cacheLine, nsets),
+		setMask: nsets - 1,
+		next:    next,
+		rnd:     rand.New(rand.NewSource(1)),
+		stats:   make(map[cacheKey]*cacheStats),
+	}
+	for c.lineShift = 0; (1 << c.lineShift) < cfg.LineSize; c.lineShift++ {
+	}
+	for i := range c.sets {
+		c.sets[i] = make([]cacheLine, cfg.Ways)
+	}
+	return c, nil
+}
+
+// Reset invalidates the cache and clears the statistics.
+func (c *Cache) Reset() {
+	for i := range c.sets {
+		for j := range c.sets[i] {
+			c.sets[i][j] = cacheLine{}
+		}
+	}
+	c.time = 0
+	c.hits = 0
+	c.misses = 0
+	c.writebacks = 0
+	c.stats = make(map[cacheKey]*cacheStats)
+}
+
+// stat returns the statistics for an address.
+func (c *Cache) stat(adr uint) *cacheStats {
+	if c.locate == nil {
+		return &cacheStats{}
+	}
+	key := c.locate(adr)
+	st := c.stats[key]
+	if st == nil {
+		st = &cacheStats{}
+		c.stats[key] = st
+	}
+	return st
+}
+
+// victim returns the way to be replaced within a set.
+func (c *Cache) victim(set []cacheLine) int {
+	// use an invalid line if we have one
+	for i := range set {
+		if !set[i].valid {
+			return i
+		}
+	}
+	k := 0
+	switch c.cfg.Policy {
+	case PolicyLRU:
+		for i := range set {
+			if set[i].used < set[k].used {
+				k = i
+			}
+		}
+	case PolicyFIFO:
+		for i := range set {
+			if set[i].fill < set[k].fill {
+				k = i
+			}
+		}
+	case PolicyRandom:
+		k = c.rnd.Intn(len(set))
+	}
+	return k
+}
+
+// line accesses a single cache line and returns the cycle penalty.
+func (c *Cache) line(adr uint, write bool) uint {
+	c.time++
+	lineAdr := adr >> c.lineShift
+	set := c.sets[lineAdr&c.setMask]
+
+	st := c.stat(adr)
+
+	// hit?
+	for i := range set {
+		if set[i].valid && set[i].tag == lineAdr {
+			c.hits++
+			st.hits++
+			set[i].used = c.time
+			if write {
+				if c.cfg.WriteBack {
+					set[i].dirty = true
+					return 0
+				}
+				// write-through
+				return c.nextAccess(adr, true)
+			}
+			return 0
+		}
+	}
+
+	// miss
+	c.misses++
+	st.misses++
+	penalty := c.cfg.Penalty
+
+	if write && !c.cfg.WriteBack {
+		// write-through with no write allocate
+		return penalty + c.nextAccess(adr, true)
+	}
+
+	// evict a line
+	k := c.victim(set)
+	if set[k].valid && set[k].dirty {
+		c.writebacks++
+		penalty += c.nextAccess(set[k].tag<<c.lineShift, true)
+	}
+
+	// fill the line
+	penalty += c.nextAccess(adr, false)
+	set[k] = cacheLine{
+		tag:   lineAdr,
+		valid: true,
+		dirty: write,
+		used:  c.time,
+		fill:  c.time,
+	}
+	return penalty
+}
+
+// nextAccess passes an access to the next level cache.
+func (c *Cache) nextAccess(adr uint, write bool) uint {
+	if c.next == nil {
+		return 0
+	}
+	return c.next.line(adr, write)
+}
+
+// Access performs a cache access and returns the cycle penalty.
+func (c *Cache) Access(adr, size uint, write bool) uint {
+	first := adr >> c.lineShift
+	last := (adr + size - 1) >> c.lineShift
+	penalty := c.line(adr, write)
+	if last != first {
+		// the access crosses a line boundary
+		penalty += c.line(last<<c.lineShift, write)
+	}
+	return penalty
+}
+
+//-----------------------------------------------------------------------------
+
+// SetCache sets the instruction and data cache models.
+// Either may be nil (no cache).
+func (m *Memory) SetCache(icache, dcache *Cache) {
+	m.icache = icache
+	m.dcache = dcache
+	for _, c := range []*Cache{icache, dcache} {
+		for ; c != nil; c = c.next {
+			c.locate = m.cacheKey
+		}
+	}
+}
+
+// cacheKey returns the cache statistics key for an address.
+func (m *Memory) cacheKey(adr uint) cacheKey {
+	name := "?"
+	if sym := m.SymbolNearest(adr); sym != nil {
+		name = sym.Name
+	}
+	return cacheKey{m.GetSectionName(adr), name}
+}
+
+// cacheAccess runs a successful memory access through a cache model.
+// Device registers are uncached.
+func (m *Memory) cacheAccess(c *Cache, pa, size uint, write bool, err error) {
+	if c == nil || err != nil {
+		return
+	}
+	if _, ok := m.findByAddr(pa, size).(*Section); !ok {
+		return
+	}
+	penalty := c.Access(pa, size, write)
+	if penalty != 0 {
+		m.csr.IncClockCycles(penalty)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// cacheSummary accumulates statistics for a report row.
+type cacheSummary struct {
+	name         string
+	hits, misses uint64
+}
+
+func (s *cacheSummary) row() []string {
+	total := s.hits + s.misses
+	rate := 0.0
+	if total != 0 {
+		rate = 100.0 * float64(s.misses) / float64(total)
+	}
+	return []string{s.name, fmt.Sprintf("%d", total), fmt.Sprintf("%d", s.hits), fmt.Sprintf("%d", s.misses), fmt.Sprintf("%.2f%%", rate)}
+}
+
+// summaryTable returns a table string for a set of summaries (sorted by misses).
+func summaryTable(title string, x map[string]*cacheSummary) []string {
+	list := []*cacheSummary{}
+	for _, v := range x {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].misses == list[j].misses {
+			return list[i].name < list[j].name
+		}
+		return list[i].misses > list[j].misses
+	})
+	rows := [][]string{{title, "accesses", "hits", "misses", "miss rate"}}
+	for _, v := range list {
+		rows = append(rows, v.row())
+	}
+	return []string{cli.TableString(rows, []int{0, 0, 0, 0, 0}, 1)}
+}
+
+// Report returns a string with the cache statistics by region and by symbol.
+func (c *Cache) Report() string {
+	s := []string{}
+	total := (&cacheSummary{hits: c.hits, misses: c.misses}).row()
+	s = append(s, fmt.Sprintf("%s: %s", c.cfg.Name, &c.cfg))
+	s = append(s, fmt.Sprintf("accesses %s hits %s misses %s (%s)", total[1], total[2], total[3], total[4]))
+	if c.writebacks != 0 {
+		s = append(s, fmt.Sprintf("writebacks %d", c.writebacks))
+	}
+
+	byRegion := make(map[string]*cacheSummary)
+	bySymbol := make(map[string]*cacheSummary)
+	add := func(x map[string]*cacheSummary, name string, st *cacheStats) {
+		sum := x[name]
+		if sum == nil {
+			sum = &cacheSummary{name: name}
+			x[name] = sum
+		}
+		sum.hits += st.hits
+		sum.misses += st.misses
+	}
+
+	for key, st := range c.stats {
+		add(byRegion, key.region, st)
+		add(bySymbol, key.symbol, st)
+	}
+
+	if len(byRegion) != 0 {
+		s = append(s, summaryTable("region", byRegion)...)
+		s = append(s, summaryTable("symbol", bySymbol)...)
+	}
+	return strings.Join(s, "\n")
+}
+
+// CacheReport returns the report for all configured caches.
+func (m *Memory) CacheReport() string {
+	s := []string{}
+	done := make(map[*Cache]bool)
+	for _, c := range []*Cache{m.icache, m.dcache} {
+		for ; c != nil && !done[c]; c = c.next {
+			done[c] = true
+			s = append(s, c.Report())
+		}
+	}
+	if len(s) == 0 {
+		return "no caches"
+	}
+	return strings.Join(s, "\n\n")
+}
+
+// CacheReset invalidates all caches and clears their statistics.
+func (m *Memory) CacheReset() {
+	for _, c := range []*Cache{m.icache, m.dcache} {
+		for ; c != nil; c = c.next {
+			c.Reset()
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,155 @@
+//-----------------------------------------------------------------------------
+/*
+
+Cache Model Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package mem
+
+import "testing"
+
+//-----------------------------------------------------------------------------
+
+func Test_CacheArg(t *testing.T) {
+	tests := []struct {
+		arg string
+		cfg *CacheConfig
+	}{
+		{"16k/4/32", &CacheConfig{Size: 16 << 10, Ways: 4, LineSize: 32, Policy: PolicyLRU, WriteBack: true}},
+		{"1M/8/64/fifo/wt/20", &CacheConfig{Size: 1 << 20, Ways: 8, LineSize: 64, Policy: PolicyFIFO, Penalty: 20}},
+		{"256/2/0x10/Random/WB/0", &CacheConfig{Size: 256, Ways: 2, LineSize: 16, Policy: PolicyRandom, WriteBack: true}},
+		{"16k/4", nil},
+		{"16q/4/32", nil},
+		{"16k/x/32", nil},
+		{"16k/4/32/mru", nil},
+	}
+	for _, v := range tests {
+		cfg, err := CacheArg("c", v.arg)
+		if v.cfg == nil {
+			if err == nil {
+				t.Errorf("\"%s\": expected an error", v.arg)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("\"%s\": %s", v.arg, err)
+			continue
+		}
+		v.cfg.Name = "c"
+		if *cfg != *v.cfg {
+			t.Errorf("\"%s\": is %+v, expected %+v", v.arg, *cfg, *v.cfg)
+		}
+	}
+}
+
+func Test_CacheGeometry(t *testing.T) {
+	tests := []struct {
+		size, ways, line uint
+		ok               bool
+	}{
+		{256, 2, 16, true},
+		{256, 2, 24, false}, // line size is not a power of 2
+		{256, 0, 16, false}, // no ways
+		{256, 3, 16, false}, // size is not a multiple of ways * line size
+		{384, 2, 16, false}, // sets are not a power of 2
+	}
+	for _, v := range tests {
+		_, err := NewCache(&CacheConfig{Name: "c", Size: v.size, Ways: v.ways, LineSize: v.line}, nil)
+		if (err == nil) != v.ok {
+			t.Errorf("%d/%d/%d: error %v", v.size, v.ways, v.line, err)
+		}
+	}
+}
+
+// newTestCache returns a single set 2-way cache with 16 byte lines.
+func newTestCache(t *testing.T, policy Policy, wb bool, next *Cache) *Cache {
+	c, err := NewCache(&CacheConfig{Name: "c", Size: 32, Ways: 2, LineSize: 16, Policy: policy, WriteBack: wb, Penalty: 10}, next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func Test_CachePolicy(t *testing.T) {
+	tests := []struct {
+		policy Policy
+		hits   uint64 // hits for A, B, A, C, A, B
+	}{
+		{PolicyLRU, 2},  // C evicts B, B evicts C
+		{PolicyFIFO, 1}, // C evicts A, A evicts B, B evicts C
+	}
+	for _, v := range tests {
+		c := newTestCache(t, v.policy, true, nil)
+		for _, adr := range []uint{0x00, 0x10, 0x00, 0x20, 0x00, 0x10} {
+			c.Access(adr, 4, false)
+		}
+		if c.hits != v.hits || c.misses != 6-v.hits {
+			t.Errorf("%s: hits %d misses %d", v.policy, c.hits, c.misses)
+		}
+	}
+	// random replacement keeps exactly one of A and B
+	c := newTestCache(t, PolicyRandom, true, nil)
+	for _, adr := range []uint{0x00, 0x10, 0x20, 0x00, 0x10} {
+		c.Access(adr, 4, false)
+	}
+	if c.hits != 1 || c.misses != 4 {
+		t.Errorf("random: hits %d misses %d", c.hits, c.misses)
+	}
+}
+
+func Test_CacheWrite(t *testing.T) {
+	// write-back: a dirty line is written back when it is evicted
+	next := newTestCache(t, PolicyLRU, true, nil)
+	c := newTestCache(t, PolicyLRU, true, next)
+	if p := c.Access(0x00, 4, true); p != 20 {
+		t.Errorf("write miss penalty %d, expected 20", p)
+	}
+	if p := c.Access(0x00, 4, true); p != 0 {
+		t.Errorf("write hit penalty %d, expected 0", p)
+	}
+	c.Access(0x10, 4, false)
+	c.Access(0x20, 4, false)
+	if c.writebacks != 1 {
+		t.Errorf("write-back: writebacks %d, expected 1", c.writebacks)
+	}
+	if next.hits != 1 || next.misses != 3 {
+		t.Errorf("write-back: next level hits %d misses %d, expected 1 3", next.hits, next.misses)
+	}
+
+	// write-through: writes go to the next level and don't allocate
+	next = newTestCache(t, PolicyLRU, true, nil)
+	c = newTestCache(t, PolicyLRU, false, next)
+	c.Access(0x00, 4, true)
+	c.Access(0x00, 4, false)
+	c.Access(0x00, 4, true)
+	c.Access(0x10, 4, false)
+	c.Access(0x20, 4, false)
+	if c.hits != 1 || c.misses != 4 || c.writebacks != 0 {
+		t.Errorf("write-through: hits %d misses %d writebacks %d, expected 1 4 0", c.hits, c.misses, c.writebacks)
+	}
+	if next.hits != 2 || next.misses != 3 {
+		t.Errorf("write-through: next level hits %d misses %d, expected 2 3", next.hits, next.misses)
+	}
+}
+
+func Test_CacheLineCross(t *testing.T) {
+	c := newTestCache(t, PolicyLRU, true, nil)
+	if p := c.Access(0x0e, 4, false); p != 20 {
+		t.Errorf("penalty %d, expected 20", p)
+	}
+	if c.misses != 2 {
+		t.Errorf("misses %d, expected 2", c.misses)
+	}
+	c.Reset()
+	if c.hits != 0 || c.misses != 0 || len(c.stats) != 0 {
+		t.Errorf("reset didn't clear the statistics")
+	}
+	c.Access(0x10, 4, false)
+	if c.misses != 1 {
+		t.Errorf("reset didn't invalidate the lines")
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,193 @@
+//-----------------------------------------------------------------------------
+/*
+
+Memory Mapped Devices
+
+A device is a memory region whose reads and writes are handled by the
+device registers rather than a memory array. Accesses are passed to the
+device as an offset from the start of the region and an access size.
+
+*/
+//-----------------------------------------------------------------------------
+
+package mem
+
+import "sort"
+
+//-----------------------------------------------------------------------------
+
+// DeviceIO is the register interface of a memory mapped device.
+type DeviceIO interface {
+	Rd(ofs, size uint) uint64
+	Wr(ofs, size uint, val uint64)
+}
+
+// DeviceState is implemented by devices whose state can be saved and
+// restored (for checkpoints and reverse execution).
+type DeviceState interface {
+	SaveState() ([]byte, error)
+	RestoreState(buf []byte) error
+}
+
+// DeviceReset is implemented by devices with state that is reset when
+// the machine is rebooted.
+type DeviceReset interface {
+	Reset()
+}
+
+// DeviceMemory is implemented by devices whose registers are plain memory
+// (E.g. a framebuffer). Reads have no side effects and writes only change
+// the bytes written, so they are undone like memory section writes.
+type DeviceMemory interface {
+	Bytes() []uint8
+}
+
+// Device is a memory region for a memory mapped device.
+type Device struct {
+	name       string    // device name
+	attr       Attribute // bitmask of attributes
+	start, end uint      // address range
+	io         DeviceIO  // device registers
+}
+
+// NewDevice returns a memory region for a memory mapped device.
+func NewDevice(name string, start, size uint, io DeviceIO) *Device {
+	return &Device{
+		name:  name,
+		attr:  AttrRW,
+		start: start,
+		end:   start + size - 1,
+		io:    io,
+	}
+}
+
+// IO returns the device register interface.
+func (m *Device) IO() DeviceIO {
+	return m.io
+}
+
+// SetAttr sets the attributes for the device.
+func (m *Device) SetAttr(attr Attribute) {
+	m.attr = attr
+}
+
+// Info returns the information for the device.
+func (m *Device) Info() *RegionInfo {
+	return &RegionInfo{
+		name:  m.name,
+		start: m.start,
+		end:   m.end,
+		attr:  m.attr,
+	}
+}
+
+// In returns true if the adr, size is entirely within the device.
+func (m *Device) In(adr, size uint) bool {
+	end := adr + size - 1
+	return (adr >= m.start) && (end <= m.end) && (end >= adr)
+}
+
+// rd reads a device register.
+func (m *Device) rd(adr, size uint) (uint64, error) {
+	err := rdError(adr, m.attr, m.name, size)
+	if err != nil {
+		return 0, err
+	}
+	return m.io.Rd(adr-m.start, size), nil
+}
+
+// wr writes a device register.
+func (m *Device) wr(adr, size uint, val uint64) error {
+	err := wrError(adr, m.attr, m.name, size)
+	if err != nil {
+		return err
+	}
+	m.io.Wr(adr-m.start, size, val)
+	return nil
+}
+
+// RdIns reads a 32-bit instruction from the device (not executable).
+func (m *Device) RdIns(adr uint) (uint, error) {
+	return 0, rdInsError(adr, m.attr&^AttrX, m.name)
+}
+
+// Rd64 reads a 64-bit device register.
+func (m *Device) Rd64(adr uint) (uint64, error) {
+	return m.rd(adr, 8)
+}
+
+// Rd32 reads a 32-bit device register.
+func (m *Device) Rd32(adr uint) (uint32, error) {
+	val, err := m.rd(adr, 4)
+	return uint32(val), err
+}
+
+// Rd16 reads a 16-bit device register.
+func (m *Device) Rd16(adr uint) (uint16, error) {
+	val, err := m.rd(adr, 2)
+	return uint16(val), err
+}
+
+// Rd8 reads an 8-bit device register.
+func (m *Device) Rd8(adr uint) (uint8, error) {
+	val, err := m.rd(adr, 1)
+	return uint8(val), err
+}
+
+// Wr64 writes a 64-bit device register.
+func (m *Device) Wr64(adr uint, val uint64) error {
+	return m.wr(adr, 8, val)
+}
+
+// Wr32 writes a 32-bit device register.
+func (m *Device) Wr32(adr uint, val uint32) error {
+	return m.wr(adr, 4, uint64(val))
+}
+
+// Wr16 writes a 16-bit device register.
+func (m *Device) Wr16(adr uint, val uint16) error {
+	return m.wr(adr, 2, uint64(val))
+}
+
+// Wr8 writes an 8-bit device register.
+func (m *Device) Wr8(adr uint, val uint8) error {
+	return m.wr(adr, 1, uint64(val))
+}
+
+//-----------------------------------------------------------------------------
+
+// Devices returns the memory mapped devices sorted by start address.
+func (m *Memory) Devices() []*Device {
+	x := []*Device{}
+	for _, r := range m.region {
+		if d, ok := r.(*Device); ok {
+			x = append(x, d)
+		}
+	}
+	sort.Slice(x, func(i, j int) bool { return x[i].start < x[j].start })
+	return x
+}
+
+// ResetDevices resets the memory mapped devices.
+// Memory contents (including device memory) are left as they are.
+func (m *Memory) ResetDevices() {
+	for _, d := range m.Devices() {
+		if x, ok := d.io.(DeviceReset); ok {
+			x.Reset()
+		}
+	}
+}
+
+// Sections returns the memory sections sorted by start address.
+func (m *Memory) Sections() []*RegionInfo {
+	x := []*RegionInfo{}
+	for _, r := range m.region {
+		if _, ok := r.(*Section); ok {
+			x = append(x, r.Info())
+		}
+	}
+	sort.Sort(regionByStart(x))
+	return x
+}
+
+//-----------------------------------------------------------------------------
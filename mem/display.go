@@ -19,18 +19,22 @@ import (
 
 //-----------------------------------------------------------------------------
 
-// Map returns a memory map display string.
-func (m *Memory) Map() string {
-	if len(m.region) == 0 {
-		return "no map"
-	}
-	// list of regions
+// Regions returns the memory region information sorted by start address.
+func (m *Memory) Regions() []*RegionInfo {
 	regions := []*RegionInfo{}
 	for _, r := range m.region {
 		regions = append(regions, r.Info())
 	}
-	// sort by start address
 	sort.Sort(regionByStart(regions))
+	return regions
+}
+
+// Map returns a memory map display string.
+func (m *Memory) Map() string {
+	if len(m.region) == 0 {
+		return "no map"
+	}
+	regions := m.Regions()
 	// display string
 	s := make([][]string, len(regions))
 	for i, r := range regions {
@@ -46,13 +50,10 @@ func (m *Memory) Map() string {
 
 // Symbols returns an address sorted string of memory symbols.
 func (m *Memory) Symbols() string {
-	if len(m.symByName) == 0 {
-		return "no symbols"
-	}
 	// list of symbols
-	symbols := []*Symbol{}
-	for _, v := range m.symByName {
-		symbols = append(symbols, v)
+	symbols := m.allSymbols()
+	if len(symbols) == 0 {
+		return "no symbols"
 	}
 	// sort by address
 	sort.Sort(symbolByAddr(symbols))
@@ -3,6 +3,17 @@
 
 ELF File Handling
 
+An ELF file is loaded by its PT_LOAD program headers. Each segment is a
+memory section with the attributes of the segment flags, and the memory
+size beyond the file data is zero filled.
+
+Position independent executables (ET_DYN) are loaded at a load bias and
+the dynamic relocations are applied.
+
+Several images (E.g. a bootloader, firmware and a kernel) can be loaded
+into the same memory. Each image has its own symbol table, and the image
+symbols can be named as "image:symbol".
+
 */
 //-----------------------------------------------------------------------------
 
@@ -10,114 +21,442 @@ package mem
 
 import (
 	"debug/elf"
+	"encoding/binary"
 	"fmt"
+	"path/filepath"
 	"strings"
 )
 
 //-----------------------------------------------------------------------------
 
-func (m *Memory) loadSymbols(f *elf.File) string {
+// Image is an ELF file loaded to memory.
+type Image struct {
+	Name    string             // image name (the base file name)
+	Bias    uint               // load bias
+	Entry   uint               // entry point
+	symbols map[string]*Symbol // image symbol table
+}
+
+// Images returns the loaded ELF images.
+func (m *Memory) Images() []*Image {
+	return m.images
+}
+
+// ImageByName returns a loaded image by name.
+func (m *Memory) ImageByName(name string) *Image {
+	for _, img := range m.images {
+		if img.Name == name {
+			return img
+		}
+	}
+	return nil
+}
+
+// SymbolByName returns the symbol for a symbol name in the image symbol table.
+func (img *Image) SymbolByName(s string) *Symbol {
+	return img.symbols[s]
+}
+
+func (img *Image) String() string {
+	return fmt.Sprintf("%-16s entry %08x bias %08x (%d symbols)", img.Name, img.Entry, img.Bias, len(img.symbols))
+}
+
+//-----------------------------------------------------------------------------
+
+// elfSymbols returns the symbol table of an ELF file (nil for a stripped file).
+func elfSymbols(f *elf.File) ([]elf.Symbol, error) {
 	st, err := f.Symbols()
+	if err == elf.ErrNoSymbols {
+		return nil, nil
+	}
 	if err != nil {
-		return fmt.Sprintf("can't load symbols")
+		return nil, fmt.Errorf("can't load symbols (%s)", err)
 	}
+	return st, nil
+}
+
+// addSymbols adds the symbols of an ELF file to memory (and to the image symbol table).
+func (m *Memory) addSymbols(st []elf.Symbol, img *Image) (string, error) {
 	n := 0
 	for i := range st {
 		if (st[i].Name == "") || (elf.ST_TYPE(st[i].Info) == elf.STT_FILE) {
 			continue
 		}
-		err := m.AddSymbol(st[i].Name, uint(st[i].Value), uint(st[i].Size))
+		adr := uint(st[i].Value)
+		if img != nil && st[i].Section != elf.SHN_ABS {
+			adr += img.Bias
+		}
+		sym, err := m.addSymbol(st[i].Name, adr, uint(st[i].Size))
 		if err != nil {
-			fmt.Printf("%s\n", err)
-		} else {
-			n++
+			return "", err
 		}
+		if img != nil {
+			img.symbols[sym.Name] = sym
+		}
+		n++
 	}
-	return fmt.Sprintf("loaded %d symbols", n)
+	return fmt.Sprintf("loaded %d symbols", n), nil
 }
 
 //-----------------------------------------------------------------------------
 
-func makeSection(f *elf.File, s *elf.Section) (*Section, string) {
+// segmentName returns the name of the first allocated section in a segment.
+func segmentName(f *elf.File, p *elf.Prog, i int) string {
+	for _, s := range f.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Size == 0 {
+			continue
+		}
+		if s.Flags&elf.SHF_TLS != 0 && s.Type == elf.SHT_NOBITS {
+			// .tbss is a template for thread local storage, it has no memory
+			continue
+		}
+		if s.Addr >= p.Vaddr && s.Addr < p.Vaddr+p.Memsz {
+			return s.Name
+		}
+	}
+	return fmt.Sprintf("segment%d", i)
+}
+
+// makeSegment returns a memory section for a loadable segment.
+func (m *Memory) makeSegment(f *elf.File, p *elf.Prog, i int, img *Image) (*Section, string, error) {
 
-	if s.Size == 0 {
-		return nil, fmt.Sprintf("%s (0 bytes)", s.Name)
+	if p.Filesz > p.Memsz {
+		return nil, "", fmt.Errorf("segment %d file size is larger than the memory size", i)
 	}
 
-	// create the memory section
-	ms := NewSection(s.Name, uint(s.Addr), uint(s.Size), AttrW)
+	name := segmentName(f, p, i)
+	if m.findByName(name) != nil {
+		// another image has a section with the same name
+		name = img.Name + ":" + name
+	}
 
-	if s.Type&elf.SHT_PROGBITS != 0 {
-		// read the section data from the ELF file
-		data, err := s.Data()
-		if err != nil {
-			return nil, fmt.Sprintf("can't read section %s (%s)", s.Name, err)
-		}
-		// write the data to the memory section
-		for i, v := range data {
-			ms.Wr8(uint(s.Addr)+uint(i), v)
-		}
+	// create the memory section, the memory beyond the file data is zero filled
+	adr := uint(p.Vaddr) + img.Bias
+	ms := NewSection(name, adr, uint(p.Memsz), AttrW)
+
+	// read the segment data from the ELF file
+	_, err := p.ReadAt(ms.mem[:p.Filesz], 0)
+	if err != nil {
+		return nil, "", fmt.Errorf("can't read segment %d (%s)", i, err)
 	}
 
 	// work out the memory attribute
-	attr := AttrR
-	if s.Flags&elf.SHF_WRITE != 0 {
+	var attr Attribute
+	if p.Flags&elf.PF_R != 0 {
+		attr |= AttrR
+	}
+	if p.Flags&elf.PF_W != 0 {
 		attr |= AttrW
 	}
-	if s.Flags&elf.SHF_EXECINSTR != 0 {
+	if p.Flags&elf.PF_X != 0 {
 		attr |= AttrX
 	}
 	ms.SetAttr(attr)
 
-	end := s.Addr + s.Size - 1
-	return ms, fmt.Sprintf("%-16s %08x-%08x %s (%d bytes)", s.Name, s.Addr, end, attr.String(), s.Size)
+	end := adr + uint(p.Memsz) - 1
+	return ms, fmt.Sprintf("%-16s %08x-%08x %s (%d bytes)", name, adr, end, attr.String(), p.Memsz), nil
 }
 
 //-----------------------------------------------------------------------------
 
-// LoadELF loads an ELF file to memory.
-func (m *Memory) LoadELF(filename string, class elf.Class) (string, error) {
+// readAddr reads the file data of a loadable segment at a virtual address.
+func readAddr(f *elf.File, adr, n uint64) ([]byte, error) {
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_LOAD && adr >= p.Vaddr && n <= p.Filesz && adr-p.Vaddr <= p.Filesz-n {
+			buf := make([]byte, n)
+			_, err := p.ReadAt(buf, int64(adr-p.Vaddr))
+			return buf, err
+		}
+	}
+	return nil, fmt.Errorf("address %x is not in the file data of a loadable segment", adr)
+}
+
+// dynamicTags returns the entries of the PT_DYNAMIC segment (nil if there is none).
+func dynamicTags(f *elf.File) (map[elf.DynTag]uint64, error) {
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_DYNAMIC {
+			continue
+		}
+		buf := make([]byte, p.Filesz)
+		_, err := p.ReadAt(buf, 0)
+		if err != nil {
+			return nil, fmt.Errorf("can't read the dynamic segment (%s)", err)
+		}
+		dyn := make(map[elf.DynTag]uint64)
+		for len(buf) != 0 {
+			var tag, val uint64
+			if f.Class == elf.ELFCLASS64 {
+				if len(buf) < 16 {
+					break
+				}
+				tag, val = binary.LittleEndian.Uint64(buf), binary.LittleEndian.Uint64(buf[8:])
+				buf = buf[16:]
+			} else {
+				if len(buf) < 8 {
+					break
+				}
+				tag, val = uint64(binary.LittleEndian.Uint32(buf)), uint64(binary.LittleEndian.Uint32(buf[4:]))
+				buf = buf[8:]
+			}
+			if elf.DynTag(tag) == elf.DT_NULL {
+				break
+			}
+			dyn[elf.DynTag(tag)] = val
+		}
+		return dyn, nil
+	}
+	return nil, nil
+}
+
+// symbolValue returns the value of a dynamic symbol for a relocation.
+func symbolValue(f *elf.File, dyn map[elf.DynTag]uint64, i uint32, bias uint) (uint64, error) {
+	if i == 0 {
+		return 0, nil
+	}
+	size := uint64(16)
+	if f.Class == elf.ELFCLASS64 {
+		size = 24
+	}
+	if x, ok := dyn[elf.DT_SYMENT]; ok {
+		size = x
+	}
+	buf, err := readAddr(f, dyn[elf.DT_SYMTAB]+uint64(i)*size, size)
+	if err != nil {
+		return 0, fmt.Errorf("bad relocation symbol index %d", i)
+	}
+	var info byte
+	var shndx uint16
+	var value uint64
+	if f.Class == elf.ELFCLASS64 {
+		info, shndx, value = buf[4], binary.LittleEndian.Uint16(buf[6:]), binary.LittleEndian.Uint64(buf[8:])
+	} else {
+		info, shndx, value = buf[12], binary.LittleEndian.Uint16(buf[14:]), uint64(binary.LittleEndian.Uint32(buf[4:]))
+	}
+	switch elf.SectionIndex(shndx) {
+	case elf.SHN_UNDEF:
+		if elf.ST_BIND(info) == elf.STB_WEAK {
+			return 0, nil
+		}
+		name := "?"
+		ofs := uint64(binary.LittleEndian.Uint32(buf))
+		if ofs < dyn[elf.DT_STRSZ] {
+			if s, err := readAddr(f, dyn[elf.DT_STRTAB]+ofs, dyn[elf.DT_STRSZ]-ofs); err == nil {
+				name = string(s[:strings.IndexByte(string(s)+"\x00", 0)])
+			}
+		}
+		return 0, fmt.Errorf("undefined symbol \"%s\"", name)
+	case elf.SHN_ABS:
+		return value, nil
+	}
+	return value + uint64(bias), nil
+}
+
+// patchSegment writes a relocated value to the segment containing the address.
+func patchSegment(segs []*Section, adr uint, buf []byte) error {
+	for _, ms := range segs {
+		if adr >= ms.start && adr+uint(len(buf))-1 <= ms.end {
+			copy(ms.mem[adr-ms.start:], buf)
+			return nil
+		}
+	}
+	return fmt.Errorf("relocation address %x is not in a loadable segment", adr)
+}
+
+// relocate applies the dynamic relocations of a position independent executable
+// to its segments. The relocation tables are found with the PT_DYNAMIC segment,
+// so section headers aren't needed.
+func relocate(f *elf.File, bias uint, segs []*Section) (string, error) {
+
+	dyn, err := dynamicTags(f)
+	if err != nil {
+		return "", err
+	}
+	if _, ok := dyn[elf.DT_REL]; ok {
+		return "", fmt.Errorf("DT_REL relocations are not supported")
+	}
+	wordSize := 4
+	entSize := uint64(12)
+	if f.Class == elf.ELFCLASS64 {
+		wordSize = 8
+		entSize = 24
+	}
+	if x, ok := dyn[elf.DT_RELAENT]; ok && x != entSize {
+		return "", fmt.Errorf("bad relocation entry size %d", x)
+	}
+
+	// the relocation tables
+	type table struct{ adr, size uint64 }
+	tables := []table{}
+	if adr, ok := dyn[elf.DT_RELA]; ok {
+		tables = append(tables, table{adr, dyn[elf.DT_RELASZ]})
+	}
+	if adr, ok := dyn[elf.DT_JMPREL]; ok {
+		if dyn[elf.DT_PLTREL] != uint64(elf.DT_RELA) {
+			return "", fmt.Errorf("DT_REL relocations are not supported")
+		}
+		tables = append(tables, table{adr, dyn[elf.DT_PLTRELSZ]})
+	}
+
+	n := 0
+	for _, t := range tables {
+		data, err := readAddr(f, t.adr, t.size)
+		if err != nil {
+			return "", fmt.Errorf("can't read the relocations (%s)", err)
+		}
+		for ofs := uint64(0); ofs+entSize <= uint64(len(data)); ofs += entSize {
+			var off, addend uint64
+			var typ, sym uint32
+			if f.Class == elf.ELFCLASS64 {
+				off = binary.LittleEndian.Uint64(data[ofs:])
+				info := binary.LittleEndian.Uint64(data[ofs+8:])
+				addend = binary.LittleEndian.Uint64(data[ofs+16:])
+				typ, sym = elf.R_TYPE64(info), elf.R_SYM64(info)
+			} else {
+				off = uint64(binary.LittleEndian.Uint32(data[ofs:]))
+				info := binary.LittleEndian.Uint32(data[ofs+4:])
+				addend = uint64(int64(int32(binary.LittleEndian.Uint32(data[ofs+8:]))))
+				typ, sym = elf.R_TYPE32(info), elf.R_SYM32(info)
+			}
+			var val uint64
+			size := wordSize
+			switch elf.R_RISCV(typ) {
+			case elf.R_RISCV_NONE:
+				continue
+			case elf.R_RISCV_RELATIVE:
+				val = uint64(bias) + addend
+			case elf.R_RISCV_32, elf.R_RISCV_64, elf.R_RISCV_JUMP_SLOT:
+				x, err := symbolValue(f, dyn, sym, bias)
+				if err != nil {
+					return "", err
+				}
+				val = x + addend
+				if elf.R_RISCV(typ) == elf.R_RISCV_32 {
+					size = 4
+				} else if elf.R_RISCV(typ) == elf.R_RISCV_64 {
+					size = 8
+				}
+			default:
+				return "", fmt.Errorf("relocation type %s is not supported", elf.R_RISCV(typ))
+			}
+			buf := make([]byte, 8)
+			binary.LittleEndian.PutUint64(buf, val)
+			err := patchSegment(segs, uint(off)+bias, buf[:size])
+			if err != nil {
+				return "", err
+			}
+			n++
+		}
+	}
+	return fmt.Sprintf("applied %d relocations", n), nil
+}
+
+//-----------------------------------------------------------------------------
+
+// ELFConfig is the ELF file loading configuration.
+type ELFConfig struct {
+	Class   elf.Class // ELF class of the machine
+	Bias    uint      // load bias for a position independent executable
+	NoEntry bool      // don't set the memory entry point (E.g. an additional image)
+}
+
+// LoadImage loads an ELF file to memory and returns the loaded image.
+// The memory is unchanged if the image can't be loaded.
+func (m *Memory) LoadImage(filename string, cfg ELFConfig) (*Image, string, error) {
 
 	f, err := elf.Open(filename)
 	if err != nil {
-		return "", fmt.Errorf("%s %s", filename, err)
+		return nil, "", fmt.Errorf("%s %s", filename, err)
 	}
 
 	defer f.Close()
 
 	if f.Machine != elf.EM_RISCV {
-		return "", fmt.Errorf("%s is not a RISC-V ELF file", filename)
+		return nil, "", fmt.Errorf("%s is not a RISC-V ELF file", filename)
 	}
 
-	if f.Class != class {
-		return "", fmt.Errorf("%s is not an %s file", filename, class)
+	if f.Class != cfg.Class {
+		return nil, "", fmt.Errorf("%s is not an %s file", filename, cfg.Class)
 	}
 
-	if f.Type != elf.ET_EXEC {
-		return "", fmt.Errorf("%s is not an executable ELF file", filename)
+	switch f.Type {
+	case elf.ET_EXEC:
+		if cfg.Bias != 0 {
+			return nil, "", fmt.Errorf("%s is not position independent, it can't have a load bias", filename)
+		}
+	case elf.ET_DYN:
+	default:
+		return nil, "", fmt.Errorf("%s is not an executable ELF file", filename)
+	}
+
+	img := &Image{
+		Name:    filepath.Base(filename),
+		Bias:    cfg.Bias,
+		Entry:   uint(f.Entry) + cfg.Bias,
+		symbols: make(map[string]*Symbol),
+	}
+	if m.ImageByName(img.Name) != nil {
+		img.Name = fmt.Sprintf("%s.%d", img.Name, len(m.images))
 	}
 
 	s := make([]string, 0)
 
-	// load the sections
-	for _, fs := range f.Sections {
-		if fs.Flags&elf.SHF_ALLOC != 0 {
-			ms, status := makeSection(f, fs)
-			if ms != nil {
-				m.Add(ms)
-			}
-			s = append(s, status)
+	// build the segments
+	segs := []*Section{}
+	for i, p := range f.Progs {
+		if p.Type != elf.PT_LOAD || p.Memsz == 0 {
+			continue
+		}
+		ms, status, err := m.makeSegment(f, p, i, img)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s %s", filename, err)
+		}
+		segs = append(segs, ms)
+		s = append(s, status)
+	}
+	if len(segs) == 0 {
+		return nil, "", fmt.Errorf("%s has no loadable segments", filename)
+	}
+
+	// apply the dynamic relocations
+	if f.Type == elf.ET_DYN {
+		status, err := relocate(f, cfg.Bias, segs)
+		if err != nil {
+			return nil, "", fmt.Errorf("%s %s", filename, err)
 		}
+		s = append(s, status)
+	}
+
+	st, err := elfSymbols(f)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s %s", filename, err)
+	}
+
+	// add the segments to memory
+	for _, ms := range segs {
+		m.Insert(ms)
 	}
 
 	// set the program entry point
-	m.Entry = f.Entry
-	s = append(s, fmt.Sprintf("%-16s %08x", "entry point", m.Entry))
+	if !cfg.NoEntry {
+		m.Entry = uint64(img.Entry)
+	}
+	s = append(s, fmt.Sprintf("%-16s %08x", "entry point", img.Entry))
 
-	// load the symbols
-	s = append(s, m.loadSymbols(f))
+	// add the symbols
+	status, err := m.addSymbols(st, img)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s %s", filename, err)
+	}
+	s = append(s, status)
+	m.images = append(m.images, img)
 
-	return strings.Join(s, "\n"), nil
+	return img, strings.Join(s, "\n"), nil
+}
+
+// LoadELF loads an ELF file to memory.
+func (m *Memory) LoadELF(filename string, class elf.Class) (string, error) {
+	_, status, err := m.LoadImage(filename, ELFConfig{Class: class})
+	return status, err
 }
 
 //-----------------------------------------------------------------------------
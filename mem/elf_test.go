@@ -0,0 +1,196 @@
+//-----------------------------------------------------------------------------
+/*
+
+ELF Loader Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package mem
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//-----------------------------------------------------------------------------
+
+// testELF is a test RV64 ELF file with a text and a data segment.
+type testELF struct {
+	typ      elf.Type
+	text     uint64 // text segment address (4 bytes of code, "main" symbol)
+	data     uint64 // data segment address (8 bytes of file data, 0x100 bytes of memory)
+	relative bool   // the data word has an R_RISCV_RELATIVE relocation to text+0x10
+	badReloc bool   // the relocation is at an address outside of the segments
+	stripped bool   // no section headers
+}
+
+// write writes the ELF file.
+func (x *testELF) write(t *testing.T, fname string) {
+	// the relocations and the dynamic section are in the text segment
+	const phOfs, textOfs, relaOfs, dynOfs, dataOfs, symOfs, strOfs, shstrOfs, shOfs = 64, 0x100, 0x140, 0x180, 0x200, 0x400, 0x500, 0x600, 0x700
+	shstr := "\x00.text\x00.data\x00.rela.dyn\x00.symtab\x00.strtab\x00.shstrtab\x00"
+	name := func(s string) uint32 { return uint32(strings.Index(shstr, "\x00"+s+"\x00") + 1) }
+	var buf bytes.Buffer
+	wr := func(ofs int, v interface{}) {
+		for buf.Len() < ofs {
+			buf.WriteByte(0)
+		}
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	hdr := elf.Header64{
+		Type: uint16(x.typ), Machine: uint16(elf.EM_RISCV), Version: 1, Entry: x.text,
+		Phoff: phOfs, Shoff: shOfs, Ehsize: 64, Phentsize: 56, Phnum: 3, Shentsize: 64, Shnum: 7, Shstrndx: 6,
+	}
+	if x.stripped {
+		hdr.Shoff, hdr.Shnum, hdr.Shstrndx = 0, 0, 0
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS], hdr.Ident[elf.EI_DATA], hdr.Ident[elf.EI_VERSION] = byte(elf.ELFCLASS64), byte(elf.ELFDATA2LSB), 1
+	wr(0, hdr)
+	wr(phOfs, []elf.Prog64{
+		{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_X), Off: textOfs, Vaddr: x.text, Filesz: 0xc0, Memsz: 0xc0},
+		{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_W), Off: dataOfs, Vaddr: x.data, Filesz: 8, Memsz: 0x100},
+		{Type: uint32(elf.PT_DYNAMIC), Flags: uint32(elf.PF_R), Off: dynOfs, Vaddr: x.text + dynOfs - textOfs, Filesz: 64, Memsz: 64},
+	})
+	wr(textOfs, uint32(0x00000013))
+	nrela := uint64(0)
+	if x.relative || x.badReloc {
+		off := x.data
+		if x.badReloc {
+			off += 0x1000
+		}
+		wr(relaOfs, elf.Rela64{Off: off, Info: uint64(elf.R_RISCV_RELATIVE), Addend: int64(x.text + 0x10)})
+		nrela = 24
+	}
+	wr(dynOfs, []elf.Dyn64{
+		{Tag: int64(elf.DT_RELA), Val: x.text + relaOfs - textOfs},
+		{Tag: int64(elf.DT_RELASZ), Val: nrela},
+		{Tag: int64(elf.DT_RELAENT), Val: 24},
+		{Tag: int64(elf.DT_NULL)},
+	})
+	wr(dataOfs, uint64(0x1234))
+	wr(symOfs, []elf.Sym64{{}, {Name: 1, Info: elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC), Shndx: 1, Value: x.text, Size: 4}})
+	wr(strOfs, []byte("\x00main\x00"))
+	wr(shstrOfs, []byte(shstr))
+	wr(shOfs, []elf.Section64{
+		{},
+		{Name: name(".text"), Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_EXECINSTR), Addr: x.text, Off: textOfs, Size: 4},
+		{Name: name(".data"), Type: uint32(elf.SHT_PROGBITS), Flags: uint64(elf.SHF_ALLOC | elf.SHF_WRITE), Addr: x.data, Off: dataOfs, Size: 8},
+		{Name: name(".rela.dyn"), Type: uint32(elf.SHT_RELA), Flags: uint64(elf.SHF_ALLOC), Addr: x.text + relaOfs - textOfs, Off: relaOfs, Size: nrela, Link: 4, Entsize: 24},
+		{Name: name(".symtab"), Type: uint32(elf.SHT_SYMTAB), Off: symOfs, Size: 48, Link: 5, Info: 1, Entsize: 24},
+		{Name: name(".strtab"), Type: uint32(elf.SHT_STRTAB), Off: strOfs, Size: 6},
+		{Name: name(".shstrtab"), Type: uint32(elf.SHT_STRTAB), Off: shstrOfs, Size: uint64(len(shstr))},
+	})
+	err := ioutil.WriteFile(fname, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_LoadELF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "elf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fw := filepath.Join(dir, "fw.elf")
+	(&testELF{typ: elf.ET_EXEC, text: 0x80000000, data: 0x80001000}).write(t, fw)
+	kernel := filepath.Join(dir, "kernel.elf")
+	(&testELF{typ: elf.ET_DYN, text: 0, data: 0x1000, relative: true}).write(t, kernel)
+	stripped := filepath.Join(dir, "stripped.elf")
+	(&testELF{typ: elf.ET_DYN, text: 0, data: 0x1000, relative: true, stripped: true}).write(t, stripped)
+	bad := filepath.Join(dir, "bad.elf")
+	(&testELF{typ: elf.ET_DYN, text: 0, data: 0x1000, badReloc: true}).write(t, bad)
+
+	m := newHeapMem(64)
+	_, err = m.LoadELF(fw, elf.ELFCLASS64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = m.LoadImage(fw, ELFConfig{Class: elf.ELFCLASS64, Bias: 0x1000})
+	if err == nil {
+		t.Errorf("load bias accepted for a fixed address executable")
+	}
+	const bias = 0x80200000
+	img, _, err := m.LoadImage(kernel, ELFConfig{Class: elf.ELFCLASS64, Bias: bias, NoEntry: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// segments, attributes and zero fill
+	attr := map[string]Attribute{}
+	for _, r := range m.Regions() {
+		attr[r.Name()] = r.Attr()
+	}
+	if attr[".text"] != AttrRX || attr[".data"] != AttrRW || attr["kernel.elf:.text"] != AttrRX {
+		t.Errorf("bad segment attributes %v", attr)
+	}
+	if m.GetSectionName(0x800010fc) != ".data" || m.GetSectionName(0x80001100) != "heap" {
+		t.Errorf("bad data segment")
+	}
+	if x, _ := m.Rd64Phys(0x800010f8); x != 0 {
+		t.Errorf("data segment is not zero filled")
+	}
+
+	// entry point and relocation
+	if m.Entry != 0x80000000 || img.Entry != bias {
+		t.Errorf("bad entry points %x %x", m.Entry, img.Entry)
+	}
+	if x, _ := m.Rd64Phys(0x80000000 + 0x1000); x != 0x1234 {
+		t.Errorf("bad data %x", x)
+	}
+	if x, _ := m.Rd64Phys(bias + 0x1000); x != bias+0x10 {
+		t.Errorf("bad relocation %x", x)
+	}
+
+	// relocation without section headers
+	_, _, err = m.LoadImage(stripped, ELFConfig{Class: elf.ELFCLASS64, Bias: 0x80300000, NoEntry: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, _ := m.Rd64Phys(0x80300000 + 0x1000); x != 0x80300000+0x10 {
+		t.Errorf("bad stripped relocation %x", x)
+	}
+
+	// a failed load doesn't change the memory
+	n := len(m.Regions())
+	_, _, err = m.LoadImage(bad, ELFConfig{Class: elf.ELFCLASS64, Bias: 0x80080000, NoEntry: true})
+	if err == nil || !strings.Contains(err.Error(), "not in a loadable segment") {
+		t.Errorf("bad relocation error %v", err)
+	}
+	if len(m.Regions()) != n || m.GetSectionName(0x80080000) != "heap" || m.ImageByName("bad.elf") != nil {
+		t.Errorf("memory changed by a failed load")
+	}
+
+	// per-image symbol tables
+	if len(m.Images()) != 3 || m.SymbolByName("main").Addr != bias {
+		t.Errorf("bad images")
+	}
+	fwMain := m.SymbolByName("fw.elf:main")
+	if fwMain == nil || fwMain.Addr != 0x80000000 || m.SymbolOffset(0x80000002) != "main+0x2" {
+		t.Errorf("bad image symbols")
+	}
+
+	// the images are kept by a snapshot
+	x, err := m.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Restore(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fwMain = m.SymbolByName("fw.elf:main")
+	if len(m.Images()) != 3 || fwMain == nil || fwMain.Addr != 0x80000000 {
+		t.Errorf("images not restored")
+	}
+}
+
+//-----------------------------------------------------------------------------
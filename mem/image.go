@@ -0,0 +1,397 @@
+//-----------------------------------------------------------------------------
+/*
+
+Program Image Loading
+
+Besides ELF files, programs can be loaded from:
+
+	raw binary        the file contents at a given load address
+	Intel HEX         ":" records with 16-bit, segment or linear addresses
+	Motorola S-record "S" records with 16, 24 or 32-bit addresses
+
+These formats carry no ELF class or symbols, so the XLEN must be given
+and the symbols can be loaded from a separate file (an ELF file, or the
+text output of nm).
+
+The image data is placed in the existing writable or executable sections
+where it fits (E.g. a ROM or RAM), otherwise new sections are created for it.
+
+*/
+//-----------------------------------------------------------------------------
+
+package mem
+
+import (
+	"bufio"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+
+// ImageFormat is a program image file format.
+type ImageFormat int
+
+// Program image file formats.
+const (
+	FormatELF    ImageFormat = iota // ELF file
+	FormatBinary                    // raw binary
+	FormatHex                       // Intel HEX
+	FormatSRec                      // Motorola S-record
+)
+
+var formatNames = map[string]ImageFormat{
+	"elf":  FormatELF,
+	"bin":  FormatBinary,
+	"hex":  FormatHex,
+	"srec": FormatSRec,
+}
+
+var formatExts = map[string]ImageFormat{
+	".bin":  FormatBinary,
+	".img":  FormatBinary,
+	".rom":  FormatBinary,
+	".hex":  FormatHex,
+	".ihex": FormatHex,
+	".ihx":  FormatHex,
+	".srec": FormatSRec,
+	".s19":  FormatSRec,
+	".s28":  FormatSRec,
+	".s37":  FormatSRec,
+	".mot":  FormatSRec,
+}
+
+func (f ImageFormat) String() string {
+	for k, v := range formatNames {
+		if v == f {
+			return k
+		}
+	}
+	return fmt.Sprintf("format %d", int(f))
+}
+
+// ImageFormatArg returns the image format for a format name (elf, bin,
+// hex or srec). An empty name selects the format by the file extension,
+// and is an ELF file for an unknown extension.
+func ImageFormatArg(name, filename string) (ImageFormat, error) {
+	if name == "" {
+		if f, ok := formatExts[strings.ToLower(filepath.Ext(filename))]; ok {
+			return f, nil
+		}
+		return FormatELF, nil
+	}
+	if f, ok := formatNames[strings.ToLower(name)]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf("image format \"%s\" is not supported (elf, bin, hex or srec)", name)
+}
+
+//-----------------------------------------------------------------------------
+
+// chunk is a contiguous block of image data.
+type chunk struct {
+	addr uint
+	data []byte
+}
+
+// mergeChunks merges the contiguous (or overlapping) image data records
+// into address sorted blocks. Where records overlap, the data of the record
+// that is later in the file is used.
+func mergeChunks(recs []chunk) []chunk {
+	sorted := []chunk{}
+	for _, r := range recs {
+		if len(r.data) != 0 {
+			sorted = append(sorted, r)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].addr < sorted[j].addr })
+	// work out the block address ranges
+	blocks := []chunk{}
+	for _, r := range sorted {
+		end := r.addr + uint(len(r.data))
+		if n := len(blocks); n > 0 {
+			b := &blocks[n-1]
+			if r.addr <= b.addr+uint(len(b.data)) {
+				if size := end - b.addr; size > uint(len(b.data)) {
+					b.data = append(b.data, make([]byte, size-uint(len(b.data)))...)
+				}
+				continue
+			}
+		}
+		blocks = append(blocks, chunk{r.addr, make([]byte, len(r.data))})
+	}
+	// copy the data in file order
+	for _, r := range recs {
+		if len(r.data) != 0 {
+			i := sort.Search(len(blocks), func(i int) bool { return blocks[i].addr+uint(len(blocks[i].data)) > r.addr })
+			copy(blocks[i].data[r.addr-blocks[i].addr:], r.data)
+		}
+	}
+	return blocks
+}
+
+// loadChunks writes the image data to memory and sets the entry point.
+func (m *Memory) loadChunks(filename string, recs []chunk, entry uint, hasEntry bool) (string, error) {
+	blocks := mergeChunks(recs)
+	if len(blocks) == 0 {
+		return "", fmt.Errorf("%s has no data", filename)
+	}
+	name := filepath.Base(filename)
+	s := make([]string, 0)
+	for i, b := range blocks {
+		size := uint(len(b.data))
+		end := b.addr + size - 1
+		r := m.findByAddr(b.addr, size)
+		if ms, ok := r.(*Section); !ok || ms.attr&(AttrW|AttrX) == 0 {
+			// create a new section
+			sname := name
+			if len(blocks) > 1 {
+				sname = fmt.Sprintf("%s.%d", name, i)
+			}
+			r = NewSection(sname, b.addr, size, AttrRWX)
+			m.Insert(r)
+		}
+		err := m.Patch(b.addr, b.data)
+		if err != nil {
+			return "", fmt.Errorf("%s %s", filename, err)
+		}
+		info := r.Info()
+		s = append(s, fmt.Sprintf("%-16s %08x-%08x %s (%d bytes)", info.name, b.addr, end, info.attr.String(), size))
+	}
+	// set the program entry point
+	if !hasEntry {
+		entry = blocks[0].addr
+	}
+	m.Entry = uint64(entry)
+	s = append(s, fmt.Sprintf("%-16s %08x", "entry point", m.Entry))
+	return strings.Join(s, "\n"), nil
+}
+
+//-----------------------------------------------------------------------------
+
+// LoadBinary loads a raw binary file to memory at an address.
+// The entry point is the load address.
+func (m *Memory) LoadBinary(filename string, adr uint) (string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return m.loadChunks(filename, []chunk{{adr, data}}, adr, true)
+}
+
+//-----------------------------------------------------------------------------
+
+// readRecords calls a function for each record (a line starting with the
+// record mark) of a text file. Record errors are reported with the line number.
+func readRecords(filename string, mark byte, fn func(rec string) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" {
+			continue
+		}
+		if s[0] != mark {
+			return fmt.Errorf("%s:%d bad record", filename, line)
+		}
+		err := fn(s[1:])
+		if err != nil {
+			if err == errEndOfFile {
+				return nil
+			}
+			return fmt.Errorf("%s:%d %s", filename, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// errEndOfFile stops the record reading.
+var errEndOfFile = fmt.Errorf("end of file")
+
+// LoadHex loads an Intel HEX file to memory. The entry point is the start
+// address record, or the lowest address.
+func (m *Memory) LoadHex(filename string) (string, error) {
+	var recs []chunk
+	var base, entry uint
+	hasEntry := false
+	err := readRecords(filename, ':', func(s string) error {
+		rec, err := hex.DecodeString(s)
+		if err != nil || len(rec) < 5 || len(rec) != int(rec[0])+5 {
+			return fmt.Errorf("bad record")
+		}
+		var sum byte
+		for _, v := range rec {
+			sum += v
+		}
+		if sum != 0 {
+			return fmt.Errorf("bad checksum")
+		}
+		addr := uint(rec[1])<<8 | uint(rec[2])
+		data := rec[4 : len(rec)-1]
+		switch rec[3] {
+		case 0x00: // data
+			recs = append(recs, chunk{base + addr, data})
+		case 0x01: // end of file
+			return errEndOfFile
+		case 0x02: // extended segment address
+			if len(data) != 2 {
+				return fmt.Errorf("bad segment address")
+			}
+			base = (uint(data[0])<<8 | uint(data[1])) << 4
+		case 0x03: // start segment address (CS:IP)
+			if len(data) != 4 {
+				return fmt.Errorf("bad start address")
+			}
+			entry = (uint(data[0])<<8|uint(data[1]))<<4 + (uint(data[2])<<8 | uint(data[3]))
+			hasEntry = true
+		case 0x04: // extended linear address
+			if len(data) != 2 {
+				return fmt.Errorf("bad linear address")
+			}
+			base = (uint(data[0])<<8 | uint(data[1])) << 16
+		case 0x05: // start linear address
+			if len(data) != 4 {
+				return fmt.Errorf("bad start address")
+			}
+			entry = uint(data[0])<<24 | uint(data[1])<<16 | uint(data[2])<<8 | uint(data[3])
+			hasEntry = true
+		default:
+			return fmt.Errorf("unknown record type %02x", rec[3])
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return m.loadChunks(filename, recs, entry, hasEntry)
+}
+
+// LoadSRec loads a Motorola S-record file to memory. The entry point is
+// the termination record address, or the lowest address.
+func (m *Memory) LoadSRec(filename string) (string, error) {
+	var recs []chunk
+	var entry uint
+	hasEntry := false
+	err := readRecords(filename, 'S', func(s string) error {
+		if len(s) < 1 {
+			return fmt.Errorf("bad record")
+		}
+		typ := s[0]
+		rec, err := hex.DecodeString(s[1:])
+		if err != nil || len(rec) < 3 || len(rec) != int(rec[0])+1 {
+			return fmt.Errorf("bad record")
+		}
+		var sum byte
+		for _, v := range rec {
+			sum += v
+		}
+		if sum != 0xff {
+			return fmt.Errorf("bad checksum")
+		}
+		// address size
+		n := 0
+		switch typ {
+		case '0', '1', '5', '9':
+			n = 2
+		case '2', '6', '8':
+			n = 3
+		case '3', '7':
+			n = 4
+		default:
+			return fmt.Errorf("unknown record type S%c", typ)
+		}
+		if len(rec) < n+2 {
+			return fmt.Errorf("bad record")
+		}
+		var addr uint
+		for _, v := range rec[1 : n+1] {
+			addr = addr<<8 | uint(v)
+		}
+		data := rec[n+1 : len(rec)-1]
+		switch typ {
+		case '1', '2', '3': // data
+			recs = append(recs, chunk{addr, data})
+		case '7', '8', '9': // termination with the start address
+			entry = addr
+			hasEntry = true
+			return errEndOfFile
+		}
+		// S0 header and S5/S6 record counts are ignored
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return m.loadChunks(filename, recs, entry, hasEntry)
+}
+
+//-----------------------------------------------------------------------------
+
+// LoadSymbols loads the symbols from a file. The file is an ELF file,
+// or the text output of nm ("addr [size] type name" lines).
+func (m *Memory) LoadSymbols(filename string) (string, error) {
+	if f, err := elf.Open(filename); err == nil {
+		defer f.Close()
+		st, err := elfSymbols(f)
+		if err != nil {
+			return "", err
+		}
+		return m.addSymbols(st, nil)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	n := 0
+	for scanner.Scan() {
+		x := strings.Fields(scanner.Text())
+		var name, size string
+		switch len(x) {
+		case 3:
+			name = x[2]
+		case 4:
+			name, size = x[3], x[1]
+		default:
+			// undefined symbols have no address
+			continue
+		}
+		adr, err := strconv.ParseUint(x[0], 16, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s bad symbol address \"%s\"", filename, x[0])
+		}
+		var sz uint64
+		if size != "" {
+			sz, err = strconv.ParseUint(size, 16, 64)
+			if err != nil {
+				return "", fmt.Errorf("%s bad symbol size \"%s\"", filename, size)
+			}
+		}
+		err = m.AddSymbol(name, uint(adr), uint(sz))
+		if err != nil {
+			fmt.Printf("%s\n", err)
+		} else {
+			n++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("loaded %d symbols", n), nil
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,90 @@
+//-----------------------------------------------------------------------------
+/*
+
+Image Loader Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package mem
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/deadsy/riscv/csr"
+)
+
+//-----------------------------------------------------------------------------
+
+// newHeapMem returns memory with a writable heap at 0x80000000 (as per the default machine).
+func newHeapMem(xlen uint) *Memory {
+	var m *Memory
+	if xlen == 32 {
+		m = NewMem32(csr.NewState(32, 0), 0)
+	} else {
+		m = NewMem64(csr.NewState(64, 0), 0)
+	}
+	m.Add(NewSection("heap", 0x80000000, 0x100000, AttrRWX))
+	return m
+}
+
+func Test_LoadImage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		// both: 4 bytes at 0x80000010, 2 bytes at 0x80000014, start 0x80000010
+		"prog.hex":  ":0200000480007A\n:0400100001020304E2\n:020014000506DF\n:040000058000001067\n:00000001FF\n",
+		"prog.srec": "S00400006B90\nS30980000010010203045C\nS30780000014050659\nS705800000106A\n",
+		"bad.hex":   ":0400100001020304E3\n",
+		// 0xbb at 0x12 is overwritten by the later record
+		"overlap.hex": ":01001200BB32\n:0400100001020304E2\n:00000001FF\n",
+		"prog.nm":     "0000000080000010 T _start\n                 U missing\n",
+	}
+	for name, s := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644)
+	}
+	for _, name := range []string{"prog.hex", "prog.srec"} {
+		m := newHeapMem(32)
+		fname := filepath.Join(dir, name)
+		if strings.HasSuffix(name, ".hex") {
+			_, err = m.LoadHex(fname)
+		} else {
+			_, err = m.LoadSRec(fname)
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		x, _ := m.Rd32Phys(0x80000010)
+		y, _ := m.Rd16Phys(0x80000014)
+		if x != 0x04030201 || y != 0x0605 || m.Entry != 0x80000010 {
+			t.Errorf("%s: bad image %x %x entry %x", name, x, y, m.Entry)
+		}
+		if m.GetSectionName(0x80000010) != "heap" {
+			t.Errorf("%s: the heap is not filled", name)
+		}
+		_, err = m.LoadSymbols(filepath.Join(dir, "prog.nm"))
+		if err != nil || m.SymbolByAddress(0x80000010) == nil {
+			t.Errorf("%s: symbols not loaded (%v)", name, err)
+		}
+	}
+	m := newHeapMem(32)
+	if _, err := m.LoadHex(filepath.Join(dir, "bad.hex")); err == nil {
+		t.Errorf("bad checksum accepted")
+	}
+	// a new section for data outside of memory
+	if _, err := m.LoadHex(filepath.Join(dir, "overlap.hex")); err != nil {
+		t.Fatal(err)
+	}
+	if x, _ := m.Rd32Phys(0x10); x != 0x04030201 || m.GetSectionName(0x10) != "overlap.hex" {
+		t.Errorf("bad overlapping records %x", x)
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -18,21 +18,32 @@ import (
 
 // Memory is emulated target memory.
 type Memory struct {
-	Entry     uint64               // entry point from ELF
-	brk       error                // pending breakpoint
-	bp        map[uint]*BreakPoint // break points
-	alen      uint                 // address bit length
-	csr       *csr.State           // CSR state
-	region    []Region             // memory regions
-	symByAddr map[uint]*Symbol     // symbol table by address
-	symByName map[string]*Symbol   // symbol table by name
-	noMemory  Region               // empty memory region
+	Entry     uint64                 // entry point from ELF
+	brk       error                  // pending breakpoint
+	bp        map[bpKey]*BreakPoint  // break points
+	bpAddr    map[uint][]*BreakPoint // break points by byte address
+	alen      uint                   // address bit length
+	csr       *csr.State             // CSR state
+	region    []Region               // memory regions
+	symByAddr map[uint]*Symbol       // symbol table by address
+	symByName map[string]*Symbol     // symbol table by name
+	symIndex  *symbolIndex           // address sorted symbol table (built on demand)
+	images    []*Image               // loaded ELF images
+	noMemory  Region                 // empty memory region
+	icache    *Cache                 // instruction cache model
+	dcache    *Cache                 // data cache model
+	tracer    Tracer                 // data access tracer (optional)
+	undo      UndoFunc               // memory write undo logger (optional)
+	devUndo   DeviceUndoFunc         // device access undo logger (optional)
+	bpUndo    BreakPointUndoFunc     // break point skip undo logger (optional)
+	bpOff     bool                   // break points are disabled
+	bpHit     bool                   // a disabled break point was hit
 }
 
 // newMemory returns a memory object.
 func newMemory(alen uint, csr *csr.State, empty Attribute) *Memory {
 	return &Memory{
-		bp:        make(map[uint]*BreakPoint),
+		bp:        make(map[bpKey]*BreakPoint),
 		alen:      alen,
 		csr:       csr,
 		region:    make([]Region, 0),
@@ -69,6 +80,23 @@ func (m *Memory) Add(r Region) {
 	m.region = append(m.region, r)
 }
 
+// Insert adds a memory region that takes precedence over the existing
+// regions at the same addresses (E.g. a program section loaded over RAM).
+func (m *Memory) Insert(r Region) {
+	m.region = append([]Region{r}, m.region...)
+}
+
+// Remove removes the memory region starting at an address.
+func (m *Memory) Remove(addr uint) error {
+	for i, r := range m.region {
+		if r.Info().start == addr {
+			m.region = append(m.region[:i], m.region[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no region at address %s", m.AddrStr(addr))
+}
+
 // findByName returns the memory region by name.
 func (m *Memory) findByName(name string) Region {
 	for _, r := range m.region {
@@ -101,6 +129,21 @@ func (m *Memory) SetAttr(name string, attr Attribute) error {
 	return nil
 }
 
+// AddAttr adds attributes to the memory region containing an address.
+func (m *Memory) AddAttr(adr uint, attr Attribute) error {
+	r := m.findByAddr(adr, 1)
+	if r == m.noMemory {
+		return fmt.Errorf("no memory at address %s", m.AddrStr(adr))
+	}
+	r.SetAttr(r.Info().attr | attr)
+	return nil
+}
+
+// Mapped returns true if an address range is within a memory region.
+func (m *Memory) Mapped(adr, size uint) bool {
+	return m.findByAddr(adr, size) != m.noMemory
+}
+
 // GetSectionName returns the name of the memory section containing the address.
 func (m *Memory) GetSectionName(adr uint) string {
 	return m.findByAddr(adr, 1).Info().name
@@ -116,21 +159,25 @@ func (m *Memory) RdInsPhys(pa uint) (uint, error) {
 
 // Rd64Phys reads a 64-bit data value from memory.
 func (m *Memory) Rd64Phys(pa uint) (uint64, error) {
+	m.saveDevice(pa, 8)
 	return m.findByAddr(pa, 8).Rd64(pa)
 }
 
 // Rd32Phys reads a 32-bit data value from memory.
 func (m *Memory) Rd32Phys(pa uint) (uint32, error) {
+	m.saveDevice(pa, 4)
 	return m.findByAddr(pa, 4).Rd32(pa)
 }
 
 // Rd16Phys reads a 16-bit data value from memory.
 func (m *Memory) Rd16Phys(pa uint) (uint16, error) {
+	m.saveDevice(pa, 2)
 	return m.findByAddr(pa, 2).Rd16(pa)
 }
 
 // Rd8Phys reads an 8-bit data value from memory.
 func (m *Memory) Rd8Phys(pa uint) (uint8, error) {
+	m.saveDevice(pa, 1)
 	return m.findByAddr(pa, 1).Rd8(pa)
 }
 
@@ -138,12 +185,38 @@ func (m *Memory) Rd8Phys(pa uint) (uint8, error) {
 // Virtual Address Read Functions
 
 // RdIns reads a 32-bit instruction from memory.
+// It doesn't touch the caches, break points or page tables (E.g. for a disassembler).
 func (m *Memory) RdIns(va uint) (uint, error) {
+	pa, err := m.debugVa2pa(va, AttrX)
+	if err != nil {
+		return 0, err
+	}
+	return m.RdInsPhys(pa)
+}
+
+// RdIns16 reads a 16-bit instruction from memory (no side effects).
+// E.g. a compressed instruction at the end of a section.
+func (m *Memory) RdIns16(va uint) (uint16, error) {
+	pa, err := m.debugVa2pa(va, AttrX)
+	if err != nil {
+		return 0, err
+	}
+	r := m.findByAddr(pa, 2)
+	// only sections can be read without side effects
+	if s, ok := r.(*Section); ok && s.attr&AttrX != 0 {
+		return s.Rd16(pa)
+	}
+	return 0, rdInsError(pa, 0, r.Info().Name())
+}
+
+// Fetch reads a 32-bit instruction from memory for execution.
+func (m *Memory) Fetch(va uint) (uint, error) {
 	pa, err := m.va2pa(va, AttrX)
 	if err != nil {
 		return 0, err
 	}
 	val, err := m.RdInsPhys(pa)
+	m.cacheAccess(m.icache, pa, 4, false, err)
 	m.monitor(pa, 4, AttrX)
 	return val, err
 }
@@ -155,7 +228,9 @@ func (m *Memory) Rd64(va uint) (uint64, error) {
 		return 0, err
 	}
 	val, err := m.Rd64Phys(pa)
+	m.cacheAccess(m.dcache, pa, 8, false, err)
 	m.monitor(pa, 8, AttrR)
+	m.trace(va, 8, AttrR, val, err)
 	return val, err
 }
 
@@ -166,7 +241,9 @@ func (m *Memory) Rd32(va uint) (uint32, error) {
 		return 0, err
 	}
 	val, err := m.Rd32Phys(pa)
+	m.cacheAccess(m.dcache, pa, 4, false, err)
 	m.monitor(pa, 4, AttrR)
+	m.trace(va, 4, AttrR, uint64(val), err)
 	return val, err
 }
 
@@ -177,7 +254,9 @@ func (m *Memory) Rd16(va uint) (uint16, error) {
 		return 0, err
 	}
 	val, err := m.Rd16Phys(pa)
+	m.cacheAccess(m.dcache, pa, 2, false, err)
 	m.monitor(pa, 2, AttrR)
+	m.trace(va, 2, AttrR, uint64(val), err)
 	return val, err
 }
 
@@ -188,30 +267,108 @@ func (m *Memory) Rd8(va uint) (uint8, error) {
 		return 0, err
 	}
 	val, err := m.Rd8Phys(pa)
+	m.cacheAccess(m.dcache, pa, 1, false, err)
 	m.monitor(pa, 1, AttrR)
+	m.trace(va, 1, AttrR, uint64(val), err)
 	return val, err
 }
 
+//-----------------------------------------------------------------------------
+// Data Access Tracing
+
+// Tracer is called for each successful virtual address data access.
+type Tracer func(va, size uint, access Attribute, val uint64)
+
+// SetTracer sets the data access tracer (nil to remove).
+func (m *Memory) SetTracer(fn Tracer) {
+	m.tracer = fn
+}
+
+func (m *Memory) trace(va, size uint, access Attribute, val uint64, err error) {
+	if m.tracer != nil && err == nil {
+		m.tracer(va, size, access, val)
+	}
+}
+
+// UndoFunc is called with the old contents of memory before it is written.
+type UndoFunc func(pa uint, old []uint8)
+
+// SetUndo sets the memory write undo logger (nil to remove).
+// Writes to memory sections and device memory (E.g. a framebuffer) are logged.
+func (m *Memory) SetUndo(fn UndoFunc) {
+	m.undo = fn
+}
+
+// DeviceUndoFunc is called with a device before its registers are accessed.
+// Register reads can change the device state (E.g. reading a receive buffer).
+type DeviceUndoFunc func(d *Device)
+
+// SetDeviceUndo sets the device access undo logger (nil to remove).
+func (m *Memory) SetDeviceUndo(fn DeviceUndoFunc) {
+	m.devUndo = fn
+}
+
+func (m *Memory) saveUndo(pa, size uint) {
+	if m.undo == nil && m.devUndo == nil {
+		return
+	}
+	var old []uint8
+	switch r := m.findByAddr(pa, size).(type) {
+	case *Section:
+		old = r.mem[pa-r.start:]
+	case *Device:
+		dm, ok := r.io.(DeviceMemory)
+		if !ok {
+			m.saveDevice(pa, size)
+			return
+		}
+		old = dm.Bytes()[pa-r.start:]
+	default:
+		return
+	}
+	if m.undo != nil {
+		m.undo(pa, append([]uint8(nil), old[:size]...))
+	}
+}
+
+// saveDevice calls the device undo logger before a device register access.
+func (m *Memory) saveDevice(pa, size uint) {
+	if m.devUndo == nil {
+		return
+	}
+	d, ok := m.findByAddr(pa, size).(*Device)
+	if !ok {
+		return
+	}
+	if _, ok := d.io.(DeviceMemory); !ok {
+		m.devUndo(d)
+	}
+}
+
 //-----------------------------------------------------------------------------
 // Physical Address Write Functions
 
 // Wr64Phys writes a 64-bit data value to memory.
 func (m *Memory) Wr64Phys(pa uint, val uint64) error {
+	m.saveUndo(pa, 8)
 	return m.findByAddr(pa, 8).Wr64(pa, val)
 }
 
 // Wr32Phys writes a 32-bit data value to memory.
 func (m *Memory) Wr32Phys(pa uint, val uint32) error {
+	m.saveUndo(pa, 4)
 	return m.findByAddr(pa, 4).Wr32(pa, val)
 }
 
 // Wr16Phys writes a 16-bit data value to memory.
 func (m *Memory) Wr16Phys(pa uint, val uint16) error {
+	m.saveUndo(pa, 2)
 	return m.findByAddr(pa, 2).Wr16(pa, val)
 }
 
 // Wr8Phys writes an 8-bit data value to memory.
 func (m *Memory) Wr8Phys(pa uint, val uint8) error {
+	m.saveUndo(pa, 1)
 	return m.findByAddr(pa, 1).Wr8(pa, val)
 }
 
@@ -225,7 +382,9 @@ func (m *Memory) Wr64(va uint, val uint64) error {
 		return err
 	}
 	err = m.Wr64Phys(pa, val)
+	m.cacheAccess(m.dcache, pa, 8, true, err)
 	m.monitor(pa, 8, AttrW)
+	m.trace(va, 8, AttrW, val, err)
 	return err
 }
 
@@ -236,7 +395,9 @@ func (m *Memory) Wr32(va uint, val uint32) error {
 		return err
 	}
 	err = m.Wr32Phys(pa, val)
+	m.cacheAccess(m.dcache, pa, 4, true, err)
 	m.monitor(pa, 4, AttrW)
+	m.trace(va, 4, AttrW, uint64(val), err)
 	return err
 }
 
@@ -247,7 +408,9 @@ func (m *Memory) Wr16(va uint, val uint16) error {
 		return err
 	}
 	err = m.Wr16Phys(pa, val)
+	m.cacheAccess(m.dcache, pa, 2, true, err)
 	m.monitor(pa, 2, AttrW)
+	m.trace(va, 2, AttrW, uint64(val), err)
 	return err
 }
 
@@ -258,12 +421,142 @@ func (m *Memory) Wr8(va uint, val uint8) error {
 		return err
 	}
 	err = m.Wr8Phys(pa, val)
+	m.cacheAccess(m.dcache, pa, 1, true, err)
 	m.monitor(pa, 1, AttrW)
+	m.trace(va, 1, AttrW, uint64(val), err)
 	return err
 }
 
 //-----------------------------------------------------------------------------
 
+// Patch writes a buffer of bytes to physical memory, ignoring the write
+// attribute of the memory region (eg: patching code in a read-only section).
+func (m *Memory) Patch(pa uint, buf []uint8) error {
+	for i, val := range buf {
+		adr := pa + uint(i)
+		r := m.findByAddr(adr, 1)
+		if r == m.noMemory {
+			return fmt.Errorf("no memory at address %s", m.AddrStr(adr))
+		}
+		attr := r.Info().attr
+		r.SetAttr(attr | AttrW | AttrM)
+		err := r.Wr8(adr, val)
+		r.SetAttr(attr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DebugRd8 reads a byte from memory for a debugger.
+// There are no break point, cache, trace or page table side effects.
+func (m *Memory) DebugRd8(addr uint, vm bool) (uint8, error) {
+	pa := addr
+	if vm {
+		var err error
+		pa, err = m.debugVa2pa(addr, AttrR)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// the region attributes are ignored
+	switch r := m.findByAddr(pa, 1).(type) {
+	case *Section:
+		return r.mem[pa-r.start], nil
+	case *Device:
+		// a device register read may have side effects
+		if dm, ok := r.io.(DeviceMemory); ok {
+			return dm.Bytes()[pa-r.start], nil
+		}
+		return 0, fmt.Errorf("device %s at address %s can't be read", r.name, m.AddrStr(pa))
+	}
+	return 0, fmt.Errorf("no memory at address %s", m.AddrStr(pa))
+}
+
+// DebugWr8 writes a byte to memory for a debugger.
+// The write attribute of the memory region is ignored.
+// The write is undo logged (reverse execution).
+func (m *Memory) DebugWr8(addr uint, val uint8, vm bool) error {
+	pa := addr
+	if vm {
+		var err error
+		pa, err = m.debugVa2pa(addr, AttrR)
+		if err != nil {
+			return err
+		}
+	}
+	m.saveUndo(pa, 1)
+	return m.Patch(pa, []uint8{val})
+}
+
+//-----------------------------------------------------------------------------
+// Host Call Access Functions
+
+// hostAddr returns the physical address for a host call access.
+// Only memory sections can be accessed by a host call.
+func (m *Memory) hostAddr(addr, size uint, attr Attribute, vm bool) (uint, error) {
+	pa := addr
+	if vm {
+		var err error
+		pa, err = m.va2pa(addr, attr)
+		if err != nil {
+			return 0, err
+		}
+	}
+	s, ok := m.findByAddr(pa, size).(*Section)
+	if !ok {
+		return 0, fmt.Errorf("no memory at address %s", m.AddrStr(pa))
+	}
+	if s.attr&attr != attr {
+		return 0, fmt.Errorf("%s access denied at address %s", attr, m.AddrStr(pa))
+	}
+	return pa, nil
+}
+
+// HostCheck checks that a buffer can be accessed by a host call (E.g. a
+// system call buffer). The target access permissions are checked.
+func (m *Memory) HostCheck(addr, n uint, attr Attribute, vm bool) error {
+	for n != 0 {
+		// check each page
+		k := 4096 - addr&4095
+		if k > n {
+			k = n
+		}
+		_, err := m.hostAddr(addr, k, attr, vm)
+		if err != nil {
+			return err
+		}
+		addr += k
+		n -= k
+	}
+	return nil
+}
+
+// HostRd8 reads a byte from memory for a host call. The target access
+// permissions are checked, but there are no break point, cache or trace
+// side effects.
+func (m *Memory) HostRd8(addr uint, vm bool) (uint8, error) {
+	pa, err := m.hostAddr(addr, 1, AttrR, vm)
+	if err != nil {
+		return 0, err
+	}
+	return m.Rd8Phys(pa)
+}
+
+// HostWr8 writes a byte to memory for a host call. The target access
+// permissions are checked, but there are no break point, cache or trace
+// side effects.
+func (m *Memory) HostWr8(addr uint, val uint8, vm bool) error {
+	pa, err := m.hostAddr(addr, 1, AttrW, vm)
+	if err != nil {
+		return err
+	}
+	return m.Wr8Phys(pa, val)
+}
+
+//-----------------------------------------------------------------------------
+
 // RdBuf reads a buffer of data from memory.
 func (m *Memory) RdBuf(addr, n, width uint, vm bool) []uint {
 	buf := make([]uint, n)
@@ -0,0 +1,220 @@
+//-----------------------------------------------------------------------------
+/*
+
+Memory Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package mem
+
+import (
+	"testing"
+
+	"github.com/deadsy/riscv/csr"
+)
+
+//-----------------------------------------------------------------------------
+
+func Test_SectionIn(t *testing.T) {
+	m := NewSection("low", 0, 0x1000, AttrRW)
+	top := ^uint(0)
+	tests := []struct {
+		adr, size uint
+		in        bool
+	}{
+		{0, 8, true},
+		{0xff8, 8, true},
+		{0xffc, 8, false},
+		{0x1000, 1, false},
+		// the access wraps around the address space
+		{top - 3, 8, false},
+		{top, 2, false},
+	}
+	for _, v := range tests {
+		if m.In(v.adr, v.size) != v.in {
+			t.Errorf("In(%x, %d) is %v, expected %v", v.adr, v.size, !v.in, v.in)
+		}
+	}
+	// a wrapped access is not a read of the low section
+	mem := NewMem64(csr.NewState(64, 0), 0)
+	mem.Add(m)
+	_, err := mem.Rd64(top - 3)
+	if err == nil {
+		t.Errorf("wrapped read did not fail")
+	}
+}
+
+// fifo is a device with a read side effect.
+type fifo struct {
+	reads int
+}
+
+func (d *fifo) Rd(ofs, size uint) uint64 {
+	d.reads++
+	return 0
+}
+
+func (d *fifo) Wr(ofs, size uint, val uint64) {}
+
+func Test_DebugAccess(t *testing.T) {
+	m := NewMem64(csr.NewState(64, 0), 0)
+	m.Add(NewSection("rom", 0x1000, 0x1000, AttrR))
+	d := &fifo{}
+	m.Add(NewDevice("fifo", 0x2000, 0x100, d))
+	m.AddBreakPoint("watch", 0x1000, AttrR|AttrW, nil)
+
+	// a device read has side effects
+	if _, err := m.DebugRd8(0x2000, false); err == nil || d.reads != 0 {
+		t.Errorf("debug read of a device")
+	}
+	// debug writes ignore the write attribute and are undo logged
+	var undo []uint
+	m.SetUndo(func(pa uint, old []uint8) {
+		undo = append(undo, pa)
+	})
+	if err := m.DebugWr8(0x1000, 0x5a, false); err != nil {
+		t.Fatal(err)
+	}
+	if x, _ := m.DebugRd8(0x1000, false); x != 0x5a {
+		t.Errorf("debug read %x", x)
+	}
+	if len(undo) != 1 || undo[0] != 0x1000 {
+		t.Errorf("debug write was not undo logged")
+	}
+	if m.GetBreak() != nil {
+		t.Errorf("debug access hit a break point")
+	}
+}
+
+func Test_BreakPoint(t *testing.T) {
+	m := NewMem64(csr.NewState(64, 0), 0)
+	m.Add(NewSection("ram", 0x1000, 0x1000, AttrRW))
+
+	// break points with the same address and a different access or name
+	m.AddBreakPoint("a", 0x1000, AttrX, nil)
+	m.AddBreakPoint("b", 0x1000, AttrX, nil)
+	m.AddBreakPoint("a", 0x1000, AttrW, nil)
+	m.RemoveBreakPoint("a", 0x1000, AttrX)
+	if !m.BreakPointAt(0x1000, AttrX) || !m.BreakPointAt(0x1000, AttrW) {
+		t.Errorf("removed the wrong break point")
+	}
+	m.RemoveBreakPoint("b", 0x1000, AttrX)
+	m.RemoveBreakPoint("a", 0x1000, AttrW)
+	if m.BreakPointAt(0x1000, AttrX|AttrW) {
+		t.Errorf("break point was not removed")
+	}
+
+	// a watch point covers its length
+	m.AddWatchPoint("w", 0x1104, 4, AttrW, nil)
+	tests := []struct {
+		adr, size uint
+		brk       bool
+	}{
+		{0x1100, 4, false},
+		{0x1100, 8, true},
+		{0x1107, 1, true},
+		{0x1108, 1, false},
+		{0x1106, 2, true},
+	}
+	for _, v := range tests {
+		var err error
+		switch v.size {
+		case 8:
+			err = m.Wr64(v.adr, 0)
+		case 4:
+			err = m.Wr32(v.adr, 0)
+		case 2:
+			err = m.Wr16(v.adr, 0)
+		default:
+			err = m.Wr8(v.adr, 0)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if brk := m.GetBreak() != nil; brk != v.brk {
+			t.Errorf("write %x (%d bytes): break %v, expected %v", v.adr, v.size, brk, v.brk)
+		}
+	}
+}
+
+func Test_RdInsPageTables(t *testing.T) {
+	state := csr.NewState(64, csr.IsaExtS|csr.IsaExtU)
+	m := NewMem64(state, 0)
+	m.Add(NewSection("ram", 0x1000, 0x1000, AttrRWX))
+	m.Add(NewSection("pt", 0x10000, 0x1000, AttrRW))
+	// sv39: a gigapage leaf maps va 0 to pa 0 (accessed bit clear)
+	const pte = 1<<3 /*X*/ | 1<<1 /*R*/ | 1 /*V*/
+	m.Wr64Phys(0x10000, pte)
+	state.DebugWr(csr.SATP, 8<<60|0x10)
+	state.SetMode(csr.ModeS)
+
+	// debugger reads don't set the accessed bit
+	_, err := m.RdIns(0x1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.RdIns16(0x1000)
+	m.DebugRd8(0x1000, true)
+	m.DebugWr8(0x1000, 0, true)
+	if x, _ := m.Rd64Phys(0x10000); x != pte {
+		t.Errorf("debugger access modified the pte %x", x)
+	}
+	// an instruction fetch does
+	m.Fetch(0x1000)
+	if x, _ := m.Rd64Phys(0x10000); !pteGetAccess(uint(x)) {
+		t.Errorf("Fetch didn't set the pte accessed bit %x", x)
+	}
+}
+
+func Test_CacheAccess(t *testing.T) {
+	m := NewMem64(csr.NewState(64, 0), 0)
+	m.Add(NewSection("ram", 0x1000, 0x1000, AttrRWX))
+	m.Add(NewDevice("fifo", 0x2000, 0x100, &fifo{}))
+	ic, _ := NewCache(&CacheConfig{Name: "icache", Size: 256, Ways: 2, LineSize: 16}, nil)
+	dc, _ := NewCache(&CacheConfig{Name: "dcache", Size: 256, Ways: 2, LineSize: 16}, nil)
+	m.SetCache(ic, dc)
+
+	// only instruction fetches go through the icache
+	m.RdIns(0x1000)
+	if ic.hits+ic.misses != 0 {
+		t.Errorf("RdIns accessed the icache")
+	}
+	m.Fetch(0x1000)
+	m.Fetch(0x1004)
+	if ic.misses != 1 || ic.hits != 1 {
+		t.Errorf("icache hits %d misses %d, expected 1 1", ic.hits, ic.misses)
+	}
+
+	// failed and device accesses don't go through the dcache
+	m.Rd32(0x3000)
+	m.Rd32(0x2000)
+	m.Wr32(0x2000, 0)
+	if dc.hits+dc.misses != 0 {
+		t.Errorf("dcache hits %d misses %d, expected none", dc.hits, dc.misses)
+	}
+
+	// statistics are by symbol, not by line
+	m.AddSymbol("a", 0x1100, 8)
+	m.AddSymbol("b", 0x1108, 8)
+	m.Rd32(0x1100)
+	m.Rd32(0x1108)
+	m.Rd32(0x110c)
+	bySymbol := make(map[string]uint64)
+	for key, st := range dc.stats {
+		bySymbol[key.symbol] += st.hits + st.misses
+	}
+	if bySymbol["a"] != 1 || bySymbol["b"] != 2 {
+		t.Errorf("symbol accesses %v, expected a:1 b:2", bySymbol)
+	}
+
+	// the statistics don't grow with the number of addresses accessed
+	for adr := uint(0x1200); adr < 0x1800; adr += 4 {
+		m.Rd32(adr)
+	}
+	if len(dc.stats) != 3 {
+		t.Errorf("%d dcache statistics, expected 3", len(dc.stats))
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -33,6 +33,26 @@ type RegionInfo struct {
 	attr       Attribute
 }
 
+// Name returns the name of the memory region.
+func (ri *RegionInfo) Name() string {
+	return ri.name
+}
+
+// Start returns the start address of the memory region.
+func (ri *RegionInfo) Start() uint {
+	return ri.start
+}
+
+// End returns the end address (inclusive) of the memory region.
+func (ri *RegionInfo) End() uint {
+	return ri.end
+}
+
+// Attr returns the attributes of the memory region.
+func (ri *RegionInfo) Attr() Attribute {
+	return ri.attr
+}
+
 //-----------------------------------------------------------------------------
 // sort regions by start address
 
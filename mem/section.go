@@ -54,7 +54,8 @@ func (m *Section) Info() *RegionInfo {
 // In returns true if the adr, size is entirely within the memory chunk.
 func (m *Section) In(adr, size uint) bool {
 	end := adr + size - 1
-	return (adr >= m.start) && (end <= m.end)
+	// end < adr: the access wraps around the address space
+	return (adr >= m.start) && (end <= m.end) && (end >= adr)
 }
 
 // RdIns reads a 32-bit instruction from memory.
@@ -0,0 +1,253 @@
+//-----------------------------------------------------------------------------
+/*
+
+Memory Snapshots
+
+A snapshot holds the contents and attributes of the memory sections, the
+device states, the symbol tables and the break points. Break point condition
+functions can't be saved. A restored break point keeps the condition
+function of any existing break point at the same address.
+
+Devices must implement DeviceState to be saved. They are restored by name,
+so the snapshot must be restored into a machine with the same devices.
+
+*/
+//-----------------------------------------------------------------------------
+
+package mem
+
+import (
+	"fmt"
+	"sort"
+)
+
+//-----------------------------------------------------------------------------
+
+// SectionSnapshot is the state of a memory section.
+type SectionSnapshot struct {
+	Name  string
+	Start uint
+	Attr  Attribute
+	Data  []uint8
+}
+
+// BreakPointSnapshot is the state of a break point.
+type BreakPointSnapshot struct {
+	Name   string
+	Addr   uint
+	Access Attribute
+	Len    uint
+	State  uint
+}
+
+// DeviceSnapshot is the state of a device.
+type DeviceSnapshot struct {
+	Name  string
+	State []byte
+}
+
+// ImageSnapshot is a loaded ELF image and its symbol table.
+type ImageSnapshot struct {
+	Name    string
+	Bias    uint
+	Entry   uint
+	Symbols []Symbol
+}
+
+// Snapshot is the serializable state of the memory.
+type Snapshot struct {
+	Entry       uint64
+	Alen        uint
+	Sections    []SectionSnapshot
+	Devices     []DeviceSnapshot
+	Symbols     []Symbol
+	Images      []ImageSnapshot
+	BreakPoints []BreakPointSnapshot
+}
+
+// symbolList returns a name sorted list of symbols.
+func symbolList(x map[string]*Symbol) []Symbol {
+	list := []Symbol{}
+	for _, s := range x {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+//-----------------------------------------------------------------------------
+
+// SaveDevices returns the states of the devices.
+// It is an error if a device state can't be saved.
+func (m *Memory) SaveDevices() ([]DeviceSnapshot, error) {
+	x := []DeviceSnapshot{}
+	for _, d := range m.Devices() {
+		ds, ok := d.io.(DeviceState)
+		if !ok {
+			return nil, fmt.Errorf("device \"%s\" state can't be saved", d.name)
+		}
+		state, err := ds.SaveState()
+		if err != nil {
+			return nil, fmt.Errorf("device \"%s\": %s", d.name, err)
+		}
+		x = append(x, DeviceSnapshot{d.name, state})
+	}
+	return x, nil
+}
+
+// RestoreDevices sets the device states. Every device must have a state.
+func (m *Memory) RestoreDevices(x []DeviceSnapshot) error {
+	state := make(map[string][]byte)
+	for _, v := range x {
+		state[v.Name] = v.State
+	}
+	devices := m.Devices()
+	for _, d := range devices {
+		if _, ok := state[d.name]; !ok {
+			return fmt.Errorf("no state for device \"%s\"", d.name)
+		}
+	}
+	if len(state) != len(devices) {
+		return fmt.Errorf("the device states don't match the machine devices")
+	}
+	for _, d := range devices {
+		ds, ok := d.io.(DeviceState)
+		if !ok {
+			return fmt.Errorf("device \"%s\" state can't be restored", d.name)
+		}
+		err := ds.RestoreState(state[d.name])
+		if err != nil {
+			return fmt.Errorf("device \"%s\": %s", d.name, err)
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+// Snapshot returns a snapshot of the memory state.
+func (m *Memory) Snapshot() (*Snapshot, error) {
+	devices, err := m.SaveDevices()
+	if err != nil {
+		return nil, err
+	}
+	x := &Snapshot{
+		Entry:   m.Entry,
+		Alen:    m.alen,
+		Devices: devices,
+	}
+	for _, r := range m.region {
+		s, ok := r.(*Section)
+		if !ok {
+			continue
+		}
+		data := make([]uint8, len(s.mem))
+		copy(data, s.mem)
+		x.Sections = append(x.Sections, SectionSnapshot{s.name, s.start, s.attr, data})
+	}
+	x.Symbols = symbolList(m.symByName)
+	for _, img := range m.images {
+		x.Images = append(x.Images, ImageSnapshot{img.Name, img.Bias, img.Entry, symbolList(img.symbols)})
+	}
+	bpList := []*BreakPoint{}
+	for _, bp := range m.bp {
+		bpList = append(bpList, bp)
+	}
+	sort.Sort(bpByAddr(bpList))
+	for _, bp := range bpList {
+		x.BreakPoints = append(x.BreakPoints, BreakPointSnapshot{bp.Name, bp.Addr, bp.Access, bp.Len, uint(bp.state)})
+	}
+	return x, nil
+}
+
+// RestoreSections sets the memory section contents and attributes from a snapshot.
+// The memory sections are replaced by the snapshot sections, other memory
+// regions (E.g. devices) are kept.
+func (m *Memory) RestoreSections(x *Snapshot) error {
+	if x.Alen != m.alen {
+		return fmt.Errorf("snapshot address length is %d bits, expected %d", x.Alen, m.alen)
+	}
+	region := []Region{}
+	for _, r := range m.region {
+		if _, ok := r.(*Section); !ok {
+			region = append(region, r)
+		}
+	}
+	for _, v := range x.Sections {
+		if len(v.Data) == 0 {
+			return fmt.Errorf("section \"%s\" has no data", v.Name)
+		}
+		data := make([]uint8, len(v.Data))
+		copy(data, v.Data)
+		region = append(region, &Section{
+			name:  v.Name,
+			attr:  v.Attr,
+			start: v.Start,
+			end:   v.Start + uint(len(data)) - 1,
+			mem:   data,
+		})
+	}
+	m.region = region
+	m.Entry = x.Entry
+	return nil
+}
+
+// Restore sets the memory state from a snapshot.
+func (m *Memory) Restore(x *Snapshot) error {
+	err := m.RestoreSections(x)
+	if err != nil {
+		return err
+	}
+	err = m.RestoreDevices(x.Devices)
+	if err != nil {
+		return err
+	}
+	// symbols
+	m.symByAddr = make(map[uint]*Symbol)
+	m.symByName = make(map[string]*Symbol)
+	m.symIndex = nil
+	m.images = nil
+	for i := range x.Symbols {
+		s := x.Symbols[i]
+		m.symByAddr[s.Addr] = &s
+		m.symByName[s.Name] = &s
+	}
+	for _, v := range x.Images {
+		img := &Image{v.Name, v.Bias, v.Entry, make(map[string]*Symbol)}
+		for i := range v.Symbols {
+			s := v.Symbols[i]
+			if sym := m.symByName[s.Name]; sym != nil && *sym == s {
+				// the symbol is shared with the symbol table
+				img.symbols[s.Name] = sym
+				continue
+			}
+			img.symbols[s.Name] = &s
+		}
+		m.images = append(m.images, img)
+	}
+	// break points
+	bp := make(map[bpKey]*BreakPoint)
+	for _, v := range x.BreakPoints {
+		if v.State > uint(sSkip) {
+			return fmt.Errorf("break point \"%s\" has a bad state %d", v.Name, v.State)
+		}
+		b := &BreakPoint{
+			Name:   v.Name,
+			Addr:   v.Addr,
+			Access: v.Access,
+			Len:    v.Len,
+			alen:   m.alen,
+			state:  bpState(v.State),
+		}
+		if old, ok := m.bp[b.key()]; ok {
+			b.cond = old.cond
+		}
+		bp[b.key()] = b
+	}
+	m.bp = bp
+	m.bpIndex()
+	m.brk = nil
+	return nil
+}
+
+//-----------------------------------------------------------------------------
@@ -188,7 +188,8 @@ func (m *Memory) sv39(va sv39va, mode csr.Mode, attr Attribute, debug bool) (uin
 	if attr&AttrW != 0 && !pteGetDirty(pte) {
 		dirty = true
 	}
-	if access || dirty {
+	// a debug walk doesn't modify the page tables
+	if (access || dirty) && !debug {
 		// Note: We may have set the R bit previously, so re-read the pte.
 		x, _ := m.Rd64Phys(pteAddr)
 		pte := uint(x)
@@ -8,7 +8,11 @@ Memory Symbols
 
 package mem
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 //-----------------------------------------------------------------------------
 
@@ -34,14 +38,112 @@ func (m *Memory) SymbolByAddress(adr uint) *Symbol {
 	return m.symByAddr[adr]
 }
 
+// symbolIndex is an address sorted symbol table for nearest symbol lookups.
+type symbolIndex struct {
+	sym    []*Symbol // symbols sorted by address
+	maxEnd []uint    // maximum end address of the sized symbols in sym[0:i+1]
+	label  []int     // index of the nearest zero sized symbol in sym[0:i+1] (-1 for none)
+}
+
+// allSymbols returns the symbols of the symbol table and the image symbol
+// tables (a symbol name in a later image hides it in the symbol table).
+func (m *Memory) allSymbols() []*Symbol {
+	sym := []*Symbol{}
+	seen := make(map[*Symbol]bool)
+	for _, v := range m.symByName {
+		sym = append(sym, v)
+		seen[v] = true
+	}
+	for _, img := range m.images {
+		for _, v := range img.symbols {
+			if !seen[v] {
+				sym = append(sym, v)
+				seen[v] = true
+			}
+		}
+	}
+	return sym
+}
+
+// newSymbolIndex returns an address sorted index of the symbol table.
+func (m *Memory) newSymbolIndex() *symbolIndex {
+	si := &symbolIndex{sym: m.allSymbols()}
+	sort.SliceStable(si.sym, func(i, j int) bool {
+		a, b := si.sym[i], si.sym[j]
+		if a.Addr == b.Addr {
+			return a.Name < b.Name
+		}
+		return a.Addr < b.Addr
+	})
+	var maxEnd uint
+	label := -1
+	for i, v := range si.sym {
+		if v.Size == 0 {
+			label = i
+		} else if v.Addr+v.Size > maxEnd {
+			maxEnd = v.Addr + v.Size
+		}
+		si.maxEnd = append(si.maxEnd, maxEnd)
+		si.label = append(si.label, label)
+	}
+	return si
+}
+
+// SymbolNearest returns the symbol nearest to (at or below) an address.
+// Sized symbols must contain the address, otherwise the nearest zero sized
+// symbol (a label) is returned.
+func (m *Memory) SymbolNearest(adr uint) *Symbol {
+	if m.symIndex == nil {
+		m.symIndex = m.newSymbolIndex()
+	}
+	si := m.symIndex
+	// the first symbol above the address
+	n := sort.Search(len(si.sym), func(i int) bool { return si.sym[i].Addr > adr })
+	if n == 0 {
+		return nil
+	}
+	// look for a sized symbol containing the address
+	for i := n - 1; i >= 0 && si.maxEnd[i] > adr; i-- {
+		s := si.sym[i]
+		if s.Size != 0 && adr < s.Addr+s.Size {
+			return s
+		}
+	}
+	if i := si.label[n-1]; i >= 0 {
+		return si.sym[i]
+	}
+	return nil
+}
+
+// SymbolOffset returns a "name+0x10" string for an address (or "" if there is no symbol).
+func (m *Memory) SymbolOffset(adr uint) string {
+	s := m.SymbolNearest(adr)
+	if s == nil {
+		return ""
+	}
+	if adr == s.Addr {
+		return s.Name
+	}
+	return fmt.Sprintf("%s+0x%x", s.Name, adr-s.Addr)
+}
+
 // SymbolByName returns the symbol for a symbol name.
+// An "image:name" symbol name is looked up in the symbol table of a loaded image.
 func (m *Memory) SymbolByName(s string) *Symbol {
-	return m.symByName[s]
+	if symbol := m.symByName[s]; symbol != nil {
+		return symbol
+	}
+	if i := strings.Index(s, ":"); i > 0 {
+		if img := m.ImageByName(s[:i]); img != nil {
+			return img.symbols[s[i+1:]]
+		}
+	}
+	return nil
 }
 
 // SymbolGetAddress returns the symbol address for a symbol name.
 func (m *Memory) SymbolGetAddress(s string) (uint, error) {
-	symbol := m.symByName[s]
+	symbol := m.SymbolByName(s)
 	if symbol == nil {
 		return 0, fmt.Errorf("%s not found", s)
 	}
@@ -50,13 +152,19 @@ func (m *Memory) SymbolGetAddress(s string) (uint, error) {
 
 // AddSymbol adds a symbol to the symbol table.
 func (m *Memory) AddSymbol(s string, adr, size uint) error {
+	_, err := m.addSymbol(s, adr, size)
+	return err
+}
+
+func (m *Memory) addSymbol(s string, adr, size uint) (*Symbol, error) {
 	if m.findByAddr(adr, size) != nil {
 		symbol := Symbol{s, adr, size}
 		m.symByAddr[adr] = &symbol
 		m.symByName[s] = &symbol
-		return nil
+		m.symIndex = nil
+		return &symbol, nil
 	}
-	return fmt.Errorf("%s is not in a memory region", s)
+	return nil, fmt.Errorf("%s is not in a memory region", s)
 }
 
 //-----------------------------------------------------------------------------
@@ -0,0 +1,59 @@
+//-----------------------------------------------------------------------------
+/*
+
+Symbol Table Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package mem
+
+import (
+	"testing"
+
+	"github.com/deadsy/riscv/csr"
+)
+
+//-----------------------------------------------------------------------------
+
+func Test_SymbolNearest(t *testing.T) {
+	m := NewMem64(csr.NewState(64, 0), 0)
+	m.Add(NewSection("ram", 0x1000, 0x1000, AttrRWX))
+	m.AddSymbol("outer", 0x1100, 0x100)
+	m.AddSymbol("inner", 0x1110, 0x10)
+	m.AddSymbol("label", 0x1080, 0)
+	m.AddSymbol("small", 0x1300, 4)
+	tests := []struct {
+		adr  uint
+		name string
+	}{
+		{0x1000, ""},      // below all symbols
+		{0x1080, "label"}, // at a label
+		{0x10f0, "label"}, // after a label
+		{0x1100, "outer"}, // at a sized symbol
+		{0x1114, "inner"}, // nested sized symbol
+		{0x1120, "outer"}, // after the nested symbol
+		{0x1200, "label"}, // past the end of the sized symbols
+		{0x1302, "small"}, // within a sized symbol after the label
+		{0x1304, "label"}, // past the end of the last symbol
+	}
+	for _, v := range tests {
+		name := ""
+		if s := m.SymbolNearest(v.adr); s != nil {
+			name = s.Name
+		}
+		if name != v.name {
+			t.Errorf("%x: got %q, expected %q", v.adr, name, v.name)
+		}
+	}
+	// adding a symbol updates the index
+	m.AddSymbol("late", 0x1200, 0)
+	if s := m.SymbolNearest(0x1204); s == nil || s.Name != "late" {
+		t.Errorf("the index was not updated %v", s)
+	}
+	if m.SymbolOffset(0x1118) != "inner+0x8" {
+		t.Errorf("bad symbol offset %s", m.SymbolOffset(0x1118))
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -102,6 +102,25 @@ func (m *Memory) bare(va uint, mode csr.Mode, attr Attribute, debug bool) (uint,
 
 // va2pa translates a virtual address to a physical address.
 func (m *Memory) va2pa(va uint, attr Attribute) (uint, error) {
+	pa, _, err := m.translate(va, attr, false)
+	return pa, err
+}
+
+// debugVa2pa translates a virtual address to a physical address
+// without setting the accessed/dirty bits of the page table entry.
+func (m *Memory) debugVa2pa(va uint, attr Attribute) (uint, error) {
+	pa, _, err := m.translate(va, attr, true)
+	return pa, err
+}
+
+// translate translates a virtual address to a physical address.
+// A debug translation also returns the annotated page table walk.
+func (m *Memory) translate(va uint, attr Attribute, debug bool) (uint, []string, error) {
+
+	// rv32 address arithmetic wraps at 32 bits
+	if m.alen == 32 {
+		va = uint(uint32(va))
+	}
 
 	// If mstatus.MPRV == 1 then mode = mstatus.MPP
 	// Instruction address-translation and protection are unaffected by the setting of MPRV.
@@ -114,6 +133,7 @@ func (m *Memory) va2pa(va uint, attr Attribute) (uint, error) {
 	}
 
 	var pa uint
+	var dbg []string
 	var err error
 
 	// get the vm
@@ -126,18 +146,18 @@ func (m *Memory) va2pa(va uint, attr Attribute) (uint, error) {
 	// run the va to pa mapping
 	switch vm {
 	case csr.Bare:
-		pa, _, err = m.bare(va, mode, attr, false)
+		pa, dbg, err = m.bare(va, mode, attr, debug)
 	case csr.SV32:
-		pa, _, err = m.sv32(sv32va(va), mode, attr, false)
+		pa, dbg, err = m.sv32(sv32va(va), mode, attr, debug)
 	case csr.SV39:
-		pa, _, err = m.sv39(sv39va(va), mode, attr, false)
+		pa, dbg, err = m.sv39(sv39va(va), mode, attr, debug)
 	case csr.SV48:
-		pa, _, err = m.sv48(sv48va(va), mode, attr, false)
+		pa, dbg, err = m.sv48(sv48va(va), mode, attr, debug)
 	default:
 		err = fmt.Errorf("%s not implmented", vm)
 	}
 
-	return pa, err
+	return pa, dbg, err
 }
 
 //-----------------------------------------------------------------------------
@@ -0,0 +1,277 @@
+//-----------------------------------------------------------------------------
+/*
+
+Record and Replay of Nondeterministic Inputs
+
+Nondeterministic inputs (E.g. wall clock time, device input, host file reads)
+are logged, keyed by the retired instruction count. In replay mode the logged
+values are returned in place of the live inputs, so an emulation run can be
+reproduced exactly.
+
+An input source wraps the function that reads the live input:
+
+t := log.Uint64("time", wallClock)
+
+The log is a JSON lines file. The first line is a header, then one line per input.
+
+{"version":1}
+{"n":1234,"src":"time","val":"0x1f3a"}
+{"n":1300,"src":"uart0","data":"aGVsbG8="}
+{"n":1400,"src":"syscall.read","rc":"5","data":"aGVsbG8="}
+
+*/
+//-----------------------------------------------------------------------------
+
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+//-----------------------------------------------------------------------------
+
+// Version is the current log file version.
+const Version = 1
+
+type header struct {
+	Version int `json:"version"`
+}
+
+// event is a logged input.
+type event struct {
+	N    uint64 `json:"n"`
+	Src  string `json:"src"`
+	Val  string `json:"val,omitempty"`
+	Rc   string `json:"rc,omitempty"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// Event kinds.
+const (
+	kindValue = iota // integer value
+	kindData         // data
+	kindRead         // data and a return code
+)
+
+func (e *event) kind() int {
+	if e.Rc != "" {
+		return kindRead
+	}
+	if e.Val != "" {
+		return kindValue
+	}
+	return kindData
+}
+
+func (e *event) String() string {
+	if e.Rc != "" {
+		return fmt.Sprintf("\"%s\" at instruction %d (rc %s, %d bytes)", e.Src, e.N, e.Rc, len(e.Data))
+	}
+	if e.Val != "" {
+		return fmt.Sprintf("\"%s\" at instruction %d (value %s)", e.Src, e.N, e.Val)
+	}
+	return fmt.Sprintf("\"%s\" at instruction %d (%d bytes)", e.Src, e.N, len(e.Data))
+}
+
+//-----------------------------------------------------------------------------
+
+// Log records or replays nondeterministic inputs.
+type Log struct {
+	replay bool          // replay mode
+	count  func() uint64 // retired instruction counter
+	w      *bufio.Writer // record: log writer
+	enc    *json.Encoder // record: event encoder
+	dec    *json.Decoder // replay: event decoder
+	next   *event        // replay: next logged input (nil at the end of the log)
+	err    error         // first error (write failure or replay divergence)
+	N      uint64        // number of inputs
+}
+
+// NewRecorder returns a log recording inputs to w.
+// count returns the number of retired instructions.
+func NewRecorder(w io.Writer, count func() uint64) (*Log, error) {
+	bw := bufio.NewWriter(w)
+	l := &Log{
+		count: count,
+		w:     bw,
+		enc:   json.NewEncoder(bw),
+	}
+	err := l.enc.Encode(&header{Version})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// NewReplayer returns a log replaying inputs from r.
+// count returns the number of retired instructions.
+func NewReplayer(r io.Reader, count func() uint64) (*Log, error) {
+	l := &Log{
+		replay: true,
+		count:  count,
+		dec:    json.NewDecoder(bufio.NewReader(r)),
+	}
+	var h header
+	err := l.dec.Decode(&h)
+	if err != nil {
+		return nil, fmt.Errorf("not a replay log: %s", err)
+	}
+	if h.Version != Version {
+		return nil, fmt.Errorf("replay log version %d is not supported (expected %d)", h.Version, Version)
+	}
+	err = l.advance()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// advance reads the next logged input.
+func (l *Log) advance() error {
+	e := &event{}
+	err := l.dec.Decode(e)
+	if err == io.EOF {
+		l.next = nil
+		return nil
+	}
+	if err != nil {
+		l.next = nil
+		return fmt.Errorf("replay log: %s", err)
+	}
+	l.next = e
+	return nil
+}
+
+// Err returns the first recording error or replay divergence.
+func (l *Log) Err() error {
+	return l.err
+}
+
+// Pending returns true if there are logged inputs that have not been replayed.
+func (l *Log) Pending() bool {
+	return l.next != nil
+}
+
+// Flush writes any buffered log output (recording).
+func (l *Log) Flush() error {
+	if l.w == nil {
+		return nil
+	}
+	err := l.w.Flush()
+	if err != nil && l.err == nil {
+		l.err = err
+	}
+	return l.err
+}
+
+//-----------------------------------------------------------------------------
+
+// record an input.
+func (l *Log) record(e *event) {
+	if l.err != nil {
+		return
+	}
+	l.err = l.enc.Encode(e)
+}
+
+// match returns the next logged input if it matches the source.
+// On a divergence the error is set and the log stops replaying.
+func (l *Log) match(src string, kind int) *event {
+	if l.err != nil {
+		return nil
+	}
+	n := l.count()
+	e := l.next
+	if e == nil {
+		l.err = fmt.Errorf("replay divergence: input \"%s\" at instruction %d is beyond the end of the log", src, n)
+		return nil
+	}
+	if e.Src != src || e.N != n || e.kind() != kind {
+		l.err = fmt.Errorf("replay divergence: input \"%s\" at instruction %d, expected %s", src, n, e)
+		return nil
+	}
+	err := l.advance()
+	if err != nil {
+		l.err = err
+	}
+	return e
+}
+
+// Uint64 returns a nondeterministic integer input.
+// fn reads the live input (it is not called when replaying).
+func (l *Log) Uint64(src string, fn func() uint64) uint64 {
+	l.N++
+	if !l.replay {
+		x := fn()
+		l.record(&event{N: l.count(), Src: src, Val: fmt.Sprintf("0x%x", x)})
+		return x
+	}
+	e := l.match(src, kindValue)
+	if e == nil {
+		return fn()
+	}
+	x, err := strconv.ParseUint(strings.TrimPrefix(e.Val, "0x"), 16, 64)
+	if err != nil {
+		l.err = fmt.Errorf("replay log: bad value %s", e)
+		return fn()
+	}
+	return x
+}
+
+// Bytes returns a nondeterministic data input.
+// fn reads the live input (it is not called when replaying).
+// Empty reads (E.g. polling an idle input) are not logged, so when
+// replaying the read is empty unless the next logged input is for this
+// source and instruction.
+func (l *Log) Bytes(src string, fn func() []byte) []byte {
+	if !l.replay {
+		x := fn()
+		if len(x) != 0 {
+			l.N++
+			l.record(&event{N: l.count(), Src: src, Data: x})
+		}
+		return x
+	}
+	if l.err != nil {
+		return fn()
+	}
+	e := l.next
+	if e == nil || e.Src != src || e.N != l.count() {
+		return nil
+	}
+	l.N++
+	e = l.match(src, kindData)
+	if e == nil {
+		return fn()
+	}
+	return e.Data
+}
+
+// Read returns a nondeterministic read result, the data and a return code
+// (E.g. a byte count or -errno). Both are logged so a failed read replays
+// as a failure. fn does the live read (it is not called when replaying).
+func (l *Log) Read(src string, fn func() ([]byte, int64)) ([]byte, int64) {
+	l.N++
+	if !l.replay {
+		x, rc := fn()
+		l.record(&event{N: l.count(), Src: src, Rc: strconv.FormatInt(rc, 10), Data: x})
+		return x, rc
+	}
+	e := l.match(src, kindRead)
+	if e == nil {
+		return fn()
+	}
+	rc, err := strconv.ParseInt(e.Rc, 10, 64)
+	if err != nil {
+		l.err = fmt.Errorf("replay log: bad return code %s", e)
+		return fn()
+	}
+	return e.Data, rc
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,92 @@
+//-----------------------------------------------------------------------------
+/*
+
+Record and Replay Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package replay
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+//-----------------------------------------------------------------------------
+
+func Test_Replay(t *testing.T) {
+	var n uint64
+	count := func() uint64 { return n }
+	live := uint64(100)
+	clock := func() uint64 { live++; return live }
+	input := func() []byte { return []byte("hello") }
+
+	// record
+	var buf bytes.Buffer
+	rec, err := NewRecorder(&buf, count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x0 := rec.Uint64("time", clock)
+	n = 5
+	x1 := rec.Bytes("uart0", input)
+	x2 := rec.Uint64("time", clock)
+	err = rec.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replay
+	log := buf.String()
+	n = 0
+	live = 0
+	rep, err := NewReplayer(strings.NewReader(log), count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Uint64("time", clock) != x0 {
+		t.Errorf("bad replay value")
+	}
+	n = 5
+	if string(rep.Bytes("uart0", nil)) != string(x1) {
+		t.Errorf("bad replay data")
+	}
+	if rep.Uint64("time", clock) != x2 || rep.Pending() || rep.Err() != nil {
+		t.Errorf("bad replay end state")
+	}
+
+	// empty reads are not logged
+	buf.Reset()
+	n = 0
+	rec, _ = NewRecorder(&buf, count)
+	empty := func() []byte { return nil }
+	rec.Bytes("uart0", empty)
+	n = 3
+	rec.Bytes("uart0", input)
+	rec.Bytes("uart0", empty)
+	rec.Flush()
+	if rec.N != 1 || strings.Count(buf.String(), "\n") != 2 {
+		t.Errorf("empty reads were logged")
+	}
+	n = 0
+	rep, _ = NewReplayer(strings.NewReader(buf.String()), count)
+	if rep.Bytes("uart0", nil) != nil {
+		t.Errorf("bad replay of an empty read")
+	}
+	n = 3
+	if string(rep.Bytes("uart0", nil)) != "hello" || rep.Bytes("uart0", nil) != nil || rep.Pending() || rep.Err() != nil {
+		t.Errorf("bad replay of a sparse input")
+	}
+
+	// divergence
+	n = 1
+	rep, _ = NewReplayer(strings.NewReader(log), count)
+	rep.Uint64("time", clock)
+	if rep.Err() == nil || !strings.Contains(rep.Err().Error(), "divergence") {
+		t.Errorf("expected a divergence, got %v", rep.Err())
+	}
+}
+
+//-----------------------------------------------------------------------------
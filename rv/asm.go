@@ -0,0 +1,1017 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Assembler
+
+The instruction encodings are built from the same definition strings used
+by the disassembler and emulator. The accepted syntax is the syntax printed
+by the disassembler: ABI register names, common pseudo-instructions, symbols
+and hex branch/jump targets. Compressed instructions are only generated for
+mnemonics with an explicit "c." prefix.
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+// instruction fields
+
+// insField is a variable field within an instruction.
+type insField struct {
+	name   string // field name (from the definition string)
+	key    string // operand that provides the field value
+	shift  uint   // bit position of the field lsb
+	bits   []uint // value bits stored in the field (msb first)
+	signed bool   // the value is sign extended
+	short  bool   // 3-bit register field (x8..x15)
+	nz     bool   // the value must be non-zero
+	nz2    bool   // the value must not be 2 (rd!={0,2})
+}
+
+// bitRange returns the bits for a "msb:lsb" or "n" range string.
+func bitRange(s string) []uint {
+	x := strings.Split(s, ":")
+	msb, _ := strconv.Atoi(x[0])
+	lsb := msb
+	if len(x) == 2 {
+		lsb, _ = strconv.Atoi(x[1])
+	}
+	bits := []uint{}
+	for i := msb; i >= lsb; i-- {
+		bits = append(bits, uint(i))
+	}
+	return bits
+}
+
+// newInsField returns the instruction field for a definition field name.
+func newInsField(name string, shift, width uint) insField {
+	f := insField{
+		name:  name,
+		shift: shift,
+	}
+	// immediates: imm[12|10:5], uimm[5:3], nzimm[9], nzuimm[5:4|9:6|2|3]
+	if i := strings.Index(name, "["); i >= 0 {
+		prefix := name[:i]
+		f.key = "imm"
+		f.signed = !strings.Contains(prefix, "u")
+		f.nz = strings.HasPrefix(prefix, "nz")
+		for _, s := range strings.Split(name[i+1:len(name)-1], "|") {
+			f.bits = append(f.bits, bitRange(s)...)
+		}
+		return f
+	}
+	// registers
+	switch name {
+	case "rd", "rd!=0", "rd!={0,2}", "rs1/rd!=0":
+		f.key = "rd"
+	case "rd0", "rs10/rd0":
+		f.key = "rd"
+		f.short = true
+	case "rs1", "rs1!=0":
+		f.key = "rs1"
+	case "rs10":
+		f.key = "rs1"
+		f.short = true
+	case "rs2", "rs2!=0":
+		f.key = "rs2"
+	case "rs20":
+		f.key = "rs2"
+		f.short = true
+	case "rs3":
+		f.key = "rs3"
+	case "shamt5", "shamt6":
+		f.key = "imm"
+	default:
+		// csr, zimm, pred, succ, rm, aq, rl
+		f.key = name
+	}
+	f.nz = strings.Contains(name, "!=0")
+	f.nz2 = strings.Contains(name, "!={0,2}")
+	if f.short {
+		width = 5
+	}
+	f.bits = bitRange(fmt.Sprintf("%d:0", width-1))
+	return f
+}
+
+// defaultOperand returns the value of an operand not provided by the assembly.
+func defaultOperand(key string) int64 {
+	switch key {
+	case "rm":
+		return frmDYN
+	case "pred", "succ":
+		// iorw
+		return 15
+	}
+	return 0
+}
+
+// check checks an operand value against the constraints of the field.
+func (f *insField) check(val int64, explicit bool) error {
+	if f.short && (val < 8 || val > 15) {
+		return fmt.Errorf("register must be one of x8..x15")
+	}
+	if explicit && f.nz && val == 0 {
+		return fmt.Errorf("%s must be non-zero", f.key)
+	}
+	if explicit && f.nz2 && val == 2 {
+		return fmt.Errorf("%s must not be sp", f.key)
+	}
+	return nil
+}
+
+// encode returns the instruction field bits for an operand value.
+func (f *insField) encode(val int64) uint {
+	if f.short {
+		val -= 8
+	}
+	var x uint
+	for _, b := range f.bits {
+		x = (x << 1) | ((uint(val) >> b) & 1)
+	}
+	return x << f.shift
+}
+
+// checkRange checks that an operand value can be stored in the instruction.
+// An operand may be split across several fields (eg: branch offsets).
+func (im *insMeta) checkRange(key string, val int64) error {
+	var msb, covered uint
+	var signed, short bool
+	for i := range im.fields {
+		f := &im.fields[i]
+		if f.key != key {
+			continue
+		}
+		for _, b := range f.bits {
+			if b > msb {
+				msb = b
+			}
+			covered |= 1 << b
+		}
+		signed = f.signed
+		short = f.short
+	}
+	if short {
+		// checked as a register
+		return nil
+	}
+	if signed {
+		if (val<<(63-msb))>>(63-msb) != val {
+			return fmt.Errorf("%s value %d out of range", key, val)
+		}
+	} else {
+		if val < 0 || val>>(msb+1) != 0 {
+			return fmt.Errorf("%s value %d out of range", key, val)
+		}
+	}
+	if uint(val)&((1<<msb)-1)&^covered != 0 {
+		return fmt.Errorf("%s value %d is not aligned", key, val)
+	}
+	return nil
+}
+
+// encode returns the instruction code for a set of operands.
+func (im *insMeta) encode(ops map[string]int64) (uint, error) {
+	ins := im.val
+	for i := range im.fields {
+		f := &im.fields[i]
+		val, ok := ops[f.key]
+		if !ok {
+			val = defaultOperand(f.key)
+		}
+		err := f.check(val, ok)
+		if err != nil {
+			return 0, err
+		}
+		err = im.checkRange(f.key, val)
+		if err != nil {
+			return 0, err
+		}
+		ins |= f.encode(val)
+	}
+	return ins, nil
+}
+
+// hasField returns true if the instruction has the named field.
+func (im *insMeta) hasField(name string) bool {
+	for i := range im.fields {
+		if im.fields[i].name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// defnName returns the instruction name from the definition string.
+func (im *insMeta) defnName() string {
+	parts := strings.Split(im.defn.defn, " ")
+	return strings.ToLower(parts[len(parts)-1])
+}
+
+//-----------------------------------------------------------------------------
+// operand templates
+
+// asmTemplate16 are the operand templates for compressed instructions.
+var asmTemplate16 = map[string]string{
+	"c.addi4spn": "rd,sp,imm",
+	"c.lw":       "rd,imm(rs1)",
+	"c.ld":       "rd,imm(rs1)",
+	"c.flw":      "frd,imm(rs1)",
+	"c.fld":      "frd,imm(rs1)",
+	"c.sw":       "rs2,imm(rs1)",
+	"c.sd":       "rs2,imm(rs1)",
+	"c.fsw":      "frs2,imm(rs1)",
+	"c.fsd":      "frs2,imm(rs1)",
+	"c.nop":      "",
+	"c.addi":     "rd,rd,imm",
+	"c.addiw":    "rd,rd,imm",
+	"c.li":       "rd,imm",
+	"c.addi16sp": "sp,sp,imm",
+	"c.lui":      "rd,uimm20",
+	"c.srli":     "rd,rd,imm",
+	"c.srai":     "rd,rd,imm",
+	"c.andi":     "rd,rd,imm",
+	"c.sub":      "rd,rd,rs2",
+	"c.xor":      "rd,rd,rs2",
+	"c.or":       "rd,rd,rs2",
+	"c.and":      "rd,rd,rs2",
+	"c.subw":     "rd,rd,rs2",
+	"c.addw":     "rd,rd,rs2",
+	"c.j":        "target",
+	"c.jal":      "ra,target",
+	"c.beqz":     "rs1,target",
+	"c.bnez":     "rs1,target",
+	"c.slli":     "rd,rd,imm",
+	"c.slli64":   "rd",
+	"c.lwsp":     "rd,imm(sp)",
+	"c.ldsp":     "rd,imm(sp)",
+	"c.flwsp":    "frd,imm(sp)",
+	"c.fldsp":    "frd,imm(sp)",
+	"c.jr":       "rs1",
+	"c.mv":       "rd,rs2",
+	"c.ebreak":   "",
+	"c.jalr":     "rs1",
+	"c.add":      "rd,rd,rs2",
+	"c.swsp":     "rs2,imm(sp)",
+	"c.sdsp":     "rs2,imm(sp)",
+	"c.fswsp":    "frs2,imm(sp)",
+	"c.fsdsp":    "frs2,imm(sp)",
+}
+
+// Major opcodes with floating point registers.
+const (
+	opLoadFP  = 0x07
+	opStoreFP = 0x27
+	opOpFP    = 0x53
+)
+
+// isFloatType returns true if the fcvt/fmv type suffix is a float register.
+func isFloatType(s string) bool {
+	return s == "s" || s == "d" || s == "q" || s == "h"
+}
+
+// floatRegs returns which of rd, rs1 and rs2 are float registers.
+func floatRegs(im *insMeta) (bool, bool, bool) {
+	op := im.val & 0x7f
+	switch {
+	case op == opLoadFP:
+		return true, false, false
+	case op == opStoreFP:
+		return false, false, true
+	case im.dt == decodeTypeR4:
+		return true, true, true
+	case op != opOpFP:
+		return false, false, false
+	}
+	x := strings.Split(im.name, ".")
+	switch x[0] {
+	case "fcvt":
+		return isFloatType(x[1]), isFloatType(x[2]), false
+	case "fmv":
+		return x[1] != "x", x[2] != "x", false
+	case "feq", "flt", "fle", "fclass":
+		return false, true, true
+	}
+	return true, true, true
+}
+
+// asmTemplate returns the operand template for an instruction.
+func asmTemplate(im *insMeta) []string {
+	if im.n == 16 {
+		s, ok := asmTemplate16[im.defnName()]
+		if !ok || s == "" {
+			return nil
+		}
+		return strings.Split(s, ",")
+	}
+
+	fd, fs1, fs2 := floatRegs(im)
+	reg := func(name string, float bool) string {
+		if float {
+			return "f" + name
+		}
+		return name
+	}
+	rd := reg("rd", fd)
+	rs1 := reg("rs1", fs1)
+	rs2 := reg("rs2", fs2)
+
+	switch im.dt {
+	case decodeTypeU:
+		return []string{rd, "uimm20"}
+	case decodeTypeJ:
+		return []string{rd, "target"}
+	case decodeTypeB:
+		return []string{rs1, rs2, "target"}
+	case decodeTypeS:
+		return []string{rs2, "imm(rs1)"}
+	case decodeTypeR4:
+		return []string{rd, rs1, rs2, "frs3", "rm?"}
+	case decodeTypeI:
+		switch {
+		case im.hasField("csr") && im.hasField("rs1"):
+			return []string{rd, "csr", rs1}
+		case im.hasField("csr"):
+			return []string{rd, "csr", "zimm"}
+		case im.hasField("pred"):
+			return []string{"pred?", "succ?"}
+		case im.hasField("shamt5") || im.hasField("shamt6"):
+			return []string{rd, rs1, "imm"}
+		case im.hasField("rs2"):
+			return []string{"rs1?", "rs2?"}
+		case !im.hasField("rd"):
+			return nil
+		}
+		op := im.val & 0x7f
+		if op == 0x03 || op == opLoadFP || im.name == "jalr" {
+			return []string{rd, "imm(rs1)"}
+		}
+		return []string{rd, rs1, "imm"}
+	case decodeTypeR:
+		t := []string{}
+		if im.hasField("aq") {
+			if im.hasField("rs2") {
+				return []string{rd, rs2, "(rs1)"}
+			}
+			return []string{rd, "(rs1)"}
+		}
+		t = append(t, rd, rs1)
+		if im.hasField("rs2") {
+			t = append(t, rs2)
+		}
+		if im.hasField("rm") {
+			t = append(t, "rm?")
+		}
+		return t
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// operand parsing
+
+// asmReg returns the register number for a register name.
+func asmReg(s string, float bool) (int64, error) {
+	names := abiXName[:]
+	prefix := "x"
+	if float {
+		names = abiFName[:]
+		prefix = "f"
+	}
+	for i, name := range names {
+		if s == name {
+			return int64(i), nil
+		}
+	}
+	if !float && s == "fp" {
+		return RegS0, nil
+	}
+	if strings.HasPrefix(s, prefix) {
+		n, err := strconv.ParseUint(s[1:], 10, 8)
+		if err == nil && n < 32 {
+			return int64(n), nil
+		}
+	}
+	if float {
+		return 0, fmt.Errorf("bad float register \"%s\"", s)
+	}
+	return 0, fmt.Errorf("bad register \"%s\"", s)
+}
+
+// parseNumber parses a decimal or hex (0x) integer.
+func parseNumber(s string, base int) (int64, error) {
+	neg := false
+	if strings.HasPrefix(s, "-") {
+		neg = true
+		s = s[1:]
+	}
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s = s[2:]
+		base = 16
+		// the disassembler prints negative hex as 0x-n
+		if strings.HasPrefix(s, "-") {
+			neg = !neg
+			s = s[1:]
+		}
+	}
+	x, err := strconv.ParseUint(s, base, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad number \"%s\"", s)
+	}
+	if neg {
+		return -int64(x), nil
+	}
+	return int64(x), nil
+}
+
+// assembler is the state for assembling an instruction.
+type assembler struct {
+	isa  *ISA
+	mem  *mem.Memory // symbol table (may be nil)
+	xlen uint        // integer register length
+	pc   uint        // address of the instruction
+}
+
+// symbol returns the value of a "symbol[+-offset]" expression.
+func (a *assembler) symbol(s string) (int64, bool) {
+	if a.mem == nil {
+		return 0, false
+	}
+	name := s
+	var ofs int64
+	if i := strings.LastIndexAny(s, "+-"); i > 0 {
+		x, err := parseNumber(s[i+1:], 0)
+		if err != nil {
+			return 0, false
+		}
+		if s[i] == '-' {
+			x = -x
+		}
+		name = s[:i]
+		ofs = x
+	}
+	sym := a.mem.SymbolByName(name)
+	if sym == nil {
+		return 0, false
+	}
+	return int64(sym.Addr) + ofs, true
+}
+
+// value returns the value of an immediate (number or symbol).
+func (a *assembler) value(s string) (int64, error) {
+	x, err := parseNumber(s, 10)
+	if err == nil {
+		return x, nil
+	}
+	if x, ok := a.symbol(s); ok {
+		return x, nil
+	}
+	return 0, fmt.Errorf("bad immediate \"%s\"", s)
+}
+
+// target returns the address of a branch/jump target (symbol or hex address).
+func (a *assembler) target(s string) (int64, error) {
+	if x, ok := a.symbol(s); ok {
+		return x, nil
+	}
+	x, err := parseNumber(s, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad target \"%s\"", s)
+	}
+	return x, nil
+}
+
+// csrArg returns the register number for a CSR name or number.
+func csrArg(s string) (int64, error) {
+	reg, err := csr.Number(s)
+	if err == nil {
+		return int64(reg), nil
+	}
+	x, err := parseNumber(s, 0)
+	if err != nil || x < 0 || x > 0xfff {
+		return 0, fmt.Errorf("bad csr \"%s\"", s)
+	}
+	return x, nil
+}
+
+// fenceArg returns the bits for a fence predecessor/successor set.
+func fenceArg(s string) (int64, error) {
+	var x int64
+	for _, c := range s {
+		i := strings.IndexRune("wroi", c)
+		if i < 0 {
+			return 0, fmt.Errorf("bad fence set \"%s\"", s)
+		}
+		x |= 1 << uint(i)
+	}
+	return x, nil
+}
+
+// rmArg returns the rounding mode for a rounding mode name.
+func rmArg(s string) (int64, error) {
+	for i, name := range rmName {
+		if s == name {
+			return int64(i), nil
+		}
+	}
+	if s == "rmm" {
+		return frmRRM, nil
+	}
+	return 0, fmt.Errorf("bad rounding mode \"%s\"", s)
+}
+
+// memArg splits an "imm(reg)" operand.
+func memArg(s string) (string, string, error) {
+	i := strings.Index(s, "(")
+	if i < 0 || !strings.HasSuffix(s, ")") {
+		return "", "", fmt.Errorf("bad memory operand \"%s\"", s)
+	}
+	return s[:i], s[i+1 : len(s)-1], nil
+}
+
+// operands matches the assembly operands to an instruction template.
+func (a *assembler) operands(im *insMeta, args []string) (map[string]int64, error) {
+	tmpl := asmTemplate(im)
+	ops := make(map[string]int64)
+
+	// set checks for repeated operands (eg: c.addi rd,rd,imm)
+	set := func(key string, val int64) error {
+		if x, ok := ops[key]; ok && x != val {
+			return fmt.Errorf("%s operands must match", key)
+		}
+		ops[key] = val
+		return nil
+	}
+
+	if len(args) > len(tmpl) {
+		return nil, errors.New("too many operands")
+	}
+
+	for i, t := range tmpl {
+		optional := strings.HasSuffix(t, "?")
+		t = strings.TrimSuffix(t, "?")
+		if i >= len(args) {
+			if optional {
+				continue
+			}
+			return nil, errors.New("not enough operands")
+		}
+		arg := args[i]
+
+		var err error
+		switch t {
+		case "rd", "rs1", "rs2", "rs3", "frd", "frs1", "frs2", "frs3":
+			float := strings.HasPrefix(t, "f")
+			var r int64
+			r, err = asmReg(arg, float)
+			if err == nil {
+				err = set(strings.TrimPrefix(t, "f"), r)
+			}
+		case "sp", "ra":
+			var r int64
+			r, err = asmReg(arg, false)
+			if err == nil {
+				want, _ := asmReg(t, false)
+				if r != want {
+					err = fmt.Errorf("operand must be %s", t)
+				}
+			}
+		case "imm", "zimm":
+			var x int64
+			x, err = a.value(arg)
+			if err == nil {
+				err = set(t, x)
+			}
+		case "uimm20":
+			var x int64
+			x, err = a.value(arg)
+			if err == nil {
+				if x >= 0x80000 && x <= 0xfffff {
+					x -= 0x100000
+				}
+				if x < -0x80000 || x > 0xfffff {
+					err = fmt.Errorf("upper immediate %d out of range", x)
+				} else {
+					err = set("imm", x<<12)
+				}
+			}
+		case "target":
+			var x int64
+			x, err = a.target(arg)
+			if err == nil {
+				err = set("imm", x-int64(a.pc))
+			}
+		case "csr":
+			var x int64
+			x, err = csrArg(arg)
+			if err == nil {
+				err = set(t, x)
+			}
+		case "rm":
+			var x int64
+			x, err = rmArg(arg)
+			if err == nil {
+				err = set(t, x)
+			}
+		case "pred", "succ":
+			var x int64
+			x, err = fenceArg(arg)
+			if err == nil {
+				err = set(t, x)
+			}
+		case "imm(rs1)", "imm(sp)", "(rs1)":
+			var ofs, base string
+			ofs, base, err = memArg(arg)
+			if err != nil {
+				break
+			}
+			var r int64
+			r, err = asmReg(base, false)
+			if err != nil {
+				break
+			}
+			if t == "imm(sp)" {
+				if r != RegSp {
+					err = errors.New("base register must be sp")
+					break
+				}
+			} else {
+				err = set("rs1", r)
+			}
+			if t == "(rs1)" {
+				if ofs != "" && ofs != "0" {
+					err = errors.New("offset must be 0")
+				}
+				break
+			}
+			var x int64
+			if ofs != "" {
+				x, err = a.value(ofs)
+			}
+			if err == nil {
+				err = set("imm", x)
+			}
+		default:
+			err = fmt.Errorf("unknown template operand \"%s\"", t)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 32-bit shifts can't have a shift amount >= xlen
+	shift := im.name == "slli" || im.name == "srli" || im.name == "srai"
+	if a.xlen == 32 && shift {
+		if ops["imm"] >= 32 {
+			return nil, fmt.Errorf("shift amount %d out of range", ops["imm"])
+		}
+	}
+
+	return ops, nil
+}
+
+//-----------------------------------------------------------------------------
+// pseudo-instructions
+
+// li returns the instruction sequence to load an immediate value.
+func (a *assembler) li(rd string, x int64) []string {
+	if a.xlen == 32 {
+		x = int64(int32(x))
+	}
+	if x >= -2048 && x < 2048 {
+		return []string{fmt.Sprintf("addi %s,zero,%d", rd, x)}
+	}
+	if x == int64(int32(x)) {
+		hi := (x + 0x800) >> 12
+		lo := x - (hi << 12)
+		s := []string{fmt.Sprintf("lui %s,0x%x", rd, hi&0xfffff)}
+		if lo != 0 {
+			addi := "addi"
+			if a.xlen == 64 {
+				addi = "addiw"
+			}
+			s = append(s, fmt.Sprintf("%s %s,%s,%d", addi, rd, rd, lo))
+		}
+		return s
+	}
+	// 64-bit: load the upper bits, shift and add the lower 12 bits
+	lo := (x << 52) >> 52
+	hi := (x - lo) >> 12
+	shift := uint(12)
+	for hi&1 == 0 {
+		hi >>= 1
+		shift++
+	}
+	s := a.li(rd, hi)
+	s = append(s, fmt.Sprintf("slli %s,%s,%d", rd, rd, shift))
+	if lo != 0 {
+		s = append(s, fmt.Sprintf("addi %s,%s,%d", rd, rd, lo))
+	}
+	return s
+}
+
+// pcrel returns the auipc/lo12 split of a pc relative offset.
+func pcrel(ofs int64) (int64, int64) {
+	hi := (ofs + 0x800) >> 12
+	return hi & 0xfffff, ofs - (hi << 12)
+}
+
+// pseudo expands a pseudo-instruction into base instructions.
+// It returns nil if the mnemonic/operands are not a pseudo-instruction.
+func (a *assembler) pseudo(mn string, args []string) ([]string, error) {
+	n := len(args)
+	arg := func(i int) string { return args[i] }
+	one := func(format string, x ...interface{}) []string {
+		return []string{fmt.Sprintf(format, x...)}
+	}
+
+	switch {
+	case mn == "nop" && n == 0:
+		return one("addi zero,zero,0"), nil
+	case mn == "li" && n == 2:
+		x, err := a.value(arg(1))
+		if err != nil {
+			return nil, err
+		}
+		return a.li(arg(0), x), nil
+	case (mn == "la" || mn == "lla") && n == 2:
+		x, err := a.target(arg(1))
+		if err != nil {
+			return nil, err
+		}
+		hi, lo := pcrel(x - int64(a.pc))
+		return []string{fmt.Sprintf("auipc %s,0x%x", arg(0), hi), fmt.Sprintf("addi %s,%s,%d", arg(0), arg(0), lo)}, nil
+	case (mn == "call" || mn == "tail") && n == 1:
+		x, err := a.target(arg(0))
+		if err != nil {
+			return nil, err
+		}
+		hi, lo := pcrel(x - int64(a.pc))
+		rd, rt := "ra", "ra"
+		if mn == "tail" {
+			rd, rt = "zero", "t1"
+		}
+		return []string{fmt.Sprintf("auipc %s,0x%x", rt, hi), fmt.Sprintf("jalr %s,%d(%s)", rd, lo, rt)}, nil
+	case mn == "mv" && n == 2:
+		return one("addi %s,%s,0", arg(0), arg(1)), nil
+	case mn == "not" && n == 2:
+		return one("xori %s,%s,-1", arg(0), arg(1)), nil
+	case (mn == "neg" || mn == "negw") && n == 2:
+		return one("sub%s %s,zero,%s", mn[3:], arg(0), arg(1)), nil
+	case mn == "sext.w" && n == 2:
+		return one("addiw %s,%s,0", arg(0), arg(1)), nil
+	case mn == "seqz" && n == 2:
+		return one("sltiu %s,%s,1", arg(0), arg(1)), nil
+	case mn == "snez" && n == 2:
+		return one("sltu %s,zero,%s", arg(0), arg(1)), nil
+	case mn == "sltz" && n == 2:
+		return one("slt %s,%s,zero", arg(0), arg(1)), nil
+	case mn == "sgtz" && n == 2:
+		return one("slt %s,zero,%s", arg(0), arg(1)), nil
+	case (mn == "beqz" || mn == "bnez" || mn == "bltz" || mn == "bgez") && n == 2:
+		return one("%s %s,zero,%s", mn[:3], arg(0), arg(1)), nil
+	case mn == "blez" && n == 2:
+		return one("bge zero,%s,%s", arg(0), arg(1)), nil
+	case mn == "bgtz" && n == 2:
+		return one("blt zero,%s,%s", arg(0), arg(1)), nil
+	case (mn == "bgt" || mn == "bgtu") && n == 3:
+		return one("blt%s %s,%s,%s", mn[3:], arg(1), arg(0), arg(2)), nil
+	case (mn == "ble" || mn == "bleu") && n == 3:
+		return one("bge%s %s,%s,%s", mn[3:], arg(1), arg(0), arg(2)), nil
+	case mn == "j" && n == 1:
+		return one("jal zero,%s", arg(0)), nil
+	case mn == "jal" && n == 1:
+		return one("jal ra,%s", arg(0)), nil
+	case mn == "jr" && n == 1:
+		return one("jalr zero,0(%s)", arg(0)), nil
+	case mn == "jalr" && n == 1:
+		if strings.Contains(arg(0), "(") {
+			return one("jalr ra,%s", arg(0)), nil
+		}
+		return one("jalr ra,0(%s)", arg(0)), nil
+	case mn == "jalr" && n == 2 && !strings.Contains(arg(1), "("):
+		return one("jalr %s,0(%s)", arg(0), arg(1)), nil
+	case mn == "ret" && n == 0:
+		return one("jalr zero,0(ra)"), nil
+	case mn == "csrr" && n == 2:
+		return one("csrrs %s,%s,zero", arg(0), arg(1)), nil
+	case (mn == "csrw" || mn == "csrs" || mn == "csrc" || mn == "csrwi" || mn == "csrsi" || mn == "csrci") && n == 2:
+		return one("csrr%s zero,%s,%s", mn[3:], arg(0), arg(1)), nil
+	case (mn == "rdcycle" || mn == "rdtime" || mn == "rdinstret") && n == 1:
+		return one("csrrs %s,%s,zero", arg(0), mn[2:]), nil
+	case mn == "frcsr" && n == 1:
+		return one("csrrs %s,fcsr,zero", arg(0)), nil
+	case mn == "fscsr" && n == 1:
+		return one("csrrw zero,fcsr,%s", arg(0)), nil
+	case mn == "fscsr" && n == 2:
+		return one("csrrw %s,fcsr,%s", arg(0), arg(1)), nil
+	case mn == "frrm" && n == 1:
+		return one("csrrs %s,frm,zero", arg(0)), nil
+	case mn == "fsrm" && n == 1:
+		return one("csrrw zero,frm,%s", arg(0)), nil
+	case mn == "fsrm" && n == 2:
+		return one("csrrw %s,frm,%s", arg(0), arg(1)), nil
+	case mn == "fsrmi" && n == 1:
+		return one("csrrwi zero,frm,%s", arg(0)), nil
+	case mn == "fsrmi" && n == 2:
+		return one("csrrwi %s,frm,%s", arg(0), arg(1)), nil
+	case mn == "frflags" && n == 1:
+		return one("csrrs %s,fflags,zero", arg(0)), nil
+	case mn == "fsflags" && n == 1:
+		return one("csrrw zero,fflags,%s", arg(0)), nil
+	case mn == "fsflags" && n == 2:
+		return one("csrrw %s,fflags,%s", arg(0), arg(1)), nil
+	case (mn == "fmv.s" || mn == "fmv.d") && n == 2:
+		return one("fsgnj%s %s,%s,%s", mn[3:], arg(0), arg(1), arg(1)), nil
+	case (mn == "fneg.s" || mn == "fneg.d") && n == 2:
+		return one("fsgnjn%s %s,%s,%s", mn[4:], arg(0), arg(1), arg(1)), nil
+	case (mn == "fabs.s" || mn == "fabs.d") && n == 2:
+		return one("fsgnjx%s %s,%s,%s", mn[4:], arg(0), arg(1), arg(1)), nil
+	case strings.HasPrefix(mn, "amo") && n == 2:
+		// two operand amo (E.g. amoswap.w rd,(rs1)) has rs2 == zero
+		return one("%s %s,zero,%s", mn, arg(0), arg(1)), nil
+	}
+	return nil, nil
+}
+
+//-----------------------------------------------------------------------------
+
+// pseudo16 are the compressed pseudo-instructions.
+var pseudo16 = map[string]string{
+	"c.ret": "c.jr ra",
+}
+
+// split splits an assembly line into mnemonic and operands.
+func split(s string) (string, []string) {
+	s = strings.TrimSpace(strings.ToLower(s))
+	i := strings.IndexAny(s, " \t")
+	if i < 0 {
+		return s, nil
+	}
+	mn := s[:i]
+	args := []string{}
+	for _, x := range strings.Split(s[i+1:], ",") {
+		args = append(args, strings.TrimSpace(x))
+	}
+	return mn, args
+}
+
+// candidates returns the instructions that match a mnemonic.
+func (a *assembler) candidates(mn string) []*insMeta {
+	list := []*insMeta{}
+	if strings.HasPrefix(mn, "c.") {
+		for _, im := range a.isa.ins16 {
+			if "c."+im.name == mn || im.defnName() == mn {
+				list = append(list, im)
+			}
+		}
+		return list
+	}
+	for _, im := range a.isa.ins32 {
+		if im.name == mn {
+			list = append(list, im)
+		}
+	}
+	return list
+}
+
+// instruction assembles a single (non-pseudo) instruction.
+func (a *assembler) instruction(mn string, args []string) (uint, error) {
+	// atomic ordering suffixes
+	var aq, rl int64
+	if strings.HasPrefix(mn, "amo") || strings.HasPrefix(mn, "lr.") || strings.HasPrefix(mn, "sc.") {
+		for _, sfx := range []string{".aqrl", ".aq", ".rl"} {
+			if strings.HasSuffix(mn, sfx) {
+				mn = strings.TrimSuffix(mn, sfx)
+				aq = int64(btoi(strings.Contains(sfx, "aq")))
+				rl = int64(btoi(strings.Contains(sfx, "rl")))
+				break
+			}
+		}
+	}
+
+	list := a.candidates(mn)
+	if len(list) == 0 {
+		return 0, fmt.Errorf("unknown instruction \"%s\"", mn)
+	}
+
+	var firstErr error
+	for _, im := range list {
+		ops, err := a.operands(im, args)
+		if err == nil {
+			if aq != 0 || rl != 0 {
+				ops["aq"] = aq
+				ops["rl"] = rl
+			}
+			var ins uint
+			ins, err = im.encode(ops)
+			if err == nil {
+				// make sure the encoding decodes as this instruction
+				x := a.isa.lookup(ins)
+				if x != nil && x.defn.defn == im.defn.defn {
+					return ins, nil
+				}
+				err = fmt.Errorf("operands not valid for %s", im.defnName())
+			}
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return 0, fmt.Errorf("%s: %s", mn, firstErr)
+}
+
+// line assembles a line that may contain a pseudo-instruction.
+func (a *assembler) line(s string) ([]uint, error) {
+	mn, args := split(s)
+	if mn == "" {
+		return nil, errors.New("no instruction")
+	}
+
+	// compressed pseudo-instructions
+	if x, ok := pseudo16[mn]; ok && len(args) == 0 {
+		mn, args = split(x)
+	}
+
+	x, err := a.pseudo(mn, args)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", mn, err)
+	}
+	if x != nil {
+		code := []uint{}
+		pc := a.pc
+		for _, line := range x {
+			mn, args := split(line)
+			ins, err := a.instruction(mn, args)
+			if err != nil {
+				return nil, err
+			}
+			code = append(code, ins)
+			a.pc += insLength(ins)
+		}
+		a.pc = pc
+		return code, nil
+	}
+
+	ins, err := a.instruction(mn, args)
+	if err != nil {
+		return nil, err
+	}
+	return []uint{ins}, nil
+}
+
+// insLength returns the length in bytes of an instruction.
+func insLength(ins uint) uint {
+	if ins&3 == 3 {
+		return 4
+	}
+	return 2
+}
+
+//-----------------------------------------------------------------------------
+
+// Assemble returns the instruction codes for an assembly line at the pc.
+// Pseudo-instructions (eg: li, la, call) may generate more than one instruction.
+// The memory is used for symbol lookup (may be nil).
+func (isa *ISA) Assemble(m *mem.Memory, xlen, pc uint, s string) ([]uint, error) {
+	a := &assembler{
+		isa:  isa,
+		mem:  m,
+		xlen: xlen,
+		pc:   pc,
+	}
+	return a.line(s)
+}
+
+// Assemble an instruction and write it to memory at the address.
+// It returns the number of bytes written.
+func (m *RV) Assemble(adr uint, s string) (uint, error) {
+	code, err := m.isa.Assemble(m.Mem, m.xlen, adr, s)
+	if err != nil {
+		return 0, err
+	}
+	buf := []uint8{}
+	for _, ins := range code {
+		for i := uint(0); i < insLength(ins); i++ {
+			buf = append(buf, uint8(ins>>(i*8)))
+		}
+	}
+	err = m.Mem.Patch(adr, buf)
+	if err != nil {
+		return 0, err
+	}
+	return uint(len(buf)), nil
+}
+
+//-----------------------------------------------------------------------------
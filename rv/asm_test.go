@@ -0,0 +1,207 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Assembler Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+//-----------------------------------------------------------------------------
+
+// asmSet checks that the disassembly of each test instruction re-assembles
+// to an instruction with the same disassembly.
+func asmSet(module []ISAModule, xlen uint, tests []daTest) error {
+	isa := NewISA(0)
+	err := isa.Add(module)
+	if err != nil {
+		return err
+	}
+	for _, v := range tests {
+		da := isa.daInstruction(v.pc, v.ins)
+		if da == "illegal" || strings.HasSuffix(da, "TODO") {
+			continue
+		}
+		s := da
+		if v.ins&3 != 3 {
+			s = "c." + da
+		}
+		code, err := isa.Assemble(nil, xlen, v.pc, s)
+		if err != nil {
+			return fmt.Errorf("\"%s\" %s", s, err)
+		}
+		if len(code) != 1 {
+			return fmt.Errorf("\"%s\" assembled to %d instructions", s, len(code))
+		}
+		if insLength(code[0]) != insLength(v.ins) {
+			return fmt.Errorf("\"%s\" assembled to the wrong length", s)
+		}
+		x := isa.daInstruction(v.pc, code[0])
+		if x != da {
+			return fmt.Errorf("\"%s\" (expected) \"%s\" (actual) %08x", da, x, code[0])
+		}
+	}
+	return nil
+}
+
+func Test_AssemblerRoundTrip(t *testing.T) {
+	rv32Tests := [][]daTest{
+		rv32iTest, rv32mTest, rv32aTest, rv32fTest, rv32dTest,
+		rv32cTest, rv32cOnlyTest, rv32fcTest,
+	}
+	rv64Tests := [][]daTest{
+		rv32iTest, rv32mTest, rv32aTest, rv32fTest, rv32dTest,
+		rv32cTest, rv32dcTest,
+		rv64iTest, rv64mTest, rv64aTest, rv64fTest, rv64dTest, rv64cTest,
+	}
+	for _, tests := range rv32Tests {
+		err := asmSet(ISArv32gc, 32, tests)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	for _, tests := range rv64Tests {
+		err := asmSet(ISArv64gc, 64, tests)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_Assembler(t *testing.T) {
+	isa := NewISA(0)
+	err := isa.Add(ISArv64gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		pc   uint
+		s    string
+		code []uint
+	}{
+		{0, "addi a0,a1,-1", []uint{0xfff58513}},
+		{0, "ADDI x10, x11, -1", []uint{0xfff58513}},
+		{0, "lui a1,0x80000", []uint{0x800005b7}},
+		{0x1000, "beq a0,a1,1010", []uint{0x00b50863}},
+		{0x1000, "jal 800", []uint{0x801ff0ef}},
+		{0, "ret", []uint{0x00008067}},
+		{0, "c.ret", []uint{0x8082}},
+		{0, "c.addi sp,sp,-32", []uint{0x1101}},
+		{0, "c.lw ra,28(sp)", []uint{0x40f2}},
+		{0, "sd ra,8(sp)", []uint{0x00113423}},
+		{0, "csrr a0,mhartid", []uint{0xf1402573}},
+		{0, "amoswap.w.aqrl t1,t0,(a0)", []uint{0x0e55232f}},
+		{0, "fcvt.w.s a0,ft0,rtz", []uint{0xc0001553}},
+		{0, "li a0,0x12345", []uint{0x00012537, 0x3455051b}},
+		{0x1000, "call 2000", []uint{0x00001097, 0x000080e7}},
+	}
+	for _, v := range tests {
+		code, err := isa.Assemble(nil, 64, v.pc, v.s)
+		if err != nil {
+			t.Errorf("\"%s\" %s", v.s, err)
+			continue
+		}
+		if fmt.Sprintf("%x", code) != fmt.Sprintf("%x", v.code) {
+			t.Errorf("\"%s\" %x (expected) %x (actual)", v.s, v.code, code)
+		}
+	}
+
+	// errors
+	bad := []string{
+		"addi a0,a1,2048",
+		"beq a0,a1,3",
+		"c.lw a0,8(a6)",
+		"c.addi zero,zero,1",
+		"lw a0,a1",
+		"add a0,a1",
+		"foo a0",
+	}
+	for _, s := range bad {
+		_, err := isa.Assemble(nil, 64, 0, s)
+		if err == nil {
+			t.Errorf("\"%s\" expected an error", s)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// evalLi evaluates a li instruction sequence.
+func evalLi(code []uint) int64 {
+	var x int64
+	for _, ins := range code {
+		switch ins & 0x7f {
+		case 0x37: // lui
+			imm, _ := decodeU(ins)
+			x = int64(imm) << 12
+		case 0x13:
+			if (ins>>12)&7 == 1 {
+				// slli
+				shamt, _, _ := decodeIc(ins)
+				x <<= shamt
+			} else {
+				// addi
+				imm, rs1, _ := decodeIa(ins)
+				if rs1 == 0 {
+					x = 0
+				}
+				x += int64(imm)
+			}
+		case 0x1b: // addiw
+			imm, _, _ := decodeIa(ins)
+			x = int64(int32(x + int64(imm)))
+		}
+	}
+	return x
+}
+
+func Test_AssemblerLi(t *testing.T) {
+	isa := NewISA(0)
+	err := isa.Add(ISArv64g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := []int64{
+		0, 1, -1, 2047, -2048, 2048, 0x7ff00000, 0x7fffffff, -0x80000000,
+		0x80000000, 0xffffffff, 0x123456789abcdef0, -0x123456789abcdef0,
+		0x7fffffffffffffff, -0x8000000000000000, 0x100000000000,
+	}
+	for _, x := range values {
+		s := fmt.Sprintf("li a0,%d", x)
+		code, err := isa.Assemble(nil, 64, 0, s)
+		if err != nil {
+			t.Errorf("\"%s\" %s", s, err)
+			continue
+		}
+		if evalLi(code) != x {
+			t.Errorf("\"%s\" evaluates to %d", s, evalLi(code))
+		}
+	}
+}
+
+// An unknown operand in an instruction template is an error (not a panic).
+func Test_AssemblerTemplate(t *testing.T) {
+	isa := NewISA(0)
+	err := isa.Add(ISArv64gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := asmTemplate16["c.lw"]
+	asmTemplate16["c.lw"] = "rd,bad"
+	defer func() { asmTemplate16["c.lw"] = tmpl }()
+	_, err = isa.Assemble(nil, 64, 0, "c.lw a0,0(a1)")
+	if err == nil || !strings.Contains(err.Error(), "unknown template operand") {
+		t.Errorf("bad template error %v", err)
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,156 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Machine Checkpoints
+
+A checkpoint is the full state of the machine (registers, CSRs, memory
+sections, device states, symbols and break points). It can be written to a file and
+restored into a fresh machine. E.g. boot once to a known point and then
+start many test runs from the checkpoint.
+
+File format: magic string, version number, gzip compressed gob encoding.
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+const checkpointMagic = "rvckpt"
+
+// CheckpointVersion is the current checkpoint file version.
+// It changes with the checkpoint layout:
+//
+// 1: initial version
+// 2: stimecmp csr (Sstc)
+// 3: mtimecmp csr (CLINT timer)
+// 4: device states and break point lengths
+// 5: loaded images
+const CheckpointVersion = 5
+
+// Checkpoint is the serializable state of the machine.
+type Checkpoint struct {
+	Xlen     uint          // bit length of integer registers
+	Ext      uint          // ISA extension bits
+	X        [32]uint64    // integer registers
+	F        [32]uint64    // float registers
+	PC       uint64        // program counter
+	ResAdr   uint          // load reserved address
+	ResValid bool          // load reserved address is valid
+	CSR      *csr.Snapshot // CSR state
+	Mem      *mem.Snapshot // memory state
+}
+
+// Checkpoint returns a checkpoint of the machine state.
+func (m *RV) Checkpoint() (*Checkpoint, error) {
+	x, err := m.Mem.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &Checkpoint{
+		Xlen:     m.xlen,
+		Ext:      m.isa.ext,
+		X:        m.x,
+		F:        m.f,
+		PC:       m.PC,
+		ResAdr:   m.resAdr,
+		ResValid: m.resValid,
+		CSR:      m.CSR.Snapshot(),
+		Mem:      x,
+	}, nil
+}
+
+// Restore sets the machine state from a checkpoint.
+func (m *RV) Restore(c *Checkpoint) error {
+	if c.Xlen != m.xlen {
+		return fmt.Errorf("checkpoint is rv%d, cpu is rv%d", c.Xlen, m.xlen)
+	}
+	if c.Ext != m.isa.ext {
+		return fmt.Errorf("checkpoint ISA extensions 0x%x don't match the cpu (0x%x)", c.Ext, m.isa.ext)
+	}
+	if c.CSR == nil || c.Mem == nil {
+		return fmt.Errorf("checkpoint is incomplete")
+	}
+	err := m.CSR.Restore(c.CSR)
+	if err != nil {
+		return err
+	}
+	err = m.Mem.Restore(c.Mem)
+	if err != nil {
+		return err
+	}
+	m.x = c.X
+	m.f = c.F
+	m.PC = c.PC
+	m.resAdr = c.ResAdr
+	m.resValid = c.ResValid
+	m.err.reset()
+	m.lastPC = 0
+	if m.rev != nil {
+		m.rev.reset(m)
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+
+// Write writes a checkpoint file.
+func (c *Checkpoint) Write(w io.Writer) error {
+	_, err := io.WriteString(w, checkpointMagic)
+	if err != nil {
+		return err
+	}
+	err = binary.Write(w, binary.LittleEndian, uint32(CheckpointVersion))
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	err = gob.NewEncoder(zw).Encode(c)
+	if err != nil {
+		zw.Close()
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadCheckpoint reads a checkpoint file.
+func ReadCheckpoint(r io.Reader) (*Checkpoint, error) {
+	magic := make([]byte, len(checkpointMagic))
+	_, err := io.ReadFull(r, magic)
+	if err != nil || string(magic) != checkpointMagic {
+		return nil, fmt.Errorf("not a checkpoint file")
+	}
+	var version uint32
+	err = binary.Read(r, binary.LittleEndian, &version)
+	if err != nil {
+		return nil, err
+	}
+	if version != CheckpointVersion {
+		return nil, fmt.Errorf("checkpoint version %d is not supported (expected %d)", version, CheckpointVersion)
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	c := &Checkpoint{}
+	err = gob.NewDecoder(zr).Decode(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,151 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Machine Checkpoint Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+// newCheckpointCPU returns a cpu with a test program loaded at 0x1000.
+func newCheckpointCPU(t *testing.T) *RV {
+	isa := NewISA(0)
+	err := isa.Add(ISArv64gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := csr.NewState(64, isa.GetExtensions())
+	m := mem.NewMem64(state, 0)
+	m.Add(mem.NewSection("text", 0x1000, 0x1000, mem.AttrRWX))
+	m.Add(mem.NewSection("data", 0x400, 0x100, mem.AttrRW))
+	cpu := NewRV64(isa, m, state)
+	prog := []string{
+		"addi a0,a0,1",
+		"sw a0,0x400(zero)",
+		"csrw mscratch,a0",
+		"jal zero,1000",
+	}
+	adr := uint(0x1000)
+	for _, s := range prog {
+		n, err := cpu.Assemble(adr, s)
+		if err != nil {
+			t.Fatalf("\"%s\" %s", s, err)
+		}
+		adr += n
+	}
+	cpu.PC = 0x1000
+	return cpu
+}
+
+func Test_Checkpoint(t *testing.T) {
+	cpu := newCheckpointCPU(t)
+	cpu.Mem.AddSymbol("loop", 0x1000, 16)
+	cpu.Mem.AddBreakPoint("data", 0x400, mem.AttrW, nil)
+	for i := 0; i < 6; i++ {
+		cpu.Run()
+		cpu.Mem.GetBreak()
+	}
+
+	c, err := cpu.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = c.Write(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ck, err := ReadCheckpoint(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restore into a fresh machine
+	isa := NewISA(0)
+	isa.Add(ISArv64gc)
+	state := csr.NewState(64, isa.GetExtensions())
+	x := NewRV64(isa, mem.NewMem64(state, 0), state)
+	err = x.Restore(ck)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// both machines should run identically
+	for i := 0; i < 10; i++ {
+		e0 := cpu.Run()
+		e1 := x.Run()
+		if (e0 == nil) != (e1 == nil) {
+			t.Fatalf("step %d: errors differ %v %v", i, e0, e1)
+		}
+		if cpu.PC != x.PC || cpu.IntRegs() != x.IntRegs() {
+			t.Fatalf("step %d: state differs\n%s\n%s", i, cpu.IntRegs(), x.IntRegs())
+		}
+	}
+	if cpu.CSR.Display() != x.CSR.Display() {
+		t.Errorf("csr state differs")
+	}
+	v0, _ := cpu.Mem.Rd32(0x400)
+	v1, _ := x.Mem.Rd32(0x400)
+	if v0 != v1 || v0 == 0 {
+		t.Errorf("memory differs %d %d", v0, v1)
+	}
+	if x.Mem.SymbolOffset(0x1004) != "loop+0x4" {
+		t.Errorf("symbol not restored")
+	}
+	if x.Mem.DisplayBreakPoints() != cpu.Mem.DisplayBreakPoints() {
+		t.Errorf("break points not restored")
+	}
+}
+
+func Test_CheckpointDevice(t *testing.T) {
+	d := &counterDevice{}
+	cpu := newDeviceCPU(t, d)
+	for i := 0; i < 6; i++ {
+		cpu.Run()
+	}
+	c, err := cpu.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.Run()
+	cpu.Run()
+	err = cpu.Restore(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.n != 3 {
+		t.Errorf("device state is %d, expected 3", d.n)
+	}
+
+	// the machine has different devices
+	x := newDeviceCPU(t, &counterDevice{})
+	x.Mem.Add(mem.NewDevice("other", 0x310, 0x10, &counterDevice{}))
+	if x.Restore(c) == nil {
+		t.Errorf("expected an error for different devices")
+	}
+	// a device without a saved state
+	x = newDeviceCPU(t, &plainDevice{})
+	if _, err := x.Checkpoint(); err == nil {
+		t.Errorf("expected an error for a device without a state")
+	}
+}
+
+func Test_CheckpointBadFile(t *testing.T) {
+	_, err := ReadCheckpoint(bytes.NewReader([]byte("not a checkpoint")))
+	if err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+//-----------------------------------------------------------------------------
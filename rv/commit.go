@@ -0,0 +1,82 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Commit Log
+
+Writes a trace of retired instructions and their architectural side effects
+using the same textual format as "spike --log-commits". E.g.
+
+core   0: 3 0x0000000080000000 (0x00000297) x5  0x0000000080000000
+core   0: 3 0x0000000080000010 (0x0062a023) mem 0x0000000080001000 0x00000001
+
+Traps are logged as per "spike -l" on the lines before the next retired
+instruction. E.g.
+
+core   0: exception trap_machine_ecall, epc 0x0000000080000014
+core   0:           c768_mstatus 0x0000000a00001800 c833_mepc 0x0000000080000014 ...
+
+The trap line is followed by the CSRs written by the trap. Implicit fflags
+updates are logged with the instruction that raised the flags.
+
+The trace can be diffed against Spike to find divergences.
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import (
+	"bufio"
+	"io"
+)
+
+//-----------------------------------------------------------------------------
+
+// CommitLog writes a Spike compatible commit log.
+type CommitLog struct {
+	w    *bufio.Writer
+	hart uint  // hart id
+	xlen uint  // integer register length
+	flen uint  // float register length
+	err  error // first write error
+}
+
+// NewCommitLog returns a commit log writing to w.
+func NewCommitLog(w io.Writer, hart uint) *CommitLog {
+	return &CommitLog{
+		w:    bufio.NewWriter(w),
+		hart: hart,
+	}
+}
+
+// Flush writes any buffered log output.
+func (c *CommitLog) Flush() error {
+	err := c.w.Flush()
+	if c.err == nil {
+		c.err = err
+	}
+	return c.err
+}
+
+// Write writes the record for a retired instruction.
+func (c *CommitLog) Write(r *Retire) {
+	_, err := c.w.WriteString(retireString(r, c.hart, c.xlen, c.flen) + "\n")
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// SetCommitLog sets the commit log (nil for none).
+func (m *RV) SetCommitLog(c *CommitLog) {
+	if c == nil {
+		m.SetRetire(nil)
+		return
+	}
+	c.xlen = m.xlen
+	c.flen = m.flen()
+	m.SetRetire(c.Write)
+}
+
+//-----------------------------------------------------------------------------
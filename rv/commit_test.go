@@ -0,0 +1,198 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Commit Log Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+func Test_CommitLog(t *testing.T) {
+	isa := NewISA(0)
+	err := isa.Add(ISArv64gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := csr.NewState(64, isa.GetExtensions())
+	m := mem.NewMem64(state, 0)
+	m.Add(mem.NewSection("text", 0x1000, 0x1000, mem.AttrRWX))
+	cpu := NewRV64(isa, m, state)
+
+	prog := []string{
+		"addi a0,zero,5",
+		"sw a0,0x400(zero)",
+		"lw a1,0x400(zero)",
+		"csrw mscratch,a1",
+		"c.addi a0,a0,1",
+	}
+	adr := uint(0x1000)
+	for _, s := range prog {
+		n, err := cpu.Assemble(adr, s)
+		if err != nil {
+			t.Fatalf("\"%s\" %s", s, err)
+		}
+		adr += n
+	}
+	m.Add(mem.NewSection("data", 0x400, 0x100, mem.AttrRW))
+
+	var buf bytes.Buffer
+	log := NewCommitLog(&buf, 0)
+	cpu.SetCommitLog(log)
+	cpu.PC = 0x1000
+	for range prog {
+		err := cpu.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.Flush()
+
+	expect := []string{
+		"core   0: 3 0x0000000000001000 (0x00500513) x10 0x0000000000000005",
+		"core   0: 3 0x0000000000001004 (0x40a02023) mem 0x0000000000000400 0x00000005",
+		"core   0: 3 0x0000000000001008 (0x40002583) x11 0x0000000000000005 mem 0x0000000000000400",
+		"core   0: 3 0x000000000000100c (0x34059073) c832_mscratch 0x0000000000000005",
+		"core   0: 3 0x0000000000001010 (0x0505) x10 0x0000000000000006",
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expect) {
+		t.Fatalf("expected %d lines, got %d\n%s", len(expect), len(lines), buf.String())
+	}
+	for i := range expect {
+		if lines[i] != expect[i] {
+			t.Errorf("\n%s (expected)\n%s (actual)", expect[i], lines[i])
+		}
+	}
+}
+
+func Test_CommitLogTrap(t *testing.T) {
+	isa := NewISA(0)
+	err := isa.Add(ISArv64gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := csr.NewState(64, isa.GetExtensions())
+	m := mem.NewMem64(state, 0)
+	m.Add(mem.NewSection("text", 0x1000, 0x1000, mem.AttrRWX))
+	cpu := NewRV64(isa, m, state)
+	prog := map[uint]string{
+		0x1000: "ecall",
+		0x1100: "addi a0,zero,1",
+		0x1104: "addi zero,zero,0",
+	}
+	for adr, s := range prog {
+		_, err := cpu.Assemble(adr, s)
+		if err != nil {
+			t.Fatalf("\"%s\" %s", s, err)
+		}
+	}
+	cpu.CSR.DebugWr(0x305, 0x1100) // mtvec
+
+	var buf bytes.Buffer
+	log := NewCommitLog(&buf, 0)
+	cpu.SetCommitLog(log)
+	// an ecall exception, the handler and a nop
+	cpu.PC = 0x1000
+	for i := 0; i < 3; i++ {
+		err := cpu.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a machine software interrupt
+	cpu.CSR.DebugWr(0x304, 1<<csr.IntMachineSoftware) // mie
+	cpu.CSR.DebugWr(csr.MSTATUS, 8)                   // mstatus.MIE
+	cpu.CSR.SetPending(csr.IntMachineSoftware, true)
+	err = cpu.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Flush()
+
+	expect := []string{
+		"core   0: exception trap_machine_ecall, epc 0x0000000000001000",
+		"core   0:           c768_mstatus 0x0000000a0000b800 c833_mepc 0x0000000000001000 c834_mcause 0x000000000000000b c835_mtval 0x0000000000000000",
+		"core   0: 3 0x0000000000001100 (0x00100513) x10 0x0000000000000001",
+		"core   0: 3 0x0000000000001104 (0x00000013)",
+		"core   0: exception interrupt #3, epc 0x0000000000001108",
+		"core   0:           c768_mstatus 0x0000000a00001880 c833_mepc 0x0000000000001108 c834_mcause 0x8000000000000003 c835_mtval 0x0000000000000000",
+		"core   0: 3 0x0000000000001100 (0x00100513) x10 0x0000000000000001",
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expect) {
+		t.Fatalf("expected %d lines, got %d\n%s", len(expect), len(lines), buf.String())
+	}
+	for i := range expect {
+		if lines[i] != expect[i] {
+			t.Errorf("\n%s (expected)\n%s (actual)", expect[i], lines[i])
+		}
+	}
+}
+
+func Test_CommitLogFlags(t *testing.T) {
+	isa := NewISA(0)
+	err := isa.Add(ISArv64gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := csr.NewState(64, isa.GetExtensions())
+	m := mem.NewMem64(state, 0)
+	m.Add(mem.NewSection("text", 0x1000, 0x1000, mem.AttrRWX))
+	cpu := NewRV64(isa, m, state)
+	prog := []string{
+		"fdiv.d f2,f1,f1",
+		"fdiv.d f3,f1,f1",
+		"csrrw zero,fflags,zero",
+	}
+	adr := uint(0x1000)
+	for _, s := range prog {
+		n, err := cpu.Assemble(adr, s)
+		if err != nil {
+			t.Fatalf("\"%s\" %s", s, err)
+		}
+		adr += n
+	}
+	cpu.CSR.DebugWr(csr.MSTATUS, 0x2000) // mstatus.FS
+
+	var buf bytes.Buffer
+	log := NewCommitLog(&buf, 0)
+	cpu.SetCommitLog(log)
+	// 0/0 sets the invalid operation flag
+	cpu.PC = 0x1000
+	for range prog {
+		err := cpu.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.Flush()
+
+	expect := []string{
+		"core   0: 3 0x0000000000001000 (0x1a10f153) f2  0x7ff8000000000000 c1_fflags 0x0000000000000010",
+		"core   0: 3 0x0000000000001004 (0x1a10f1d3) f3  0x7ff8000000000000",
+		"core   0: 3 0x0000000000001008 (0x00101073) c1_fflags 0x0000000000000000",
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expect) {
+		t.Fatalf("expected %d lines, got %d\n%s", len(expect), len(lines), buf.String())
+	}
+	for i := range expect {
+		if lines[i] != expect[i] {
+			t.Errorf("\n%s (expected)\n%s (actual)", expect[i], lines[i])
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -275,6 +275,72 @@ type Ecall interface {
 	Call(m *RV) error
 }
 
+// SetEcall sets the handler for ecalls from user mode.
+// Other ecalls are environment call exceptions.
+func (m *RV) SetEcall(e Ecall) {
+	m.ecall = e
+}
+
+// SetSBI sets the handler for ecalls from supervisor mode (E.g. SBI firmware).
+func (m *RV) SetSBI(e Ecall) {
+	m.sbi = e
+}
+
+//-----------------------------------------------------------------------------
+
+// pollInterval is the number of instructions between device polls.
+const pollInterval = 1024
+
+// AddPoller adds a function that is called periodically as the CPU runs.
+// Devices use this to check for (nondeterministic) input.
+func (m *RV) AddPoller(fn func()) {
+	m.poll = append(m.poll, fn)
+}
+
+// Halt stops the emulation with an error (E.g. an exit) once the current
+// instruction has completed. Devices use this to stop the emulation from
+// a register write.
+func (m *RV) Halt(err error) {
+	m.halt = err
+}
+
+// Reboot resets the cpu and devices once the current instruction has completed.
+// Memory isn't reloaded, so writable data keeps the values left by the last boot.
+func (m *RV) Reboot() {
+	m.reboot = true
+}
+
+// OnReset adds a function that is called after the cpu is reset
+// (E.g. to set up the state left by boot firmware).
+func (m *RV) OnReset(fn func()) {
+	m.onReset = append(m.onReset, fn)
+}
+
+// SetDTB sets the device tree blob address passed to the boot code
+// (a0 = hart id, a1 = device tree address) at reset.
+func (m *RV) SetDTB(adr uint64) {
+	m.dtb = adr
+	m.setBootArgs()
+}
+
+// SetResetVector sets the PC at reset (0 = the program entry point).
+func (m *RV) SetResetVector(adr uint64) {
+	m.resetPC = adr
+}
+
+// SetCPI sets the clock cycles per instruction (default 2).
+func (m *RV) SetCPI(n uint) {
+	m.cpi = n
+}
+
+// setBootArgs sets the boot arguments for the device tree.
+func (m *RV) setBootArgs() {
+	if m.dtb != 0 {
+		m.WrX(RegA0, 0)
+		m.WrX(RegA1, m.dtb)
+	}
+}
+
 //-----------------------------------------------------------------------------
 
 func intRegString(reg []uint, pc, xlen uint) string {
@@ -10,6 +10,7 @@ package rv
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/deadsy/riscv/csr"
 	"github.com/deadsy/riscv/mem"
@@ -32,6 +33,16 @@ var abiFName = [32]string{
 	"fs8", "fs9", "fs10", "fs11", "ft8", "ft9", "ft10", "ft11",
 }
 
+// XName returns the ABI name of an integer register.
+func XName(i uint) string {
+	return abiXName[i]
+}
+
+// FName returns the ABI name of a float register.
+func FName(i uint) string {
+	return abiFName[i]
+}
+
 // Register numbers.
 const (
 	RegZero = iota // 0: zero
@@ -183,12 +194,14 @@ func daTypeIj(name string, pc uint, ins uint) string {
 	return fmt.Sprintf("%s %s,%s,%d", name, abiXName[rd], csr.Name(csrReg), uimm)
 }
 
+// daTypeIk disassembles "sfence.vma rs1,rs2" (vaddr, asid).
+// The operands are in the objdump order, so the output can be assembled.
 func daTypeIk(name string, pc uint, ins uint) string {
 	rs2, rs1 := decodeId(ins)
 	if rs2 == 0 && rs1 == 0 {
 		return fmt.Sprintf("%s", name)
 	}
-	return fmt.Sprintf("%s %s,%s", name, abiXName[rs2], abiXName[rs1])
+	return fmt.Sprintf("%s %s,%s", name, abiXName[rs1], abiXName[rs2])
 }
 
 //-----------------------------------------------------------------------------
@@ -225,9 +238,6 @@ func daTypeRa(name string, pc uint, ins uint) string {
 
 func daTypeRb(name string, pc uint, ins uint) string {
 	rs2, rs1, _, rd := decodeR(ins)
-	if rs2 == 0 {
-		return fmt.Sprintf("%s %s,(%s)", name, abiXName[rd], abiXName[rs1])
-	}
 	return fmt.Sprintf("%s %s,%s,(%s)", name, abiXName[rd], abiXName[rs2], abiXName[rs1])
 }
 
@@ -251,6 +261,12 @@ func daTypeRf(name string, pc uint, ins uint) string {
 	return fmt.Sprintf("%s %s,%s,%s", name, abiXName[rd], abiFName[rs1], abiFName[rs2])
 }
 
+// load reserved
+func daTypeRg(name string, pc uint, ins uint) string {
+	_, rs1, _, rd := decodeR(ins)
+	return fmt.Sprintf("%s %s,(%s)", name, abiXName[rd], abiXName[rs1])
+}
+
 func daTypeRh(name string, pc uint, ins uint) string {
 	_, rs1, _, rd := decodeR(ins)
 	return fmt.Sprintf("%s %s,%s", name, abiFName[rd], abiFName[rs1])
@@ -363,6 +379,11 @@ func daTypeCIh(name string, pc uint, ins uint) string {
 	return fmt.Sprintf("%s %s,%d(sp)", name, abiXName[rd], uimm)
 }
 
+func daTypeCIi(name string, pc uint, ins uint) string {
+	uimm, rd := decodeCIg(ins)
+	return fmt.Sprintf("%s %s,%d(sp)", name, abiFName[rd], uimm)
+}
+
 //-----------------------------------------------------------------------------
 // Type CIW Decodes
 
@@ -437,6 +458,11 @@ func daTypeCSc(name string, pc uint, ins uint) string {
 	return fmt.Sprintf("%s %s,%d(%s)", name, abiFName[rs2], uimm, abiXName[rs1])
 }
 
+func daTypeCSd(name string, pc uint, ins uint) string {
+	uimm, rs1, rs2 := decodeCSa(ins)
+	return fmt.Sprintf("%s %s,%d(%s)", name, abiFName[rs2], uimm, abiXName[rs1])
+}
+
 //-----------------------------------------------------------------------------
 // Type CSS Decodes
 
@@ -455,6 +481,21 @@ func daTypeCSSc(name string, pc uint, ins uint) string {
 	return fmt.Sprintf("%s %s,%d(sp)", name, abiXName[rs2], uimm)
 }
 
+func daTypeCSSd(name string, pc uint, ins uint) string {
+	uimm, rd := decodeCSSa(ins)
+	return fmt.Sprintf("%s %s,%d(sp)", name, abiFName[rd], uimm)
+}
+
+func daTypeCSSe(name string, pc uint, ins uint) string {
+	imm, rs2 := decodeCSSb(ins)
+	return fmt.Sprintf("%s %s,%d(sp)", name, abiFName[rs2], imm)
+}
+
+func daTypeCSSf(name string, pc uint, ins uint) string {
+	uimm, rs2 := decodeCSSc(ins)
+	return fmt.Sprintf("%s %s,%d(sp)", name, abiFName[rs2], uimm)
+}
+
 //-----------------------------------------------------------------------------
 // Type CB Decodes
 
@@ -470,14 +511,20 @@ type Disassembly struct {
 	Dump     string // address and memory bytes
 	Symbol   string // symbol for the address (if any)
 	Assembly string // assembly instructions
+	Target   string // <symbol+offset> for a pc relative target (if any)
+	Ins      uint   // instruction code
 	Length   uint   // length in bytes of decode
 }
 
 func (da *Disassembly) String() string {
+	s := fmt.Sprintf("%s    %-18s", da.Dump, da.Assembly)
+	if da.Target != "" {
+		s += " " + da.Target
+	}
 	if da.Symbol != "" {
-		return fmt.Sprintf("%s    %-18s %s", da.Dump, da.Assembly, util.GreenString(da.Symbol))
+		s += " " + util.GreenString(da.Symbol)
 	}
-	return fmt.Sprintf("%s    %-18s", da.Dump, da.Assembly)
+	return s
 }
 
 //-----------------------------------------------------------------------------
@@ -491,10 +538,100 @@ func (isa *ISA) daInstruction(pc uint, ins uint) string {
 	return "illegal"
 }
 
+// maxPrevWalk is the maximum distance decoded forward from a symbol to find the previous instruction.
+const maxPrevWalk = 4096
+
+// prevIns returns the address of the instruction before pc.
+// Instructions have variable length, so decode forward from the enclosing symbol.
+func prevIns(m *mem.Memory, pc uint) (uint, bool) {
+	s := m.SymbolNearest(pc)
+	if s == nil || pc-s.Addr > maxPrevWalk {
+		return 0, false
+	}
+	for adr := s.Addr; adr < pc; {
+		x, err := m.RdIns16(adr)
+		if err != nil {
+			return 0, false
+		}
+		n := insLength(uint(x))
+		if adr+n == pc {
+			return adr, true
+		}
+		adr += n
+	}
+	return 0, false
+}
+
+// daTarget returns the target address of a pc relative instruction.
+// auipc+addi/load/store/jalr pairs are resolved using the previous instruction.
+// prev is the address of the previous instruction (if known).
+func (isa *ISA) daTarget(m *mem.Memory, pc, ins, prev uint, known bool) (uint, bool) {
+	im := isa.lookup(ins)
+	if im == nil {
+		return 0, false
+	}
+	switch im.dt {
+	case decodeTypeB:
+		imm, _, _ := decodeB(ins)
+		return uint(int(pc) + imm), true
+	case decodeTypeJ:
+		imm, _ := decodeJ(ins)
+		return uint(int(pc) + imm), true
+	case decodeTypeCB:
+		imm, _ := decodeCB(ins)
+		return uint(int(pc) + imm), true
+	case decodeTypeCJ:
+		imm := decodeCJ(ins)
+		return uint(int(pc) + imm), true
+	}
+
+	// the lo12 part of an auipc pair
+	var imm int
+	var rs1 uint
+	switch {
+	case im.dt == decodeTypeS:
+		imm, _, rs1 = decodeS(ins)
+	case im.dt == decodeTypeI && im.n == 32 && im.hasField("imm[11:0]"):
+		imm, rs1, _ = decodeIa(ins)
+	default:
+		return 0, false
+	}
+	if !known {
+		prev, known = prevIns(m, pc)
+	}
+	if !known || pc-prev != 4 {
+		return 0, false
+	}
+	x, err := m.RdIns(prev)
+	if err != nil || x&0x7f != 0x17 {
+		return 0, false
+	}
+	hi, rd := decodeU(x)
+	if rd == 0 || rd != rs1 {
+		return 0, false
+	}
+	return uint(int(pc) - 4 + (hi << 12) + imm), true
+}
+
+// symbolTarget returns a "<symbol+offset>" string for a target address.
+func symbolTarget(m *mem.Memory, adr uint) string {
+	s := m.SymbolOffset(adr)
+	if s == "" {
+		return ""
+	}
+	return fmt.Sprintf("<%s>", s)
+}
+
 //-----------------------------------------------------------------------------
 
 // Disassemble a RISC-V instruction at the address.
 func (isa *ISA) Disassemble(m *mem.Memory, adr uint) *Disassembly {
+	return isa.disassemble(m, adr, 0, false)
+}
+
+// disassemble a RISC-V instruction at the address.
+// prev is the address of the previous instruction (if known).
+func (isa *ISA) disassemble(m *mem.Memory, adr, prev uint, known bool) *Disassembly {
 	var da Disassembly
 	// symbol
 	s := m.SymbolByAddress(adr)
@@ -502,18 +639,60 @@ func (isa *ISA) Disassemble(m *mem.Memory, adr uint) *Disassembly {
 		da.Symbol = s.Name
 	}
 	// instruction
-	ins, _ := m.RdIns(adr)
+	ins, err := m.RdIns(adr)
+	if err != nil {
+		// a 16-bit instruction at the end of a section
+		x, err := m.RdIns16(adr)
+		if err == nil && x&3 != 3 {
+			ins = uint(x)
+		}
+	}
 	pcStr := m.AddrStr(adr)
 	if ins&3 == 3 {
 		da.Dump = fmt.Sprintf("%s: %08x", pcStr, uint32(ins))
 		da.Assembly = isa.daInstruction(adr, ins)
 		da.Length = 4
 	} else {
+		ins &= 0xffff
 		da.Dump = fmt.Sprintf("%s: %04x    ", pcStr, uint16(ins))
 		da.Assembly = isa.daInstruction(adr, ins)
 		da.Length = 2
 	}
+	da.Ins = ins
+	// branch/jump/pc relative target
+	if target, ok := isa.daTarget(m, adr, ins, prev, known); ok {
+		da.Target = symbolTarget(m, target)
+	}
 	return &da
 }
 
+// DisassembleRange returns the disassembly of a memory range.
+// A label line is emitted at the start of each symbol.
+func (isa *ISA) DisassembleRange(m *mem.Memory, adr, size uint) string {
+	s := []string{}
+	// starting within a symbol
+	if m.SymbolByAddress(adr) == nil {
+		if x := m.SymbolOffset(adr); x != "" {
+			s = append(s, fmt.Sprintf("%s <%s>:", m.AddrStr(adr), x))
+		}
+	}
+	end := adr + size
+	var prev uint
+	known := false
+	for adr < end {
+		da := isa.disassemble(m, adr, prev, known)
+		prev, known = adr, true
+		if da.Symbol != "" {
+			if len(s) != 0 {
+				s = append(s, "")
+			}
+			s = append(s, fmt.Sprintf("%s <%s>:", m.AddrStr(adr), util.GreenString(da.Symbol)))
+			da.Symbol = ""
+		}
+		s = append(s, da.String())
+		adr += da.Length
+	}
+	return strings.Join(s, "\n")
+}
+
 //-----------------------------------------------------------------------------
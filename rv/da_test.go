@@ -10,7 +10,11 @@ package rv
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
 )
 
 //-----------------------------------------------------------------------------
@@ -127,6 +131,7 @@ var rv32iTest = []daTest{
 	{0, 0x00000013, "nop"},
 	{0, 0x0000100f, "fence.i"},
 	{0, 0x12000073, "sfence.vma"},
+	{0, 0x12b50073, "sfence.vma a0,a1"}, // rs1 (vaddr) then rs2 (asid)
 }
 
 var rv32mTest = []daTest{
@@ -145,6 +150,8 @@ var rv32aTest = []daTest{
 	{0, 0x60b6a72f, "amoand.w a4,a1,(a3)"},
 	{0, 0x00b6a72f, "amoadd.w a4,a1,(a3)"},
 	{0, 0xe0b6a72f, "amomaxu.w a4,a1,(a3)"},
+	{0, 0x0805a52f, "amoswap.w a0,zero,(a1)"},
+	{0, 0x1805272f, "sc.w a4,zero,(a0)"},
 }
 
 var rv32fTest = []daTest{
@@ -200,6 +207,7 @@ var rv32dTest = []daTest{
 }
 
 var rv32cTest = []daTest{
+	{0, 0x9002, "ebreak"},
 	{0, 0x4705, "li a4,1"},
 	{0, 0x8082, "ret"},
 	{0, 0xce06, "sw ra,28(sp)"},
@@ -251,17 +259,23 @@ var rv32cOnlyTest = []daTest{
 var rv32fcTest = []daTest{
 	{0, 0x7654, "flw fa3,44(a2)"},
 	{0, 0xfedc, "fsw fa5,60(a3)"},
+	{0, 0x6522, "flw fa0,8(sp)"},
+	{0, 0xfe2e, "fsw fa1,60(sp)"},
 }
 
 var rv32dcTest = []daTest{
 	{0, 0x3210, "fld fa2,32(a2)"},
 	{0, 0xba98, "fsd fa4,48(a3)"},
+	{0, 0x2642, "fld fa2,16(sp)"},
+	{0, 0xac36, "fsd fa3,24(sp)"},
 }
 
 //-----------------------------------------------------------------------------
 // rv64
 
 var rv64iTest = []daTest{
+	{0, 0x00813503, "ld a0,8(sp)"}, // load syntax (not "ld a0,sp,8")
+	{0, 0xff043403, "ld s0,-16(s0)"},
 	{0, 0x008a16bb, "sllw a3,s4,s0"},
 	{0, 0x00e6163b, "sllw a2,a2,a4"},
 	{0, 0x41978cbb, "subw s9,a5,s9"},
@@ -301,6 +315,7 @@ var rv64mTest = []daTest{
 }
 
 var rv64aTest = []daTest{
+	{0, 0x0805b52f, "amoswap.d a0,zero,(a1)"},
 	{0, 0x08b6b72f, "amoswap.d a4,a1,(a3)"},
 	{0, 0x00b6b72f, "amoadd.d a4,a1,(a3)"},
 	{0, 0x20b6b72f, "amoxor.d a4,a1,(a3)"},
@@ -421,4 +436,72 @@ func Test_Disassembly(t *testing.T) {
 	}
 }
 
+func Test_DisassemblyTarget(t *testing.T) {
+	isa := NewISA(0)
+	err := isa.Add(ISArv64gc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := csr.NewState(64, isa.GetExtensions())
+	cpu := NewRV64(isa, mem.NewMem64(state, 0), state)
+	m := cpu.Mem
+	m.Add(mem.NewSection("text", 0x1000, 0x1000, mem.AttrRX))
+	m.Add(mem.NewSection("data", 0x2000, 0x1000, mem.AttrRW))
+	prog := map[uint]string{
+		// the upper half of the addi and the c.addi look like "auipc a0"
+		0x1000: "addi t0,a4,81",
+		0x1004: "c.addi a1,a1,1",
+		0x1006: "addi a0,a0,16",
+		// an auipc pair after a compressed instruction
+		0x1100: "c.addi a0,a0,1",
+		0x1102: "auipc a0,0x1",
+		0x1106: "addi a0,a0,16",
+		// auipc pairs with a load and a jalr
+		0x1200: "auipc a1,0x1",
+		0x1204: "ld a2,-256(a1)",
+		0x1208: "auipc ra,0x0",
+		0x120c: "jalr ra,-8(ra)",
+		// the auipc and load registers don't match
+		0x1210: "auipc a1,0x1",
+		0x1214: "ld a2,0(a0)",
+	}
+	for adr, s := range prog {
+		_, err := cpu.Assemble(adr, s)
+		if err != nil {
+			t.Fatalf("\"%s\" %s", s, err)
+		}
+	}
+	m.AddSymbol("f", 0x1000, 0x10)
+	m.AddSymbol("g", 0x1100, 0x10)
+	m.AddSymbol("h", 0x1200, 0x20)
+	m.AddSymbol("data", 0x2100, 0x100)
+
+	if x, _ := m.RdIns(0x1002); x&0x7f != 0x17 || (x>>7)&31 != 10 {
+		t.Fatalf("bad test program %08x", x)
+	}
+	ins, _ := m.RdIns(0x1006)
+	if adr, ok := cpu.isa.daTarget(m, 0x1006, ins, 0, false); ok {
+		t.Errorf("auipc pair misread after a compressed instruction %x", adr)
+	}
+
+	tests := []struct {
+		adr    uint
+		target string
+	}{
+		{0x1106, "<data+0x12>"},
+		{0x1204, "<data>"},
+		{0x120c, "<h>"},
+		{0x1214, ""},
+	}
+	for _, v := range tests {
+		if da := cpu.Disassemble(v.adr); da.Target != v.target {
+			t.Errorf("%x: target %q, expected %q", v.adr, da.Target, v.target)
+		}
+	}
+	// a range resolves the pairs
+	if s := cpu.DisassembleRange(0x1100, 10); !strings.Contains(s, "<data+0x12>") {
+		t.Errorf("bad range target\n%s", s)
+	}
+}
+
 //-----------------------------------------------------------------------------
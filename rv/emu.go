@@ -438,12 +438,43 @@ func emu_FENCE_I(m *RV, ins uint) error {
 }
 
 func emu_ECALL(m *RV, ins uint) error {
-	m.PC = m.CSR.ECALL(m.PC, 0)
+	if m.ecall != nil && m.CSR.GetMode() == csr.ModeU {
+		err := m.ecall.Call(m)
+		if err != nil {
+			return err
+		}
+		m.PC += 4
+		return nil
+	}
+	if m.sbi != nil && m.CSR.GetMode() == csr.ModeS {
+		err := m.sbi.Call(m)
+		if err != nil {
+			return err
+		}
+		m.PC += 4
+		return nil
+	}
+	switch m.CSR.GetMode() {
+	case csr.ModeU:
+		m.trap(uint(csr.ExEnvCallFromUserMode), 0, false)
+	case csr.ModeS:
+		m.trap(uint(csr.ExEnvCallFromSupervisorMode), 0, false)
+	case csr.ModeM:
+		m.trap(uint(csr.ExEnvCallFromMachineMode), 0, false)
+	}
 	return nil
 }
 
 func emu_EBREAK(m *RV, ins uint) error {
-	m.PC = m.CSR.Exception(m.PC, uint(csr.ExBreakpoint), uint(m.PC), false)
+	if m.semihost != nil && m.isSemihost() {
+		err := m.semihost.Call(m)
+		if err != nil {
+			return err
+		}
+		m.PC += 4
+		return nil
+	}
+	m.trap(uint(csr.ExBreakpoint), uint(m.PC), false)
 	return nil
 }
 
@@ -457,7 +488,7 @@ func emu_CSRRW(m *RV, ins uint) error {
 			return m.errCSR(err, ins)
 		}
 	}
-	err = m.CSR.Wr(csr, m.rdX(rs1))
+	err = m.wrCSR(csr, m.rdX(rs1))
 	if err != nil {
 		return m.errCSR(err, ins)
 	}
@@ -473,7 +504,7 @@ func emu_CSRRS(m *RV, ins uint) error {
 		return m.errCSR(err, ins)
 	}
 	if rs1 != 0 {
-		err := m.CSR.Wr(csr, t|m.rdX(rs1))
+		err := m.wrCSR(csr, t|m.rdX(rs1))
 		if err != nil {
 			return m.errCSR(err, ins)
 		}
@@ -490,7 +521,7 @@ func emu_CSRRC(m *RV, ins uint) error {
 		return m.errCSR(err, ins)
 	}
 	if rs1 != 0 {
-		err := m.CSR.Wr(csr, t & ^m.rdX(rs1))
+		err := m.wrCSR(csr, t & ^m.rdX(rs1))
 		if err != nil {
 			return m.errCSR(err, ins)
 		}
@@ -509,7 +540,7 @@ func emu_CSRRWI(m *RV, ins uint) error {
 		}
 		m.wrX(rd, t)
 	}
-	err := m.CSR.Wr(csr, uint64(zimm))
+	err := m.wrCSR(csr, uint64(zimm))
 	if err != nil {
 		return m.errCSR(err, ins)
 	}
@@ -523,7 +554,7 @@ func emu_CSRRSI(m *RV, ins uint) error {
 	if err != nil {
 		return m.errCSR(err, ins)
 	}
-	err = m.CSR.Wr(csr, t|uint64(zimm))
+	err = m.wrCSR(csr, t|uint64(zimm))
 	if err != nil {
 		return m.errCSR(err, ins)
 	}
@@ -538,7 +569,7 @@ func emu_CSRRCI(m *RV, ins uint) error {
 	if err != nil {
 		return m.errCSR(err, ins)
 	}
-	err = m.CSR.Wr(csr, t & ^uint64(zimm))
+	err = m.wrCSR(csr, t & ^uint64(zimm))
 	if err != nil {
 		return m.errCSR(err, ins)
 	}
@@ -566,7 +597,10 @@ func emu_MRET(m *RV, ins uint) error {
 }
 
 func emu_WFI(m *RV, ins uint) error {
-	return m.errTodo()
+	// wait-for-interrupt is a nop (the next instruction checks for interrupts)
+	m.CSR.UpdateTimer()
+	m.PC += 4
+	return nil
 }
 
 func emu_SFENCE_VMA(m *RV, ins uint) error {
@@ -716,28 +750,39 @@ func emu_REMU(m *RV, ins uint) error {
 // rv32a
 
 func emu_LR_W(m *RV, ins uint) error {
-	return m.errTodo()
+	_, rs1, _, rd := decodeR(ins)
+	adr := uint(m.rdX(rs1))
+	val, err := m.Mem.Rd32(adr)
+	if err != nil {
+		return m.errMemory(err)
+	}
+	m.wrX(rd, uint64(int32(val)))
+	m.reserve(adr)
+	m.PC += 4
+	return nil
 }
 
 func emu_SC_W(m *RV, ins uint) error {
-	return m.errTodo()
-	/*
-	     rs2, rs1, _, rd := decodeR(ins)
-	   	m.amo.Lock()
-	   	adr := uint(m.rdX(rs1))
-	   	err = m.Mem.Wr32(adr, uint32(m.rdX(rs2)))
-	   	if err != nil {
-	   		return m.errMemory(err)
-	   	}
-	   	m.amo.Unlock()
-	   	m.PC += 4
-	   	return nil
-	*/
+	rs2, rs1, _, rd := decodeR(ins)
+	adr := uint(m.rdX(rs1))
+	if !m.reserved(adr) {
+		m.wrX(rd, 1)
+		m.PC += 4
+		return nil
+	}
+	err := m.Mem.Wr32(adr, uint32(m.rdX(rs2)))
+	if err != nil {
+		return m.errMemory(err)
+	}
+	m.wrX(rd, 0)
+	m.PC += 4
+	return nil
 }
 
 func emu_AMOSWAP_W(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd32(adr)
 	if err != nil {
@@ -748,7 +793,6 @@ func emu_AMOSWAP_W(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, uint64(int32(t)))
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -756,6 +800,7 @@ func emu_AMOSWAP_W(m *RV, ins uint) error {
 func emu_AMOADD_W(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd32(adr)
 	if err != nil {
@@ -766,7 +811,6 @@ func emu_AMOADD_W(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, uint64(int32(t)))
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -774,6 +818,7 @@ func emu_AMOADD_W(m *RV, ins uint) error {
 func emu_AMOXOR_W(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd32(adr)
 	if err != nil {
@@ -784,7 +829,6 @@ func emu_AMOXOR_W(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, uint64(int32(t)))
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -792,6 +836,7 @@ func emu_AMOXOR_W(m *RV, ins uint) error {
 func emu_AMOAND_W(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd32(adr)
 	if err != nil {
@@ -802,7 +847,6 @@ func emu_AMOAND_W(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, uint64(int32(t)))
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -810,6 +854,7 @@ func emu_AMOAND_W(m *RV, ins uint) error {
 func emu_AMOOR_W(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd32(adr)
 	if err != nil {
@@ -820,7 +865,6 @@ func emu_AMOOR_W(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, uint64(int32(t)))
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -828,6 +872,7 @@ func emu_AMOOR_W(m *RV, ins uint) error {
 func emu_AMOMIN_W(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd32(adr)
 	if err != nil {
@@ -838,7 +883,6 @@ func emu_AMOMIN_W(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, uint64(int32(t)))
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -846,6 +890,7 @@ func emu_AMOMIN_W(m *RV, ins uint) error {
 func emu_AMOMAX_W(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd32(adr)
 	if err != nil {
@@ -856,7 +901,6 @@ func emu_AMOMAX_W(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, uint64(int32(t)))
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -864,6 +908,7 @@ func emu_AMOMAX_W(m *RV, ins uint) error {
 func emu_AMOMINU_W(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd32(adr)
 	if err != nil {
@@ -874,7 +919,6 @@ func emu_AMOMINU_W(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, uint64(int32(t)))
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -882,6 +926,7 @@ func emu_AMOMINU_W(m *RV, ins uint) error {
 func emu_AMOMAXU_W(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd32(adr)
 	if err != nil {
@@ -892,7 +937,6 @@ func emu_AMOMAXU_W(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, uint64(int32(t)))
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -1729,7 +1773,9 @@ func emu_C_SLLI(m *RV, ins uint) error {
 }
 
 func emu_C_SLLI64(m *RV, ins uint) error {
-	return m.errTodo()
+	// hint
+	m.PC += 2
+	return nil
 }
 
 func emu_C_LWSP(m *RV, ins uint) error {
@@ -1766,7 +1812,7 @@ func emu_C_MV(m *RV, ins uint) error {
 }
 
 func emu_C_EBREAK(m *RV, ins uint) error {
-	m.PC = m.CSR.Exception(m.PC, uint(csr.ExBreakpoint), uint(m.PC), false)
+	m.trap(uint(csr.ExBreakpoint), uint(m.PC), false)
 	return nil
 }
 
@@ -1813,38 +1859,122 @@ func emu_C_JAL(m *RV, ins uint) error {
 // rv32fc
 
 func emu_C_FLW(m *RV, ins uint) error {
-	return m.errTodo()
+	if m.CSR.IsFloatOff() {
+		return m.errIllegal(ins)
+	}
+	uimm, rs1, rd := decodeCS(ins)
+	adr := uint(m.rdX(rs1)) + uimm
+	x, err := m.Mem.Rd32(adr)
+	if err != nil {
+		return m.errMemory(err)
+	}
+	m.wrFS(rd, x)
+	m.PC += 2
+	return nil
 }
 
 func emu_C_FLWSP(m *RV, ins uint) error {
-	return m.errTodo()
+	if m.CSR.IsFloatOff() {
+		return m.errIllegal(ins)
+	}
+	uimm, rd := decodeCSSa(ins)
+	adr := uint(m.rdX(RegSp)) + uimm
+	x, err := m.Mem.Rd32(adr)
+	if err != nil {
+		return m.errMemory(err)
+	}
+	m.wrFS(rd, x)
+	m.PC += 2
+	return nil
 }
 
 func emu_C_FSW(m *RV, ins uint) error {
-	return m.errTodo()
+	if m.CSR.IsFloatOff() {
+		return m.errIllegal(ins)
+	}
+	uimm, rs1, rs2 := decodeCS(ins)
+	adr := uint(m.rdX(rs1)) + uimm
+	err := m.Mem.Wr32(adr, m.rdFS(rs2))
+	if err != nil {
+		return m.errMemory(err)
+	}
+	m.PC += 2
+	return nil
 }
 
 func emu_C_FSWSP(m *RV, ins uint) error {
-	return m.errTodo()
+	if m.CSR.IsFloatOff() {
+		return m.errIllegal(ins)
+	}
+	uimm, rs2 := decodeCSSb(ins)
+	adr := uint(m.rdX(RegSp)) + uimm
+	err := m.Mem.Wr32(adr, m.rdFS(rs2))
+	if err != nil {
+		return m.errMemory(err)
+	}
+	m.PC += 2
+	return nil
 }
 
 //-----------------------------------------------------------------------------
 // rv32dc
 
 func emu_C_FLD(m *RV, ins uint) error {
-	return m.errTodo()
+	if m.CSR.IsFloatOff() {
+		return m.errIllegal(ins)
+	}
+	uimm, rs1, rd := decodeCSa(ins)
+	adr := uint(m.rdX(rs1)) + uimm
+	x, err := m.Mem.Rd64(adr)
+	if err != nil {
+		return m.errMemory(err)
+	}
+	m.wrFD(rd, x)
+	m.PC += 2
+	return nil
 }
 
 func emu_C_FLDSP(m *RV, ins uint) error {
-	return m.errTodo()
+	if m.CSR.IsFloatOff() {
+		return m.errIllegal(ins)
+	}
+	uimm, rd := decodeCIg(ins)
+	adr := uint(m.rdX(RegSp)) + uimm
+	x, err := m.Mem.Rd64(adr)
+	if err != nil {
+		return m.errMemory(err)
+	}
+	m.wrFD(rd, x)
+	m.PC += 2
+	return nil
 }
 
 func emu_C_FSD(m *RV, ins uint) error {
-	return m.errTodo()
+	if m.CSR.IsFloatOff() {
+		return m.errIllegal(ins)
+	}
+	uimm, rs1, rs2 := decodeCSa(ins)
+	adr := uint(m.rdX(rs1)) + uimm
+	err := m.Mem.Wr64(adr, m.rdFD(rs2))
+	if err != nil {
+		return m.errMemory(err)
+	}
+	m.PC += 2
+	return nil
 }
 
 func emu_C_FSDSP(m *RV, ins uint) error {
-	return m.errTodo()
+	if m.CSR.IsFloatOff() {
+		return m.errIllegal(ins)
+	}
+	uimm, rs2 := decodeCSSc(ins)
+	adr := uint(m.rdX(RegSp)) + uimm
+	err := m.Mem.Wr64(adr, m.rdFD(rs2))
+	if err != nil {
+		return m.errMemory(err)
+	}
+	m.PC += 2
+	return nil
 }
 
 //-----------------------------------------------------------------------------
@@ -2034,16 +2164,39 @@ func emu_REMUW(m *RV, ins uint) error {
 // rv64a
 
 func emu_LR_D(m *RV, ins uint) error {
-	return m.errTodo()
+	_, rs1, _, rd := decodeR(ins)
+	adr := uint(m.rdX(rs1))
+	val, err := m.Mem.Rd64(adr)
+	if err != nil {
+		return m.errMemory(err)
+	}
+	m.wrX(rd, val)
+	m.reserve(adr)
+	m.PC += 4
+	return nil
 }
 
 func emu_SC_D(m *RV, ins uint) error {
-	return m.errTodo()
+	rs2, rs1, _, rd := decodeR(ins)
+	adr := uint(m.rdX(rs1))
+	if !m.reserved(adr) {
+		m.wrX(rd, 1)
+		m.PC += 4
+		return nil
+	}
+	err := m.Mem.Wr64(adr, m.rdX(rs2))
+	if err != nil {
+		return m.errMemory(err)
+	}
+	m.wrX(rd, 0)
+	m.PC += 4
+	return nil
 }
 
 func emu_AMOSWAP_D(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd64(adr)
 	if err != nil {
@@ -2054,7 +2207,6 @@ func emu_AMOSWAP_D(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, t)
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -2062,6 +2214,7 @@ func emu_AMOSWAP_D(m *RV, ins uint) error {
 func emu_AMOADD_D(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd64(adr)
 	if err != nil {
@@ -2072,7 +2225,6 @@ func emu_AMOADD_D(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, t)
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -2080,6 +2232,7 @@ func emu_AMOADD_D(m *RV, ins uint) error {
 func emu_AMOXOR_D(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd64(adr)
 	if err != nil {
@@ -2090,7 +2243,6 @@ func emu_AMOXOR_D(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, t)
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -2098,6 +2250,7 @@ func emu_AMOXOR_D(m *RV, ins uint) error {
 func emu_AMOAND_D(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd64(adr)
 	if err != nil {
@@ -2108,7 +2261,6 @@ func emu_AMOAND_D(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, t)
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -2116,6 +2268,7 @@ func emu_AMOAND_D(m *RV, ins uint) error {
 func emu_AMOOR_D(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd64(adr)
 	if err != nil {
@@ -2126,7 +2279,6 @@ func emu_AMOOR_D(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, t)
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -2134,6 +2286,7 @@ func emu_AMOOR_D(m *RV, ins uint) error {
 func emu_AMOMIN_D(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd64(adr)
 	if err != nil {
@@ -2144,7 +2297,6 @@ func emu_AMOMIN_D(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, t)
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -2152,6 +2304,7 @@ func emu_AMOMIN_D(m *RV, ins uint) error {
 func emu_AMOMAX_D(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd64(adr)
 	if err != nil {
@@ -2162,7 +2315,6 @@ func emu_AMOMAX_D(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, t)
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -2170,6 +2322,7 @@ func emu_AMOMAX_D(m *RV, ins uint) error {
 func emu_AMOMINU_D(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd64(adr)
 	if err != nil {
@@ -2180,7 +2333,6 @@ func emu_AMOMINU_D(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, t)
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -2188,6 +2340,7 @@ func emu_AMOMINU_D(m *RV, ins uint) error {
 func emu_AMOMAXU_D(m *RV, ins uint) error {
 	rs2, rs1, _, rd := decodeR(ins)
 	m.amo.Lock()
+	defer m.amo.Unlock()
 	adr := uint(m.rdX(rs1))
 	t, err := m.Mem.Rd64(adr)
 	if err != nil {
@@ -2198,7 +2351,6 @@ func emu_AMOMAXU_D(m *RV, ins uint) error {
 		return m.errMemory(err)
 	}
 	m.wrX(rd, t)
-	m.amo.Unlock()
 	m.PC += 4
 	return nil
 }
@@ -2376,11 +2528,34 @@ func emu_C_SD(m *RV, ins uint) error {
 }
 
 func emu_C_SUBW(m *RV, ins uint) error {
-	return m.errTodo()
+	rd, rs := decodeCRa(ins)
+	m.wrX(rd, uint64(int32(m.rdX(rd)-m.rdX(rs))))
+	m.PC += 2
+	return nil
 }
 
 func emu_C_ADDW(m *RV, ins uint) error {
-	return m.errTodo()
+	rd, rs := decodeCRa(ins)
+	m.wrX(rd, uint64(int32(m.rdX(rd)+m.rdX(rs))))
+	m.PC += 2
+	return nil
+}
+
+//-----------------------------------------------------------------------------
+// Load Reserved/Store Conditional
+
+// reserve sets the reservation for a load reserved.
+func (m *RV) reserve(adr uint) {
+	m.resValid = true
+	m.resAdr = adr
+}
+
+// reserved returns true if a store conditional to the address can succeed.
+// The reservation is cleared.
+func (m *RV) reserved(adr uint) bool {
+	ok := m.resValid && m.resAdr == adr
+	m.resValid = false
+	return ok
 }
 
 //-----------------------------------------------------------------------------
@@ -2395,7 +2570,13 @@ func (m *RV) wrX(i uint, val uint64) {
 	if m.xlen == 32 {
 		val = uint64(uint32(val))
 	}
+	if m.rev != nil && m.rev.cur != nil {
+		m.rev.cur.x = append(m.rev.cur.x, regUndo{i, m.x[i]})
+	}
 	m.x[i] = val
+	if m.retire != nil {
+		m.retire.X = append(m.retire.X, RegWrite{i, val})
+	}
 }
 
 // rdX reads an integer register
@@ -2415,7 +2596,13 @@ func (m *RV) rdX(i uint) uint64 {
 
 // wrFS writes a 32-bit float register.
 func (m *RV) wrFS(i uint, val uint32) {
+	if m.rev != nil && m.rev.cur != nil {
+		m.rev.cur.f = append(m.rev.cur.f, regUndo{i, m.f[i]})
+	}
 	m.f[i] = uint64(val) | upper32
+	if m.retire != nil {
+		m.retire.F = append(m.retire.F, RegWrite{i, m.f[i]})
+	}
 }
 
 // rdFS reads a 32-bit float register.
@@ -2425,7 +2612,29 @@ func (m *RV) rdFS(i uint) uint32 {
 
 // wrFD writes a 64-bit float register.
 func (m *RV) wrFD(i uint, val uint64) {
+	if m.rev != nil && m.rev.cur != nil {
+		m.rev.cur.f = append(m.rev.cur.f, regUndo{i, m.f[i]})
+	}
 	m.f[i] = val
+	if m.retire != nil {
+		m.retire.F = append(m.retire.F, RegWrite{i, val})
+	}
+}
+
+//-----------------------------------------------------------------------------
+// CSR Access
+
+// wrCSR writes a CSR.
+func (m *RV) wrCSR(reg uint, val uint64) error {
+	err := m.CSR.Wr(reg, val)
+	if err == nil && m.retire != nil {
+		// log the value as written (some bits may be read-only)
+		if x, err := m.CSR.Rd(reg); err == nil {
+			val = x
+		}
+		m.retire.CSR = append(m.retire.CSR, RegWrite{reg, val})
+	}
+	return err
 }
 
 // rdFD reads a 64-bit float register.
@@ -2495,24 +2704,53 @@ func minUint64(a, b uint64) uint64 {
 
 // RV is a RISC-V CPU.
 type RV struct {
-	x      [32]uint64  // integer registers
-	f      [32]uint64  // float registers
-	PC     uint64      // program counter
-	isa    *ISA        // ISA implemented for the CPU
-	Mem    *mem.Memory // memory of the target system
-	CSR    *csr.State  // CSR state
-	amo    sync.Mutex  // lock for atomic operations
-	lastPC uint64      // stuck PC detection
-	xlen   uint        // bit length of integer registers
-	err    *errBuffer  // buffer of handled/un-handled emulation errors
+	x        [32]uint64  // integer registers
+	f        [32]uint64  // float registers
+	PC       uint64      // program counter
+	isa      *ISA        // ISA implemented for the CPU
+	Mem      *mem.Memory // memory of the target system
+	CSR      *csr.State  // CSR state
+	amo      sync.Mutex  // lock for atomic operations
+	lastPC   uint64      // stuck PC detection
+	resAdr   uint        // load reserved address
+	resValid bool        // load reserved address is valid
+	xlen     uint        // bit length of integer registers
+	err      *errBuffer  // buffer of handled/un-handled emulation errors
+	predict  *Predictor  // branch predictor model (optional)
+	retire   *Retire     // retired instruction record (optional)
+	retFn    RetireFunc  // called for each retired instruction
+	rev      *Reverse    // reverse execution recorder (optional)
+	semihost Semihost    // semihosting call handler (optional)
+	ecall    Ecall       // user mode ecall handler (optional)
+	sbi      Ecall       // supervisor mode ecall handler (optional)
+	poll     []func()    // periodic device polling functions
+	dtb      uint64      // device tree blob address (optional)
+	resetPC  uint64      // reset vector (0 = program entry point)
+	cpi      uint        // clock cycles per instruction
+	halt     error       // stop the emulation after the current instruction
+	reboot   bool        // reset the cpu after the current instruction
+	onReset  []func()    // called after a cpu reset
 }
 
 // Reset the CPU.
 func (m *RV) Reset() {
 	m.PC = m.Mem.Entry
+	if m.resetPC != 0 {
+		m.PC = m.resetPC
+	}
 	m.CSR.Reset()
 	m.err.reset()
 	m.lastPC = 0
+	m.resValid = false
+	m.setBootArgs()
+	m.halt = nil
+	m.reboot = false
+	for _, fn := range m.onReset {
+		fn()
+	}
+	if m.rev != nil {
+		m.rev.reset(m)
+	}
 }
 
 // NewRV64 returns a 64-bit RISC-V CPU.
@@ -2523,6 +2761,7 @@ func NewRV64(isa *ISA, mem *mem.Memory, csr *csr.State) *RV {
 		Mem:  mem,
 		CSR:  csr,
 		err:  newErrBuffer(32),
+		cpi:  2,
 	}
 	m.Reset()
 	return &m
@@ -2536,6 +2775,7 @@ func NewRV32(isa *ISA, mem *mem.Memory, csr *csr.State) *RV {
 		Mem:  mem,
 		CSR:  csr,
 		err:  newErrBuffer(32),
+		cpi:  2,
 	}
 	m.Reset()
 	return &m
@@ -2544,7 +2784,11 @@ func NewRV32(isa *ISA, mem *mem.Memory, csr *csr.State) *RV {
 //-----------------------------------------------------------------------------
 
 func (m *RV) errHandler(err error) error {
-	e := err.(*Error)
+	e, ok := err.(*Error)
+	if !ok {
+		// an error from a call handler (ecall, sbi, semihosting) stops the emulation
+		return err
+	}
 
 	// record the error
 	m.err.write(e)
@@ -2552,12 +2796,13 @@ func (m *RV) errHandler(err error) error {
 	// handle the error
 	switch e.Type {
 	case ErrIllegal, ErrCSR:
-		m.PC = m.CSR.Exception(m.PC, uint(csr.ExInsIllegal), e.ins, false)
+		m.trap(uint(csr.ExInsIllegal), e.ins, false)
 		return nil
 	case ErrMemory:
 		em := e.err.(*mem.Error)
-		if em.Type&(mem.ErrBreak|mem.ErrEmpty) == 0 {
-			m.PC = m.CSR.Exception(m.PC, uint(em.Ex), em.Addr, false)
+		// a misaligned access traps before the (empty) memory is accessed
+		if em.Type&mem.ErrBreak == 0 && (em.Type&mem.ErrEmpty == 0 || em.Type&mem.ErrAlign != 0) {
+			m.trap(uint(em.Ex), em.Addr, false)
 			return nil
 		}
 	}
@@ -2567,11 +2812,62 @@ func (m *RV) errHandler(err error) error {
 
 //-----------------------------------------------------------------------------
 
+// trap takes an exception or interrupt trap at the PC.
+// It is reported with the next retired instruction.
+func (m *RV) trap(code, val uint, isInterrupt bool) {
+	epc := m.PC
+	m.PC = m.CSR.Exception(epc, code, val, isInterrupt)
+	if m.retire != nil {
+		m.retire.trap(Trap{code, isInterrupt, epc, uint64(val), m.trapWrites()})
+	}
+}
+
 // Run the CPU for a single instruction.
 func (m *RV) Run() error {
+	var err error
+	if m.rev != nil {
+		err = m.record()
+	} else {
+		err = m.run()
+	}
+	if m.reboot {
+		m.Mem.ResetDevices()
+		m.Reset()
+	}
+	return err
+}
+
+// record runs a single instruction and records the undo information.
+func (m *RV) record() error {
+	m.rev.begin(m)
+	err := m.run()
+	m.rev.end(m, err)
+	return err
+}
+
+// run the CPU for a single instruction.
+func (m *RV) run() error {
+
+	// poll the devices (on the retired instruction count, so the polls
+	// are the same for a recorded or replayed run)
+	if len(m.poll) != 0 {
+		if _, n := m.CSR.Counters(); n%pollInterval == 0 {
+			if m.rev != nil {
+				m.rev.poll(m)
+			}
+			for _, fn := range m.poll {
+				fn()
+			}
+		}
+	}
+
+	// take a pending interrupt
+	if code, ok := m.CSR.Interrupt(); ok {
+		m.trap(uint(code), 0, true)
+	}
 
 	// read the next instruction
-	ins, err := m.Mem.RdIns(uint(m.PC))
+	ins, err := m.Mem.Fetch(uint(m.PC))
 	if err != nil {
 		return m.errHandler(m.errMemory(err))
 	}
@@ -2588,14 +2884,32 @@ func (m *RV) Run() error {
 		return m.errHandler(m.errIllegal(ins))
 	}
 
+	pc := m.PC
+	var fflags uint64
+	var fflagsOk bool
+	if m.retire != nil {
+		m.retire.begin(pc, ins, m.CSR.GetMode())
+		x, err := m.CSR.Rd(csr.FFLAGS)
+		fflags, fflagsOk = x, err == nil
+	}
 	err = im.defn.emu(m, ins)
 	if err != nil {
 		return m.errHandler(err)
 	}
+	if m.retire != nil && !m.retire.trapped {
+		m.retireFlags(fflags, fflagsOk)
+		m.retFn(m.retire)
+		m.retire.Traps = m.retire.Traps[:0]
+	}
+
+	// branch prediction
+	if m.predict != nil {
+		m.predict.observe(m, im, pc, ins)
+	}
 
 	// Update the CSR registers
 	m.CSR.IncInstructions()
-	m.CSR.IncClockCycles(2)
+	m.CSR.IncClockCycles(m.cpi)
 
 	// check for breaks points
 	err = m.Mem.GetBreak()
@@ -2603,6 +2917,12 @@ func (m *RV) Run() error {
 		return m.errMemory(err)
 	}
 
+	// a device has stopped the emulation
+	if m.halt != nil {
+		err, m.halt = m.halt, nil
+		return err
+	}
+
 	// stuck PC detection
 	if m.PC == m.lastPC {
 		return m.errStuckPC()
@@ -2628,9 +2948,44 @@ func (m *RV) FloatRegs() string {
 	return floatRegString(m.f[:])
 }
 
+// Xlen returns the bit length of the integer registers.
+func (m *RV) Xlen() uint {
+	return m.xlen
+}
+
+// ISA returns the instruction set of the CPU.
+func (m *RV) ISA() *ISA {
+	return m.isa
+}
+
+// RdX reads an integer register.
+func (m *RV) RdX(i uint) uint64 {
+	return m.rdX(i)
+}
+
+// WrX writes an integer register.
+func (m *RV) WrX(i uint, val uint64) {
+	m.wrX(i, val)
+}
+
+// RdF reads a float register.
+func (m *RV) RdF(i uint) uint64 {
+	return m.f[i]
+}
+
+// WrF writes a float register.
+func (m *RV) WrF(i uint, val uint64) {
+	m.wrFD(i, val)
+}
+
 // Disassemble the instruction at the address.
 func (m *RV) Disassemble(addr uint) *Disassembly {
 	return m.isa.Disassemble(m.Mem, addr)
 }
 
+// DisassembleRange returns the disassembly of a memory range.
+func (m *RV) DisassembleRange(addr, size uint) string {
+	return m.isa.DisassembleRange(m.Mem, addr, size)
+}
+
 //-----------------------------------------------------------------------------
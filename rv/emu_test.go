@@ -0,0 +1,341 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Instruction Emulation Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+// Memory map for the emulation tests.
+const (
+	testText = 0x1000 // program
+	testData = 0x2000 // load/store data
+)
+
+// newTestCPU returns a cpu with text and data memory and the floating point unit on.
+func newTestCPU(t *testing.T, xlen uint) *RV {
+	module := ISArv64gc
+	if xlen == 32 {
+		module = ISArv32gc
+	}
+	isa := NewISA(0)
+	err := isa.Add(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := csr.NewState(xlen, isa.GetExtensions())
+	var cpu *RV
+	if xlen == 32 {
+		cpu = NewRV32(isa, mem.NewMem32(state, 0), state)
+	} else {
+		cpu = NewRV64(isa, mem.NewMem64(state, 0), state)
+	}
+	cpu.Mem.Add(mem.NewSection("text", testText, 0x1000, mem.AttrRX))
+	cpu.Mem.Add(mem.NewSection("data", testData, 0x1000, mem.AttrRW))
+	cpu.Reset()
+	state.Wr(csr.MSTATUS, 1<<13)
+	return cpu
+}
+
+// asmTest assembles a program at the start of the text memory and
+// returns the end address.
+func (m *RV) asmTest(t *testing.T, prog []string) uint {
+	t.Helper()
+	adr := uint(testText)
+	for _, s := range prog {
+		n, err := m.Assemble(adr, s)
+		if err != nil {
+			t.Fatalf("\"%s\" %s", s, err)
+		}
+		adr += n
+	}
+	return adr
+}
+
+// runTest assembles and runs a program, one instruction per line.
+func (m *RV) runTest(t *testing.T, prog []string) {
+	t.Helper()
+	adr := m.asmTest(t, prog)
+	m.PC = testText
+	m.lastPC = 0
+	for _, s := range prog {
+		err := m.Run()
+		if err != nil {
+			t.Fatalf("\"%s\" %s", s, err)
+		}
+	}
+	if m.PC != uint64(adr) {
+		t.Fatalf("pc is %x, expected %x", m.PC, adr)
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func Test_AddressWrap(t *testing.T) {
+	m := newTestCPU(t, 32)
+	m.Mem.Add(mem.NewSection("low", 0, 0x1000, mem.AttrRW))
+	m.Mem.Add(mem.NewSection("high", 0xfffff000, 0x1000, mem.AttrRW))
+	m.Mem.Wr32(0xfffffffc, 0x12345678)
+	m.wrX(RegA1, 0xfffffff0)
+	m.runTest(t, []string{
+		"lw a0,-4(zero)",
+		"sw a0,0x10(a1)",
+	})
+	x, _ := m.Mem.Rd32(0)
+	if m.rdX(RegA0) != 0x12345678 || x != 0x12345678 {
+		t.Errorf("rv32 addresses do not wrap")
+	}
+}
+
+func Test_MisalignedEmpty(t *testing.T) {
+	m := newTestCPU(t, 64)
+	m.CSR.Wr(csr.MTVEC, testText+0x800)
+	m.asmTest(t, []string{"lw a0,1(zero)", "lw a0,0(zero)"})
+	// a misaligned access to empty memory traps
+	m.PC = testText
+	err := m.Run()
+	cause, _ := m.CSR.Rd(csr.MCAUSE)
+	if err != nil || m.PC != testText+0x800 || cause != uint64(csr.ExLoadAddrMisaligned) {
+		t.Errorf("misaligned access did not trap (%v)", err)
+	}
+	// an aligned access to empty memory stops the emulation
+	m.PC = testText + 4
+	err = m.Run()
+	if err == nil {
+		t.Errorf("empty memory access did not stop the emulation")
+	}
+}
+
+func Test_DebugTime(t *testing.T) {
+	m := newTestCPU(t, 64)
+	n := uint64(0)
+	m.CSR.SetTime(func() uint64 { n++; return 100 + n })
+	x, _ := m.CSR.Rd(0xc01) // time
+	// debugger and display reads don't read the time source
+	y, _ := m.CSR.DebugRd(0xc01)
+	m.CSR.Display()
+	if n != 1 || x != 101 || y != 101 {
+		t.Errorf("debug time read has side effects (%d reads)", n)
+	}
+}
+
+func Test_Poll(t *testing.T) {
+	m := newTestCPU(t, 64)
+	polls := []uint64{}
+	m.AddPoller(func() {
+		_, n := m.CSR.Counters()
+		polls = append(polls, n)
+	})
+	m.asmTest(t, []string{"addi a0,a0,1", "j 0x1000"})
+	m.PC = testText
+	for i := 0; i < 3000; i++ {
+		if i == 100 {
+			// a breakpoint stops an instruction before it retires
+			m.Mem.AddBreakPoint("bp", uint(m.PC), mem.AttrX, nil)
+			m.Run()
+			m.Mem.RemoveBreakPoint("bp", uint(m.PC), mem.AttrX)
+			continue
+		}
+		err := m.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the devices are polled on the retired instruction count
+	if len(polls) < 2 {
+		t.Fatalf("polled %d times", len(polls))
+	}
+	for _, n := range polls {
+		if n%pollInterval != 0 {
+			t.Fatalf("polled at instruction %d", n)
+		}
+	}
+}
+
+func Test_LoadReserved(t *testing.T) {
+	for _, xlen := range []uint{32, 64} {
+		m := newTestCPU(t, xlen)
+		m.wrX(RegA0, testData)
+		m.wrX(RegA1, testData+8)
+		m.wrX(RegA2, 0x55)
+
+		// lr/sc pair succeeds
+		m.runTest(t, []string{
+			"lr.w a3,(a0)",
+			"sc.w a4,a2,(a0)",
+		})
+		x, _ := m.Mem.Rd32(testData)
+		if m.rdX(RegA4) != 0 || x != 0x55 {
+			t.Errorf("rv%d: sc.w failed (%d)", xlen, m.rdX(RegA4))
+		}
+
+		// sc without a reservation fails, the reservation is used once
+		m.runTest(t, []string{
+			"lr.w a3,(a0)",
+			"sc.w a4,zero,(a0)",
+			"sc.w a5,zero,(a0)",
+		})
+		x, _ = m.Mem.Rd32(testData)
+		if m.rdX(RegA4) != 0 || m.rdX(RegA5) != 1 || x != 0 {
+			t.Errorf("rv%d: second sc.w succeeded", xlen)
+		}
+
+		// sc to another address fails
+		m.runTest(t, []string{
+			"lr.w a3,(a0)",
+			"sc.w a4,a2,(a1)",
+		})
+		x, _ = m.Mem.Rd32(testData + 8)
+		if m.rdX(RegA4) != 1 || x != 0 {
+			t.Errorf("rv%d: sc.w to another address succeeded", xlen)
+		}
+
+		// reset clears the reservation
+		m.runTest(t, []string{"lr.w a3,(a0)"})
+		m.Reset()
+		m.runTest(t, []string{"sc.w a4,a2,(a0)"})
+		if m.rdX(RegA4) != 1 {
+			t.Errorf("rv%d: reservation survived a reset", xlen)
+		}
+	}
+
+	// lr.d/sc.d
+	m := newTestCPU(t, 64)
+	m.wrX(RegA0, testData)
+	m.wrX(RegA2, 0x123456789a)
+	m.Mem.Wr64(testData, 1<<63)
+	m.runTest(t, []string{
+		"lr.d a3,(a0)",
+		"sc.d a4,a2,(a0)",
+	})
+	x, _ := m.Mem.Rd64(testData)
+	if m.rdX(RegA3) != 1<<63 || m.rdX(RegA4) != 0 || x != 0x123456789a {
+		t.Errorf("rv64: bad lr.d/sc.d")
+	}
+}
+
+func Test_WaitForInterrupt(t *testing.T) {
+	m := newTestCPU(t, 64)
+	m.runTest(t, []string{"wfi", "wfi"})
+}
+
+func Test_CompressedW(t *testing.T) {
+	m := newTestCPU(t, 64)
+	m.wrX(RegA0, 0x7fffffff)
+	m.wrX(RegA1, 1)
+	m.wrX(RegA2, 0x80000000)
+	m.wrX(RegA3, 0x1234)
+	m.runTest(t, []string{
+		"c.addw a0,a0,a1",
+		"c.subw a2,a2,a1",
+	})
+	if m.rdX(RegA0) != 0xffffffff80000000 {
+		t.Errorf("bad c.addw %x", m.rdX(RegA0))
+	}
+	if m.rdX(RegA2) != 0x7fffffff {
+		t.Errorf("bad c.subw %x", m.rdX(RegA2))
+	}
+
+	// c.slli64 a3 (a shift of zero) is a hint
+	m.Mem.Patch(testText, []uint8{0x82, 0x06})
+	m.PC = testText
+	err := m.Run()
+	if err != nil || m.PC != testText+2 || m.rdX(RegA3) != 0x1234 {
+		t.Errorf("c.slli64 is not a hint (%v)", err)
+	}
+}
+
+func Test_CompressedFloat(t *testing.T) {
+	// rv32: c.flw/c.fsw, c.flwsp/c.fswsp
+	m := newTestCPU(t, 32)
+	m.wrX(RegA0, testData)
+	m.wrX(RegSp, testData+0x100)
+	m.Mem.Wr32(testData+4, 0x3f800000)
+	m.Mem.Wr32(testData+0x108, 0x40000000)
+	m.runTest(t, []string{
+		"c.flw fa0,4(a0)",
+		"c.flwsp fa1,8(sp)",
+		"c.fsw fa1,12(a0)",
+		"c.fswsp fa0,16(sp)",
+	})
+	x, _ := m.Mem.Rd32(testData + 12)
+	y, _ := m.Mem.Rd32(testData + 0x110)
+	if x != 0x40000000 || y != 0x3f800000 {
+		t.Errorf("rv32: bad c.flw/c.fsw %x %x", x, y)
+	}
+	if m.f[10] != 0xffffffff3f800000 {
+		t.Errorf("rv32: c.flw is not nan-boxed")
+	}
+
+	// rv64: c.fld/c.fsd, c.fldsp/c.fsdsp
+	m = newTestCPU(t, 64)
+	m.wrX(RegA0, testData)
+	m.wrX(RegSp, testData+0x100)
+	m.Mem.Wr64(testData+8, 0x3ff0000000000000)
+	m.Mem.Wr64(testData+0x108, 0x4000000000000000)
+	m.runTest(t, []string{
+		"c.fld fa0,8(a0)",
+		"c.fldsp fa1,8(sp)",
+		"c.fsd fa1,16(a0)",
+		"c.fsdsp fa0,24(sp)",
+	})
+	a, _ := m.Mem.Rd64(testData + 16)
+	b, _ := m.Mem.Rd64(testData + 0x118)
+	if a != 0x4000000000000000 || b != 0x3ff0000000000000 {
+		t.Errorf("rv64: bad c.fld/c.fsd %x %x", a, b)
+	}
+
+	// the floating point unit is off
+	m.CSR.Wr(csr.MSTATUS, 0)
+	m.CSR.Wr(csr.MTVEC, testText+0x800)
+	m.PC = testText
+	m.Run()
+	if m.PC != testText+0x800 {
+		t.Errorf("c.fld with the floating point unit off did not trap")
+	}
+}
+
+func Test_AtomicFault(t *testing.T) {
+	m := newTestCPU(t, 64)
+	m.CSR.Wr(csr.MTVEC, testText+0x800)
+	m.wrX(RegA0, testText+0x100) // read only
+	m.wrX(RegA1, testData)
+	m.wrX(RegA2, 1)
+	m.asmTest(t, []string{
+		"amoadd.w a3,a2,(a0)",
+		"amoadd.d a3,a2,(a1)",
+	})
+	done := make(chan bool)
+	go func() {
+		// the amo store fault traps
+		m.PC = testText
+		m.Run()
+		// the amo lock has been released
+		m.PC = testText + 4
+		m.Run()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the amo lock was not released")
+	}
+	x, _ := m.Mem.Rd64(testData)
+	if x != 1 {
+		t.Errorf("bad amoadd.d")
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -27,7 +27,7 @@ const (
 	ErrCSR                   // CSR exception
 	ErrTodo                  // unimplemented instruction
 	ErrStuck                 // stuck program counter
-	//ErrExit                  // exit from emulation
+	ErrExit                  // exit from emulation
 )
 
 // Error is a general emulation error.
@@ -37,6 +37,7 @@ type Error struct {
 	ins  uint   // illegal instruction value
 	pc   uint64 // program counter at which error occurrred
 	err  error  // sub error
+	code int    // exit status
 }
 
 func (e *Error) Error() string {
@@ -57,8 +58,8 @@ func (e *Error) Error() string {
 		return "ebreak exception at PC " + pcStr
 	case ErrCSR:
 		return fmt.Sprintf("csr exception at PC %s, %s", pcStr, e.err)
-	//case ErrExit:
-	//	return "exit at PC " + pcStr
+	case ErrExit:
+		return fmt.Sprintf("exit(%d) at PC %s", e.code, pcStr)
 	case ErrTodo:
 		return "unimplemented instruction at PC " + pcStr
 	case ErrStuck:
@@ -75,6 +76,11 @@ func (e *Error) GetMemError() *mem.Error {
 	return e.err.(*mem.Error)
 }
 
+// ExitStatus returns the exit status for an exit error.
+func (e *Error) ExitStatus() int {
+	return e.code
+}
+
 // GetCSRError returns a CSR error from the general CPU error.
 func (e *Error) GetCSRError() *csr.Error {
 	if e.Type != ErrCSR {
@@ -140,6 +146,16 @@ func (m *RV) errStuckPC() error {
 	}
 }
 
+// Exit returns the error for an exit from the emulation.
+func (m *RV) Exit(status int) error {
+	return &Error{
+		Type: ErrExit,
+		alen: m.xlen,
+		pc:   m.PC,
+		code: status,
+	}
+}
+
 func (m *RV) errTodo() error {
 	return &Error{
 		Type: ErrTodo,
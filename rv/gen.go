@@ -200,6 +200,7 @@ var knownDecodes = map[string]decodeType{
 	"3b_1b_rs1/rd!=0_5b_2b":                   decodeTypeCI,
 	"3b_uimm[5]_rd_uimm[4:3|8:6]_2b":          decodeTypeCSS,
 	"3b_uimm[5]_rd!=0_uimm[4:2|7:6]_2b":       decodeTypeCSS,
+	"3b_uimm[5]_rd!=0_uimm[4:3|8:6]_2b":       decodeTypeCSS,
 	"3b_uimm[5]_rd_uimm[4:2|7:6]_2b":          decodeTypeCSS,
 	"3b_1b_rs1!=0_5b_2b":                      decodeTypeCR,
 	"3b_1b_rd!=0_rs2!=0_2b":                   decodeTypeCR,
@@ -226,6 +227,10 @@ func nameRemap(name string) string {
 		"c.swsp":     "sw",
 		"c.ldsp":     "ld",
 		"c.sdsp":     "sd",
+		"c.flwsp":    "flw",
+		"c.fswsp":    "fsw",
+		"c.fldsp":    "fld",
+		"c.fsdsp":    "fsd",
 		"c.addi16sp": "addi",
 		"c.addi4spn": "addi",
 	}
@@ -289,16 +294,20 @@ func parseDefn(id *insDefn, ilen int) (*insMeta, error) {
 
 	s0 := make([]string, 0) // bit pattern
 	s1 := make([]string, 0) // decode signature
+	pos := ilen             // bit position of the current field
 
 	for _, x := range parts {
 		if isBits(x) {
 			s0 = append(s0, fmt.Sprintf("%s", x))
 			s1 = append(s1, fmt.Sprintf("%db", len(x)))
+			pos -= len(x)
 		} else {
 			n, err := isField(x)
 			if err == nil {
 				s0 = append(s0, dontCare(n))
 				s1 = append(s1, x)
+				pos -= n
+				im.fields = append(im.fields, newInsField(x, uint(pos), uint(n)))
 			} else {
 				return nil, err
 			}
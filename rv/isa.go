@@ -123,7 +123,7 @@ var ISArv32a = ISAModule{
 	ext:  csr.IsaExtA,
 	ilen: 32,
 	defn: []insDefn{
-		{"00010 aq rl 00000 rs1 010 rd 0101111 LR.W", daTypeRb, emu_LR_W},         // R
+		{"00010 aq rl 00000 rs1 010 rd 0101111 LR.W", daTypeRg, emu_LR_W},         // R
 		{"00011 aq rl rs2 rs1 010 rd 0101111 SC.W", daTypeRb, emu_SC_W},           // R
 		{"00001 aq rl rs2 rs1 010 rd 0101111 AMOSWAP.W", daTypeRb, emu_AMOSWAP_W}, // R
 		{"00000 aq rl rs2 rs1 010 rd 0101111 AMOADD.W", daTypeRb, emu_AMOADD_W},   // R
@@ -230,11 +230,11 @@ var ISArv32c = ISAModule{
 		{"110 imm[8|4:3] rs10 imm[7:6|2:1|5] 01 C.BEQZ", daTypeCBa, emu_C_BEQZ},          // CB
 		{"111 imm[8|4:3] rs10 imm[7:6|2:1|5] 01 C.BNEZ", daTypeCBa, emu_C_BNEZ},          // CB
 		{"000 nzuimm[5] rs1/rd!=0 nzuimm[4:0] 10 C.SLLI", daTypeCIe, emu_C_SLLI},         // CI (Quadrant 2)
-		{"000 0 rs1/rd!=0 00000 10 C.SLLI64", daNone, emu_C_SLLI64},                      // CI
+		{"000 0 rs1/rd!=0 00000 10 C.SLLI64", daTypeCRe, emu_C_SLLI64},                   // CI
 		{"010 uimm[5] rd!=0 uimm[4:2|7:6] 10 C.LWSP", daTypeCSSa, emu_C_LWSP},            // CSS
 		{"100 0 rs1!=0 00000 10 C.JR", daTypeCRd, emu_C_JR},                              // CR
 		{"100 0 rd!=0 rs2!=0 10 C.MV", daTypeCRa, emu_C_MV},                              // CR
-		{"100 1 00000 00000 10 C.EBREAK", daNone, emu_C_EBREAK},                          // CI
+		{"100 1 00000 00000 10 C.EBREAK", daTypeIi, emu_C_EBREAK},                        // CI
 		{"100 1 rs1!=0 00000 10 C.JALR", daTypeCRe, emu_C_JALR},                          // CR
 		{"100 1 rs1/rd!=0 rs2!=0 10 C.ADD", daTypeCRb, emu_C_ADD},                        // CR
 		{"110 uimm[5:2|7:6] rs2 10 C.SWSP", daTypeCSSb, emu_C_SWSP},                      // CSS
@@ -256,9 +256,9 @@ var ISArv32fc = ISAModule{
 	ilen: 16,
 	defn: []insDefn{
 		{"011 uimm[5:3] rs10 uimm[2|6] rd0 00 C.FLW", daTypeCSc, emu_C_FLW},  // CL
-		{"011 uimm[5] rd uimm[4:2|7:6] 10 C.FLWSP", daNone, emu_C_FLWSP},     // CSS
+		{"011 uimm[5] rd uimm[4:2|7:6] 10 C.FLWSP", daTypeCSSd, emu_C_FLWSP}, // CSS
 		{"111 uimm[5:3] rs10 uimm[2|6] rs20 00 C.FSW", daTypeCSc, emu_C_FSW}, // CS
-		{"111 uimm[5:2|7:6] rs2 10 C.FSWSP", daNone, emu_C_FSWSP},            // CSS
+		{"111 uimm[5:2|7:6] rs2 10 C.FSWSP", daTypeCSSe, emu_C_FSWSP},        // CSS
 	},
 }
 
@@ -267,10 +267,10 @@ var ISArv32dc = ISAModule{
 	ext:  csr.IsaExtC,
 	ilen: 16,
 	defn: []insDefn{
-		{"001 uimm[5:3] rs10 uimm[7:6] rd0 00 C.FLD", daTypeCSc, emu_C_FLD},  // CL
-		{"001 uimm[5] rd uimm[4:3|8:6] 10 C.FLDSP", daNone, emu_C_FLDSP},     // CSS
-		{"101 uimm[5:3] rs10 uimm[7:6] rs20 00 C.FSD", daTypeCSc, emu_C_FSD}, // CS
-		{"101 uimm[5:3|8:6] rs2 10 C.FSDSP", daNone, emu_C_FSDSP},            // CSS
+		{"001 uimm[5:3] rs10 uimm[7:6] rd0 00 C.FLD", daTypeCSd, emu_C_FLD},  // CL
+		{"001 uimm[5] rd uimm[4:3|8:6] 10 C.FLDSP", daTypeCIi, emu_C_FLDSP},  // CSS
+		{"101 uimm[5:3] rs10 uimm[7:6] rs20 00 C.FSD", daTypeCSd, emu_C_FSD}, // CS
+		{"101 uimm[5:3|8:6] rs2 10 C.FSDSP", daTypeCSSf, emu_C_FSDSP},        // CSS
 	},
 }
 
@@ -283,7 +283,7 @@ var ISArv64i = ISAModule{
 	ilen: 32,
 	defn: []insDefn{
 		{"imm[11:0] rs1 110 rd 0000011 LWU", daTypeIc, emu_LWU},          // I
-		{"imm[11:0] rs1 011 rd 0000011 LD", daTypeIa, emu_LD},            // I
+		{"imm[11:0] rs1 011 rd 0000011 LD", daTypeIc, emu_LD},            // I
 		{"imm[11:5] rs2 rs1 011 imm[4:0] 0100011 SD", daTypeSa, emu_SD},  // S
 		{"000000 shamt6 rs1 001 rd 0010011 SLLI", daTypeId, emu_SLLI},    // I
 		{"000000 shamt6 rs1 101 rd 0010011 SRLI", daTypeId, emu_SRLI},    // I
@@ -318,7 +318,7 @@ var ISArv64a = ISAModule{
 	ext:  csr.IsaExtA,
 	ilen: 32,
 	defn: []insDefn{
-		{"00010 aq rl 00000 rs1 011 rd 0101111 LR.D", daTypeRb, emu_LR_D},         // R
+		{"00010 aq rl 00000 rs1 011 rd 0101111 LR.D", daTypeRg, emu_LR_D},         // R
 		{"00011 aq rl rs2 rs1 011 rd 0101111 SC.D", daTypeRb, emu_SC_D},           // R
 		{"00001 aq rl rs2 rs1 011 rd 0101111 AMOSWAP.D", daTypeRb, emu_AMOSWAP_D}, // R
 		{"00000 aq rl rs2 rs1 011 rd 0101111 AMOADD.D", daTypeRb, emu_AMOADD_D},   // R
@@ -363,13 +363,13 @@ var ISArv64c = ISAModule{
 	ext:  csr.IsaExtC,
 	ilen: 16,
 	defn: []insDefn{
-		{"001 imm[5] rd!=0 imm[4:0] 01 C.ADDIW", daTypeCIc, emu_C_ADDIW},   // CI
-		{"011 uimm[5] rd uimm[4:3|8:6] 10 C.LDSP", daTypeCIh, emu_C_LDSP},  // CI
-		{"011 uimm[5:3] rs10 uimm[7:6] rd0 00 C.LD", daTypeCSb, emu_C_LD},  // CL
-		{"100 1 11 rs10/rd0 00 rs20 01 C.SUBW", daTypeCRc, emu_C_SUBW},     // CR
-		{"100 1 11 rs10/rd0 01 rs20 01 C.ADDW", daTypeCRc, emu_C_ADDW},     // CR
-		{"111 uimm[5:3] rs10 uimm[7:6] rs20 00 C.SD", daTypeCSb, emu_C_SD}, // CS
-		{"111 uimm[5:3|8:6] rs2 10 C.SDSP", daTypeCSSc, emu_C_SDSP},        // CSS
+		{"001 imm[5] rd!=0 imm[4:0] 01 C.ADDIW", daTypeCIc, emu_C_ADDIW},     // CI
+		{"011 uimm[5] rd!=0 uimm[4:3|8:6] 10 C.LDSP", daTypeCIh, emu_C_LDSP}, // CI
+		{"011 uimm[5:3] rs10 uimm[7:6] rd0 00 C.LD", daTypeCSb, emu_C_LD},    // CL
+		{"100 1 11 rs10/rd0 00 rs20 01 C.SUBW", daTypeCRc, emu_C_SUBW},       // CR
+		{"100 1 11 rs10/rd0 01 rs20 01 C.ADDW", daTypeCRc, emu_C_ADDW},       // CR
+		{"111 uimm[5:3] rs10 uimm[7:6] rs20 00 C.SD", daTypeCSb, emu_C_SD},   // CS
+		{"111 uimm[5:3|8:6] rs2 10 C.SDSP", daTypeCSSc, emu_C_SDSP},          // CSS
 	},
 }
 
@@ -414,6 +414,79 @@ var ISArv64gc = []ISAModule{
 	ISArv64c,
 }
 
+// ISAModules returns the ISA modules for a list of single letter
+// extensions (E.g. "i", "m", "a", "f", "d", "c" or "g" for imafd).
+func ISAModules(xlen uint, ext []string) ([]ISAModule, error) {
+	has := map[string]bool{}
+	for _, e := range ext {
+		e = strings.ToLower(e)
+		switch e {
+		case "g":
+			for _, x := range []string{"i", "m", "a", "f", "d"} {
+				has[x] = true
+			}
+		case "i", "m", "a", "f", "d", "c":
+			has[e] = true
+		default:
+			return nil, fmt.Errorf("extension \"%s\" is not supported", e)
+		}
+	}
+	if !has["i"] {
+		return nil, fmt.Errorf("the base integer extension (i) is required")
+	}
+	if has["d"] && !has["f"] {
+		return nil, fmt.Errorf("extension d requires extension f")
+	}
+	rv32 := []struct {
+		ext string
+		im  ISAModule
+	}{
+		{"i", ISArv32i}, {"m", ISArv32m}, {"a", ISArv32a}, {"f", ISArv32f}, {"d", ISArv32d},
+	}
+	rv64 := []struct {
+		ext string
+		im  ISAModule
+	}{
+		{"i", ISArv64i}, {"m", ISArv64m}, {"a", ISArv64a}, {"f", ISArv64f}, {"d", ISArv64d},
+	}
+	x := []ISAModule{}
+	for _, m := range rv32 {
+		if has[m.ext] {
+			x = append(x, m.im)
+		}
+	}
+	switch xlen {
+	case 32:
+		if has["c"] {
+			x = append(x, ISArv32c, ISArv32cOnly)
+			if has["f"] {
+				x = append(x, ISArv32fc)
+			}
+			if has["d"] {
+				x = append(x, ISArv32dc)
+			}
+		}
+	case 64:
+		if has["c"] {
+			x = append(x, ISArv32c)
+			if has["d"] {
+				x = append(x, ISArv32dc)
+			}
+		}
+		for _, m := range rv64 {
+			if has[m.ext] {
+				x = append(x, m.im)
+			}
+		}
+		if has["c"] {
+			x = append(x, ISArv64c)
+		}
+	default:
+		return nil, fmt.Errorf("xlen %d is not supported", xlen)
+	}
+	return x, nil
+}
+
 //-----------------------------------------------------------------------------
 
 // insMeta is instruction meta-data determined at runtime
@@ -423,6 +496,7 @@ type insMeta struct {
 	n         int        // instruction bit length
 	val, mask uint       // value and mask of fixed bits in the instruction
 	dt        decodeType // decode type
+	fields    []insField // variable fields of the instruction
 }
 
 // decodeConstant returns go code for decoding constants for this instruction.
@@ -0,0 +1,451 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Branch Prediction Simulation
+
+The predictor observes the branches and jumps as they are emulated and
+records how well a given prediction scheme would have done. Mispredictions
+can optionally be charged to the mcycle counter.
+
+Conditional branches: static BTFN, bimodal or gshare.
+Direct jumps (jal/j): always predicted correctly.
+Indirect jumps (jalr/jr): return address stack for returns, else last target.
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	cli "github.com/deadsy/go-cli"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+// ctrlFlow is the control flow type of an instruction.
+type ctrlFlow int
+
+const (
+	cfNone     ctrlFlow = iota // not a control flow instruction
+	cfBranch                   // conditional branch
+	cfJump                     // direct jump (jal)
+	cfIndirect                 // indirect jump (jalr)
+)
+
+// getCtrlFlow returns the control flow type for an instruction.
+func getCtrlFlow(im *insMeta) ctrlFlow {
+	if im.dt == decodeTypeB || im.dt == decodeTypeCB {
+		return cfBranch
+	}
+	switch im.name {
+	case "jal", "j":
+		return cfJump
+	case "jalr", "jr":
+		return cfIndirect
+	}
+	return cfNone
+}
+
+// isLink returns true if the register is a link register (ra or t0).
+func isLink(r uint) bool {
+	return r == RegRa || r == RegT0
+}
+
+// jumpRegs returns the rd, rs1 registers for an indirect jump.
+func jumpRegs(im *insMeta, ins uint) (uint, uint) {
+	if im.n == 32 {
+		_, rs1, rd := decodeIa(ins)
+		return rd, rs1
+	}
+	rs1, _ := decodeCR(ins)
+	if im.name == "jalr" {
+		// c.jalr
+		return RegRa, rs1
+	}
+	// c.jr
+	return RegZero, rs1
+}
+
+// branchOffset returns the pc offset for a conditional branch.
+func branchOffset(im *insMeta, ins uint) int {
+	if im.dt == decodeTypeB {
+		imm, _, _ := decodeB(ins)
+		return imm
+	}
+	imm, _ := decodeCB(ins)
+	return imm
+}
+
+//-----------------------------------------------------------------------------
+
+// Predictor types.
+const (
+	PredictBTFN    = iota // static backwards taken, forwards not taken
+	PredictBimodal        // table of 2-bit counters indexed by pc
+	PredictGshare         // table of 2-bit counters indexed by pc ^ global history
+)
+
+var predictName = map[uint]string{
+	PredictBTFN:    "btfn",
+	PredictBimodal: "bimodal",
+	PredictGshare:  "gshare",
+}
+
+// PredictConfig is the configuration for a branch predictor.
+type PredictConfig struct {
+	Type    uint // predictor type
+	Bits    uint // log2 of the counter table size
+	History uint // global history bits (gshare)
+	RAS     uint // return address stack depth (0 = none)
+	Penalty uint // mispredict penalty charged to mcycle (0 = none)
+}
+
+func (cfg *PredictConfig) String() string {
+	s := []string{predictName[cfg.Type]}
+	if cfg.Type != PredictBTFN {
+		s = append(s, fmt.Sprintf("%d entries", 1<<cfg.Bits))
+	}
+	if cfg.Type == PredictGshare {
+		s = append(s, fmt.Sprintf("%d history bits", cfg.History))
+	}
+	s = append(s, fmt.Sprintf("ras %d", cfg.RAS))
+	s = append(s, fmt.Sprintf("penalty %d", cfg.Penalty))
+	return strings.Join(s, ", ")
+}
+
+// PredictArg converts a "type[,bits=n][,hist=n][,ras=n][,penalty=n]" string
+// (eg: "gshare,bits=12,hist=10,ras=8") to a predictor configuration.
+func PredictArg(arg string) (*PredictConfig, error) {
+	cfg := &PredictConfig{
+		Bits:    10,
+		History: 8,
+		RAS:     8,
+	}
+	x := strings.Split(arg, ",")
+	found := false
+	for k, v := range predictName {
+		if strings.ToLower(x[0]) == v {
+			cfg.Type = k
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("predictor type \"%s\" is not valid (btfn, bimodal, gshare)", x[0])
+	}
+	for _, s := range x[1:] {
+		kv := strings.Split(s, "=")
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("predictor option \"%s\" is not valid", s)
+		}
+		n, err := strconv.ParseUint(kv[1], 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("predictor option \"%s\" is not valid", s)
+		}
+		switch kv[0] {
+		case "bits":
+			cfg.Bits = uint(n)
+		case "hist":
+			cfg.History = uint(n)
+		case "ras":
+			cfg.RAS = uint(n)
+		case "penalty":
+			cfg.Penalty = uint(n)
+		default:
+			return nil, fmt.Errorf("predictor option \"%s\" is not valid", s)
+		}
+	}
+	if cfg.Bits > 24 || cfg.History > 24 {
+		return nil, fmt.Errorf("predictor table is too large")
+	}
+	return cfg, nil
+}
+
+//-----------------------------------------------------------------------------
+
+// predictStats are the prediction statistics for an instruction address.
+type predictStats struct {
+	cf     ctrlFlow
+	n      uint64 // number of executions
+	taken  uint64 // number of times taken
+	misses uint64 // number of mispredictions
+}
+
+// Predictor is a branch predictor model.
+type Predictor struct {
+	cfg    PredictConfig
+	table  []uint8           // 2-bit saturating counters
+	ghr    uint              // global history register
+	ras    []uint64          // return address stack
+	btb    map[uint64]uint64 // last target of indirect jumps
+	stats  map[uint64]*predictStats
+	n      uint64 // total control flow instructions
+	misses uint64 // total mispredictions
+}
+
+// NewPredictor returns a branch predictor model.
+func NewPredictor(cfg *PredictConfig) *Predictor {
+	p := &Predictor{
+		cfg: *cfg,
+	}
+	p.Reset()
+	return p
+}
+
+// Reset resets the predictor state and statistics.
+func (p *Predictor) Reset() {
+	p.table = make([]uint8, 1<<p.cfg.Bits)
+	for i := range p.table {
+		// weakly not taken
+		p.table[i] = 1
+	}
+	p.ghr = 0
+	p.ras = make([]uint64, 0, p.cfg.RAS)
+	p.btb = make(map[uint64]uint64)
+	p.stats = make(map[uint64]*predictStats)
+	p.n = 0
+	p.misses = 0
+}
+
+// index returns the counter table index for a branch.
+func (p *Predictor) index(pc uint64) uint {
+	idx := uint(pc >> 1)
+	if p.cfg.Type == PredictGshare {
+		idx ^= p.ghr
+	}
+	return idx & ((1 << p.cfg.Bits) - 1)
+}
+
+// branch predicts and updates the state for a conditional branch.
+func (p *Predictor) branch(pc uint64, offset int, taken bool) bool {
+	var predict bool
+	switch p.cfg.Type {
+	case PredictBTFN:
+		predict = offset < 0
+	case PredictBimodal, PredictGshare:
+		idx := p.index(pc)
+		predict = p.table[idx] >= 2
+		if taken {
+			if p.table[idx] < 3 {
+				p.table[idx]++
+			}
+		} else {
+			if p.table[idx] > 0 {
+				p.table[idx]--
+			}
+		}
+		if p.cfg.Type == PredictGshare {
+			p.ghr = ((p.ghr << 1) | uint(btoi(taken))) & ((1 << p.cfg.History) - 1)
+		}
+	}
+	return predict == taken
+}
+
+// push pushes a return address on the return address stack.
+func (p *Predictor) push(adr uint64) {
+	if p.cfg.RAS == 0 {
+		return
+	}
+	if uint(len(p.ras)) == p.cfg.RAS {
+		// overflow: lose the oldest entry
+		copy(p.ras, p.ras[1:])
+		p.ras = p.ras[:len(p.ras)-1]
+	}
+	p.ras = append(p.ras, adr)
+}
+
+// pop pops a return address from the return address stack.
+func (p *Predictor) pop() (uint64, bool) {
+	n := len(p.ras)
+	if n == 0 {
+		return 0, false
+	}
+	adr := p.ras[n-1]
+	p.ras = p.ras[:n-1]
+	return adr, true
+}
+
+// indirect predicts and updates the state for an indirect jump.
+func (p *Predictor) indirect(pc, next, target uint64, rd, rs1 uint) bool {
+	var hit bool
+	if isLink(rs1) && rs1 != rd && p.cfg.RAS != 0 {
+		// return: predict with the return address stack
+		adr, ok := p.pop()
+		hit = ok && adr == target
+	} else {
+		// other: predict with the last target
+		adr, ok := p.btb[pc]
+		hit = ok && adr == target
+		p.btb[pc] = target
+	}
+	if isLink(rd) {
+		// call
+		p.push(next)
+	}
+	return hit
+}
+
+// observe is called after a control flow instruction has been emulated.
+func (p *Predictor) observe(m *RV, im *insMeta, pc uint64, ins uint) {
+	cf := getCtrlFlow(im)
+	next := pc + uint64(im.n>>3)
+	taken := m.PC != next
+	var hit bool
+
+	switch cf {
+	case cfBranch:
+		hit = p.branch(pc, branchOffset(im, ins), taken)
+	case cfJump:
+		if im.n == 32 {
+			_, rd := decodeJ(ins)
+			if isLink(rd) {
+				p.push(next)
+			}
+		} else if im.name == "jal" {
+			// c.jal
+			p.push(next)
+		}
+		hit = true
+	case cfIndirect:
+		rd, rs1 := jumpRegs(im, ins)
+		hit = p.indirect(pc, next, m.PC, rd, rs1)
+	default:
+		return
+	}
+
+	st := p.stats[pc]
+	if st == nil {
+		st = &predictStats{cf: cf}
+		p.stats[pc] = st
+	}
+	st.n++
+	p.n++
+	if taken {
+		st.taken++
+	}
+	if !hit {
+		st.misses++
+		p.misses++
+		if p.cfg.Penalty != 0 {
+			m.CSR.IncClockCycles(p.cfg.Penalty)
+		}
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+func btoi(x bool) int {
+	if x {
+		return 1
+	}
+	return 0
+}
+
+func missRate(misses, n uint64) string {
+	rate := 0.0
+	if n != 0 {
+		rate = 100.0 * float64(misses) / float64(n)
+	}
+	return fmt.Sprintf("%.2f%%", rate)
+}
+
+// maxReportPCs is the maximum number of per-pc report entries.
+const maxReportPCs = 32
+
+// Report returns a string with the misprediction statistics by pc and by function.
+func (p *Predictor) Report(m *mem.Memory) string {
+	s := []string{}
+	s = append(s, fmt.Sprintf("predictor: %s", &p.cfg))
+	s = append(s, fmt.Sprintf("branches %d mispredicts %d (%s)", p.n, p.misses, missRate(p.misses, p.n)))
+	if p.n == 0 {
+		return strings.Join(s, "\n")
+	}
+
+	type fnStats struct {
+		name      string
+		n, misses uint64
+	}
+	pcs := []uint64{}
+	byFunc := make(map[string]*fnStats)
+	for pc, st := range p.stats {
+		pcs = append(pcs, pc)
+		name := "?"
+		if sym := m.SymbolNearest(uint(pc)); sym != nil {
+			name = sym.Name
+		}
+		fs := byFunc[name]
+		if fs == nil {
+			fs = &fnStats{name: name}
+			byFunc[name] = fs
+		}
+		fs.n += st.n
+		fs.misses += st.misses
+	}
+
+	// per pc (worst first)
+	sort.Slice(pcs, func(i, j int) bool {
+		a, b := p.stats[pcs[i]], p.stats[pcs[j]]
+		if a.misses == b.misses {
+			return pcs[i] < pcs[j]
+		}
+		return a.misses > b.misses
+	})
+	if len(pcs) > maxReportPCs {
+		pcs = pcs[:maxReportPCs]
+	}
+	rows := [][]string{{"pc", "type", "count", "taken", "mispredicts", "miss rate"}}
+	for _, pc := range pcs {
+		st := p.stats[pc]
+		cfStr := [4]string{"", "branch", "jump", "indirect"}[st.cf]
+		rows = append(rows, []string{m.AddrStr(uint(pc)), cfStr, fmt.Sprintf("%d", st.n), fmt.Sprintf("%d", st.taken), fmt.Sprintf("%d", st.misses), missRate(st.misses, st.n)})
+	}
+	s = append(s, cli.TableString(rows, []int{0, 0, 0, 0, 0, 0}, 1))
+
+	// per function (worst first)
+	fns := []*fnStats{}
+	for _, v := range byFunc {
+		fns = append(fns, v)
+	}
+	sort.Slice(fns, func(i, j int) bool {
+		if fns[i].misses == fns[j].misses {
+			return fns[i].name < fns[j].name
+		}
+		return fns[i].misses > fns[j].misses
+	})
+	rows = [][]string{{"function", "count", "mispredicts", "miss rate"}}
+	for _, fs := range fns {
+		rows = append(rows, []string{fs.name, fmt.Sprintf("%d", fs.n), fmt.Sprintf("%d", fs.misses), missRate(fs.misses, fs.n)})
+	}
+	s = append(s, cli.TableString(rows, []int{0, 0, 0, 0}, 1))
+
+	return strings.Join(s, "\n")
+}
+
+//-----------------------------------------------------------------------------
+
+// SetPredictor sets the branch predictor model (nil for none).
+func (m *RV) SetPredictor(p *Predictor) {
+	m.predict = p
+}
+
+// PredictReport returns the branch predictor report.
+func (m *RV) PredictReport() string {
+	if m.predict == nil {
+		return "no branch predictor"
+	}
+	return m.predict.Report(m.Mem)
+}
+
+// PredictReset resets the branch predictor state and statistics.
+func (m *RV) PredictReset() {
+	if m.predict != nil {
+		m.predict.Reset()
+	}
+}
+
+//-----------------------------------------------------------------------------
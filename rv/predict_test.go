@@ -0,0 +1,62 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Branch Prediction Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import "testing"
+
+//-----------------------------------------------------------------------------
+
+func Test_Predict(t *testing.T) {
+	// a loop branch: taken 9 times, then not taken
+	pattern := []bool{true, true, true, true, true, true, true, true, true, false}
+	tests := []struct {
+		arg    string
+		misses int
+	}{
+		{"btfn", 1},
+		{"bimodal", 2},
+		{"gshare,bits=4,hist=2", 4},
+	}
+	for _, v := range tests {
+		cfg, err := PredictArg(v.arg)
+		if err != nil {
+			t.Fatalf("%s: %s", v.arg, err)
+		}
+		p := NewPredictor(cfg)
+		misses := 0
+		for _, taken := range pattern {
+			if !p.branch(0x100, -8, taken) {
+				misses++
+			}
+		}
+		if misses != v.misses {
+			t.Errorf("%s: expected %d mispredicts, got %d", v.arg, v.misses, misses)
+		}
+	}
+}
+
+func Test_PredictRAS(t *testing.T) {
+	cfg, _ := PredictArg("btfn,ras=2")
+	p := NewPredictor(cfg)
+	// nested calls: the third call overflows the stack
+	p.push(0x10)
+	p.push(0x20)
+	p.push(0x30)
+	if !p.indirect(0x100, 0x104, 0x30, RegZero, RegRa) {
+		t.Error("expected return to 0x30 to be predicted")
+	}
+	if !p.indirect(0x100, 0x104, 0x20, RegZero, RegRa) {
+		t.Error("expected return to 0x20 to be predicted")
+	}
+	if p.indirect(0x100, 0x104, 0x10, RegZero, RegRa) {
+		t.Error("expected return to 0x10 to be mispredicted")
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,270 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Random Instruction Streams
+
+Generates random (but legal) instruction streams from the value/mask and
+field information of the instruction definitions. The streams are run on
+the emulator to self-test the decoder, disassembler, assembler and the
+instruction emulation.
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+// randomExclude are instructions that are not generated.
+// They are illegal or change the control state of the CPU (privilege, trap handling).
+var randomExclude = map[string]bool{
+	"c.illegal":   true,
+	"ecall":       true,
+	"ebreak":      true,
+	"c.ebreak":    true,
+	"uret":        true,
+	"sret":        true,
+	"mret":        true,
+	"sfence.vma":  true,
+	"hfence.bvma": true,
+	"hfence.gvma": true,
+	"csrrw":       true,
+	"csrrs":       true,
+	"csrrc":       true,
+	"csrrwi":      true,
+	"csrrsi":      true,
+	"csrrci":      true,
+}
+
+// width returns the bit width of the field within the instruction.
+func (f *insField) width() uint {
+	if f.short {
+		return 3
+	}
+	return uint(len(f.bits))
+}
+
+// raw returns the field bits of an instruction.
+func (f *insField) raw(ins uint) uint {
+	return (ins >> f.shift) & ((1 << f.width()) - 1)
+}
+
+// legal returns true if the instruction meets the constraints of its fields.
+func (im *insMeta) legal(ins, xlen uint) bool {
+	hasNz := false
+	var nz uint
+	for i := range im.fields {
+		f := &im.fields[i]
+		x := f.raw(ins)
+		if f.key == "imm" {
+			if f.nz {
+				hasNz = true
+				nz |= x
+			}
+			if xlen == 32 && strings.HasPrefix(f.name, "shamt") && x >= 32 {
+				return false
+			}
+			if xlen == 32 && f.name == "nzuimm[5]" && x != 0 {
+				// rv32c shifts: shamt[5] is reserved
+				return false
+			}
+			continue
+		}
+		if f.nz && x == 0 {
+			return false
+		}
+		if f.nz2 && (x == 0 || x == 2) {
+			return false
+		}
+		if f.key == "rm" && (x == 5 || x == 6) {
+			return false
+		}
+	}
+	return !hasNz || nz != 0
+}
+
+//-----------------------------------------------------------------------------
+
+// RandomGen generates random legal instructions.
+type RandomGen struct {
+	isa  *ISA
+	xlen uint
+	rnd  *rand.Rand
+	ins  []*insMeta // instructions that can be generated
+}
+
+// NewRandomGen returns a random instruction generator for the ISA.
+func NewRandomGen(isa *ISA, xlen uint, seed int64) *RandomGen {
+	g := &RandomGen{
+		isa:  isa,
+		xlen: xlen,
+		rnd:  rand.New(rand.NewSource(seed)),
+	}
+	for _, im := range append(isa.ins32[:len(isa.ins32):len(isa.ins32)], isa.ins16...) {
+		if !randomExclude[im.defnName()] {
+			g.ins = append(g.ins, im)
+		}
+	}
+	return g
+}
+
+// Instruction returns a random legal instruction.
+func (g *RandomGen) Instruction() uint {
+	for {
+		im := g.ins[g.rnd.Intn(len(g.ins))]
+		ins := im.val | (uint(g.rnd.Uint32()) &^ im.mask)
+		if im.n == 16 {
+			ins &= 0xffff
+		}
+		// the instruction may decode as another (more specific) instruction
+		x := g.isa.lookup(ins)
+		if x == nil || randomExclude[x.defnName()] || !x.legal(ins, g.xlen) {
+			continue
+		}
+		return ins
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// Memory map for random instruction streams.
+const (
+	randomText = 0x10000 // instruction stream
+	randomData = 0x80000 // load/store data
+	randomTrap = 0xf0000 // trap handler
+	randomSize = 1 << 16 // data size
+	randomPad  = 1 << 12 // data padding for the load/store offsets
+)
+
+// roundTrip checks that the disassembly of an instruction re-assembles to an
+// instruction with the same disassembly.
+func (isa *ISA) roundTrip(xlen, pc, ins uint) error {
+	da := isa.daInstruction(pc, ins)
+	s := da
+	if ins&3 != 3 {
+		s = "c." + da
+	}
+	code, err := isa.Assemble(nil, xlen, pc, s)
+	if err != nil {
+		return fmt.Errorf("%08x \"%s\" does not assemble: %s", ins, s, err)
+	}
+	if len(code) != 1 || insLength(code[0]) != insLength(ins) {
+		return fmt.Errorf("%08x \"%s\" assembles to a different length", ins, s)
+	}
+	x := isa.daInstruction(pc, code[0])
+	if x != da {
+		return fmt.Errorf("%08x \"%s\" re-assembles as %08x \"%s\"", ins, da, code[0], x)
+	}
+	return nil
+}
+
+// step runs a single instruction, converting panics to errors.
+func (m *RV) step() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return m.Run()
+}
+
+// RandomTest generates a random instruction stream of n instructions and
+// runs it with a trap handler installed. The instructions are executed in
+// stream order (control flow changes are undone). It checks that:
+// each instruction round trips through the disassembler and assembler,
+// no instruction is unimplemented, panics, stops the emulation or takes an
+// illegal instruction trap.
+func RandomTest(module []ISAModule, xlen uint, seed int64, n int) error {
+	isa := NewISA(csr.IsaExtS | csr.IsaExtU)
+	err := isa.Add(module)
+	if err != nil {
+		return err
+	}
+	state := csr.NewState(xlen, isa.GetExtensions())
+	var m *RV
+	if xlen == 32 {
+		mm := mem.NewMem32(state, 0)
+		m = NewRV32(isa, mm, state)
+	} else {
+		mm := mem.NewMem64(state, 0)
+		m = NewRV64(isa, mm, state)
+	}
+	m.Mem.Add(mem.NewSection("text", randomText, uint(4*n), mem.AttrRX))
+	m.Mem.Add(mem.NewSection("data", randomData-randomPad, randomSize+2*randomPad, mem.AttrRW))
+	m.Mem.Add(mem.NewSection("trap", randomTrap, 4, mem.AttrRX))
+	// zero register +/- offset
+	top := uint((1<<xlen - 1) &^ uint64(randomPad-1))
+	m.Mem.Add(mem.NewSection("low", 0, randomPad, mem.AttrRW))
+	m.Mem.Add(mem.NewSection("high", top, randomPad, mem.AttrRW))
+
+	// generate the instruction stream
+	g := NewRandomGen(isa, xlen, seed)
+	stream := make([]uint, n)
+	adr := uint(randomText)
+	for i := range stream {
+		ins := g.Instruction()
+		err := isa.roundTrip(xlen, adr, ins)
+		if err != nil {
+			return err
+		}
+		buf := []uint8{}
+		for j := uint(0); j < insLength(ins); j++ {
+			buf = append(buf, uint8(ins>>(j*8)))
+		}
+		err = m.Mem.Patch(adr, buf)
+		if err != nil {
+			return err
+		}
+		stream[i] = adr
+		adr += insLength(ins)
+	}
+
+	// trap handler, floating point enabled
+	m.Reset()
+	state.Wr(csr.MTVEC, randomTrap)
+	state.Wr(csr.MSTATUS, 1<<13)
+
+	for i := 1; i < 32; i++ {
+		m.wrFD(uint(i), g.rnd.Uint64())
+	}
+
+	// run the instruction stream
+	for _, pc := range stream {
+		// registers point into the data area
+		for i := uint(1); i < 32; i++ {
+			if x := m.rdX(i); x < randomData || x >= randomData+randomSize {
+				m.wrX(i, uint64(randomData+g.rnd.Intn(randomSize)))
+			}
+		}
+		m.PC = uint64(pc)
+		// an odd pc is never reached
+		m.lastPC = 1
+		ins, _ := m.Mem.RdIns(pc)
+		if ins&3 != 3 {
+			ins &= 0xffff
+		}
+		da := isa.daInstruction(pc, ins)
+		err := m.step()
+		if err != nil {
+			return fmt.Errorf("%08x \"%s\": %s", ins, da, err)
+		}
+		if m.PC == randomTrap {
+			cause, _ := state.Rd(csr.MCAUSE)
+			if cause == uint64(csr.ExInsIllegal) {
+				return fmt.Errorf("%08x \"%s\": illegal instruction trap", ins, da)
+			}
+		}
+	}
+	return nil
+}
+
+//-----------------------------------------------------------------------------
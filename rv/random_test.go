@@ -0,0 +1,44 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Random Instruction Stream Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import "testing"
+
+//-----------------------------------------------------------------------------
+
+func Test_Random(t *testing.T) {
+	for seed := int64(0); seed < 8; seed++ {
+		err := RandomTest(ISArv32gc, 32, seed, 1000)
+		if err != nil {
+			t.Errorf("rv32 seed %d: %s", seed, err)
+		}
+		err = RandomTest(ISArv64gc, 64, seed, 1000)
+		if err != nil {
+			t.Errorf("rv64 seed %d: %s", seed, err)
+		}
+	}
+}
+
+func FuzzRandom(f *testing.F) {
+	f.Add(int64(0), false)
+	f.Add(int64(1), true)
+	f.Fuzz(func(t *testing.T, seed int64, rv64 bool) {
+		var err error
+		if rv64 {
+			err = RandomTest(ISArv64gc, 64, seed, 200)
+		} else {
+			err = RandomTest(ISArv32gc, 32, seed, 200)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+//-----------------------------------------------------------------------------
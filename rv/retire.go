@@ -0,0 +1,276 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Retired Instruction Records
+
+A record of each retired instruction and its architectural side effects
+(register, CSR and memory accesses) is made available to a callback.
+This is used for commit logs and co-simulation.
+
+The CSR writes include the implicit fflags updates of float instructions.
+
+An instruction that traps doesn't retire. The traps (exceptions and
+interrupts) and their CSR writes (E.g. mepc, mcause, mtval and mstatus)
+are reported with the next retired instruction.
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import (
+	"fmt"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+// RegWrite is a register write.
+type RegWrite struct {
+	Reg uint
+	Val uint64
+}
+
+// MemAccess is a memory data access.
+type MemAccess struct {
+	Adr  uint
+	Size uint // bytes
+	Val  uint64
+}
+
+// Trap is a trap taken by the cpu.
+type Trap struct {
+	Cause     uint       // exception or interrupt code
+	Interrupt bool       // an interrupt (or an exception)
+	EPC       uint64     // exception program counter
+	Tval      uint64     // trap value
+	CSR       []RegWrite // CSR writes by the trap
+}
+
+// Retire is the record of a retired instruction.
+type Retire struct {
+	PC      uint64
+	Ins     uint
+	Mode    csr.Mode
+	X       []RegWrite  // integer register writes
+	F       []RegWrite  // float register writes
+	CSR     []RegWrite  // CSR writes
+	Rd      []MemAccess // memory reads
+	Wr      []MemAccess // memory writes
+	Traps   []Trap      // traps taken before the instruction
+	trapped bool        // the instruction has trapped
+}
+
+// RetireFunc is called with the record of each retired instruction.
+// The record is re-used for the next instruction.
+type RetireFunc func(r *Retire)
+
+// begin starts the record for an instruction.
+func (r *Retire) begin(pc uint64, ins uint, mode csr.Mode) {
+	r.PC = pc
+	if ins&3 != 3 {
+		ins &= 0xffff
+	}
+	r.Ins = ins
+	r.Mode = mode
+	r.X = r.X[:0]
+	r.F = r.F[:0]
+	r.CSR = r.CSR[:0]
+	r.Rd = r.Rd[:0]
+	r.Wr = r.Wr[:0]
+	r.trapped = false
+}
+
+// trap records a trap.
+func (r *Retire) trap(t Trap) {
+	r.Traps = append(r.Traps, t)
+	r.trapped = true
+}
+
+// wroteCSR returns true if the instruction has written one of the CSRs.
+func (r *Retire) wroteCSR(reg ...uint) bool {
+	for _, v := range r.CSR {
+		for _, x := range reg {
+			if v.Reg == x {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trapCSR are the CSRs written by a trap to each mode.
+var trapCSR = map[csr.Mode][]uint{
+	csr.ModeU: {csr.USTATUS, csr.UEPC, csr.UCAUSE, csr.UTVAL},
+	csr.ModeS: {csr.SSTATUS, csr.SEPC, csr.SCAUSE, csr.STVAL},
+	csr.ModeM: {csr.MSTATUS, csr.MEPC, csr.MCAUSE, csr.MTVAL},
+}
+
+// trapWrites returns the CSR writes of a trap to the current mode.
+func (m *RV) trapWrites() []RegWrite {
+	x := []RegWrite{}
+	for _, reg := range trapCSR[m.CSR.GetMode()] {
+		if val, err := m.CSR.Rd(reg); err == nil {
+			x = append(x, RegWrite{reg, val})
+		}
+	}
+	return x
+}
+
+// retireFlags records an implicit fflags update (E.g. by a float instruction).
+func (m *RV) retireFlags(fflags uint64, ok bool) {
+	x, err := m.CSR.Rd(csr.FFLAGS)
+	if !ok || err != nil || x == fflags || m.retire.wroteCSR(csr.FFLAGS, csr.FCSR) {
+		return
+	}
+	m.retire.CSR = append(m.retire.CSR, RegWrite{csr.FFLAGS, x})
+}
+
+// memTrace records a memory data access.
+func (r *Retire) memTrace(va, size uint, access mem.Attribute, val uint64) {
+	if access == mem.AttrW {
+		r.Wr = append(r.Wr, MemAccess{va, size, val})
+	} else {
+		r.Rd = append(r.Rd, MemAccess{va, size, val})
+	}
+}
+
+//-----------------------------------------------------------------------------
+
+// hexValue returns a fixed width hex string for a value of n bits.
+func hexValue(n uint, val uint64) string {
+	return fmt.Sprintf("0x%0*x", n/4, val)
+}
+
+// spikeTraps are the Spike exception names.
+var spikeTraps = map[csr.ECode]string{
+	csr.ExInsAddrMisaligned:         "trap_instruction_address_misaligned",
+	csr.ExInsAccessFault:            "trap_instruction_access_fault",
+	csr.ExInsIllegal:                "trap_illegal_instruction",
+	csr.ExBreakpoint:                "trap_breakpoint",
+	csr.ExLoadAddrMisaligned:        "trap_load_address_misaligned",
+	csr.ExLoadAccessFault:           "trap_load_access_fault",
+	csr.ExStoreAddrMisaligned:       "trap_store_address_misaligned",
+	csr.ExStoreAccessFault:          "trap_store_access_fault",
+	csr.ExEnvCallFromUserMode:       "trap_user_ecall",
+	csr.ExEnvCallFromSupervisorMode: "trap_supervisor_ecall",
+	csr.ExEnvCallFromMachineMode:    "trap_machine_ecall",
+	csr.ExInsPageFault:              "trap_instruction_page_fault",
+	csr.ExLoadPageFault:             "trap_load_page_fault",
+	csr.ExStorePageFault:            "trap_store_page_fault",
+}
+
+// TrapName returns the Spike name of a trap.
+func TrapName(t *Trap) string {
+	if t.Interrupt {
+		return fmt.Sprintf("interrupt #%d", t.Cause)
+	}
+	if s, ok := spikeTraps[csr.ECode(t.Cause)]; ok {
+		return s
+	}
+	return fmt.Sprintf("trap #%d", t.Cause)
+}
+
+// trapString returns the Spike log string (spike -l) for a trap.
+// The CSR writes of the trap are on an additional line.
+func trapString(t *Trap, hart, xlen uint) string {
+	s := fmt.Sprintf("core%4d: exception %s, epc %s", hart, TrapName(t), hexValue(xlen, t.EPC))
+	if t.Tval != 0 {
+		s += fmt.Sprintf("\ncore%4d:           tval %s", hart, hexValue(xlen, t.Tval))
+	}
+	if len(t.CSR) != 0 {
+		s += fmt.Sprintf("\ncore%4d:          ", hart)
+		for _, v := range t.CSR {
+			s += fmt.Sprintf(" c%d_%s %s", v.Reg, csr.Name(v.Reg), hexValue(xlen, v.Val))
+		}
+	}
+	return s
+}
+
+// retireString returns the Spike commit log string for a retire record.
+// Traps are on the lines before the instruction.
+func retireString(r *Retire, hart, xlen, flen uint) string {
+	s := ""
+	for i := range r.Traps {
+		s += trapString(&r.Traps[i], hart, xlen) + "\n"
+	}
+	s += fmt.Sprintf("core%4d: %d %s", hart, r.Mode, hexValue(xlen, r.PC))
+	if r.Ins&3 == 3 {
+		s += fmt.Sprintf(" (%s)", hexValue(32, uint64(r.Ins)))
+	} else {
+		s += fmt.Sprintf(" (%s)", hexValue(16, uint64(r.Ins)))
+	}
+	for _, v := range r.X {
+		s += fmt.Sprintf(" x%-2d %s", v.Reg, hexValue(xlen, v.Val))
+	}
+	for _, v := range r.F {
+		s += fmt.Sprintf(" f%-2d %s", v.Reg, hexValue(flen, v.Val))
+	}
+	for _, v := range r.CSR {
+		s += fmt.Sprintf(" c%d_%s %s", v.Reg, csr.Name(v.Reg), hexValue(xlen, v.Val))
+	}
+	for _, v := range r.Rd {
+		s += fmt.Sprintf(" mem %s", hexValue(xlen, uint64(v.Adr)))
+	}
+	for _, v := range r.Wr {
+		s += fmt.Sprintf(" mem %s %s", hexValue(xlen, uint64(v.Adr)), hexValue(v.Size*8, v.Val))
+	}
+	return s
+}
+
+//-----------------------------------------------------------------------------
+
+// flen returns the float register length.
+func (m *RV) flen() uint {
+	if m.isa.GetExtensions()&csr.IsaExtD != 0 {
+		return 64
+	}
+	return 32
+}
+
+// SetRetire sets a callback for retired instructions (nil for none).
+func (m *RV) SetRetire(fn RetireFunc) {
+	m.retFn = fn
+	if fn == nil {
+		m.retire = nil
+		m.Mem.SetTracer(nil)
+		return
+	}
+	m.retire = &Retire{}
+	m.Mem.SetTracer(m.retire.memTrace)
+}
+
+// GetRetire returns the callback for retired instructions.
+func (m *RV) GetRetire() RetireFunc {
+	return m.retFn
+}
+
+// RetireFuncs returns a callback that calls each of the (non-nil) callbacks in turn.
+func RetireFuncs(fn ...RetireFunc) RetireFunc {
+	var fns []RetireFunc
+	for _, f := range fn {
+		if f != nil {
+			fns = append(fns, f)
+		}
+	}
+	switch len(fns) {
+	case 0:
+		return nil
+	case 1:
+		return fns[0]
+	}
+	return func(r *Retire) {
+		for _, f := range fns {
+			f(r)
+		}
+	}
+}
+
+// RetireString returns the Spike commit log string for a retire record.
+func (m *RV) RetireString(r *Retire) string {
+	return retireString(r, 0, m.xlen, m.flen())
+}
+
+//-----------------------------------------------------------------------------
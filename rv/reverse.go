@@ -0,0 +1,515 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Reverse Execution
+
+An undo log records the old values of the registers, CSRs, memory,
+device states and break point skip states changed by each instruction. Stepping backwards applies the undo records
+in reverse order.
+
+The undo log is bounded by a memory budget. The oldest records are dropped
+when the budget is exceeded. Periodic checkpoints of the machine state let
+us go back further: the machine is restored to the nearest checkpoint and
+re-executed forwards (the emulation is deterministic) to rebuild the undo
+log.
+
+Notes:
+
+A device state is saved before the instruction accesses the device
+registers, and all the device states are saved before the devices are
+polled. Re-execution would repeat the device I/O (E.g. console input and
+output), so there are no checkpoints when the machine has devices, pollers
+or host call handlers (ecall, SBI, semihosting, HTIF) and the history is
+limited to the undo log.
+Cache and branch prediction statistics are not undone.
+State changes made outside of instruction execution (E.g. the cli) are not logged.
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+// ReverseConfig is the reverse execution configuration.
+type ReverseConfig struct {
+	Budget   uint   // memory budget in bytes
+	Interval uint64 // instructions between checkpoints (0 = no checkpoints)
+}
+
+// ReverseArg converts a "budget[,interval=n]" string (budget in MiB)
+// (eg: "64,interval=100000") to a reverse execution configuration.
+func ReverseArg(arg string) (*ReverseConfig, error) {
+	x := strings.Split(arg, ",")
+	n, err := strconv.ParseUint(x[0], 0, 16)
+	if err != nil || n == 0 {
+		return nil, fmt.Errorf("reverse budget \"%s\" is not valid", x[0])
+	}
+	cfg := &ReverseConfig{
+		Budget:   uint(n) << 20,
+		Interval: 100000,
+	}
+	for _, s := range x[1:] {
+		kv := strings.Split(s, "=")
+		if len(kv) != 2 || kv[0] != "interval" {
+			return nil, fmt.Errorf("reverse option \"%s\" is not valid", s)
+		}
+		n, err := strconv.ParseUint(kv[1], 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("reverse option \"%s\" is not valid", s)
+		}
+		cfg.Interval = n
+	}
+	return cfg, nil
+}
+
+//-----------------------------------------------------------------------------
+
+// regUndo is the old value of a register.
+type regUndo struct {
+	reg uint
+	val uint64
+}
+
+// memUndo is the old contents of memory.
+type memUndo struct {
+	pa  uint
+	old []uint8
+}
+
+// devUndo is the old state of a device.
+type devUndo struct {
+	d     mem.DeviceState
+	state []byte
+}
+
+// undoEntry records the state changed by a single instruction.
+type undoEntry struct {
+	pc       uint64
+	lastPC   uint64
+	resAdr   uint
+	resValid bool
+	cycle    uint64
+	instret  uint64
+	x        []regUndo
+	f        []regUndo
+	mem      []memUndo
+	dev      []devUndo
+	bp       []*mem.BreakPoint // break points with a cleared skip state
+	csr      *csr.Snapshot     // old CSR state (nil if unchanged)
+	brk      bool              // the instruction hit a break point
+}
+
+// entrySize is the overhead of an undo entry (approximate bytes).
+const entrySize = 160
+
+// size returns the approximate memory usage of the entry.
+func (e *undoEntry) size() uint {
+	n := uint(entrySize + 16*(len(e.x)+len(e.f)+len(e.bp)))
+	for _, v := range e.mem {
+		n += 32 + uint(len(v.old))
+	}
+	for _, v := range e.dev {
+		n += 32 + uint(len(v.state))
+	}
+	if e.csr != nil {
+		n += 64 + 8*uint(len(e.csr.Regs))
+	}
+	return n
+}
+
+// changed returns true if the instruction changed the machine state.
+func (e *undoEntry) changed(m *RV) bool {
+	cycle, instret := m.CSR.Counters()
+	return e.pc != m.PC || len(e.x) != 0 || len(e.f) != 0 || len(e.mem) != 0 ||
+		len(e.dev) != 0 || len(e.bp) != 0 || e.csr != nil || e.cycle != cycle || e.instret != instret
+}
+
+// reverseCheckpoint is a checkpoint taken during recording.
+type reverseCheckpoint struct {
+	n    uint64      // instruction number
+	ck   *Checkpoint // machine state
+	size uint        // approximate bytes
+}
+
+//-----------------------------------------------------------------------------
+
+// Reverse is the reverse execution state.
+type Reverse struct {
+	cfg    ReverseConfig
+	log    []*undoEntry         // undo log (oldest first)
+	ck     []*reverseCheckpoint // checkpoints (oldest first)
+	size   uint                 // memory usage of the log and checkpoints
+	n      uint64               // number of recorded instructions
+	cur    *undoEntry           // entry for the current instruction
+	shadow *csr.Snapshot        // CSR state before the current instruction
+}
+
+// NewReverse returns a reverse execution recorder.
+func NewReverse(cfg *ReverseConfig) *Reverse {
+	return &Reverse{cfg: *cfg}
+}
+
+// SetReverse sets the reverse execution recorder (nil to remove).
+// It is an error if a device state can't be saved.
+func (m *RV) SetReverse(r *Reverse) error {
+	if r == nil {
+		m.rev = nil
+		m.Mem.SetUndo(nil)
+		m.Mem.SetDeviceUndo(nil)
+		m.Mem.SetBreakPointUndo(nil)
+		return nil
+	}
+	_, err := m.Mem.SaveDevices()
+	if err != nil {
+		return err
+	}
+	m.rev = r
+	m.Mem.SetUndo(func(pa uint, old []uint8) {
+		if e := r.entry(); e != nil {
+			e.mem = append(e.mem, memUndo{pa, old})
+			if e != r.cur {
+				r.size += 32 + uint(len(old))
+			}
+		}
+	})
+	m.Mem.SetDeviceUndo(r.saveDevice)
+	m.Mem.SetBreakPointUndo(func(bp *mem.BreakPoint) {
+		if e := r.entry(); e != nil {
+			e.bp = append(e.bp, bp)
+			if e != r.cur {
+				r.size += 16
+			}
+		}
+	})
+	r.reset(m)
+	return nil
+}
+
+// replayable returns true if the machine can be re-executed from a checkpoint.
+// This is checked as we record, devices may be added after SetReverse.
+func (m *RV) replayable() bool {
+	// re-execution would repeat the device I/O and the host calls
+	return len(m.Mem.Devices()) == 0 && len(m.poll) == 0 &&
+		m.ecall == nil && m.sbi == nil && m.semihost == nil
+}
+
+// reset discards the recorded history.
+func (r *Reverse) reset(m *RV) {
+	r.log = nil
+	r.ck = nil
+	r.size = 0
+	r.n = 0
+	r.cur = nil
+	r.shadow = m.CSR.Snapshot()
+}
+
+// start returns the earliest instruction number we can go back to.
+func (r *Reverse) start() uint64 {
+	n := r.n - uint64(len(r.log))
+	if len(r.ck) != 0 && r.ck[0].n < n {
+		n = r.ck[0].n
+	}
+	return n
+}
+
+// String returns the reverse execution status.
+func (r *Reverse) String() string {
+	return fmt.Sprintf("%d instructions recorded, %d undo records, %d checkpoints, %d/%d KiB",
+		r.n-r.start(), len(r.log), len(r.ck), r.size>>10, r.cfg.Budget>>10)
+}
+
+//-----------------------------------------------------------------------------
+
+// begin recording an instruction.
+func (r *Reverse) begin(m *RV) {
+	if r.cfg.Interval != 0 && r.n%r.cfg.Interval == 0 && m.replayable() {
+		n := len(r.ck)
+		if n == 0 || r.ck[n-1].n != r.n {
+			r.addCheckpoint(m)
+		}
+	}
+	m.Mem.WatchHit()
+	cycle, instret := m.CSR.Counters()
+	r.cur = &undoEntry{
+		pc:       m.PC,
+		lastPC:   m.lastPC,
+		resAdr:   m.resAdr,
+		resValid: m.resValid,
+		cycle:    cycle,
+		instret:  instret,
+	}
+}
+
+// end recording an instruction.
+func (r *Reverse) end(m *RV, err error) {
+	e := r.cur
+	r.cur = nil
+	if m.CSR.Changed(r.shadow) {
+		e.csr = r.shadow
+		r.shadow = m.CSR.Snapshot()
+	}
+	if !e.changed(m) {
+		return
+	}
+	e.brk = isBreak(err) || m.Mem.WatchHit()
+	r.log = append(r.log, e)
+	r.size += e.size()
+	r.n++
+	r.trim()
+}
+
+// entry returns the undo entry for a memory or device change.
+// A change between instructions (E.g. a debugger write) is undone
+// with the last recorded instruction.
+func (r *Reverse) entry() *undoEntry {
+	if r.cur != nil {
+		return r.cur
+	}
+	if len(r.log) != 0 {
+		return r.log[len(r.log)-1]
+	}
+	return nil
+}
+
+// saveDevice saves the device state (once per instruction).
+func (r *Reverse) saveDevice(d *mem.Device) {
+	e := r.entry()
+	if e == nil {
+		return
+	}
+	ds, ok := d.IO().(mem.DeviceState)
+	if !ok {
+		return
+	}
+	for _, v := range e.dev {
+		if v.d == ds {
+			return
+		}
+	}
+	// SetReverse has checked the state can be saved
+	state, _ := ds.SaveState()
+	e.dev = append(e.dev, devUndo{ds, state})
+	if e != r.cur {
+		r.size += 32 + uint(len(state))
+	}
+}
+
+// poll saves the device states before the devices are polled.
+func (r *Reverse) poll(m *RV) {
+	for _, d := range m.Mem.Devices() {
+		r.saveDevice(d)
+	}
+}
+
+// addCheckpoint adds a checkpoint of the current machine state.
+func (r *Reverse) addCheckpoint(m *RV) {
+	ck, err := m.Checkpoint()
+	if err != nil {
+		// SetReverse has checked the checkpoint can be taken
+		return
+	}
+	size := uint(entrySize)
+	for _, s := range ck.Mem.Sections {
+		size += uint(len(s.Data))
+	}
+	r.ck = append(r.ck, &reverseCheckpoint{r.n, ck, size})
+	r.size += size
+	r.trim()
+}
+
+// trim the history to the memory budget.
+func (r *Reverse) trim() {
+	for r.size > r.cfg.Budget {
+		logStart := r.n - uint64(len(r.log))
+		nck := len(r.ck)
+		if len(r.log) != 0 && (nck == 0 || nck == 1 || logStart < r.ck[nck-1].n) {
+			// drop the oldest undo record
+			r.size -= r.log[0].size()
+			r.log[0] = nil
+			r.log = r.log[1:]
+		} else if nck > 1 {
+			// drop the oldest checkpoint
+			r.size -= r.ck[0].size
+			r.ck[0] = nil
+			r.ck = r.ck[1:]
+		} else {
+			break
+		}
+	}
+}
+
+// isBreak returns true if the error is a memory break point.
+func isBreak(err error) bool {
+	e, ok := err.(*Error)
+	if !ok || e.Type != ErrMemory {
+		return false
+	}
+	me, ok := e.err.(*mem.Error)
+	return ok && me.Type&mem.ErrBreak != 0
+}
+
+//-----------------------------------------------------------------------------
+
+// undo applies an undo entry.
+func (m *RV) undo(e *undoEntry) {
+	for i := len(e.mem) - 1; i >= 0; i-- {
+		m.Mem.Patch(e.mem[i].pa, e.mem[i].old)
+	}
+	for i := len(e.dev) - 1; i >= 0; i-- {
+		e.dev[i].d.RestoreState(e.dev[i].state)
+	}
+	for _, bp := range e.bp {
+		// the break point may have been removed
+		m.Mem.SkipBreakPoint(bp.Name, bp.Addr, bp.Access)
+	}
+	for i := len(e.f) - 1; i >= 0; i-- {
+		m.f[e.f[i].reg] = e.f[i].val
+	}
+	for i := len(e.x) - 1; i >= 0; i-- {
+		m.x[e.x[i].reg] = e.x[i].val
+	}
+	if e.csr != nil {
+		m.CSR.Restore(e.csr)
+		m.rev.shadow = e.csr
+	}
+	m.CSR.SetCounters(e.cycle, e.instret)
+	m.PC = e.pc
+	m.lastPC = e.lastPC
+	m.resAdr = e.resAdr
+	m.resValid = e.resValid
+}
+
+// replay restores the machine to the last checkpoint before instruction n and
+// re-executes forwards to instruction n (rebuilding the undo log).
+func (m *RV) replay(n uint64) error {
+	r := m.rev
+	var rc *reverseCheckpoint
+	for _, v := range r.ck {
+		if v.n < n {
+			rc = v
+		}
+	}
+	if rc == nil {
+		return fmt.Errorf("no checkpoint before instruction %d", n)
+	}
+	c := rc.ck
+	err := m.CSR.Restore(c.CSR)
+	if err != nil {
+		return err
+	}
+	err = m.Mem.RestoreSections(c.Mem)
+	if err != nil {
+		return err
+	}
+	m.x = c.X
+	m.f = c.F
+	m.PC = c.PC
+	m.resAdr = c.ResAdr
+	m.resValid = c.ResValid
+	m.lastPC = 0
+	// discard the newer history
+	for len(r.ck) != 0 && r.ck[len(r.ck)-1] != rc {
+		r.size -= r.ck[len(r.ck)-1].size
+		r.ck = r.ck[:len(r.ck)-1]
+	}
+	for _, e := range r.log {
+		r.size -= e.size()
+	}
+	r.log = nil
+	r.n = rc.n
+	r.shadow = m.CSR.Snapshot()
+	// re-execute without break points or side effects
+	retire, predict := m.retire, m.predict
+	m.retire, m.predict = nil, nil
+	m.Mem.EnableBreakPoints(false)
+	defer func() {
+		m.retire, m.predict = retire, predict
+		m.Mem.EnableBreakPoints(true)
+	}()
+	for r.n < n {
+		k := r.n
+		m.record()
+		if r.n == k {
+			return fmt.Errorf("replay stopped at instruction %d (pc %x)", k, m.PC)
+		}
+	}
+	return nil
+}
+
+// reverseStep steps the emulation backwards by one instruction.
+// It returns the undo entry for the instruction.
+func (m *RV) reverseStep() (*undoEntry, error) {
+	r := m.rev
+	if r == nil {
+		return nil, fmt.Errorf("reverse execution is not enabled")
+	}
+	if r.n == r.start() {
+		return nil, fmt.Errorf("at the start of the reverse history")
+	}
+	if len(r.log) == 0 {
+		err := m.replay(r.n)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e := r.log[len(r.log)-1]
+	r.log[len(r.log)-1] = nil
+	r.log = r.log[:len(r.log)-1]
+	r.size -= e.size()
+	r.n--
+	m.undo(e)
+	// drop checkpoints after this point
+	for len(r.ck) != 0 && r.ck[len(r.ck)-1].n > r.n {
+		r.size -= r.ck[len(r.ck)-1].size
+		r.ck = r.ck[:len(r.ck)-1]
+	}
+	return e, nil
+}
+
+// ReverseStep steps the emulation backwards by one instruction.
+func (m *RV) ReverseStep() error {
+	_, err := m.reverseStep()
+	return err
+}
+
+// ReverseContinue steps the emulation backwards until the previous break point
+// or watch point hit. It returns the number of instructions stepped back.
+func (m *RV) ReverseContinue() (uint64, error) {
+	var n uint64
+	for {
+		e, err := m.reverseStep()
+		if err != nil {
+			return n, err
+		}
+		n++
+		if e.brk || m.Mem.BreakPointAt(uint(m.PC), mem.AttrX) {
+			return n, nil
+		}
+		// watch points added after the write was recorded
+		for _, v := range e.mem {
+			if m.Mem.BreakPointAt(v.pa, mem.AttrW) {
+				return n, nil
+			}
+		}
+	}
+}
+
+// ReverseStatus returns the reverse execution status.
+func (m *RV) ReverseStatus() string {
+	if m.rev == nil {
+		return "reverse execution is not enabled"
+	}
+	return m.rev.String()
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,205 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Reverse Execution Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/deadsy/riscv/mem"
+)
+
+//-----------------------------------------------------------------------------
+
+// machineState returns a string for the machine state.
+func machineState(m *RV) string {
+	v, _ := m.Mem.Rd32(0x400)
+	return fmt.Sprintf("%x %x\n%s\n%s\n%s", m.PC, v, m.IntRegs(), m.FloatRegs(), m.CSR.Display())
+}
+
+func testReverse(t *testing.T, cfg *ReverseConfig) {
+	cpu := newCheckpointCPU(t)
+	err := cpu.SetReverse(NewReverse(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := []string{machineState(cpu)}
+	for i := 0; i < 100; i++ {
+		err := cpu.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		state = append(state, machineState(cpu))
+	}
+	for i := len(state) - 2; i >= 0; i-- {
+		err := cpu.ReverseStep()
+		if err != nil {
+			t.Fatalf("step back to %d: %s", i, err)
+		}
+		s := machineState(cpu)
+		if s != state[i] {
+			t.Fatalf("step back to %d: state differs\n%s\n%s", i, s, state[i])
+		}
+	}
+	if cpu.ReverseStep() == nil {
+		t.Errorf("expected an error at the start of the history")
+	}
+}
+
+func Test_Reverse(t *testing.T) {
+	// undo log only
+	testReverse(t, &ReverseConfig{Budget: 1 << 20})
+	// checkpoints and a small undo log
+	testReverse(t, &ReverseConfig{Budget: 40 << 10, Interval: 16})
+}
+
+// counterDevice is a device with a counter that counts up as it is read.
+type counterDevice struct {
+	n uint8
+}
+
+func (d *counterDevice) Rd(ofs, size uint) uint64 {
+	d.n++
+	return uint64(d.n)
+}
+
+func (d *counterDevice) Wr(ofs, size uint, val uint64) {
+	d.n = uint8(val)
+}
+
+func (d *counterDevice) SaveState() ([]byte, error) {
+	return []byte{d.n}, nil
+}
+
+func (d *counterDevice) RestoreState(buf []byte) error {
+	if len(buf) != 1 {
+		return fmt.Errorf("bad state")
+	}
+	d.n = buf[0]
+	return nil
+}
+
+// plainDevice is a device without a saved state.
+type plainDevice struct{}
+
+func (d *plainDevice) Rd(ofs, size uint) uint64 {
+	return 0
+}
+
+func (d *plainDevice) Wr(ofs, size uint, val uint64) {
+}
+
+// newDeviceCPU returns a cpu with a test program that reads a counter device.
+func newDeviceCPU(t *testing.T, d mem.DeviceIO) *RV {
+	cpu := newCheckpointCPU(t)
+	cpu.Mem.Add(mem.NewDevice("counter", 0x300, 0x10, d))
+	prog := []string{
+		"lw a0,0x300(zero)",
+		"jal zero,1000",
+	}
+	adr := uint(0x1000)
+	for _, s := range prog {
+		n, err := cpu.Assemble(adr, s)
+		if err != nil {
+			t.Fatalf("\"%s\" %s", s, err)
+		}
+		adr += n
+	}
+	return cpu
+}
+
+func Test_ReverseDevice(t *testing.T) {
+	d := &counterDevice{}
+	cpu := newDeviceCPU(t, d)
+	cpu.AddPoller(func() { d.n += 100 })
+	err := cpu.SetReverse(NewReverse(&ReverseConfig{Budget: 1 << 20, Interval: 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := []uint8{d.n}
+	for i := 0; i < 20; i++ {
+		err := cpu.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		state = append(state, d.n)
+	}
+	if state[1] != 101 || state[20] != 110 {
+		t.Fatalf("bad device state %v", state)
+	}
+	for i := len(state) - 2; i >= 0; i-- {
+		err := cpu.ReverseStep()
+		if err != nil {
+			t.Fatalf("step back to %d: %s", i, err)
+		}
+		if d.n != state[i] {
+			t.Fatalf("step back to %d: device state is %d, expected %d", i, d.n, state[i])
+		}
+	}
+
+	// a device without a saved state
+	cpu = newDeviceCPU(t, &plainDevice{})
+	if cpu.SetReverse(NewReverse(&ReverseConfig{Budget: 1 << 20})) == nil {
+		t.Errorf("expected an error for a device without a state")
+	}
+}
+
+func Test_ReverseContinue(t *testing.T) {
+	cpu := newCheckpointCPU(t)
+	err := cpu.SetReverse(NewReverse(&ReverseConfig{Budget: 1 << 20}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		cpu.Run()
+	}
+	// watch the store
+	cpu.Mem.AddBreakPoint("data", 0x400, mem.AttrW, nil)
+	n, err := cpu.ReverseContinue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// instruction 18 is the last store
+	if n != 3 || cpu.PC != 0x1004 {
+		t.Errorf("stopped after %d instructions at %x", n, cpu.PC)
+	}
+}
+
+func Test_ReverseSkip(t *testing.T) {
+	cpu := newCheckpointCPU(t)
+	err := cpu.SetReverse(NewReverse(&ReverseConfig{Budget: 1 << 20}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// skip the first store
+	cpu.Mem.AddBreakPoint("data", 0x400, mem.AttrW, nil)
+	cpu.Mem.SkipBreakPoint("data", 0x400, mem.AttrW)
+	skip := cpu.Mem.DisplayBreakPoints()
+	for i := 0; i < 2; i++ {
+		err := cpu.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cpu.Mem.DisplayBreakPoints() == skip {
+		t.Fatalf("the skip state was not cleared")
+	}
+	// stepping back over the store restores the skip state
+	cpu.ReverseStep()
+	if s := cpu.Mem.DisplayBreakPoints(); s != skip {
+		t.Errorf("got \"%s\", expected \"%s\"", s, skip)
+	}
+	// and the store doesn't break
+	err = cpu.Run()
+	if err != nil {
+		t.Errorf("the skipped store triggered %s", err)
+	}
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,71 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Semihosting
+
+A semihosting call is an ebreak within a magic instruction sequence:
+
+slli x0, x0, 0x1f
+ebreak
+srai x0, x0, 7
+
+The operation number is in a0, the parameter (or parameter block address)
+is in a1 and the result is returned in a0. An ebreak without the magic
+sequence (or a c.ebreak) is a normal breakpoint exception.
+
+See: https://github.com/riscv-non-isa/riscv-semihosting
+
+*/
+//-----------------------------------------------------------------------------
+
+package rv
+
+import "github.com/deadsy/riscv/mem"
+
+//-----------------------------------------------------------------------------
+
+// Semihosting instruction sequence.
+const (
+	shEntry = 0x01f01013 // slli x0, x0, 0x1f
+	shExit  = 0x40705013 // srai x0, x0, 7
+)
+
+// Semihost handles semihosting calls.
+type Semihost interface {
+	Call(m *RV) error
+}
+
+// SetSemihost sets the semihosting call handler.
+func (m *RV) SetSemihost(sh Semihost) {
+	m.semihost = sh
+}
+
+// rdCode reads a 32-bit code word from executable memory.
+// There are no break point side effects.
+func (m *RV) rdCode(adr uint) (uint32, bool) {
+	if m.Mem.HostCheck(adr, 4, mem.AttrX, true) != nil {
+		return 0, false
+	}
+	var val uint32
+	for i := uint(0); i < 4; i++ {
+		x, err := m.Mem.DebugRd8(adr+i, true)
+		if err != nil {
+			return 0, false
+		}
+		val |= uint32(x) << (8 * i)
+	}
+	return val, true
+}
+
+// isSemihost returns true if the ebreak at the PC is a semihosting call.
+func (m *RV) isSemihost() bool {
+	pc := uint(m.PC)
+	if pc < 4 {
+		return false
+	}
+	x0, ok0 := m.rdCode(pc - 4)
+	x1, ok1 := m.rdCode(pc + 4)
+	return ok0 && ok1 && x0 == shEntry && x1 == shExit
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,315 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Supervisor Binary Interface
+
+A built-in SBI implementation, so S-mode kernels can run without loading
+M-mode firmware (E.g. OpenSBI). An ECALL from S-mode is handled here.
+
+See:
+
+https://github.com/riscv-non-isa/riscv-sbi-doc
+
+The extension id is passed in a7 and the function id in a6.
+Arguments are passed in a0..a5.
+An error code is returned in a0 and a value in a1.
+Legacy extensions return a single value in a0.
+
+The emulator has a single hart (hartid 0).
+
+*/
+//-----------------------------------------------------------------------------
+
+package sbi
+
+import (
+	"fmt"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/device"
+	"github.com/deadsy/riscv/replay"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// SBI error codes.
+const (
+	errSuccess          = 0
+	errFailed           = -1
+	errNotSupported     = -2
+	errInvalidParam     = -3
+	errDenied           = -4
+	errInvalidAddress   = -5
+	errAlreadyAvailable = -6
+)
+
+// Extension ids.
+const (
+	extLegacySetTimer     = 0x00
+	extLegacyPutchar      = 0x01
+	extLegacyGetchar      = 0x02
+	extLegacyClearIPI     = 0x03
+	extLegacySendIPI      = 0x04
+	extLegacyFenceI       = 0x05
+	extLegacySfenceVMA    = 0x06
+	extLegacySfenceASID   = 0x07
+	extLegacyShutdown     = 0x08
+	extBase               = 0x10
+	extTime               = 0x54494d45 // "TIME"
+	extIPI                = 0x735049   // "sPI"
+	extRfence             = 0x52464e43 // "RFNC"
+	extHSM                = 0x48534d   // "HSM"
+	extSystemReset        = 0x53525354 // "SRST"
+	specVersion           = 1 << 24    // v1.0
+	implID                = 0x7276     // not a registered implementation id
+	implVersion           = 1
+	hsmStarted            = 0
+	hsmSuspendRetentive   = 0
+	srstShutdown          = 0
+	srstColdReboot        = 1
+	srstWarmReboot        = 2
+	srstReasonSystemFault = 1
+)
+
+//-----------------------------------------------------------------------------
+
+// Config is the SBI configuration.
+type Config struct {
+	Console *device.Console // console (default os.Stdin and os.Stdout)
+	Inputs  *replay.Log     // record/replay of nondeterministic inputs (optional)
+}
+
+// SBI is a supervisor binary interface object.
+type SBI struct {
+	cfg Config
+}
+
+// NewSBI returns an SBI object.
+func NewSBI(cfg Config) *SBI {
+	if cfg.Console == nil {
+		cfg.Console = device.NewConsole(nil, nil)
+	}
+	return &SBI{cfg: cfg}
+}
+
+//-----------------------------------------------------------------------------
+
+// Boot starts a kernel in supervisor mode (as the firmware would).
+// Exceptions (other than S/M-mode ecalls) and supervisor interrupts are
+// delegated to S-mode.
+func Boot(m *rv.RV, entry, dtb uint64) {
+	medeleg := uint64(0xffff) &^ (1<<csr.ExEnvCallFromSupervisorMode | 1<<csr.ExEnvCallFromMachineMode)
+	mideleg := uint64(1<<csr.IntSupervisorSoftware | 1<<csr.IntSupervisorTimer | 1<<csr.IntSupervisorExternal)
+	m.CSR.DebugWr(csr.MEDELEG, medeleg)
+	m.CSR.DebugWr(csr.MIDELEG, mideleg)
+	m.CSR.SetMode(csr.ModeS)
+	m.WrX(rv.RegA0, 0)
+	m.WrX(rv.RegA1, dtb)
+	m.PC = entry
+}
+
+//-----------------------------------------------------------------------------
+
+// getchar returns a console input character (or -1 if there is none).
+func (s *SBI) getchar() int64 {
+	buf := s.cfg.Console.Input(s.cfg.Inputs, "sbi.getchar", 1)
+	if len(buf) == 0 {
+		return -1
+	}
+	return int64(buf[0])
+}
+
+// hartMask checks a hart mask and returns true if it selects hart 0.
+func hartMask(m *rv.RV, mask, base uint64) (bool, int64) {
+	if base == allOnes(m) {
+		// all harts
+		return true, errSuccess
+	}
+	if base != 0 {
+		if mask != 0 {
+			return false, errInvalidParam
+		}
+		return false, errSuccess
+	}
+	if mask>>1 != 0 {
+		return false, errInvalidParam
+	}
+	return mask&1 != 0, errSuccess
+}
+
+// allOnes returns an XLEN all ones value.
+func allOnes(m *rv.RV) uint64 {
+	if m.Xlen() == 32 {
+		return 0xffffffff
+	}
+	return ^uint64(0)
+}
+
+// timerArg returns the 64-bit timer value argument.
+func timerArg(m *rv.RV) uint64 {
+	if m.Xlen() == 32 {
+		return m.RdX(rv.RegA1)<<32 | m.RdX(rv.RegA0)
+	}
+	return m.RdX(rv.RegA0)
+}
+
+// probe returns true if an extension is supported.
+func probe(ext uint64) bool {
+	switch ext {
+	case extBase, extTime, extIPI, extRfence, extHSM, extSystemReset:
+		return true
+	}
+	return ext <= extLegacyShutdown
+}
+
+//-----------------------------------------------------------------------------
+
+// legacy handles the legacy (v0.1) extensions.
+func (s *SBI) legacy(m *rv.RV, ext uint64) (int64, error) {
+	switch ext {
+	case extLegacySetTimer:
+		m.CSR.SetTimer(timerArg(m))
+	case extLegacyPutchar:
+		s.cfg.Console.Write([]byte{byte(m.RdX(rv.RegA0))})
+	case extLegacyGetchar:
+		return s.getchar(), nil
+	case extLegacyClearIPI:
+		m.CSR.SetPending(csr.IntSupervisorSoftware, false)
+	case extLegacySendIPI:
+		// a0 is the address of a hart mask (0 = all harts)
+		mask := uint64(1)
+		if adr := m.RdX(rv.RegA0); adr != 0 {
+			x, err := m.Mem.Rd8(uint(adr))
+			if err != nil {
+				return errInvalidAddress, nil
+			}
+			mask = uint64(x)
+		}
+		if mask&1 != 0 {
+			m.CSR.SetPending(csr.IntSupervisorSoftware, true)
+		}
+	case extLegacyFenceI, extLegacySfenceVMA, extLegacySfenceASID:
+		// single hart: nothing to do remotely
+	case extLegacyShutdown:
+		return 0, m.Exit(0)
+	}
+	return errSuccess, nil
+}
+
+// call handles the v0.2+ extensions and returns (error, value).
+func (s *SBI) call(m *rv.RV, ext, fid uint64) (int64, uint64, error) {
+	a0 := m.RdX(rv.RegA0)
+	a1 := m.RdX(rv.RegA1)
+	switch ext {
+
+	case extBase:
+		switch fid {
+		case 0: // get_spec_version
+			return errSuccess, specVersion, nil
+		case 1: // get_impl_id
+			return errSuccess, implID, nil
+		case 2: // get_impl_version
+			return errSuccess, implVersion, nil
+		case 3: // probe_extension
+			if probe(a0) {
+				return errSuccess, 1, nil
+			}
+			return errSuccess, 0, nil
+		case 4, 5, 6: // get_mvendorid, get_marchid, get_mimpid
+			x, _ := m.CSR.DebugRd(0xf11 + uint(fid) - 4)
+			return errSuccess, x, nil
+		}
+
+	case extTime:
+		if fid == 0 { // set_timer
+			m.CSR.SetTimer(timerArg(m))
+			return errSuccess, 0, nil
+		}
+
+	case extIPI:
+		if fid == 0 { // send_ipi
+			sel, rc := hartMask(m, a0, a1)
+			if sel {
+				m.CSR.SetPending(csr.IntSupervisorSoftware, true)
+			}
+			return rc, 0, nil
+		}
+
+	case extRfence:
+		switch fid {
+		case 0, 1, 2: // remote_fence_i, remote_sfence_vma, remote_sfence_vma_asid
+			// there are no caches or TLBs to flush
+			_, rc := hartMask(m, a0, a1)
+			return rc, 0, nil
+		}
+
+	case extHSM:
+		switch fid {
+		case 0: // hart_start
+			if a0 == 0 {
+				return errAlreadyAvailable, 0, nil
+			}
+			return errInvalidParam, 0, nil
+		case 1: // hart_stop
+			// stopping the only hart stops the emulation
+			return errSuccess, 0, m.Exit(0)
+		case 2: // hart_get_status
+			if a0 == 0 {
+				return errSuccess, hsmStarted, nil
+			}
+			return errInvalidParam, 0, nil
+		case 3: // hart_suspend
+			if uint32(a0) == hsmSuspendRetentive {
+				// resume on the next interrupt, as per WFI
+				return errSuccess, 0, nil
+			}
+			return errNotSupported, 0, nil
+		}
+
+	case extSystemReset:
+		if fid == 0 { // system_reset
+			switch uint32(a0) {
+			case srstShutdown:
+				if uint32(a1) == srstReasonSystemFault {
+					return errSuccess, 0, m.Exit(1)
+				}
+				return errSuccess, 0, m.Exit(0)
+			case srstColdReboot, srstWarmReboot:
+				// reset the cpu and devices after the ecall (the boot code runs again)
+				m.Reboot()
+				return errSuccess, 0, nil
+			}
+			return errInvalidParam, 0, nil
+		}
+	}
+
+	return errNotSupported, 0, nil
+}
+
+// Call handles an SBI call.
+func (s *SBI) Call(m *rv.RV) error {
+	ext := m.RdX(rv.RegA7)
+	if ext <= extLegacyShutdown {
+		rc, err := s.legacy(m, ext)
+		if err != nil {
+			return err
+		}
+		m.WrX(rv.RegA0, uint64(rc))
+		return nil
+	}
+	rc, val, err := s.call(m, ext, m.RdX(rv.RegA6))
+	if err != nil {
+		return err
+	}
+	m.WrX(rv.RegA0, uint64(rc))
+	m.WrX(rv.RegA1, val)
+	return nil
+}
+
+// String returns a description of the SBI implementation.
+func (s *SBI) String() string {
+	return fmt.Sprintf("sbi v%d.%d", specVersion>>24, specVersion&0xffffff)
+}
+
+//-----------------------------------------------------------------------------
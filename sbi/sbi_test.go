@@ -0,0 +1,191 @@
+//-----------------------------------------------------------------------------
+/*
+
+SBI Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package sbi
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/deadsy/riscv/csr"
+	"github.com/deadsy/riscv/device"
+	"github.com/deadsy/riscv/machine"
+	"github.com/deadsy/riscv/machine/machinetest"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+const (
+	textBase    = 0x1000
+	handlerBase = 0x1100
+	dtbBase     = 0x2000
+)
+
+// newCPU returns a cpu with a nop and an ecall at textBase and a nop at handlerBase.
+func newCPU(t *testing.T, xlen uint) *rv.RV {
+	mc := machinetest.New(t, xlen,
+		machine.Region{Name: "text", Base: textBase, Size: 0x1000, Attr: "rx"},
+	)
+	machinetest.Assemble(t, mc.CPU, textBase, "addi zero,zero,0", "ecall")
+	machinetest.Assemble(t, mc.CPU, handlerBase, "addi zero,zero,0")
+	return mc.CPU
+}
+
+// sbi runs SBI calls.
+type sbi struct {
+	t   *testing.T
+	cpu *rv.RV
+}
+
+// call runs an SBI call and returns a0 and a1.
+func (x *sbi) call(ext, fid uint64, args ...uint64) (int64, uint64, error) {
+	m := x.cpu
+	m.PC = textBase
+	m.WrX(rv.RegA7, ext)
+	m.WrX(rv.RegA6, fid)
+	for i, v := range args {
+		m.WrX(rv.RegA0+uint(i), v)
+	}
+	for i := 0; i < 2; i++ {
+		err := m.Run()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if m.PC != textBase+8 {
+		x.t.Fatalf("pc is %x, expected %x", m.PC, textBase+8)
+	}
+	rc := int64(m.RdX(rv.RegA0))
+	if m.Xlen() == 32 {
+		rc = int64(int32(rc))
+	}
+	return rc, m.RdX(rv.RegA1), nil
+}
+
+// must runs an SBI call that should succeed.
+func (x *sbi) must(ext, fid uint64, args ...uint64) uint64 {
+	rc, val, err := x.call(ext, fid, args...)
+	if err != nil {
+		x.t.Fatal(err)
+	}
+	if rc != errSuccess {
+		x.t.Fatalf("sbi call %x/%d returned %d", ext, fid, rc)
+	}
+	return val
+}
+
+//-----------------------------------------------------------------------------
+
+func testSBI(t *testing.T, xlen uint) {
+	var out bytes.Buffer
+	cpu := newCPU(t, xlen)
+	cpu.SetSBI(NewSBI(Config{Console: device.NewConsole(&bytes.Buffer{}, &out)}))
+	x := &sbi{t, cpu}
+
+	// boot
+	Boot(cpu, textBase, dtbBase)
+	if cpu.CSR.GetMode() != csr.ModeS || cpu.RdX(rv.RegA0) != 0 || cpu.RdX(rv.RegA1) != dtbBase {
+		t.Fatalf("bad boot state")
+	}
+
+	// base extension
+	if x.must(extBase, 0) != specVersion {
+		t.Errorf("bad spec version")
+	}
+	if x.must(extBase, 3, extTime) != 1 || x.must(extBase, 3, 0x12345) != 0 {
+		t.Errorf("bad extension probe")
+	}
+	if rc, _, _ := x.call(0x12345, 0); rc != errNotSupported {
+		t.Errorf("unknown extension returned %d", rc)
+	}
+
+	// legacy console
+	x.call(extLegacyPutchar, 0, 'h')
+	x.call(extLegacyPutchar, 0, 'i')
+	if out.String() != "hi" {
+		t.Errorf("console output is \"%s\"", out.String())
+	}
+	if rc, _, _ := x.call(extLegacyGetchar, 0); rc != -1 {
+		t.Errorf("getchar returned %d", rc)
+	}
+
+	// ipi
+	x.must(extIPI, 0, 1, 0)
+	if !cpu.CSR.Pending(csr.IntSupervisorSoftware) {
+		t.Errorf("ipi is not pending")
+	}
+	x.call(extLegacyClearIPI, 0)
+	if rc, _, _ := x.call(extIPI, 0, 2, 0); rc != errInvalidParam {
+		t.Errorf("ipi to a bad hart returned %d", rc)
+	}
+	x.must(extRfence, 1, 0, allOnes(cpu))
+
+	// hart state management
+	if x.must(extHSM, 2, 0) != hsmStarted {
+		t.Errorf("hart 0 is not started")
+	}
+	if rc, _, _ := x.call(extHSM, 0, 0, textBase, 0); rc != errAlreadyAvailable {
+		t.Errorf("hart start returned %d", rc)
+	}
+
+	// timer
+	x.must(extTime, 0, ^uint64(0)>>1, 0)
+	if cpu.CSR.Pending(csr.IntSupervisorTimer) {
+		t.Errorf("timer is pending")
+	}
+	x.must(extTime, 0, 0, 0)
+	if !cpu.CSR.Pending(csr.IntSupervisorTimer) {
+		t.Errorf("timer is not pending")
+	}
+
+	// timer interrupt delivery
+	cpu.CSR.DebugWr(0x105, handlerBase)               // stvec
+	cpu.CSR.DebugWr(0x104, 1<<csr.IntSupervisorTimer) // sie
+	cpu.CSR.DebugWr(csr.SSTATUS, 2)                   // sstatus.SIE
+	cpu.PC = textBase
+	err := cpu.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cause, _ := cpu.CSR.DebugRd(0x142)
+	if cpu.PC != handlerBase+4 || cause != 1<<(xlen-1)|uint64(csr.IntSupervisorTimer) {
+		t.Errorf("timer interrupt not taken (pc %x, scause %x)", cpu.PC, cause)
+	}
+
+	// system reset
+	_, _, err = x.call(extSystemReset, 0, srstShutdown, srstReasonSystemFault)
+	e, ok := err.(*rv.Error)
+	if !ok || e.Type != rv.ErrExit || e.ExitStatus() != 1 {
+		t.Errorf("bad system reset %v", err)
+	}
+	reset := false
+	cpu.OnReset(func() { reset = true })
+	cpu.PC = textBase + 4 // ecall
+	cpu.WrX(rv.RegA7, extSystemReset)
+	cpu.WrX(rv.RegA6, 0)
+	cpu.WrX(rv.RegA0, srstWarmReboot)
+	cpu.WrX(rv.RegA1, 0)
+	err = cpu.Run()
+	if err != nil {
+		t.Errorf("reboot stopped the emulation: %v", err)
+	}
+	if !reset {
+		t.Errorf("reboot did not reset the cpu")
+	}
+}
+
+func Test_SBI32(t *testing.T) {
+	testSBI(t, 32)
+}
+
+func Test_SBI64(t *testing.T) {
+	testSBI(t, 64)
+}
+
+//-----------------------------------------------------------------------------
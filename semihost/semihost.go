@@ -0,0 +1,535 @@
+//-----------------------------------------------------------------------------
+/*
+
+RISC-V Semihosting Calls
+
+Semihosting calls (see rv/semihost.go) are dispatched to host operations.
+The parameter block fields are XLEN bits wide.
+
+File operations are confined to a sandbox root directory. A file name is
+relative to the root directory and can't escape it (see hostcall). The special file name
+":tt" is the console (stdin, stdout or stderr depending on the open mode).
+
+Nondeterministic inputs (file/console reads and clocks) go through the
+record/replay log (if there is one).
+
+See: https://github.com/ARM-software/abi-aa/blob/main/semihosting/semihosting.rst
+
+*/
+//-----------------------------------------------------------------------------
+
+package semihost
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/deadsy/riscv/device"
+	"github.com/deadsy/riscv/hostcall"
+	"github.com/deadsy/riscv/mem"
+	"github.com/deadsy/riscv/replay"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+// Semihosting operations.
+const (
+	sysOpen         = 0x01
+	sysClose        = 0x02
+	sysWriteC       = 0x03
+	sysWrite0       = 0x04
+	sysWrite        = 0x05
+	sysRead         = 0x06
+	sysIsTTY        = 0x09
+	sysSeek         = 0x0a
+	sysFlen         = 0x0c
+	sysClock        = 0x10
+	sysTime         = 0x11
+	sysErrno        = 0x13
+	sysGetCmdline   = 0x15
+	sysHeapInfo     = 0x16
+	sysExit         = 0x18
+	sysExitExtended = 0x20
+)
+
+// adpStoppedApplicationExit is the exit reason for a normal exit.
+const adpStoppedApplicationExit = 0x20026
+
+// open modes (fopen style)
+var openFlags = []int{
+	os.O_RDONLY,                             // r
+	os.O_RDONLY,                             // rb
+	os.O_RDWR,                               // r+
+	os.O_RDWR,                               // r+b
+	os.O_WRONLY | os.O_CREATE | os.O_TRUNC,  // w
+	os.O_WRONLY | os.O_CREATE | os.O_TRUNC,  // wb
+	os.O_RDWR | os.O_CREATE | os.O_TRUNC,    // w+
+	os.O_RDWR | os.O_CREATE | os.O_TRUNC,    // w+b
+	os.O_WRONLY | os.O_CREATE | os.O_APPEND, // a
+	os.O_WRONLY | os.O_CREATE | os.O_APPEND, // ab
+	os.O_RDWR | os.O_CREATE | os.O_APPEND,   // a+
+	os.O_RDWR | os.O_CREATE | os.O_APPEND,   // a+b
+}
+
+//-----------------------------------------------------------------------------
+
+// Config is the semihosting configuration.
+type Config struct {
+	Root       string          // sandbox root directory for files ("" = no file access)
+	Cmdline    string          // command line returned by SYS_GET_CMDLINE
+	HeapBase   uint            // SYS_HEAPINFO heap base (0 = unknown)
+	HeapLimit  uint            // SYS_HEAPINFO heap limit (0 = unknown)
+	StackBase  uint            // SYS_HEAPINFO stack base (0 = unknown)
+	StackLimit uint            // SYS_HEAPINFO stack limit (0 = unknown)
+	Console    *device.Console // console (default os.Stdin and os.Stdout)
+	Stderr     io.Writer       // console error output (default os.Stderr)
+	Inputs     *replay.Log     // record/replay of nondeterministic inputs (optional)
+}
+
+// file is an open file handle.
+type file struct {
+	f   *os.File  // host file (nil for the console)
+	rd  io.Reader // console input
+	wr  io.Writer // console output
+	tty bool      // is this the console?
+}
+
+// Semihost handles semihosting calls.
+type Semihost struct {
+	cfg   Config
+	files map[uint64]*file // open files
+	next  uint64           // next file handle
+	errno int              // errno for the last failed operation
+	start time.Time        // start time for SYS_CLOCK
+}
+
+// NewSemihost returns a semihosting call handler.
+func NewSemihost(cfg Config) *Semihost {
+	if cfg.Console == nil {
+		cfg.Console = device.NewConsole(nil, nil)
+	}
+	if cfg.Stderr == nil {
+		cfg.Stderr = os.Stderr
+	}
+	return &Semihost{
+		cfg:   cfg,
+		files: map[uint64]*file{},
+		next:  1,
+		start: time.Now(),
+	}
+}
+
+// Close closes any open host files.
+func (s *Semihost) Close() {
+	for h, x := range s.files {
+		if x.f != nil {
+			x.f.Close()
+		}
+		delete(s.files, h)
+	}
+}
+
+//-----------------------------------------------------------------------------
+// target memory access
+
+// call is the state for a semihosting call.
+type call struct {
+	m     *rv.RV
+	mem   *hostcall.Memory
+	fault bool // a memory access has failed
+}
+
+// newCall returns the state for a semihosting call.
+func newCall(m *rv.RV) *call {
+	return &call{m: m, mem: hostcall.NewMemory(m.Mem, true)}
+}
+
+// rdWord reads an XLEN word.
+func (c *call) rdWord(adr uint64) uint64 {
+	x, ok := c.mem.RdWord(adr, int(c.m.Xlen()>>3))
+	c.fault = c.fault || !ok
+	return x
+}
+
+// wrWord writes an XLEN word.
+func (c *call) wrWord(adr, val uint64) {
+	ok := c.mem.WrWord(adr, val, int(c.m.Xlen()>>3))
+	c.fault = c.fault || !ok
+}
+
+// arg reads the n-th parameter block word.
+func (c *call) arg(n uint) uint64 {
+	return c.rdWord(c.m.RdX(rv.RegA1) + uint64(n*(c.m.Xlen()>>3)))
+}
+
+// rdBuf reads a buffer.
+func (c *call) rdBuf(adr, n uint64) []byte {
+	buf, ok := c.mem.RdBuf(adr, n)
+	c.fault = c.fault || !ok
+	return buf
+}
+
+// rdString reads a nul terminated string.
+func (c *call) rdString(adr uint64) []byte {
+	s, ok := c.mem.RdString(adr)
+	c.fault = c.fault || !ok
+	return []byte(s)
+}
+
+// wrBuf writes a buffer.
+func (c *call) wrBuf(adr uint64, buf []byte) {
+	ok := c.mem.WrBuf(adr, buf)
+	c.fault = c.fault || !ok
+}
+
+//-----------------------------------------------------------------------------
+
+// setErrno sets the errno for a host error.
+func (s *Semihost) setErrno(err error) {
+	s.errno = hostcall.Errno(err)
+}
+
+// input returns the data and return code (-errno on failure) of a host
+// file operation (a nondeterministic input).
+func (s *Semihost) input(src string, fn func() ([]byte, int64)) ([]byte, int64) {
+	return hostcall.Input(s.cfg.Inputs, src, fn)
+}
+
+// check sets the errno for a failed host file operation.
+func (s *Semihost) check(rc int64) int64 {
+	if rc < 0 {
+		s.errno = int(-rc)
+		return -1
+	}
+	return rc
+}
+
+// getFile returns the file for a handle.
+func (s *Semihost) getFile(h uint64) *file {
+	x, ok := s.files[h]
+	if !ok {
+		s.errno = int(syscall.EBADF)
+		return nil
+	}
+	return x
+}
+
+// newHandle returns a handle for an open file.
+func (s *Semihost) newHandle(x *file) uint64 {
+	h := s.next
+	s.next++
+	s.files[h] = x
+	return h
+}
+
+// open opens a file.
+func (s *Semihost) open(name string, mode uint64) int64 {
+	if mode >= uint64(len(openFlags)) {
+		s.errno = int(syscall.EINVAL)
+		return -1
+	}
+	if name == ":tt" {
+		switch {
+		case mode < 4:
+			return int64(s.newHandle(&file{rd: s.cfg.Console.Reader(), tty: true}))
+		case mode < 8:
+			return int64(s.newHandle(&file{wr: s.cfg.Console.Writer(), tty: true}))
+		}
+		return int64(s.newHandle(&file{wr: s.cfg.Stderr, tty: true}))
+	}
+	path, err := hostcall.Path(s.cfg.Root, name)
+	if err != nil {
+		s.setErrno(err)
+		return -1
+	}
+	var f *os.File
+	_, rc := s.input("semihost.open", func() ([]byte, int64) {
+		var err error
+		f, err = os.OpenFile(path, openFlags[mode], 0644)
+		if err != nil {
+			return nil, -int64(hostcall.Errno(err))
+		}
+		return nil, 0
+	})
+	if s.check(rc) < 0 {
+		return -1
+	}
+	if f == nil {
+		// replayed open, the file reads are replayed and writes are discarded
+		return int64(s.newHandle(&file{wr: ioutil.Discard}))
+	}
+	return int64(s.newHandle(&file{f: f}))
+}
+
+// write writes a buffer to a file and returns the number of bytes not written.
+func (s *Semihost) write(x *file, buf []byte) int64 {
+	var n int
+	var err error
+	if x.f != nil {
+		n, err = x.f.Write(buf)
+	} else if x.wr != nil {
+		n, err = x.wr.Write(buf)
+	} else {
+		err = syscall.EBADF
+	}
+	if err != nil {
+		s.setErrno(err)
+	}
+	return int64(len(buf) - n)
+}
+
+// read reads from a file.
+func (s *Semihost) read(x *file, n uint64) []byte {
+	buf, rc := s.input("semihost.read", func() ([]byte, int64) {
+		buf := make([]byte, n)
+		var k int
+		var err error
+		if x.f != nil {
+			k, err = io.ReadFull(x.f, buf)
+		} else if x.rd != nil {
+			k, err = x.rd.Read(buf)
+		} else {
+			err = syscall.EBADF
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return buf[:k], -int64(hostcall.Errno(err))
+		}
+		return buf[:k], 0
+	})
+	s.check(rc)
+	return buf
+}
+
+// clock returns a nondeterministic clock value.
+func (s *Semihost) clock(src string, fn func() uint64) uint64 {
+	return hostcall.Clock(s.cfg.Inputs, src, fn)
+}
+
+// exit returns the exit error for an exit reason and subcode.
+func exit(m *rv.RV, reason, subcode uint64) error {
+	if reason == adpStoppedApplicationExit {
+		return m.Exit(int(int32(subcode)))
+	}
+	return m.Exit(1)
+}
+
+//-----------------------------------------------------------------------------
+
+// Call handles a semihosting call.
+func (s *Semihost) Call(m *rv.RV) error {
+	c := newCall(m)
+	op := m.RdX(rv.RegA0)
+	var rc int64
+
+	switch op {
+
+	case sysOpen:
+		name := c.rdBuf(c.arg(0), c.arg(2))
+		mode := c.arg(1)
+		if c.fault {
+			break
+		}
+		rc = s.open(string(name), mode)
+
+	case sysClose:
+		h := c.arg(0)
+		if c.fault {
+			break
+		}
+		x := s.getFile(h)
+		if x == nil {
+			rc = -1
+			break
+		}
+		delete(s.files, h)
+		if x.f != nil {
+			err := x.f.Close()
+			if err != nil {
+				s.setErrno(err)
+				rc = -1
+			}
+		}
+
+	case sysWriteC:
+		buf := c.rdBuf(m.RdX(rv.RegA1), 1)
+		if !c.fault {
+			s.cfg.Console.Write(buf)
+		}
+		// a0 is preserved
+		rc = int64(op)
+
+	case sysWrite0:
+		buf := c.rdString(m.RdX(rv.RegA1))
+		if !c.fault {
+			s.cfg.Console.Write(buf)
+		}
+		// a0 is preserved
+		rc = int64(op)
+
+	case sysWrite:
+		h, adr, n := c.arg(0), c.arg(1), c.arg(2)
+		buf := c.rdBuf(adr, n)
+		if c.fault {
+			break
+		}
+		x := s.getFile(h)
+		if x == nil {
+			rc = int64(n)
+			break
+		}
+		rc = s.write(x, buf)
+
+	case sysRead:
+		h, adr, n := c.arg(0), c.arg(1), c.arg(2)
+		if c.fault {
+			break
+		}
+		x := s.getFile(h)
+		if x == nil {
+			rc = -1
+			break
+		}
+		// a larger read is a short read
+		k := hostcall.Clamp(n)
+		if !c.mem.Check(adr, k, mem.AttrW) {
+			c.fault = true
+			break
+		}
+		buf := s.read(x, k)
+		c.wrBuf(adr, buf)
+		rc = int64(n) - int64(len(buf))
+
+	case sysIsTTY:
+		h := c.arg(0)
+		if c.fault {
+			break
+		}
+		x := s.getFile(h)
+		if x == nil {
+			rc = -1
+			break
+		}
+		if x.tty {
+			rc = 1
+		}
+
+	case sysSeek:
+		h, pos := c.arg(0), c.arg(1)
+		if c.fault {
+			break
+		}
+		x := s.getFile(h)
+		if x == nil {
+			rc = -1
+			break
+		}
+		_, rc = s.input("semihost.seek", func() ([]byte, int64) {
+			if x.f == nil {
+				return nil, -int64(syscall.ESPIPE)
+			}
+			_, err := x.f.Seek(int64(pos), io.SeekStart)
+			if err != nil {
+				return nil, -int64(hostcall.Errno(err))
+			}
+			return nil, 0
+		})
+		rc = s.check(rc)
+
+	case sysFlen:
+		h := c.arg(0)
+		if c.fault {
+			break
+		}
+		x := s.getFile(h)
+		if x == nil {
+			rc = -1
+			break
+		}
+		_, rc = s.input("semihost.flen", func() ([]byte, int64) {
+			if x.f == nil {
+				return nil, 0
+			}
+			fi, err := x.f.Stat()
+			if err != nil {
+				return nil, -int64(hostcall.Errno(err))
+			}
+			return nil, fi.Size()
+		})
+		rc = s.check(rc)
+
+	case sysClock:
+		// centiseconds since the start of execution
+		rc = int64(s.clock("semihost.clock", func() uint64 {
+			return uint64(time.Since(s.start) / (10 * time.Millisecond))
+		}))
+
+	case sysTime:
+		// seconds since the unix epoch
+		rc = int64(s.clock("semihost.time", func() uint64 {
+			return uint64(time.Now().Unix())
+		}))
+
+	case sysErrno:
+		rc = int64(s.errno)
+
+	case sysGetCmdline:
+		adr, n := c.arg(0), c.arg(1)
+		if c.fault {
+			break
+		}
+		cmdline := append([]byte(s.cfg.Cmdline), 0)
+		if uint64(len(cmdline)) > n {
+			rc = -1
+			break
+		}
+		c.wrBuf(adr, cmdline)
+		c.wrWord(m.RdX(rv.RegA1)+uint64(m.Xlen()>>3), uint64(len(s.cfg.Cmdline)))
+
+	case sysHeapInfo:
+		adr := c.rdWord(m.RdX(rv.RegA1))
+		if c.fault {
+			break
+		}
+		size := uint64(m.Xlen() >> 3)
+		c.wrWord(adr, uint64(s.cfg.HeapBase))
+		c.wrWord(adr+size, uint64(s.cfg.HeapLimit))
+		c.wrWord(adr+2*size, uint64(s.cfg.StackBase))
+		c.wrWord(adr+3*size, uint64(s.cfg.StackLimit))
+
+	case sysExit:
+		if m.Xlen() == 32 {
+			// a1 is the reason, there is no subcode
+			return exit(m, m.RdX(rv.RegA1), 0)
+		}
+		reason, subcode := c.arg(0), c.arg(1)
+		if c.fault {
+			break
+		}
+		return exit(m, reason, subcode)
+
+	case sysExitExtended:
+		reason, subcode := c.arg(0), c.arg(1)
+		if c.fault {
+			break
+		}
+		return exit(m, reason, subcode)
+
+	default:
+		// not supported
+		s.errno = int(syscall.ENOSYS)
+		rc = -1
+	}
+
+	if c.fault {
+		s.errno = int(syscall.EFAULT)
+		rc = -1
+	}
+	m.WrX(rv.RegA0, uint64(rc))
+	return nil
+}
+
+//-----------------------------------------------------------------------------
@@ -0,0 +1,271 @@
+//-----------------------------------------------------------------------------
+/*
+
+Semihosting Testing
+
+*/
+//-----------------------------------------------------------------------------
+
+package semihost
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/deadsy/riscv/device"
+	"github.com/deadsy/riscv/machine"
+	"github.com/deadsy/riscv/machine/machinetest"
+	"github.com/deadsy/riscv/rv"
+)
+
+//-----------------------------------------------------------------------------
+
+const (
+	textBase  = 0x1000
+	dataBase  = 0x2000
+	blockBase = 0x2800
+)
+
+// newCPU returns a cpu with a semihosting call sequence at textBase.
+func newCPU(t *testing.T, xlen uint) *rv.RV {
+	mc := machinetest.New(t, xlen,
+		machine.Region{Name: "text", Base: textBase, Size: 0x1000, Attr: "rx"},
+		machine.Region{Name: "data", Base: dataBase, Size: 0x1000, Attr: "rw"},
+	)
+	machinetest.Assemble(t, mc.CPU, textBase,
+		"slli zero,zero,0x1f",
+		"ebreak",
+		"srai zero,zero,7",
+		"ebreak",
+	)
+	return mc.CPU
+}
+
+// semihost runs a semihosting call.
+type semihost struct {
+	t   *testing.T
+	cpu *rv.RV
+}
+
+// block writes a parameter block and returns its address.
+func (x *semihost) block(args ...uint64) uint64 {
+	m := x.cpu.Mem
+	for i, v := range args {
+		if x.cpu.Xlen() == 32 {
+			m.Wr32(blockBase+uint(i)*4, uint32(v))
+		} else {
+			m.Wr64(blockBase+uint(i)*8, v)
+		}
+	}
+	return blockBase
+}
+
+// call runs the semihosting sequence and returns a0.
+func (x *semihost) call(op, arg uint64) (int64, error) {
+	m := x.cpu
+	m.PC = textBase
+	m.WrX(rv.RegA0, op)
+	m.WrX(rv.RegA1, arg)
+	for i := 0; i < 3; i++ {
+		err := m.Run()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if m.PC != textBase+12 {
+		x.t.Fatalf("pc is %x, expected %x", m.PC, textBase+12)
+	}
+	if m.Xlen() == 32 {
+		return int64(int32(m.RdX(rv.RegA0))), nil
+	}
+	return int64(m.RdX(rv.RegA0)), nil
+}
+
+// must runs a semihosting call that should succeed.
+func (x *semihost) must(op, arg uint64) int64 {
+	rc, err := x.call(op, arg)
+	if err != nil {
+		x.t.Fatal(err)
+	}
+	return rc
+}
+
+// str writes a string to data memory and returns the address.
+func (x *semihost) str(adr uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		x.cpu.Mem.Wr8(uint(adr)+uint(i), s[i])
+	}
+	x.cpu.Mem.Wr8(uint(adr)+uint(len(s)), 0)
+	return adr
+}
+
+//-----------------------------------------------------------------------------
+
+func testSemihost(t *testing.T, xlen uint) {
+	root, err := ioutil.TempDir("", "semihost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var out bytes.Buffer
+	cpu := newCPU(t, xlen)
+	sh := NewSemihost(Config{
+		Root:     root,
+		Cmdline:  "prog arg1",
+		HeapBase: 0x80000000,
+		Console:  device.NewConsole(&bytes.Buffer{}, &out),
+	})
+	defer sh.Close()
+	cpu.SetSemihost(sh)
+	x := &semihost{t, cpu}
+
+	// console output
+	x.must(sysWrite0, x.str(dataBase, "hello "))
+	x.must(sysWriteC, x.str(dataBase, "w"))
+	tt := x.must(sysOpen, x.block(x.str(dataBase, ":tt"), 4, 3))
+	x.must(sysWrite, x.block(uint64(tt), x.str(dataBase, "orld"), 4))
+	if out.String() != "hello world" {
+		t.Errorf("console output is \"%s\"", out.String())
+	}
+	if x.must(sysIsTTY, x.block(uint64(tt))) != 1 {
+		t.Errorf(":tt is not a tty")
+	}
+
+	// write a file (escaping the root directory is not possible)
+	h := x.must(sysOpen, x.block(x.str(dataBase, "../../test.txt"), 4, 14))
+	if h < 0 {
+		t.Fatalf("open failed")
+	}
+	if x.must(sysWrite, x.block(uint64(h), x.str(dataBase, "0123456789"), 10)) != 0 {
+		t.Errorf("write failed")
+	}
+	x.must(sysClose, x.block(uint64(h)))
+	buf, err := ioutil.ReadFile(filepath.Join(root, "test.txt"))
+	if err != nil || string(buf) != "0123456789" {
+		t.Errorf("bad file contents \"%s\" %v", buf, err)
+	}
+
+	// read the file
+	h = x.must(sysOpen, x.block(x.str(dataBase, "test.txt"), 0, 8))
+	if x.must(sysFlen, x.block(uint64(h))) != 10 {
+		t.Errorf("bad file length")
+	}
+	x.must(sysSeek, x.block(uint64(h), 6))
+	if x.must(sysRead, x.block(uint64(h), dataBase, 8)) != 4 {
+		t.Errorf("bad read count")
+	}
+	if b := x.cpu.Mem.RdBuf(dataBase, 4, 8, true); b[0] != '6' || b[3] != '9' {
+		t.Errorf("bad read data %v", b)
+	}
+	x.must(sysClose, x.block(uint64(h)))
+
+	// errors
+	if x.must(sysOpen, x.block(x.str(dataBase, "nofile"), 0, 6)) != -1 {
+		t.Errorf("opened a missing file")
+	}
+	if x.must(sysErrno, 0) != 2 {
+		t.Errorf("errno is not ENOENT")
+	}
+	if x.must(sysClose, x.block(99)) != -1 {
+		t.Errorf("closed a bad handle")
+	}
+	h = x.must(sysOpen, x.block(x.str(dataBase, "test.txt"), 0, 8))
+	if x.must(sysRead, x.block(uint64(h), dataBase+0xf00, ^uint64(0)>>(64-xlen))) != -1 {
+		t.Errorf("read with a bad length")
+	}
+	if x.must(sysErrno, 0) != 14 {
+		t.Errorf("errno is not EFAULT")
+	}
+	x.must(sysClose, x.block(uint64(h)))
+	if x.must(0x99, 0) != -1 || x.must(sysErrno, 0) != 38 {
+		t.Errorf("unsupported operation did not return -1 (ENOSYS)")
+	}
+
+	// command line and heap info
+	size := uint64(xlen >> 3)
+	if x.must(sysGetCmdline, x.block(dataBase, 64)) != 0 {
+		t.Errorf("get cmdline failed")
+	}
+	if b := x.cpu.Mem.RdBuf(dataBase, 10, 8, true); b[5] != 'a' || b[9] != 0 {
+		t.Errorf("bad cmdline %v", b)
+	}
+	x.block(dataBase + 0x100)
+	x.must(sysHeapInfo, blockBase)
+	if v, _ := cpu.Mem.Rd32(dataBase + 0x100); v != 0x80000000 {
+		t.Errorf("bad heap base %x", v)
+	}
+	if v, _ := cpu.Mem.Rd32(uint(dataBase + 0x100 + size)); v != 0 {
+		t.Errorf("bad heap limit %x", v)
+	}
+
+	// exit
+	_, err = x.call(sysExitExtended, x.block(adpStoppedApplicationExit, 3))
+	e, ok := err.(*rv.Error)
+	if !ok || e.Type != rv.ErrExit || e.ExitStatus() != 3 {
+		t.Errorf("bad exit %v", err)
+	}
+
+	// an ebreak without the semihosting sequence is a breakpoint exception
+	cpu.PC = textBase + 12
+	err = cpu.Run()
+	if err != nil || cpu.PC == textBase+16 {
+		t.Errorf("ebreak was not a breakpoint exception (pc %x, %v)", cpu.PC, err)
+	}
+}
+
+func Test_Semihost32(t *testing.T) {
+	testSemihost(t, 32)
+}
+
+func Test_Semihost64(t *testing.T) {
+	testSemihost(t, 64)
+}
+
+// Going back over a semihosting call doesn't repeat the call.
+func Test_SemihostReverse(t *testing.T) {
+	var out bytes.Buffer
+	mc := machinetest.New(t, 64,
+		machine.Region{Name: "text", Base: textBase, Size: 0x1000, Attr: "rx"},
+		machine.Region{Name: "data", Base: dataBase, Size: 0x1000, Attr: "rw"},
+	)
+	cpu := mc.CPU
+	machinetest.Assemble(t, cpu, textBase,
+		"addi a0,zero,3",
+		"lui a1,0x2",
+		"slli zero,zero,0x1f",
+		"ebreak",
+		"srai zero,zero,7",
+		"jal zero,1000",
+	)
+	cpu.Mem.Wr8(dataBase, 'x')
+	sh := NewSemihost(Config{Console: device.NewConsole(&bytes.Buffer{}, &out)})
+	defer sh.Close()
+	cpu.SetSemihost(sh)
+	// the checkpoints (heap sized) would overflow the budget and trim the undo log
+	err := cpu.SetReverse(rv.NewReverse(&rv.ReverseConfig{Budget: 3 << 20, Interval: 6}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu.PC = textBase
+	for i := 0; i < 18; i++ {
+		err := cpu.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 12; i++ {
+		err := cpu.ReverseStep()
+		if err != nil {
+			t.Fatalf("step back %d: %s", i, err)
+		}
+	}
+	if cpu.PC != textBase || out.String() != "xxx" {
+		t.Errorf("pc %x output \"%s\", expected %x \"xxx\"", cpu.PC, out.String(), textBase)
+	}
+}
+
+//-----------------------------------------------------------------------------